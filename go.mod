@@ -3,11 +3,14 @@ module asmr-downloader
 go 1.24.3
 
 require (
+	github.com/bogem/id3v2/v2 v2.1.4
+	github.com/go-flac/flacvorbis v0.2.0
+	github.com/go-flac/go-flac v1.0.0
 	github.com/gtuk/discordwebhook v1.2.0
 	github.com/melbahja/got v0.7.0
 	github.com/xxjwxc/gowp v0.0.0-20220528192505-f87b7668d4ff
 	go.uber.org/zap v1.10.0
-	golang.org/x/text v0.3.3
+	golang.org/x/text v0.3.8
 	modernc.org/sqlite v1.27.0
 )
 
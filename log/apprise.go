@@ -0,0 +1,131 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// appriseTimeout 发送Apprise通知的请求超时时间
+const appriseTimeout = 10 * time.Second
+
+// AppriseNotifier
+//
+//	@Description: 通过Apprise API(POST <url>/notify/<key>)发送通知, 由Apprise转发到邮件、短信、Matrix等渠道
+type AppriseNotifier struct {
+	// Apprise API地址 如http://localhost:8000
+	Url string
+	// Apprise中保存的配置key
+	Key string
+	// 通知标题
+	Title string
+}
+
+// appriseMessage Apprise API的请求内容
+type appriseMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Type  string `json:"type"`
+}
+
+// AppriseWebhook 通过InitAppriseLogger配置的Apprise通知
+var AppriseWebhook = &AppriseNotifier{}
+
+// InitAppriseLogger
+//
+//	@Description: 初始化Apprise通知, 之后通过DiscordWebhook发送的消息会同时发送到Apprise
+//	@param url Apprise API地址, 为空时不发送
+//	@param key Apprise中保存的配置key
+func InitAppriseLogger(url string, key string) {
+	AppriseWebhook.Url = strings.TrimRight(url, "/")
+	AppriseWebhook.Key = key
+	AppriseWebhook.Title = "ASMR Downloader"
+	if url != "" {
+		RegisterNotifier(AppriseWebhook)
+	}
+}
+
+// Send
+//
+//	@Description: 发送通知, 包含"失败"的消息以failure类型发送
+//	@receiver a
+//	@param message
+//	@return error
+func (a *AppriseNotifier) Send(message string) error {
+	if a.Url == "" {
+		return nil
+	}
+	messageType := "info"
+	if strings.Contains(message, "失败") {
+		messageType = "failure"
+	}
+	payload, err := json.Marshal(appriseMessage{Title: a.Title, Body: message, Type: messageType})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: appriseTimeout}
+	resp, err := client.Post(a.Url+"/notify/"+url.PathEscape(a.Key), "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("Apprise响应状态码: %d, %s", resp.StatusCode, body)
+}
+
+// forwardNotifiers DiscordWebhook之外同时接收消息的通知渠道
+var forwardNotifiers = struct {
+	sync.RWMutex
+	notifiers []Notifier
+}{}
+
+// RegisterNotifier
+//
+//	@Description: 注册额外的通知渠道, 通过DiscordWebhook发送的消息(去重后)会同时发送到这些渠道, 重复注册同一渠道无效
+//	@param notifier
+func RegisterNotifier(notifier Notifier) {
+	forwardNotifiers.Lock()
+	defer forwardNotifiers.Unlock()
+	for _, registered := range forwardNotifiers.notifiers {
+		if registered == notifier {
+			return
+		}
+	}
+	forwardNotifiers.notifiers = append(forwardNotifiers.notifiers, notifier)
+}
+
+// hasForwardNotifiers
+//
+//	@Description: 是否注册了额外的通知渠道
+//	@return bool
+func hasForwardNotifiers() bool {
+	forwardNotifiers.RLock()
+	defer forwardNotifiers.RUnlock()
+	return len(forwardNotifiers.notifiers) > 0
+}
+
+// forward
+//
+//	@Description: 将消息发送到额外的通知渠道, 发送失败只记录日志
+//	@param message
+func forward(message string) {
+	forwardNotifiers.RLock()
+	notifiers := forwardNotifiers.notifiers
+	forwardNotifiers.RUnlock()
+	for _, notifier := range notifiers {
+		if err := notifier.Send(message); err != nil {
+			AsmrLog.Error("发送通知失败: ", zap.String("error", err.Error()))
+		}
+	}
+}
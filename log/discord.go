@@ -1,29 +1,456 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
 	"github.com/gtuk/discordwebhook"
+	"go.uber.org/zap"
 )
 
+// Notifier
+//
+//	@Description: 通知发送接口, Discord Webhook等通知渠道均实现该接口
+type Notifier interface {
+	Send(message string) error
+}
+
 type webhook struct {
 	Username string
 	Url      string
+
+	mu sync.Mutex
+	// 连续发送失败次数
+	consecutiveFailures int
+	// 熔断打开时, 在此时间之前不再尝试发送
+	openUntil time.Time
+	// 熔断冷却结束后是否正在进行探测发送
+	probing bool
+	// 连续失败多少次后打开熔断
+	breakerThreshold int
+	// 熔断冷却时间
+	breakerCooldown time.Duration
+	// 发送失败时的最大重试次数
+	maxRetry int
+	// 相同消息在该时间内只发送一次 小于等于0表示不去重
+	dedupWindow time.Duration
+	// 去重时间窗口内已发送的消息
+	recent map[string]*dedupEntry
+	// 同时进行的发送请求数量限制
+	slots chan struct{}
+	// 等待后台发送的消息
+	queued []string
+	// 正在发送排队消息的后台goroutine数量, 不超过并发限制
+	workers int
+	// 后台是否正在发送排队的消息
+	draining bool
+	// 排队消息全部发送完成时关闭
+	drained chan struct{}
+}
+
+// dedupEntry
+//
+//	@Description: 已发送消息的去重记录
+type dedupEntry struct {
+	sentAt time.Time
+	// 被忽略的重复次数
+	suppressed int
 }
 
-var DiscordWebhook = &webhook{}
+// DefaultWebhookRetry 默认Webhook发送失败重试次数
+const DefaultWebhookRetry = 2
+
+// webhookRetryBackoff 首次重试前的等待时间, 之后每次翻倍
+const webhookRetryBackoff = 500 * time.Millisecond
+
+// DefaultWebhookConcurrency 默认同时进行的Webhook发送请求数量
+const DefaultWebhookConcurrency = 1
+
+// webhookQueueLimit 最多排队的消息数量, 超出后丢弃最早的消息
+const webhookQueueLimit = 1000
+
+var DiscordWebhook = &webhook{
+	breakerThreshold: 5,
+	breakerCooldown:  5 * time.Minute,
+	slots:            make(chan struct{}, DefaultWebhookConcurrency),
+}
 
-func InitDiscordLogger(url string) {
+// InitDiscordLogger
+//
+//	@Description: 初始化Discord Webhook
+//	@param url
+//	@param maxRetry 发送失败(网络错误/5xx/429)时的最大重试次数
+func InitDiscordLogger(url string, maxRetry int) {
 	if url != "" {
 		DiscordWebhook.Url = url
 		DiscordWebhook.Username = "ASMR Downloader"
 	}
+	if maxRetry < 0 {
+		maxRetry = 0
+	}
+	DiscordWebhook.maxRetry = maxRetry
+}
+
+// webhookError
+//
+//	@Description: Webhook发送错误
+type webhookError struct {
+	// 响应状态码 网络错误时为0
+	StatusCode int
+	// 是否可以重试
+	Retryable bool
+	Err       error
+}
+
+func (e *webhookError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("Webhook响应状态码: %d, %s", e.StatusCode, e.Err.Error())
+	}
+	return e.Err.Error()
+}
+
+func (e *webhookError) Unwrap() error {
+	return e.Err
+}
+
+// SetWebhookCircuitBreaker
+//
+//	@Description: 设置Discord Webhook熔断策略, 连续失败threshold次后在cooldown时间内停止发送, 冷却结束后再次探测
+//	@param threshold 小于等于0表示关闭熔断
+//	@param cooldown
+func SetWebhookCircuitBreaker(threshold int, cooldown time.Duration) {
+	DiscordWebhook.mu.Lock()
+	defer DiscordWebhook.mu.Unlock()
+	DiscordWebhook.breakerThreshold = threshold
+	DiscordWebhook.breakerCooldown = cooldown
+}
+
+// SetWebhookDedup
+//
+//	@Description: 设置Discord Webhook消息去重, window时间内相同的消息只发送一次, 窗口结束时汇总发送重复次数
+//	@param window 小于等于0表示不去重
+func SetWebhookDedup(window time.Duration) {
+	DiscordWebhook.mu.Lock()
+	defer DiscordWebhook.mu.Unlock()
+	DiscordWebhook.dedupWindow = window
+	DiscordWebhook.recent = nil
 }
 
 func (DW *webhook) Send(message string) error {
-	if DW.Url == "" {
+	if DW.Url == "" && !hasForwardNotifiers() {
 		return nil // 如果没有设置URL，则不发送消息
 	}
-	return discordwebhook.SendMessage(DW.Url, discordwebhook.Message{
+	if DW.suppressDuplicate(message) {
+		return nil
+	}
+	forward(message)
+	if DW.Url == "" {
+		return nil
+	}
+	return DW.limitedDeliver(message)
+}
+
+// SetWebhookConcurrency
+//
+//	@Description: 设置同时进行的Discord Webhook发送请求数量, 消息排队由后台发送, 调用方(下载任务)不会等待
+//	@param n 小于等于0时为DefaultWebhookConcurrency
+func SetWebhookConcurrency(n int) {
+	if n <= 0 {
+		n = DefaultWebhookConcurrency
+	}
+	DiscordWebhook.mu.Lock()
+	defer DiscordWebhook.mu.Unlock()
+	DiscordWebhook.slots = make(chan struct{}, n)
+}
+
+// limitedDeliver
+//
+//	@Description: 将消息加入队列由后台发送, 同时发送的请求数不超过并发限制. 发送(包括重试等待)不占用调用方
+//	@receiver DW
+//	@param message
+//	@return error 排队的消息返回nil, 发送失败只记录日志
+func (DW *webhook) limitedDeliver(message string) error {
+	DW.mu.Lock()
+	if DW.slots == nil {
+		//未设置并发限制
+		DW.mu.Unlock()
+		return DW.deliver(message)
+	}
+	defer DW.mu.Unlock()
+	if len(DW.queued) >= webhookQueueLimit {
+		DW.queued = DW.queued[1:]
+	}
+	DW.queued = append(DW.queued, message)
+	if !DW.draining {
+		DW.draining = true
+		DW.drained = make(chan struct{})
+	}
+	if DW.workers < cap(DW.slots) {
+		DW.workers++
+		go DW.drain()
+	}
+	return nil
+}
+
+// drain
+//
+//	@Description: 后台依次发送排队的消息
+//	@receiver DW
+func (DW *webhook) drain() {
+	for {
+		DW.mu.Lock()
+		if len(DW.queued) == 0 {
+			DW.workers--
+			if DW.workers == 0 {
+				DW.draining = false
+				close(DW.drained)
+			}
+			DW.mu.Unlock()
+			return
+		}
+		message := DW.queued[0]
+		DW.queued = DW.queued[1:]
+		slots := DW.slots
+		DW.mu.Unlock()
+		slots <- struct{}{}
+		err := DW.deliver(message)
+		<-slots
+		if err != nil {
+			AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
+		}
+	}
+}
+
+// FlushWebhookQueue
+//
+//	@Description: 等待排队的Discord Webhook消息发送完成, 用于程序退出前
+//	@param timeout 最长等待时间
+//	@return bool 是否全部发送完成
+func FlushWebhookQueue(timeout time.Duration) bool {
+	DiscordWebhook.mu.Lock()
+	draining, drained := DiscordWebhook.draining, DiscordWebhook.drained
+	DiscordWebhook.mu.Unlock()
+	if !draining {
+		return true
+	}
+	select {
+	case <-drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// suppressDuplicate
+//
+//	@Description: 判断消息是否为去重时间窗口内的重复消息, 第一次重复时安排窗口结束后发送汇总
+//	@receiver DW
+//	@param message
+//	@return bool 是否忽略该消息
+func (DW *webhook) suppressDuplicate(message string) bool {
+	DW.mu.Lock()
+	defer DW.mu.Unlock()
+	if DW.dedupWindow <= 0 {
+		return false
+	}
+	now := time.Now()
+	if entry, ok := DW.recent[message]; ok && now.Sub(entry.sentAt) < DW.dedupWindow {
+		entry.suppressed++
+		if entry.suppressed == 1 {
+			time.AfterFunc(DW.dedupWindow-now.Sub(entry.sentAt), func() {
+				DW.flushDuplicate(message, entry)
+			})
+		}
+		return true
+	}
+	if DW.recent == nil {
+		DW.recent = map[string]*dedupEntry{}
+	}
+	//清理已过期且没有待汇总重复次数的记录
+	for key, entry := range DW.recent {
+		if entry.suppressed == 0 && now.Sub(entry.sentAt) >= DW.dedupWindow {
+			delete(DW.recent, key)
+		}
+	}
+	DW.recent[message] = &dedupEntry{sentAt: now}
+	return false
+}
+
+// flushDuplicate
+//
+//	@Description: 去重时间窗口结束, 发送被忽略的重复消息汇总
+//	@receiver DW
+//	@param message
+//	@param entry
+func (DW *webhook) flushDuplicate(message string, entry *dedupEntry) {
+	DW.mu.Lock()
+	suppressed := entry.suppressed
+	if DW.recent[message] == entry {
+		delete(DW.recent, message)
+	}
+	DW.mu.Unlock()
+	message = fmt.Sprintf("%s (x%d occurrences)", message, suppressed)
+	forward(message)
+	if DW.Url == "" {
+		return
+	}
+	if err := DW.limitedDeliver(message); err != nil {
+		AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
+	}
+}
+
+// deliver
+//
+//	@Description: 发送消息, 失败时按退避重试
+//	@receiver DW
+//	@param message
+//	@return error
+func (DW *webhook) deliver(message string) error {
+	if !DW.allowSend() {
+		return nil // 熔断期间直接丢弃消息, 避免重复的错误日志
+	}
+	var err error
+	backoff := webhookRetryBackoff
+	for attempt := 0; attempt <= DW.maxRetry; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		err = DW.post(message)
+		if err == nil {
+			break
+		}
+		if whErr, ok := err.(*webhookError); ok && !whErr.Retryable {
+			break
+		}
+	}
+	DW.reportResult(err)
+	return err
+}
+
+// post
+//
+//	@Description: 发送一次Webhook请求, 并区分可重试(网络错误/5xx/429)与不可重试的错误
+//	@receiver DW
+//	@param message
+//	@return error
+func (DW *webhook) post(message string) error {
+	payload := new(bytes.Buffer)
+	err := json.NewEncoder(payload).Encode(discordwebhook.Message{
 		Username: &DW.Username,
 		Content:  &message,
 	})
+	if err != nil {
+		return &webhookError{Err: err}
+	}
+	resp, err := http.Post(DW.Url, "application/json", payload)
+	if err != nil {
+		return &webhookError{Retryable: true, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return &webhookError{
+		StatusCode: resp.StatusCode,
+		Retryable:  resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+		Err:        fmt.Errorf("%s", body),
+	}
+}
+
+// webhookValidateTimeout 校验Webhook时的请求超时时间
+const webhookValidateTimeout = 10 * time.Second
+
+// ValidateWebhook
+//
+//	@Description: 校验Discord Webhook URL是否可用, 通过GET请求Webhook地址确认其存在, 不会发送消息
+//	@return error
+func ValidateWebhook() error {
+	return DiscordWebhook.Validate()
+}
+
+// Validate
+//
+//	@Description: 校验Webhook URL格式并确认Discord接受该Webhook
+//	@receiver DW
+//	@return error
+func (DW *webhook) Validate() error {
+	if DW.Url == "" {
+		return fmt.Errorf("未设置Discord Webhook URL")
+	}
+	parsed, err := url.Parse(DW.Url)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("Discord Webhook URL格式有误: %s", DW.Url)
+	}
+	client := &http.Client{Timeout: webhookValidateTimeout}
+	resp, err := client.Get(DW.Url)
+	if err != nil {
+		return fmt.Errorf("无法连接Discord Webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("Discord Webhook不存在或token无效, 响应状态码: %d", resp.StatusCode)
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Discord Webhook校验失败, 响应状态码: %d, %s", resp.StatusCode, body)
+	}
+}
+
+// allowSend
+//
+//	@Description: 判断熔断状态下是否允许发送
+//	@receiver DW
+//	@return bool
+func (DW *webhook) allowSend() bool {
+	DW.mu.Lock()
+	defer DW.mu.Unlock()
+	if DW.openUntil.IsZero() {
+		return true
+	}
+	if DW.probing || time.Now().Before(DW.openUntil) {
+		return false
+	}
+	//冷却结束 放行一次探测
+	DW.probing = true
+	return true
+}
+
+// reportResult
+//
+//	@Description: 记录发送结果并更新熔断状态
+//	@receiver DW
+//	@param err
+func (DW *webhook) reportResult(err error) {
+	DW.mu.Lock()
+	defer DW.mu.Unlock()
+	if err == nil {
+		if !DW.openUntil.IsZero() {
+			AsmrLog.Info("Discord Webhook已恢复发送")
+		}
+		DW.consecutiveFailures = 0
+		DW.openUntil = time.Time{}
+		DW.probing = false
+		return
+	}
+	DW.consecutiveFailures++
+	if DW.probing {
+		//探测失败 继续熔断
+		DW.probing = false
+		DW.openUntil = time.Now().Add(DW.breakerCooldown)
+		return
+	}
+	if DW.breakerThreshold > 0 && DW.openUntil.IsZero() && DW.consecutiveFailures >= DW.breakerThreshold {
+		DW.openUntil = time.Now().Add(DW.breakerCooldown)
+		AsmrLog.Warn(fmt.Sprintf("Discord Webhook连续发送失败%d次, 暂时停用%s", DW.consecutiveFailures, DW.breakerCooldown))
+	}
 }
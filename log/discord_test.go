@@ -0,0 +1,166 @@
+package log
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gtuk/discordwebhook"
+)
+
+func TestWebhookDedup(t *testing.T) {
+	var mu sync.Mutex
+	var messages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg discordwebhook.Message
+		_ = json.NewDecoder(r.Body).Decode(&msg)
+		mu.Lock()
+		messages = append(messages, *msg.Content)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	DW := &webhook{Url: server.URL, dedupWindow: 100 * time.Millisecond}
+	for i := 0; i < 4; i++ {
+		if err := DW.Send("error code: 1015"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DW.Send("other"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"error code: 1015", "other", "error code: 1015 (x3 occurrences)"}
+	if len(messages) != len(want) {
+		t.Fatalf("unexpected messages: %q", messages)
+	}
+	for i := range want {
+		if messages[i] != want[i] {
+			t.Fatalf("unexpected messages: %q", messages)
+		}
+	}
+}
+
+func TestAppriseForwarding(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	var messages []appriseMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg appriseMessage
+		_ = json.NewDecoder(r.Body).Decode(&msg)
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		messages = append(messages, msg)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	defer func() { forwardNotifiers.notifiers = nil }()
+
+	apprise := &AppriseNotifier{Url: server.URL, Key: "asmr", Title: "ASMR Downloader"}
+	RegisterNotifier(apprise)
+	RegisterNotifier(apprise)
+	//未设置Discord Webhook时仍然转发
+	DW := &webhook{}
+	if err := DW.Send("文件: a.mp3下载失败"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(messages) != 1 || paths[0] != "/notify/asmr" {
+		t.Fatalf("unexpected apprise requests: %v %+v", paths, messages)
+	}
+	if messages[0].Title != "ASMR Downloader" || messages[0].Body != "文件: a.mp3下载失败" || messages[0].Type != "failure" {
+		t.Fatalf("unexpected apprise payload: %+v", messages[0])
+	}
+}
+
+func TestWebhookConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var inflight, peak, count int
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inflight++
+		peak = max(peak, inflight)
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		inflight--
+		count++
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	DW := &webhook{Url: server.URL, slots: make(chan struct{}, 1)}
+	done := make(chan struct{})
+	go func() {
+		_ = DW.Send("first")
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	//超出并发限制的消息排队, 不阻塞调用方
+	start := time.Now()
+	for _, message := range []string{"second", "third"} {
+		if err := DW.Send(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("queued sends should not block the caller")
+	}
+	close(release)
+	<-done
+	DW.mu.Lock()
+	drained := DW.drained
+	DW.mu.Unlock()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("queued messages were not sent")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if count != 3 || peak != 1 {
+		t.Fatalf("expected 3 serialized requests, got count=%d peak=%d", count, peak)
+	}
+}
+
+func TestWebhookSendDoesNotWaitForDelivery(t *testing.T) {
+	var requests sync.WaitGroup
+	requests.Add(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//响应缓慢且失败 发送方会重试
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		requests.Done()
+	}))
+	defer server.Close()
+
+	DW := &webhook{Url: server.URL, maxRetry: 1, slots: make(chan struct{}, 1)}
+	start := time.Now()
+	if err := DW.Send("download failed"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("expected Send to return promptly, took %s", elapsed)
+	}
+	requests.Wait()
+	DW.mu.Lock()
+	drained := DW.drained
+	DW.mu.Unlock()
+	select {
+	case <-drained:
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued message was not delivered")
+	}
+}
@@ -0,0 +1,226 @@
+package log
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// logSampling 日志去重设置与窗口内的计数, 所有通过With派生的core共享
+type logSampling struct {
+	mu sync.Mutex
+	// 去重时间窗口 小于等于0表示不去重
+	window time.Duration
+	// 窗口内相同的日志最多输出的条数
+	burst int
+	// 按日志级别、内容与字段统计的窗口
+	recent map[string]*sampledEntry
+}
+
+// sampledEntry 一个去重窗口内相同日志的计数
+type sampledEntry struct {
+	start time.Time
+	seen  int
+	// 被省略的条数
+	suppressed int
+	// 汇总已输出
+	flushed bool
+	// 窗口结束时用于输出汇总
+	core   zapcore.Core
+	entry  zapcore.Entry
+	fields []zapcore.Field
+}
+
+// sampling 当前的日志去重设置
+var sampling = &logSampling{}
+
+// SetLogSampling
+//
+//	@Description: 设置日志去重, window时间内级别、内容与字段都相同的日志只输出前burst条, 窗口结束时输出一条汇总省略的条数.
+//	用于大量下载失败时避免重复的错误日志拖慢程序、占满磁盘
+//	@param window 小于等于0表示不去重
+//	@param burst 小于等于0时为1
+func SetLogSampling(window time.Duration, burst int) {
+	if burst <= 0 {
+		burst = 1
+	}
+	sampling.mu.Lock()
+	sampling.window = window
+	sampling.burst = burst
+	pending := sampling.takePending()
+	sampling.recent = nil
+	sampling.mu.Unlock()
+	//修改设置前省略的日志同样输出汇总
+	for _, sampled := range pending {
+		writeSummary(sampled)
+	}
+}
+
+// samplingCore
+//
+//	@Description: 按SetLogSampling的设置省略重复日志的zapcore.Core
+type samplingCore struct {
+	zapcore.Core
+}
+
+func (c samplingCore) With(fields []zapcore.Field) zapcore.Core {
+	return samplingCore{Core: c.Core.With(fields)}
+}
+
+func (c samplingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c samplingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	if sampling.allow(c.Core, entry, fields) {
+		return c.Core.Write(entry, fields)
+	}
+	return nil
+}
+
+func (c samplingCore) Sync() error {
+	sampling.flushAll()
+	return c.Core.Sync()
+}
+
+// allow
+//
+//	@Description: 判断日志是否需要输出, 第一次省略时安排窗口结束后输出汇总
+//	@receiver s
+//	@param core
+//	@param entry
+//	@param fields
+//	@return bool
+func (s *logSampling) allow(core zapcore.Core, entry zapcore.Entry, fields []zapcore.Field) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.window <= 0 {
+		return true
+	}
+	key := sampleKey(entry, fields)
+	now := time.Now()
+	if sampled, ok := s.recent[key]; ok && now.Sub(sampled.start) < s.window {
+		sampled.seen++
+		if sampled.seen <= s.burst {
+			return true
+		}
+		sampled.suppressed++
+		if sampled.suppressed == 1 {
+			time.AfterFunc(s.window-now.Sub(sampled.start), func() {
+				s.flush(key, sampled)
+			})
+		}
+		return false
+	}
+	if s.recent == nil {
+		s.recent = map[string]*sampledEntry{}
+	}
+	//窗口已结束但定时汇总还未执行 先输出上一个窗口的汇总再开始新窗口
+	if sampled, ok := s.recent[key]; ok && sampled.suppressed > 0 && !sampled.flushed {
+		sampled.flushed = true
+		writeSummary(sampled)
+	}
+	//清理已过期且没有待汇总条数的记录
+	for k, sampled := range s.recent {
+		if (sampled.suppressed == 0 || sampled.flushed) && now.Sub(sampled.start) >= s.window {
+			delete(s.recent, k)
+		}
+	}
+	s.recent[key] = &sampledEntry{start: now, seen: 1, core: core, entry: entry, fields: fields}
+	return true
+}
+
+// flush
+//
+//	@Description: 去重窗口结束, 输出被省略的日志条数
+//	@receiver s
+//	@param key
+//	@param sampled
+func (s *logSampling) flush(key string, sampled *sampledEntry) {
+	s.mu.Lock()
+	if s.recent[key] == sampled {
+		delete(s.recent, key)
+	}
+	if sampled.flushed {
+		//已通过Sync或新窗口输出
+		s.mu.Unlock()
+		return
+	}
+	sampled.flushed = true
+	s.mu.Unlock()
+	writeSummary(sampled)
+}
+
+// flushAll
+//
+//	@Description: 立即输出所有窗口中被省略的日志条数
+//	@receiver s
+func (s *logSampling) flushAll() {
+	s.mu.Lock()
+	pending := s.takePending()
+	s.mu.Unlock()
+	for _, sampled := range pending {
+		writeSummary(sampled)
+	}
+}
+
+// takePending
+//
+//	@Description: 取出所有还未输出汇总的窗口并标记为已输出, 调用方需持有锁
+//	@receiver s
+//	@return []*sampledEntry
+func (s *logSampling) takePending() []*sampledEntry {
+	var pending []*sampledEntry
+	for key, sampled := range s.recent {
+		if sampled.suppressed > 0 && !sampled.flushed {
+			sampled.flushed = true
+			pending = append(pending, sampled)
+			delete(s.recent, key)
+		}
+	}
+	return pending
+}
+
+// writeSummary
+//
+//	@Description: 输出一条汇总日志, 内容与字段与被省略的日志相同
+//	@param sampled
+func writeSummary(sampled *sampledEntry) {
+	entry := sampled.entry
+	entry.Time = time.Now()
+	entry.Message = fmt.Sprintf("%s (重复%d次, 已省略)", entry.Message, sampled.suppressed)
+	_ = sampled.core.Write(entry, sampled.fields)
+}
+
+// sampleKey
+//
+//	@Description: 按日志级别、内容与字段生成去重的key
+//	@param entry
+//	@param fields
+//	@return string
+func sampleKey(entry zapcore.Entry, fields []zapcore.Field) string {
+	encoder := zapcore.NewMapObjectEncoder()
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+	keys := make([]string, 0, len(encoder.Fields))
+	for key := range encoder.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var builder strings.Builder
+	builder.WriteString(entry.Level.String())
+	builder.WriteByte(0)
+	builder.WriteString(entry.Message)
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(&builder, "\x00%s=%v", key, encoder.Fields[key])
+	}
+	return builder.String()
+}
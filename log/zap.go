@@ -3,16 +3,58 @@ package log
 import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 var AsmrLog *zap.Logger
 var LogFile *os.File
 
+// consoleWriter
+//
+//	@Description: 控制台日志的输出位置, 默认为标准输出, 可以在运行中切换
+type consoleWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (c *consoleWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Write(p)
+}
+
+func (c *consoleWriter) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if syncer, ok := c.w.(interface{ Sync() error }); ok {
+		//标准输出为终端或管道时Sync会失败 忽略
+		_ = syncer.Sync()
+	}
+	return nil
+}
+
+// console 控制台日志的输出位置
+var console = &consoleWriter{w: os.Stdout}
+
+// SetConsoleOutput
+//
+//	@Description: 设置控制台日志的输出位置, 例如将文件内容输出到标准输出时改为标准错误, 避免日志混入文件内容
+//	@param w 为nil时恢复为标准输出
+func SetConsoleOutput(w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	console.w = w
+}
+
 const logDir = "." + string(filepath.Separator) + "logs"
 
 func init() {
@@ -23,7 +65,7 @@ func init() {
 	fileEncoder := zapcore.NewJSONEncoder(zap.NewDevelopmentEncoderConfig())
 
 	// 设置控制台的输出
-	consoleOutput := zapcore.Lock(os.Stdout)
+	consoleOutput := zapcore.AddSync(console)
 
 	_, err := os.Stat(logDir) //os.Stat获取文件信息
 	if err != nil {
@@ -63,8 +105,8 @@ func init() {
 		zapcore.NewCore(fileEncoder, fileOutput, zap.DebugLevel),
 	)
 
-	// 创建 logger
-	logger := zap.New(core)
+	// 创建 logger, 按SetLogSampling的设置省略重复日志
+	logger := zap.New(samplingCore{Core: core})
 
 	// 输出日志信息
 	//logger.Info("hello world")
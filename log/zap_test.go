@@ -1,7 +1,74 @@
 package log
 
-import "testing"
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
 
 func TestTestZapLog(t *testing.T) {
 	TestZapLog()
 }
+
+func TestLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	logger := zap.New(samplingCore{Core: zapcore.NewCore(encoder, zapcore.AddSync(&buf), zap.DebugLevel)})
+	SetLogSampling(time.Hour, 2)
+	defer SetLogSampling(0, 0)
+
+	for i := 0; i < 5; i++ {
+		logger.Error("下载失败", zap.String("url", "a"))
+	}
+	logger.Error("下载失败", zap.String("url", "b"))
+	if lines := strings.Count(buf.String(), "\n"); lines != 3 {
+		t.Fatalf("expected 3 lines before flush, got %d:\n%s", lines, buf.String())
+	}
+	_ = logger.Sync()
+	if !strings.Contains(buf.String(), "下载失败 (重复3次, 已省略)") {
+		t.Fatalf("expected summary line, got:\n%s", buf.String())
+	}
+
+	SetLogSampling(0, 0)
+	buf.Reset()
+	for i := 0; i < 3; i++ {
+		logger.Error("下载失败", zap.String("url", "a"))
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 3 {
+		t.Fatalf("expected sampling to be disabled, got %d lines", lines)
+	}
+}
+
+func TestLogSamplingKeepsSummaries(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	logger := zap.New(samplingCore{Core: zapcore.NewCore(encoder, zapcore.AddSync(&buf), zap.DebugLevel)})
+	SetLogSampling(time.Hour, 1)
+	defer SetLogSampling(0, 0)
+
+	for i := 0; i < 3; i++ {
+		logger.Error("下载失败", zap.String("url", "a"))
+	}
+	//窗口已结束但定时汇总还未执行时又出现相同的日志
+	sampling.mu.Lock()
+	for _, sampled := range sampling.recent {
+		sampled.start = sampled.start.Add(-2 * time.Hour)
+	}
+	sampling.mu.Unlock()
+	logger.Error("下载失败", zap.String("url", "a"))
+	if !strings.Contains(buf.String(), "下载失败 (重复2次, 已省略)") {
+		t.Fatalf("expected the previous window summary, got:\n%s", buf.String())
+	}
+
+	//修改设置时输出未汇总的条数
+	buf.Reset()
+	logger.Error("下载失败", zap.String("url", "a"))
+	SetLogSampling(0, 0)
+	if !strings.Contains(buf.String(), "下载失败 (重复1次, 已省略)") {
+		t.Fatalf("expected the pending summary on reconfigure, got:\n%s", buf.String())
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
@@ -27,6 +30,46 @@ func main() {
 	defer log.LogFile.Close()
 	defer log.AsmrLog.Sync()
 	//获取程序传入的参数
+	//导出下载失败日志: export-failed [csv|json]
+	if len(os.Args) >= 2 && os.Args[1] == "export-failed" {
+		format := "csv"
+		if len(os.Args) >= 3 {
+			format = strings.ToLower(strings.TrimSpace(os.Args[2]))
+		}
+		if err := utils.ExportFailedDownloads(format, os.Stdout); err != nil {
+			log.AsmrLog.Fatal("导出下载失败日志失败: ", zap.String("fatal", err.Error()))
+		}
+		return
+	}
+	//合并多台机器的下载失败日志: merge-failed <输出文件> <下载失败日志>...
+	if len(os.Args) >= 2 && os.Args[1] == "merge-failed" {
+		if len(os.Args) < 4 {
+			log.AsmrLog.Fatal("用法: merge-failed <输出文件> <下载失败日志>...")
+		}
+		count, err := utils.MergeFailedDownloads(os.Args[3:], os.Args[2])
+		if err != nil {
+			log.AsmrLog.Fatal("合并下载失败日志失败: ", zap.String("fatal", err.Error()))
+		}
+		log.AsmrLog.Info(fmt.Sprintf("已合并%d条下载失败记录到%s", count, os.Args[2]))
+		return
+	}
+	//整理下载失败日志 按主机分组排序: sort-failed
+	if len(os.Args) >= 2 && os.Args[1] == "sort-failed" {
+		if err := utils.SortFailedDownloadsByHost(); err != nil {
+			log.AsmrLog.Fatal("整理下载失败日志失败: ", zap.String("fatal", err.Error()))
+		}
+		return
+	}
+	//将文件内容输出到标准输出 用于管道: stdout <文件url>
+	if len(os.Args) >= 2 && os.Args[1] == "stdout" {
+		if len(os.Args) < 3 {
+			log.AsmrLog.Fatal("用法: stdout <文件url>")
+		}
+		if err := utils.DownloadToStdout(context.Background(), os.Args[2]); err != nil {
+			log.AsmrLog.Fatal("下载失败: ", zap.String("fatal", err.Error()))
+		}
+		return
+	}
 	//简易下载模式
 	if len(os.Args) >= 2 && os.Args[1] != "" && os.Args[1] != "cron" {
 		builder := strings.Builder{}
@@ -64,6 +107,28 @@ func main() {
 	var globalConfig *config.Config
 	//判断是否初次运行
 	globalConfig = CheckIfFirstStart(config.ConfigFileName)
+	// 应用下载与通知相关配置(Discord webhook等)
+	if err := config.Apply(globalConfig); err != nil {
+		log.AsmrLog.Fatal("应用配置失败: ", zap.String("fatal", err.Error()))
+	}
+	if globalConfig.DiscordWebhook != "" {
+		if err := log.ValidateWebhook(); err != nil {
+			log.AsmrLog.Warn("Discord Webhook不可用, 请检查配置: ", zap.String("error", err.Error()))
+		}
+	}
+	if config.AsmrBaseApiUrl != "" {
+		if err := utils.SelfTest(context.Background(), config.AsmrBaseApiUrl); err != nil {
+			log.AsmrLog.Warn("网络自检失败, 请检查代理设置: ", zap.String("error", err.Error()))
+		}
+	}
+	if globalConfig.AutoTuneSampleURL != "" {
+		if maxWorker, err := utils.AutoTuneConcurrency(context.Background(), globalConfig.AutoTuneSampleURL); err != nil {
+			log.AsmrLog.Warn("自动选择并发数失败, 使用max_worker: ", zap.String("error", err.Error()))
+		} else {
+			globalConfig.MaxWorker = maxWorker
+		}
+	}
+	go shutdownOnSignal(globalConfig.ShutdownTimeoutDuration())
 	_ = storage.GetDbInstance()
 	log.AsmrLog.Info("", zap.String("info", fmt.Sprintf("GlobalConfig=%s", globalConfig.SafePrintInfoStr())))
 	asmrClient := spider.NewASMRClient(globalConfig.MaxWorker, globalConfig)
@@ -74,6 +139,8 @@ func main() {
 	}
 	log.AsmrLog.Info("账号登录成功!")
 	var authStr = asmrClient.Authorization
+	//无人值守时定期重试下载失败的文件
+	utils.StartAutoFix(context.Background(), time.Duration(globalConfig.AutoFixIntervalMinutes)*time.Minute, globalConfig.MaxFailedRetry)
 
 	//检查数据更新
 	ifNeedUpdateMetadata, err := CheckIfNeedUpdateMetadata(authStr)
@@ -86,9 +153,6 @@ func main() {
 	// Format the time using the standard format string
 	currentTimeStr := now.Format("2006-01-02 15:04:05")
 
-	// Discord webhook init
-	log.InitDiscordLogger(globalConfig.DiscordWebhook)
-
 	if ifNeedUpdateMetadata {
 		if err := log.DiscordWebhook.Send("网站有新作品更新,正在进行更新..."); err != nil {
 			log.AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
@@ -122,11 +186,20 @@ func main() {
 			fixBrokenDownloadFile := utils.CheckIfNeedFixBrokenDownloadFile()
 			if fixBrokenDownloadFile {
 				log.AsmrLog.Info("发现上一次运行存在下载失败的媒体文件，正在进行修复下载...")
-				utils.FixBrokenDownloadFile(asmrClient.GlobalConfig.MaxFailedRetry)
+				sortFailedDownloads(asmrClient.GlobalConfig.SortFailedByHost)
+				utils.FixBrokenDownloadFileWithMaxAge(asmrClient.GlobalConfig.MaxFailedRetry, asmrClient.GlobalConfig.FailedRecordMaxAge())
 				log.AsmrLog.Info("修复下载完成...")
 			}
+			//校验已下载文件 重新下载内容损坏的文件
+			if manifest := asmrClient.GlobalConfig.ChecksumManifest; manifest != "" && utils.FileOrDirExists(manifest) {
+				if _, err := utils.FixCorruptFiles(manifest, asmrClient.GlobalConfig.MaxFailedRetry); err != nil {
+					log.AsmrLog.Error("校验已下载文件失败: ", zap.String("error", err.Error()))
+				}
+			}
 			log.AsmrLog.Info("正在下载ASMR作品文件,请稍后...")
-			DownloadItemHandler(asmrClient)
+			if err := DownloadItemHandler(asmrClient); err != nil {
+				log.AsmrLog.Fatal("下载任务已中止: ", zap.String("error", err.Error()))
+			}
 			log.AsmrLog.Info("当前下载任务已完成...")
 			if err := log.DiscordWebhook.Send("当前下载任务已完成..."); err != nil {
 				log.AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
@@ -141,10 +214,40 @@ func main() {
 		}
 		log.AsmrLog.Info("ASMR作品本地与网站完全同步.当前无需下载")
 	}
+	utils.FlushFailureSinks()
+	if !log.FlushWebhookQueue(webhookFlushTimeout) {
+		log.AsmrLog.Warn("部分Discord Webhook消息未能在退出前发送")
+	}
 	//close db con
 	_ = storage.StoreDb.Db.Close()
 }
 
+// webhookFlushTimeout 退出前等待排队的Webhook消息发送完成的最长时间
+const webhookFlushTimeout = 10 * time.Second
+
+// shutdownOnSignal
+//
+//	@Description: 收到退出信号后取消所有下载任务, 等待其结束后退出
+//	@param timeout 等待下载任务结束的最长时间
+func shutdownOnSignal(timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	log.AsmrLog.Info("收到退出信号, 正在取消下载任务...")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	interrupted, err := utils.Shutdown(ctx)
+	utils.FlushFailureSinks()
+	log.FlushWebhookQueue(webhookFlushTimeout)
+	if err != nil {
+		log.AsmrLog.Error(fmt.Sprintf("已中断%d个下载任务, 部分任务未能正常结束: %s", interrupted, err.Error()))
+	} else {
+		log.AsmrLog.Info(fmt.Sprintf("已中断%d个下载任务", interrupted))
+	}
+	_ = log.AsmrLog.Sync()
+	os.Exit(1)
+}
+
 func SimpleModeDownload(idList []string, allFlag bool) {
 	c := &config.Config{
 		Account:          "guest",
@@ -175,10 +278,12 @@ func SimpleModeDownload(idList []string, allFlag bool) {
 		value := idList[i]
 		pool.Do(func() error {
 			asmrClient.SimpleDownloadItem(value)
-			return nil
+			return utils.FailFastError()
 		})
 	}
-	_ = pool.Wait()
+	if err := pool.Wait(); err != nil {
+		log.AsmrLog.Fatal("下载任务已中止: ", zap.String("error", err.Error()))
+	}
 	log.AsmrLog.Info("所有任务下载完成,程序即将退出 ")
 }
 
@@ -186,7 +291,8 @@ func SimpleModeDownload(idList []string, allFlag bool) {
 //
 //	@Description: ASMR作品下载
 //	@param asmrClient
-func DownloadItemHandler(asmrClient *spider.ASMRClient) {
+//	@return error 开启fail fast且有文件下载失败时返回该错误
+func DownloadItemHandler(asmrClient *spider.ASMRClient) error {
 	//批量下载大小 默认为1, -1表示一次性全部下载
 	var batchTaskCount = asmrClient.GlobalConfig.BatchTaskCount
 
@@ -197,7 +303,7 @@ func DownloadItemHandler(asmrClient *spider.ASMRClient) {
 	if err != nil {
 		if err == sql.ErrNoRows {
 			//没有数据了
-			return
+			return nil
 		}
 		log.AsmrLog.Fatal("查询数据库失败: ", zap.String("error", err.Error()))
 	}
@@ -218,6 +324,20 @@ func DownloadItemHandler(asmrClient *spider.ASMRClient) {
 	}
 	rows.Close()
 
+	//整体下载进度 每分钟输出一次
+	progress := utils.NewBatchProgress()
+	utils.SetBatchProgress(progress)
+	progress.NotifyEvery(log.DiscordWebhook, asmrClient.GlobalConfig.ProgressNotifyEveryFiles,
+		time.Duration(asmrClient.GlobalConfig.ProgressNotifyEveryMinutes)*time.Minute)
+	stopReporting := progress.StartReporting(time.Minute, func(snapshot utils.BatchProgressSnapshot) {
+		log.AsmrLog.Info("当前下载进度: ", zap.String("info", snapshot.String()))
+	})
+	defer func() {
+		stopReporting()
+		utils.SetBatchProgress(nil)
+		log.AsmrLog.Info("本次下载进度: ", zap.String("info", progress.Snapshot().String()))
+	}()
+
 	sem := make(chan struct{}, batchTaskCount)
 	dbLock := &sync.Mutex{}
 	left := len(download_queue)
@@ -225,8 +345,16 @@ func DownloadItemHandler(asmrClient *spider.ASMRClient) {
 
 	for _, i := range download_queue {
 		sem <- struct{}{}
+		if utils.FailFastError() != nil {
+			break
+		}
 		go func() {
 			asmrClient.DownloadItem(strings.Replace(i.rjid, "RJ", "", 1), i.subtitleFlag)
+			if utils.FailFastError() != nil {
+				//下载已中止 作品未下载完整
+				<-sem
+				return
+			}
 			dbLock.Lock()
 			UpdateItemDownStatus(i.rjid, i.subtitleFlag)
 			dbLock.Unlock()
@@ -238,8 +366,25 @@ func DownloadItemHandler(asmrClient *spider.ASMRClient) {
 			log.DiscordWebhook.Send(fmt.Sprintf("已下载作品数量: %d, 还剩 %d 个作品未下载", downloaded, left-downloaded))
 		}
 	}
-	utils.FixBrokenDownloadFile(maxRetry)
+	if err := utils.FailFastError(); err != nil {
+		return err
+	}
+	sortFailedDownloads(asmrClient.GlobalConfig.SortFailedByHost)
+	utils.FixBrokenDownloadFileWithMaxAge(maxRetry, asmrClient.GlobalConfig.FailedRecordMaxAge())
+	return nil
+}
 
+// sortFailedDownloads
+//
+//	@Description: 开启sort_failed_by_host时在修复下载前将下载失败记录按主机分组排序
+//	@param enabled
+func sortFailedDownloads(enabled bool) {
+	if !enabled {
+		return
+	}
+	if err := utils.SortFailedDownloadsByHost(); err != nil {
+		log.AsmrLog.Error("整理下载失败日志失败: ", zap.String("error", err.Error()))
+	}
 }
 
 // UpdateItemDownStatus
@@ -397,22 +542,20 @@ func MetaDataAllTaskHandler(authStr string, asmrClient *spider.ASMRClient, wg *s
 	//计算最大页数
 	var totalCount = indexPageInfo.Pagination.TotalCount
 	var pageSize = indexPageInfo.Pagination.PageSize
-	maxPage := utils.CalculateMaxPage(totalCount, pageSize)
-	//maxPage = 2
 	pool := asmrClient.WorkerPool
 	//接受数据
 	//并发10
 	//limiter := make(chan bool, 20)
 	fetchWg := &sync.WaitGroup{}
+	fetchWg.Add(1)
 	go func() {
-		fetchWg.Add(1)
 		defer fetchWg.Done()
-		for i := 1; i <= maxPage; i++ { //开启20个请求
-			pageIndex := i
+		_ = utils.ForEachPage(totalCount, pageSize, func(pageIndex int, _ int, _ int) error {
 			pool.Do(func() error {
 				return PageAllDataTaskHandler(collectPageDataChannel, authStr, pageIndex)
 			})
-		}
+			return nil
+		})
 		_ = pool.Wait()
 		close(collectPageDataChannel)
 	}()
@@ -467,22 +610,20 @@ func MetaDataTaskHandler(authStr string, subTitleFlag int, asmrClient *spider.AS
 	//计算最大页数
 	var totalCount = indexPageInfo.Pagination.TotalCount
 	var pageSize = indexPageInfo.Pagination.PageSize
-	maxPage := utils.CalculateMaxPage(totalCount, pageSize)
-	//maxPage = 2
 	pool := asmrClient.WorkerPool
 	//接受数据
 	//并发10
 	//limiter := make(chan bool, 20)
 	fetchWg := &sync.WaitGroup{}
+	fetchWg.Add(1)
 	go func() {
-		fetchWg.Add(1)
 		defer fetchWg.Done()
-		for i := 1; i <= maxPage; i++ { //开启20个请求
-			pageIndex := i
+		_ = utils.ForEachPage(totalCount, pageSize, func(pageIndex int, _ int, _ int) error {
 			pool.Do(func() error {
 				return PageDataTaskHandler(targetChannel, authStr, pageIndex, subTitleFlag)
 			})
-		}
+			return nil
+		})
 		_ = pool.Wait()
 		close(targetChannel)
 	}()
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -120,17 +121,26 @@ func (asmrClient *ASMRClient) DownloadItem(id string, subtitleFlag int) {
 	log.AsmrLog.Info("作品 RJ 号: ", zap.String("info", rjId))
 	tracks, err := asmrClient.GetVoiceTracks(id)
 	if err != nil {
-		log.AsmrLog.Error(fmt.Sprintf("获取作品: %s音轨失败: %s\n", err.Error()))
+		log.AsmrLog.Error(fmt.Sprintf("获取作品: %s音轨失败: %s\n", rjId, err.Error()))
 		return
 	}
-	basePath := config.GetConfig().DownloadDir
+	basePath := utils.DateBucketPath(config.GetConfig().DownloadDir)
 	if subtitleFlag == 1 {
 		basePath = filepath.Join(basePath, "subtitle")
 	} else if subtitleFlag == 0 {
 		basePath = filepath.Join(basePath, "nosubtitle")
 	}
-	itemStorePath := filepath.Join(basePath, "RJ"+id)
-	asmrClient.EnsureFileDirsExist(tracks, itemStorePath)
+	itemStorePath := utils.RJFolderPath(basePath, id)
+	if itemStorePath == "" {
+		itemStorePath = filepath.Join(basePath, "RJ"+id)
+	}
+	//设置了暂存目录时先下载到暂存目录 完整后再移动到最终目录
+	downloadPath := utils.StagingPathFor(itemStorePath)
+	if !ensureDiskSpace(rjId, tracks, downloadPath) {
+		return
+	}
+	asmrClient.EnsureFileDirsExist(tracks, downloadPath)
+	asmrClient.publishWork(rjId, tracks, itemStorePath, downloadPath)
 
 }
 
@@ -145,13 +155,63 @@ func (asmrClient *ASMRClient) SimpleDownloadItem(id string) {
 	log.AsmrLog.Info("作品 RJ 号: ", zap.String("info", rjId))
 	tracks, err := asmrClient.GetVoiceTracks(realId)
 	if err != nil {
-		log.AsmrLog.Error(fmt.Sprintf("获取作品: %s音轨失败: %s\n", err.Error()))
+		log.AsmrLog.Error(fmt.Sprintf("获取作品: %s音轨失败: %s\n", rjId, err.Error()))
 		return
 	}
-	basePath := asmrClient.GlobalConfig.DownloadDir
-	itemStorePath := filepath.Join(basePath, id)
-	asmrClient.EnsureFileDirsExist(tracks, itemStorePath)
+	basePath := utils.DateBucketPath(asmrClient.GlobalConfig.DownloadDir)
+	itemStorePath := utils.RJFolderPath(basePath, id)
+	if itemStorePath == "" {
+		itemStorePath = filepath.Join(basePath, id)
+	}
+	//设置了暂存目录时先下载到暂存目录 完整后再移动到最终目录
+	downloadPath := utils.StagingPathFor(itemStorePath)
+	if !ensureDiskSpace(rjId, tracks, downloadPath) {
+		return
+	}
+	asmrClient.EnsureFileDirsExist(tracks, downloadPath)
+	asmrClient.publishWork(rjId, tracks, itemStorePath, downloadPath)
+
+}
+
+// ensureDiskSpace
+//
+//	@Description: 下载作品前检查可用inode是否足够创建作品的所有文件与目录, 不足时记录日志并发送通知
+//	@param rjId
+//	@param tracks
+//	@param storePath
+//	@return bool 是否可以下载
+func ensureDiskSpace(rjId string, tracks []track, storePath string) bool {
+	_, err := utils.HasEnoughDiskSpace(storePath, 0, countTrackInodes(tracks)+1)
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, utils.ErrDiskFull) {
+		//无法获取可用空间时照常下载
+		log.AsmrLog.Warn("获取可用空间失败: ", zap.String("error", err.Error()))
+		return true
+	}
+	message := fmt.Sprintf("作品: %s 下载失败: %s", rjId, err.Error())
+	log.AsmrLog.Error(message)
+	if err := log.DiscordWebhook.Send(message); err != nil {
+		log.AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
+	}
+	return false
+}
 
+// countTrackInodes
+//
+//	@Description: 统计音轨中的文件与目录数量
+//	@param tracks
+//	@return int64
+func countTrackInodes(tracks []track) int64 {
+	var count int64
+	for _, t := range tracks {
+		count++
+		if t.Type == "folder" {
+			count += countTrackInodes(t.Children)
+		}
+	}
+	return count
 }
 
 // EnsureFileDirsExist
@@ -168,7 +228,7 @@ func (asmrClient *ASMRClient) EnsureFileDirsExist(tracks []track, basePath strin
 			path = strings.Replace(path, str, "_", -1)
 		}
 	}
-	_ = os.MkdirAll(path, os.ModePerm)
+	_ = os.MkdirAll(path, utils.DirMode())
 
 	// 根据下载类型处理
 	switch asmrClient.GlobalConfig.DownloadType {
@@ -176,7 +236,7 @@ func (asmrClient *ASMRClient) EnsureFileDirsExist(tracks []track, basePath strin
 		// 下载所有文件
 		for _, t := range tracks {
 			if t.Type != "folder" {
-				asmrClient.DownloadFile(t.MediaDownloadURL, path, t.Title)
+				asmrClient.DownloadFile(t.MediaDownloadURL, path, t.Title, trackAssetKind(t), asmrClient.trackTags(t))
 			} else {
 				asmrClient.EnsureFileDirsExist(t.Children, fmt.Sprintf("%s/%s", path, t.Title))
 			}
@@ -194,7 +254,7 @@ func (asmrClient *ASMRClient) EnsureFileDirsExist(tracks []track, basePath strin
 					mp3Path = strings.Replace(mp3Path, str, "_", -1)
 				}
 			}
-			_ = os.MkdirAll(mp3Path, os.ModePerm)
+			_ = os.MkdirAll(mp3Path, utils.DirMode())
 			for _, t := range tracks {
 				if t.Type == "folder" {
 					collectMP3Titles(t.Children, fmt.Sprintf("%s/%s", mp3Path, t.Title))
@@ -216,7 +276,7 @@ func (asmrClient *ASMRClient) EnsureFileDirsExist(tracks []track, basePath strin
 					allPath = strings.Replace(allPath, str, "_", -1)
 				}
 			}
-			_ = os.MkdirAll(allPath, os.ModePerm)
+			_ = os.MkdirAll(allPath, utils.DirMode())
 			for _, t := range tracks {
 				if t.Type == "folder" {
 					processFiles(t.Children, fmt.Sprintf("%s/%s", currentPath, t.Title))
@@ -230,7 +290,7 @@ func (asmrClient *ASMRClient) EnsureFileDirsExist(tracks []track, basePath strin
 						continue
 					}
 
-					asmrClient.DownloadFile(t.MediaDownloadURL, currentPath, t.Title)
+					asmrClient.DownloadFile(t.MediaDownloadURL, currentPath, t.Title, trackAssetKind(t), asmrClient.trackTags(t))
 				}
 			}
 		}
@@ -239,7 +299,7 @@ func (asmrClient *ASMRClient) EnsureFileDirsExist(tracks []track, basePath strin
 		// 默认行为，下载所有文件
 		for _, t := range tracks {
 			if t.Type != "folder" {
-				asmrClient.DownloadFile(t.MediaDownloadURL, path, t.Title)
+				asmrClient.DownloadFile(t.MediaDownloadURL, path, t.Title, trackAssetKind(t), asmrClient.trackTags(t))
 			} else {
 				asmrClient.EnsureFileDirsExist(t.Children, fmt.Sprintf("%s/%s", path, t.Title))
 			}
@@ -247,27 +307,212 @@ func (asmrClient *ASMRClient) EnsureFileDirsExist(tracks []track, basePath strin
 	}
 }
 
-// DownloadFile
+// plannedFile 根据音轨信息预期下载的文件
+type plannedFile struct {
+	t   track
+	dir string
+}
+
+// planTrackFiles
 //
-//	@Description: 文件下载
+//	@Description: 按与EnsureFileDirsExist相同的规则列出作品应下载的所有文件
 //	@receiver asmrClient
-//	@param url
-//	@param dirPath
+//	@param tracks
+//	@param basePath
+//	@return []plannedFile
+//	@return string 文件所在的作品根目录
+func (asmrClient *ASMRClient) planTrackFiles(tracks []track, basePath string) ([]plannedFile, string) {
+	var planned []plannedFile
+	if asmrClient.GlobalConfig.DownloadType == "prioritizemp3" {
+		mp3Titles := make(map[string]bool)
+		var collect func([]track)
+		collect = func(tracks []track) {
+			for _, t := range tracks {
+				if t.Type == "folder" {
+					collect(t.Children)
+				} else if strings.HasSuffix(strings.ToLower(t.Title), ".mp3") {
+					mp3Titles[strings.TrimSuffix(t.Title, filepath.Ext(t.Title))] = true
+				}
+			}
+		}
+		collect(tracks)
+		var walk func([]track, string)
+		walk = func(tracks []track, currentPath string) {
+			for _, t := range tracks {
+				if t.Type == "folder" {
+					walk(t.Children, fmt.Sprintf("%s/%s", currentPath, t.Title))
+					continue
+				}
+				ext := strings.ToLower(filepath.Ext(t.Title))
+				if (ext == ".wav" || ext == ".flac") && mp3Titles[strings.TrimSuffix(t.Title, filepath.Ext(t.Title))] {
+					continue
+				}
+				planned = append(planned, plannedFile{t: t, dir: currentPath})
+			}
+		}
+		walk(tracks, basePath)
+		return planned, basePath
+	}
+	var walk func([]track, string)
+	walk = func(tracks []track, currentPath string) {
+		currentPath = windowsSafeDir(currentPath)
+		for _, t := range tracks {
+			if t.Type == "folder" {
+				walk(t.Children, fmt.Sprintf("%s/%s", currentPath, t.Title))
+			} else {
+				planned = append(planned, plannedFile{t: t, dir: currentPath})
+			}
+		}
+	}
+	walk(tracks, basePath)
+	return planned, windowsSafeDir(basePath)
+}
+
+// windowsSafeDir
+//
+//	@Description: windows下替换目录路径中的非法字符
+//	@param path
+//	@return string
+func windowsSafeDir(path string) string {
+	if runtime.GOOS == "windows" {
+		for _, str := range []string{"?", "<", ">", ":", "*", "|", " "} {
+			path = strings.Replace(path, str, "_", -1)
+		}
+	}
+	return path
+}
+
+// windowsSafeFileName
+//
+//	@Description: windows下替换文件名中的非法字符
 //	@param fileName
-func (asmrClient *ASMRClient) DownloadFile(url string, dirPath string, fileName string) {
+//	@return string
+func windowsSafeFileName(fileName string) string {
 	if runtime.GOOS == "windows" {
 		for _, str := range []string{"?", "<", ">", ":", "/", "\\", "*", "|", " "} {
 			fileName = strings.Replace(fileName, str, "_", -1)
 		}
 	}
-	savePath := dirPath + "/" + fileName
-	if utils.FileOrDirExists(savePath) {
-		log.AsmrLog.Info(fmt.Sprintf("文件: %s 已存在, 跳过下载...\n", savePath))
+	return fileName
+}
+
+// publishWork
+//
+//	@Description: 作品下载结束后检查完整性, 设置了暂存目录时将完整的作品移动到最终目录, 不完整的作品保留在暂存目录
+//	@receiver asmrClient
+//	@param rjId
+//	@param tracks
+//	@param itemStorePath 作品的最终目录
+//	@param downloadPath 作品的下载目录
+func (asmrClient *ASMRClient) publishWork(rjId string, tracks []track, itemStorePath string, downloadPath string) {
+	if !asmrClient.GlobalConfig.VerifyWorkComplete && !utils.StagingEnabled() {
+		return
+	}
+	complete := asmrClient.ensureWorkComplete(rjId, tracks, downloadPath)
+	if !utils.StagingEnabled() {
+		return
+	}
+	if !complete {
+		log.AsmrLog.Warn(fmt.Sprintf("作品: %s 未完整下载, 保留在暂存目录: %s", rjId, downloadPath))
+		return
+	}
+	if err := utils.FinalizeWork(itemStorePath); err != nil {
+		log.AsmrLog.Error(fmt.Sprintf("作品: %s 移动到最终目录失败: %s", rjId, err.Error()))
+	}
+}
+
+// ensureWorkComplete
+//
+//	@Description: 检查作品目录中是否存在所有预期的文件, 缺少的文件重新加入下载
+//	@receiver asmrClient
+//	@param rjId
+//	@param tracks
+//	@param itemStorePath
+//	@return bool 重新下载后作品是否完整
+func (asmrClient *ASMRClient) ensureWorkComplete(rjId string, tracks []track, itemStorePath string) bool {
+	planned, root := asmrClient.planTrackFiles(tracks, itemStorePath)
+	expected := make([]string, 0, len(planned))
+	byPath := map[string]plannedFile{}
+	for _, file := range planned {
+		fileName := windowsSafeFileName(file.t.Title)
+		if utils.SkippedByRule(fileName, trackAssetKind(file.t)) {
+			continue
+		}
+		rel, err := filepath.Rel(root, utils.StorePathFor(file.dir, fileName, trackAssetKind(file.t)))
+		if err != nil {
+			continue
+		}
+		expected = append(expected, rel)
+		byPath[rel] = file
+	}
+	missing, err := utils.VerifyWorkComplete(root, expected)
+	if err != nil {
+		log.AsmrLog.Error(fmt.Sprintf("检查作品: %s 完整性失败: %s", rjId, err.Error()))
+		return false
+	}
+	if len(missing) == 0 {
+		return true
+	}
+	log.AsmrLog.Warn(fmt.Sprintf("作品: %s 缺少%d个文件, 重新加入下载", rjId, len(missing)), zap.Strings("missing", missing))
+	for _, rel := range missing {
+		file := byPath[rel]
+		asmrClient.DownloadFile(file.t.MediaDownloadURL, file.dir, file.t.Title, trackAssetKind(file.t), asmrClient.trackTags(file.t))
+	}
+	missing, err = utils.VerifyWorkComplete(root, expected)
+	return err == nil && len(missing) == 0
+}
+
+// DownloadFile
+//
+//	@Description: 文件下载
+//	@receiver asmrClient
+//	@param url
+//	@param dirPath
+//	@param fileName
+//	@param kind
+//	@param tags 下载完成后写入的音频标签, 为nil时不写入
+func (asmrClient *ASMRClient) DownloadFile(url string, dirPath string, fileName string, kind utils.AssetKind, tags *utils.AudioTags) {
+	fileName = windowsSafeFileName(fileName)
+	savePath := utils.CollisionFreePathFor(utils.StorePathFor(dirPath, fileName, kind), url)
+	//清单中有ETag/Last-Modified记录时 交给下载器发起条件请求确认文件是否有更新
+	if utils.SkipIfExists(savePath, url) {
 		return
 	}
 	log.AsmrLog.Info("正在下载 ", zap.String("info", savePath))
-	_ = utils.NewFileDownloader(url, dirPath, fileName)()
+	_ = utils.NewFileDownloaderWithOptions(url, dirPath, fileName, utils.DownloadOptions{Kind: kind, Tags: tags})()
+
+}
+
+// trackTags
+//
+//	@Description: 根据音轨信息生成音频标签
+//	@receiver asmrClient
+//	@param t
+//	@return *utils.AudioTags 未开启tag_audio或不是音频时返回nil
+func (asmrClient *ASMRClient) trackTags(t track) *utils.AudioTags {
+	if !asmrClient.GlobalConfig.TagAudio || trackAssetKind(t) != utils.AssetAudio {
+		return nil
+	}
+	return &utils.AudioTags{
+		Title: strings.TrimSuffix(t.Title, filepath.Ext(t.Title)),
+		Album: t.WorkTitle,
+	}
+}
 
+// trackAssetKind
+//
+//	@Description: 根据音轨类型获取文件类型
+//	@param t
+//	@return utils.AssetKind
+func trackAssetKind(t track) utils.AssetKind {
+	switch t.Type {
+	case "audio":
+		return utils.AssetAudio
+	case "image":
+		return utils.AssetImage
+	default:
+		return utils.DetectAssetKind(t.Title)
+	}
 }
 
 // GetPerPageInfo 获取每页的信息
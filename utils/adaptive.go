@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"asmr-downloader/log"
+)
+
+// AdaptiveOptions
+//
+//	@Description: 自适应并发控制选项(AIMD): 最近的失败率超过阈值时并发数减半并增加请求间隔, 连续成功后逐步恢复
+type AdaptiveOptions struct {
+	// 并发数上限 小于等于0表示关闭自适应并发控制
+	MaxConcurrency int
+	// 并发数下限 小于等于0时为1
+	MinConcurrency int
+	// 触发降低并发数的失败率(0-1) 小于等于0时为0.5
+	FailureThreshold float64
+	// 计算失败率使用的最近下载结果数 小于等于0时为20
+	Window int
+	// 每次降低并发数时请求间隔的增量 小于等于0时为1秒
+	DelayStep time.Duration
+	// 请求间隔上限 小于等于0时为30秒
+	MaxDelay time.Duration
+}
+
+// AdaptiveState
+//
+//	@Description: 自适应并发控制的当前状态
+type AdaptiveState struct {
+	// 当前的并发数上限
+	Limit int `json:"limit"`
+	// 当前的请求间隔
+	Delay time.Duration `json:"delay"`
+	// 正在进行的下载数
+	Running int `json:"running"`
+	// 最近的失败率
+	FailureRate float64 `json:"failure_rate"`
+}
+
+// adaptiveLimiter 自适应并发控制
+var adaptiveLimiter = struct {
+	sync.Mutex
+	opts    AdaptiveOptions
+	limit   int
+	delay   time.Duration
+	running int
+	// 最近的下载结果 true表示失败
+	outcomes []bool
+	// 上次调整后连续成功的次数
+	successes int
+	// 上一个请求开始的时间
+	lastStart time.Time
+	// 状态变化时关闭并重新创建 用于唤醒等待的下载
+	changed chan struct{}
+}{changed: make(chan struct{})}
+
+// SetAdaptiveConcurrency
+//
+//	@Description: 设置自适应并发控制, 从MaxConcurrency开始, 失败率过高时减半(乘性减少), 每成功limit个文件加1(加性增加)
+//	@param opts MaxConcurrency小于等于0时关闭
+func SetAdaptiveConcurrency(opts AdaptiveOptions) {
+	if opts.MinConcurrency <= 0 {
+		opts.MinConcurrency = 1
+	}
+	if opts.MinConcurrency > opts.MaxConcurrency {
+		opts.MinConcurrency = opts.MaxConcurrency
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 0.5
+	}
+	if opts.Window <= 0 {
+		opts.Window = 20
+	}
+	if opts.DelayStep <= 0 {
+		opts.DelayStep = time.Second
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = 30 * time.Second
+	}
+	adaptiveLimiter.Lock()
+	defer adaptiveLimiter.Unlock()
+	adaptiveLimiter.opts = opts
+	adaptiveLimiter.limit = opts.MaxConcurrency
+	adaptiveLimiter.delay = 0
+	adaptiveLimiter.outcomes = nil
+	adaptiveLimiter.successes = 0
+	notifyAdaptiveChanged()
+}
+
+// AdaptiveConcurrencyState
+//
+//	@Description: 获取自适应并发控制的当前状态
+//	@return AdaptiveState
+func AdaptiveConcurrencyState() AdaptiveState {
+	adaptiveLimiter.Lock()
+	defer adaptiveLimiter.Unlock()
+	return AdaptiveState{
+		Limit:       adaptiveLimiter.limit,
+		Delay:       adaptiveLimiter.delay,
+		Running:     adaptiveLimiter.running,
+		FailureRate: adaptiveFailureRate(),
+	}
+}
+
+// notifyAdaptiveChanged
+//
+//	@Description: 唤醒等待名额的下载, 调用方需持有adaptiveLimiter的锁
+func notifyAdaptiveChanged() {
+	close(adaptiveLimiter.changed)
+	adaptiveLimiter.changed = make(chan struct{})
+}
+
+// adaptiveFailureRate
+//
+//	@Description: 计算最近的失败率, 调用方需持有adaptiveLimiter的锁
+//	@return float64
+func adaptiveFailureRate() float64 {
+	if len(adaptiveLimiter.outcomes) == 0 {
+		return 0
+	}
+	failures := 0
+	for _, failed := range adaptiveLimiter.outcomes {
+		if failed {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(adaptiveLimiter.outcomes))
+}
+
+// acquireAdaptive
+//
+//	@Description: 等待自适应并发控制的下载名额, 并与上一个请求保持当前的请求间隔
+//	@param ctx
+//	@return func() 释放名额
+//	@return error ctx结束时返回
+func acquireAdaptive(ctx context.Context) (func(), error) {
+	for {
+		adaptiveLimiter.Lock()
+		if adaptiveLimiter.opts.MaxConcurrency <= 0 {
+			adaptiveLimiter.Unlock()
+			return func() {}, nil
+		}
+		var wait time.Duration
+		if adaptiveLimiter.running < adaptiveLimiter.limit {
+			wait = time.Until(adaptiveLimiter.lastStart.Add(adaptiveLimiter.delay))
+			if wait <= 0 {
+				adaptiveLimiter.running++
+				adaptiveLimiter.lastStart = time.Now()
+				adaptiveLimiter.Unlock()
+				return releaseAdaptive, nil
+			}
+		}
+		changed := adaptiveLimiter.changed
+		adaptiveLimiter.Unlock()
+
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-changed:
+		case <-timer:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// releaseAdaptive
+//
+//	@Description: 释放自适应并发控制的下载名额
+func releaseAdaptive() {
+	adaptiveLimiter.Lock()
+	defer adaptiveLimiter.Unlock()
+	adaptiveLimiter.running--
+	notifyAdaptiveChanged()
+}
+
+// recordAdaptiveOutcome
+//
+//	@Description: 记录下载结果并调整并发数与请求间隔
+//	@param failed
+func recordAdaptiveOutcome(failed bool) {
+	adaptiveLimiter.Lock()
+	defer adaptiveLimiter.Unlock()
+	opts := adaptiveLimiter.opts
+	if opts.MaxConcurrency <= 0 {
+		return
+	}
+	adaptiveLimiter.outcomes = append(adaptiveLimiter.outcomes, failed)
+	if len(adaptiveLimiter.outcomes) > opts.Window {
+		adaptiveLimiter.outcomes = adaptiveLimiter.outcomes[len(adaptiveLimiter.outcomes)-opts.Window:]
+	}
+	if failed {
+		adaptiveLimiter.successes = 0
+		//样本过少时不调整 避免单次失败就降低并发数
+		if len(adaptiveLimiter.outcomes)*2 < opts.Window || adaptiveFailureRate() <= opts.FailureThreshold {
+			return
+		}
+		adaptiveLimiter.limit = max(adaptiveLimiter.limit/2, opts.MinConcurrency)
+		adaptiveLimiter.delay = min(adaptiveLimiter.delay+opts.DelayStep, opts.MaxDelay)
+		//重新统计 等待新的并发数下的结果
+		adaptiveLimiter.outcomes = nil
+		log.AsmrLog.Warn(fmt.Sprintf("下载失败率过高, 并发数降低为%d, 请求间隔增加为%s", adaptiveLimiter.limit, adaptiveLimiter.delay))
+		notifyAdaptiveChanged()
+		return
+	}
+	adaptiveLimiter.successes++
+	if adaptiveLimiter.successes < adaptiveLimiter.limit {
+		return
+	}
+	//每成功limit个文件(约一轮)恢复一次
+	adaptiveLimiter.successes = 0
+	if adaptiveLimiter.delay > 0 {
+		adaptiveLimiter.delay = max(adaptiveLimiter.delay-opts.DelayStep, 0)
+	} else if adaptiveLimiter.limit < opts.MaxConcurrency {
+		adaptiveLimiter.limit++
+	} else {
+		return
+	}
+	log.AsmrLog.Info(fmt.Sprintf("下载恢复正常, 并发数为%d, 请求间隔为%s", adaptiveLimiter.limit, adaptiveLimiter.delay))
+	notifyAdaptiveChanged()
+}
@@ -0,0 +1,293 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding/japanese"
+
+	"asmr-downloader/log"
+)
+
+// ArchiveExtractor
+//
+//	@Description: 压缩包解压方法, 用于接入外部工具解压zip以外的格式(如rar)
+//	@param archive 压缩包路径
+//	@param dest 解压目录
+//	@return error
+type ArchiveExtractor func(archive string, dest string) error
+
+// archiveExtraction 下载完成后自动解压的设置
+var archiveExtraction = struct {
+	sync.RWMutex
+	enabled bool
+	// 解压成功后删除压缩包
+	deleteArchive bool
+	// 按扩展名(小写, 带.)注册的解压方法
+	extractors map[string]ArchiveExtractor
+}{extractors: map[string]ArchiveExtractor{}}
+
+// ErrArchiveTruncated 边解压边截断的压缩包在解压中途失败, 压缩包已不完整, 需要重新下载
+var ErrArchiveTruncated = errors.New("压缩包已截断")
+
+// zipMagic zip文件开头的签名
+var zipMagic = []byte("PK\x03\x04")
+
+// SetArchiveExtraction
+//
+//	@Description: 设置下载完成后是否自动解压压缩包到所在目录. 内置支持zip, rar等格式不支持, 需要通过RegisterArchiveExtractor注册外部工具
+//	@param enabled
+//	@param deleteArchive 解压成功后删除压缩包, 开启时zip从最后一个文件开始解压并逐步截断压缩包, 磁盘占用不会达到压缩包与解压后文件之和
+func SetArchiveExtraction(enabled bool, deleteArchive bool) {
+	archiveExtraction.Lock()
+	defer archiveExtraction.Unlock()
+	archiveExtraction.enabled = enabled
+	archiveExtraction.deleteArchive = deleteArchive
+}
+
+// RegisterArchiveExtractor
+//
+//	@Description: 按扩展名注册压缩包解压方法, 会覆盖内置的zip解压
+//	@param ext 扩展名 如.rar
+//	@param extractor 为nil时删除
+func RegisterArchiveExtractor(ext string, extractor ArchiveExtractor) {
+	ext = strings.ToLower(ext)
+	archiveExtraction.Lock()
+	defer archiveExtraction.Unlock()
+	if extractor == nil {
+		delete(archiveExtraction.extractors, ext)
+		return
+	}
+	archiveExtraction.extractors[ext] = extractor
+}
+
+// CommandExtractor
+//
+//	@Description: 创建调用外部命令的解压方法, 参数中的{archive}与{dest}替换为压缩包路径与解压目录, 例如"unrar x -o+ {archive} {dest}/"
+//	@param command
+//	@return ArchiveExtractor
+func CommandExtractor(command string) ArchiveExtractor {
+	return func(archive string, dest string) error {
+		fields := strings.Fields(command)
+		if len(fields) == 0 {
+			return fmt.Errorf("解压命令为空")
+		}
+		replacer := strings.NewReplacer("{archive}", archive, "{dest}", dest)
+		for i := range fields {
+			fields[i] = replacer.Replace(fields[i])
+		}
+		output, err := exec.Command(fields[0], fields[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("执行解压命令失败: %w, %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+}
+
+// extractDownloadedArchive
+//
+//	@Description: 下载完成的文件是压缩包时解压到所在目录, 解压失败时保留压缩包并记录日志
+//	@param storePath
+//	@return error 压缩包已截断无法使用时返回, 需要重新下载
+func extractDownloadedArchive(storePath string) error {
+	archiveExtraction.RLock()
+	enabled, deleteArchive := archiveExtraction.enabled, archiveExtraction.deleteArchive
+	extractor := archiveExtraction.extractors[strings.ToLower(filepath.Ext(storePath))]
+	archiveExtraction.RUnlock()
+	if !enabled {
+		return nil
+	}
+	dest := filepath.Dir(storePath)
+	var err error
+	switch {
+	case extractor != nil:
+		err = extractor(storePath, dest)
+	case isZipFile(storePath):
+		var count int
+		count, err = ExtractZip(storePath, dest, deleteArchive)
+		if err == nil {
+			log.AsmrLog.Info(fmt.Sprintf("已解压%d个文件: %s", count, storePath))
+		}
+	case strings.EqualFold(filepath.Ext(storePath), ".rar"):
+		log.AsmrLog.Warn("不支持解压rar文件, 请配置外部解压命令: ", zap.String("info", storePath))
+		return nil
+	default:
+		return nil
+	}
+	if errors.Is(err, ErrArchiveTruncated) {
+		log.AsmrLog.Error("解压失败, 压缩包已截断无法使用, 需要重新下载: ", zap.String("info", storePath), zap.String("error", err.Error()))
+		return err
+	}
+	if err != nil {
+		log.AsmrLog.Error("解压失败, 保留压缩包: ", zap.String("info", storePath), zap.String("error", err.Error()))
+		return nil
+	}
+	if deleteArchive {
+		if err := os.Remove(storePath); err != nil {
+			log.AsmrLog.Error("删除压缩包失败: ", zap.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+// isZipFile
+//
+//	@Description: 按扩展名或文件开头的签名判断是否为zip文件
+//	@param path
+//	@return bool
+func isZipFile(path string) bool {
+	if strings.EqualFold(filepath.Ext(path), ".zip") {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, len(zipMagic))
+	_, err = io.ReadFull(f, head)
+	return err == nil && bytes.Equal(head, zipMagic)
+}
+
+// ExtractZip
+//
+//	@Description: 解压zip文件到dest, 文件名中的路径逐级清理(防止解压到dest以外), 非UTF-8文件名按Shift_JIS解码
+//	@param archive
+//	@param dest
+//	@param truncate 先校验所有文件的CRC, 再按数据在压缩包中的位置从后往前解压, 每解压一个文件截断压缩包(压缩包之后会被删除),
+//	降低解压期间的磁盘占用. 截断后解压失败时返回ErrArchiveTruncated
+//	@return int 解压的文件数
+//	@return error
+func ExtractZip(archive string, dest string, truncate bool) (int, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	files := reader.File
+	if truncate {
+		//截断后无法再读取前面的文件 先确认所有文件都能完整解压
+		if err := verifyZipMembers(files); err != nil {
+			return 0, err
+		}
+		//zip的文件目录在末尾 打开时已读入内存, 之后只读取各文件的数据
+		//文件目录的顺序不一定是数据的实际顺序 按数据位置从后往前解压
+		offsets := make(map[*zip.File]int64, len(files))
+		for _, file := range files {
+			offset, err := file.DataOffset()
+			if err != nil {
+				return 0, fmt.Errorf("读取%s的数据位置失败: %w", file.Name, err)
+			}
+			offsets[file] = offset
+		}
+		files = append([]*zip.File(nil), files...)
+		sort.SliceStable(files, func(i, j int) bool { return offsets[files[i]] > offsets[files[j]] })
+	}
+	truncated := false
+	count := 0
+	for _, file := range files {
+		member := zipMemberPath(file)
+		if member == "" {
+			continue
+		}
+		target := filepath.Join(dest, member)
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, DirMode()); err != nil {
+				return count, err
+			}
+			continue
+		}
+		if err := extractZipMember(file, target); err != nil {
+			if truncated {
+				return count, fmt.Errorf("%w, 解压%s失败: %w", ErrArchiveTruncated, file.Name, err)
+			}
+			return count, fmt.Errorf("解压%s失败: %w", file.Name, err)
+		}
+		count++
+		if offset, err := file.DataOffset(); truncate && err == nil && os.Truncate(archive, offset) == nil {
+			truncated = true
+		}
+	}
+	return count, nil
+}
+
+// verifyZipMembers
+//
+//	@Description: 完整读取zip中的每个文件, 校验CRC与大小
+//	@param files
+//	@return error
+func verifyZipMembers(files []*zip.File) error {
+	for _, file := range files {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		in, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("校验%s失败: %w", file.Name, err)
+		}
+		_, err = io.Copy(io.Discard, in)
+		_ = in.Close()
+		if err != nil {
+			return fmt.Errorf("校验%s失败: %w", file.Name, err)
+		}
+	}
+	return nil
+}
+
+// zipMemberPath
+//
+//	@Description: 获取zip中文件清理后的相对路径
+//	@param file
+//	@return string
+func zipMemberPath(file *zip.File) string {
+	name := file.Name
+	if file.NonUTF8 || !utf8.ValidString(name) {
+		if decoded, err := japanese.ShiftJIS.NewDecoder().String(name); err == nil {
+			name = decoded
+		}
+	}
+	var parts []string
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		parts = append(parts, SanitizeFileName(part))
+	}
+	return filepath.Join(parts...)
+}
+
+// extractZipMember
+//
+//	@Description: 解压zip中的单个文件
+//	@param file
+//	@param target
+//	@return err
+func extractZipMember(file *zip.File, target string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(target), DirMode()); err != nil {
+		return err
+	}
+	in, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FileMode())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := out.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// AssetKind
+//
+//	@Description: 下载文件的类型, 用于按类型应用不同的下载规则
+type AssetKind string
+
+const (
+	AssetAudio    AssetKind = "audio"
+	AssetImage    AssetKind = "image"
+	AssetMetadata AssetKind = "metadata"
+	AssetSubtitle AssetKind = "subtitle"
+	AssetOther    AssetKind = "other"
+)
+
+// assetKindByExt 按扩展名推断文件类型
+var assetKindByExt = map[string]AssetKind{
+	".mp3":  AssetAudio,
+	".wav":  AssetAudio,
+	".flac": AssetAudio,
+	".m4a":  AssetAudio,
+	".aac":  AssetAudio,
+	".ogg":  AssetAudio,
+	".opus": AssetAudio,
+	".jpg":  AssetImage,
+	".jpeg": AssetImage,
+	".png":  AssetImage,
+	".gif":  AssetImage,
+	".webp": AssetImage,
+	".json": AssetMetadata,
+	".txt":  AssetMetadata,
+	".pdf":  AssetMetadata,
+	".vtt":  AssetSubtitle,
+	".lrc":  AssetSubtitle,
+	".srt":  AssetSubtitle,
+	".ass":  AssetSubtitle,
+}
+
+// DetectAssetKind
+//
+//	@Description: 按文件扩展名推断文件类型
+//	@param fileName
+//	@return AssetKind
+func DetectAssetKind(fileName string) AssetKind {
+	if kind, ok := assetKindByExt[strings.ToLower(filepath.Ext(fileName))]; ok {
+		return kind
+	}
+	return AssetOther
+}
+
+// KindRule
+//
+//	@Description: 某一类型文件的下载规则
+type KindRule struct {
+	// 文件名匹配任意一个模式(filepath.Match语法)时跳过下载
+	SkipPatterns []string `json:"skip_patterns"`
+	// 下载完成后文件小于该大小视为下载失败, 0表示不限制
+	MinSize int64 `json:"min_size"`
+	// 保存到下载目录下的子目录, 为空时直接保存到下载目录
+	Folder string `json:"folder"`
+}
+
+// kindRules 各类型文件的下载规则
+var kindRules = struct {
+	sync.RWMutex
+	rules map[AssetKind]KindRule
+}{rules: map[AssetKind]KindRule{}}
+
+// SetKindRule
+//
+//	@Description: 设置某一类型文件的下载规则
+//	@param kind
+//	@param rule
+func SetKindRule(kind AssetKind, rule KindRule) {
+	kindRules.Lock()
+	defer kindRules.Unlock()
+	kindRules.rules[kind] = rule
+}
+
+// kindRuleFor
+//
+//	@Description: 获取某一类型文件的下载规则, 未设置时返回空规则
+//	@param kind
+//	@return KindRule
+func kindRuleFor(kind AssetKind) KindRule {
+	kindRules.RLock()
+	defer kindRules.RUnlock()
+	return kindRules.rules[kind]
+}
+
+// shouldSkip
+//
+//	@Description: 判断文件名是否匹配跳过规则
+//	@receiver rule
+//	@param fileName
+//	@return bool
+func (rule KindRule) shouldSkip(fileName string) bool {
+	for _, pattern := range rule.SkipPatterns {
+		if matched, _ := filepath.Match(pattern, fileName); matched {
+			return true
+		}
+	}
+	return false
+}
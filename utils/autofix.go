@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// autoFixRun 自动修复每轮执行的修复函数
+var autoFixRun = FixBrokenDownloadFile
+
+// StartAutoFix
+//
+//	@Description: 在后台按interval定期重试下载失败的文件, 直到ctx结束. 没有下载失败记录时跳过该轮, 每轮修复后发送Webhook汇总
+//	@param ctx
+//	@param interval 小于等于0时不启动
+//	@param maxRetry 每个文件的最大重试次数
+func StartAutoFix(ctx context.Context, interval time.Duration, maxRetry int) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			runAutoFix(maxRetry)
+		}
+	}()
+}
+
+// runAutoFix
+//
+//	@Description: 执行一轮自动修复
+//	@param maxRetry
+func runAutoFix(maxRetry int) {
+	if !CheckIfNeedFixBrokenDownloadFile() {
+		return
+	}
+	log.AsmrLog.Info("自动修复: 正在重试下载失败的文件...")
+	result, err := autoFixRun(maxRetry)
+	message := ""
+	if err != nil {
+		message = fmt.Sprintf("自动修复失败: %s", err.Error())
+		log.AsmrLog.Error(message)
+	} else {
+		message = fmt.Sprintf("自动修复完成: 成功%d个, 仍然失败%d个, 不再重试%d个, 过期%d个, 清理%d条记录",
+			result.Recovered, result.StillFailing, result.Permanent, result.Expired, result.Pruned)
+		log.AsmrLog.Info(message)
+	}
+	if err := log.DiscordWebhook.Send(message); err != nil {
+		log.AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
+	}
+}
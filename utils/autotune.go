@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// autoTuneLevels 自动选择并发数时依次测试的并发数
+var autoTuneLevels = []int{1, 2, 4, 6, 8, 12, 16}
+
+// autoTunePlateauGain 吞吐量增幅低于该比例时视为达到瓶颈
+const autoTunePlateauGain = 0.1
+
+// ConcurrencyMeasurement
+//
+//	@Description: 某个并发数下的测速结果
+type ConcurrencyMeasurement struct {
+	Concurrency int `json:"concurrency"`
+	// 整体吞吐量 字节/秒
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// 失败的请求数
+	Failures int `json:"failures"`
+	// 是否被限流(429/1015)
+	Throttled bool `json:"throttled"`
+}
+
+// String
+//
+//	@Description: 格式化测速结果
+//	@receiver m
+//	@return string
+func (m ConcurrencyMeasurement) String() string {
+	result := fmt.Sprintf("并发数: %d, 吞吐量: %.2f MB/s", m.Concurrency, m.BytesPerSecond/1024/1024)
+	if m.Failures > 0 {
+		result += fmt.Sprintf(", 失败: %d", m.Failures)
+	}
+	if m.Throttled {
+		result += ", 被限流"
+	}
+	return result
+}
+
+// AutoTuneConcurrency
+//
+//	@Description: 以递增的并发数同时下载样本文件的开头部分, 返回吞吐量不再明显增加(或出现1015限流)时的并发数, 每一档的测速结果写入日志
+//	@param ctx
+//	@param sampleURL 样本文件 应足够大(至少4MB)
+//	@return int 选择的并发数
+//	@return error 并发数为1时也无法下载样本文件或ctx被取消时返回
+func AutoTuneConcurrency(ctx context.Context, sampleURL string) (int, error) {
+	measurements, err := MeasureConcurrency(ctx, sampleURL, autoTuneLevels)
+	for _, m := range measurements {
+		log.AsmrLog.Info("并发测速: ", zap.String("info", m.String()))
+	}
+	if err != nil {
+		return 0, err
+	}
+	best := pickConcurrency(measurements)
+	if best == 0 {
+		return 0, fmt.Errorf("下载样本文件%s失败", sampleURL)
+	}
+	log.AsmrLog.Info(fmt.Sprintf("自动选择并发数: %d", best))
+	return best, nil
+}
+
+// MeasureConcurrency
+//
+//	@Description: 依次以levels中的并发数测量下载样本文件的整体吞吐量, 吞吐量不再明显增加或被限流时停止
+//	@param ctx
+//	@param sampleURL
+//	@param levels 从小到大的并发数
+//	@return []ConcurrencyMeasurement 已完成的测速结果
+//	@return error ctx被取消时返回
+func MeasureConcurrency(ctx context.Context, sampleURL string, levels []int) ([]ConcurrencyMeasurement, error) {
+	var measurements []ConcurrencyMeasurement
+	for _, level := range levels {
+		if err := ctx.Err(); err != nil {
+			return measurements, err
+		}
+		m := measureLevel(ctx, sampleURL, level)
+		measurements = append(measurements, m)
+		if m.Throttled || m.BytesPerSecond == 0 {
+			break
+		}
+		if len(measurements) > 1 {
+			previous := measurements[len(measurements)-2].BytesPerSecond
+			if m.BytesPerSecond < previous*(1+autoTunePlateauGain) {
+				break
+			}
+		}
+	}
+	return measurements, nil
+}
+
+// pickConcurrency
+//
+//	@Description: 从测速结果中选择并发数: 被限流前吞吐量最高的并发数, 吞吐量相近时选择较小的并发数
+//	@param measurements
+//	@return int 没有成功的测速时为0
+func pickConcurrency(measurements []ConcurrencyMeasurement) int {
+	best := ConcurrencyMeasurement{}
+	for _, m := range measurements {
+		if m.Throttled || m.Failures > 0 {
+			break
+		}
+		if m.BytesPerSecond >= best.BytesPerSecond*(1+autoTunePlateauGain) {
+			best = m
+		}
+	}
+	return best.Concurrency
+}
+
+// measureLevel
+//
+//	@Description: 以level个连接同时下载样本文件的开头部分, 统计整体吞吐量
+//	@param ctx
+//	@param sampleURL
+//	@param level
+//	@return ConcurrencyMeasurement
+func measureLevel(ctx context.Context, sampleURL string, level int) ConcurrencyMeasurement {
+	ctx, cancel := context.WithTimeout(ctx, bandwidthProbeTimeout)
+	defer cancel()
+	result := ConcurrencyMeasurement{Concurrency: level}
+	var mu sync.Mutex
+	var total int64
+	var wg sync.WaitGroup
+	stopwatch := NewStopwatch()
+	for i := 0; i < level; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := sampleDownload(ctx, sampleURL)
+			mu.Lock()
+			defer mu.Unlock()
+			total += n
+			switch {
+			case errors.Is(err, ErrThrottled):
+				result.Throttled = true
+			case err != nil && !errors.Is(err, context.DeadlineExceeded):
+				result.Failures++
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := stopwatch.Elapsed(); elapsed > 0 {
+		result.BytesPerSecond = float64(total) / elapsed.Seconds()
+	}
+	return result
+}
+
+// sampleDownload
+//
+//	@Description: 下载样本文件开头的一部分并丢弃
+//	@param ctx
+//	@param sampleURL
+//	@return int64 下载的字节数
+//	@return error 被限流时为ErrThrottled, 超时时为context.DeadlineExceeded
+func sampleDownload(ctx context.Context, sampleURL string) (int64, error) {
+	req, err := NewRequest(ctx, "GET", sampleURL)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", bandwidthProbeBytes-1))
+	client := Client.Get().(*http.Client)
+	defer Client.Put(client)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return 0, ErrThrottled
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("下载%s失败, 状态码: %d", sampleURL, resp.StatusCode)
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, bandwidthProbeBytes))
+	if ctx.Err() != nil {
+		//测速时间到 已下载的部分仍计入吞吐量
+		return n, context.DeadlineExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// defaultBandwidthSampleCapacity 默认最多保留的带宽采样数
+const defaultBandwidthSampleCapacity = 1440
+
+// BandwidthSample
+//
+//	@Description: 一次带宽采样
+type BandwidthSample struct {
+	Time time.Time `json:"time"`
+	// 采样间隔内的平均速度 字节/秒
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// 截至采样时累计接收的字节数
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// bandwidthSampler 带宽采样器, 采样结果保存在环形缓冲区中
+var bandwidthSampler = struct {
+	sync.Mutex
+	samples []BandwidthSample
+	// 下一个采样写入的位置
+	next int
+	// 缓冲区是否已写满
+	full bool
+	stop chan struct{}
+	// 运行结束时写入的CSV文件路径 为空时不写入
+	csvPath string
+}{}
+
+// StartBandwidthSampler
+//
+//	@Description: 开始按interval记录所有下载的整体速度, 最多保留capacity个采样(超出后覆盖最早的采样). 再次调用会重新开始采样
+//	@param interval 小于等于0时停止采样
+//	@param capacity 小于等于0时为1440
+func StartBandwidthSampler(interval time.Duration, capacity int) {
+	StopBandwidthSampler()
+	if interval <= 0 {
+		return
+	}
+	if capacity <= 0 {
+		capacity = defaultBandwidthSampleCapacity
+	}
+	stop := make(chan struct{})
+	bandwidthSampler.Lock()
+	bandwidthSampler.samples = make([]BandwidthSample, capacity)
+	bandwidthSampler.next = 0
+	bandwidthSampler.full = false
+	bandwidthSampler.stop = stop
+	bandwidthSampler.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		lastBytes := receivedBytes.Load()
+		lastTime := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				total := receivedBytes.Load()
+				addBandwidthSample(BandwidthSample{
+					Time:           now,
+					BytesPerSecond: float64(total-lastBytes) / now.Sub(lastTime).Seconds(),
+					TotalBytes:     total,
+				})
+				lastBytes, lastTime = total, now
+			}
+		}
+	}()
+}
+
+// StopBandwidthSampler
+//
+//	@Description: 停止带宽采样, 已记录的采样仍然保留
+func StopBandwidthSampler() {
+	bandwidthSampler.Lock()
+	defer bandwidthSampler.Unlock()
+	if bandwidthSampler.stop != nil {
+		close(bandwidthSampler.stop)
+		bandwidthSampler.stop = nil
+	}
+}
+
+// addBandwidthSample
+//
+//	@Description: 写入一个采样, 缓冲区已满时覆盖最早的采样
+//	@param sample
+func addBandwidthSample(sample BandwidthSample) {
+	bandwidthSampler.Lock()
+	defer bandwidthSampler.Unlock()
+	if len(bandwidthSampler.samples) == 0 {
+		return
+	}
+	bandwidthSampler.samples[bandwidthSampler.next] = sample
+	bandwidthSampler.next = (bandwidthSampler.next + 1) % len(bandwidthSampler.samples)
+	if bandwidthSampler.next == 0 {
+		bandwidthSampler.full = true
+	}
+}
+
+// BandwidthSamples
+//
+//	@Description: 获取按时间排序的带宽采样
+//	@return []BandwidthSample
+func BandwidthSamples() []BandwidthSample {
+	bandwidthSampler.Lock()
+	defer bandwidthSampler.Unlock()
+	if !bandwidthSampler.full {
+		return append([]BandwidthSample{}, bandwidthSampler.samples[:bandwidthSampler.next]...)
+	}
+	result := append([]BandwidthSample{}, bandwidthSampler.samples[bandwidthSampler.next:]...)
+	return append(result, bandwidthSampler.samples[:bandwidthSampler.next]...)
+}
+
+// WriteBandwidthCSV
+//
+//	@Description: 将带宽采样以CSV格式写入w, 列为时间、速度(字节/秒)、累计字节数
+//	@param w
+//	@return error
+func WriteBandwidthCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"time", "bytes_per_second", "total_bytes"}); err != nil {
+		return err
+	}
+	for _, sample := range BandwidthSamples() {
+		if err := writer.Write([]string{
+			sample.Time.Format(time.RFC3339),
+			strconv.FormatFloat(sample.BytesPerSecond, 'f', 2, 64),
+			strconv.FormatInt(sample.TotalBytes, 10),
+		}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// SetBandwidthCSV
+//
+//	@Description: 设置DownloadBatch与FixBrokenDownloadFile结束时写入带宽采样的CSV文件, 传入空字符串关闭
+//	@param path
+func SetBandwidthCSV(path string) {
+	bandwidthSampler.Lock()
+	defer bandwidthSampler.Unlock()
+	bandwidthSampler.csvPath = path
+}
+
+// saveBandwidthCSV
+//
+//	@Description: 设置了CSV文件时写入带宽采样
+func saveBandwidthCSV() {
+	bandwidthSampler.Lock()
+	path := bandwidthSampler.csvPath
+	bandwidthSampler.Unlock()
+	if path == "" {
+		return
+	}
+	f, err := os.Create(path)
+	if err == nil {
+		err = WriteBandwidthCSV(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.AsmrLog.Error("写入带宽采样失败: ", zap.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,343 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// JobStatus 下载任务的结果状态
+type JobStatus string
+
+const (
+	// JobDone 下载完成
+	JobDone JobStatus = "done"
+	// JobSkipped 匹配跳过规则或文件未修改, 未下载
+	JobSkipped JobStatus = "skipped"
+	// JobExists 文件已存在, 未下载
+	JobExists JobStatus = "exists"
+	// JobCanceled 下载被取消
+	JobCanceled JobStatus = "canceled"
+	// JobFailed 下载失败
+	JobFailed JobStatus = "failed"
+	// JobDeferred 已达到下载数量限制, 推迟到之后下载
+	JobDeferred JobStatus = "deferred"
+)
+
+// JobResult
+//
+//	@Description: 单个文件的下载结果
+type JobResult struct {
+	URL string
+	// 文件保存路径
+	Path   string
+	Status JobStatus
+	// 下载失败或取消的原因
+	Err error
+}
+
+// DownloadJob
+//
+//	@Description: 批量下载中的单个文件
+type DownloadJob struct {
+	URL string `json:"url"`
+	// 保存目录
+	Path string `json:"path"`
+	// 文件名 为空时按url和响应头确定
+	Filename string `json:"filename,omitempty"`
+	// 额外请求头(会覆盖默认请求头)
+	Headers map[string]string `json:"headers,omitempty"`
+	// 预期sha256校验值 为空时不校验
+	Checksum string `json:"checksum,omitempty"`
+	// 文件已存在时跳过下载
+	SkipExisting bool `json:"skip_existing,omitempty"`
+	// 下载截止时间 为零值时不限制
+	Deadline time.Time `json:"-"`
+	// 最长下载时间 小于等于0时不限制
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// 元数据 没有指定文件名时用于渲染文件名模板
+	Meta map[string]string `json:"meta,omitempty"`
+	// 文件名模板 如"{rj} - {title}{ext}", 为空时使用SetFilenameTemplate设置的模板
+	FilenameTemplate string `json:"filename_template,omitempty"`
+}
+
+// BatchOptions
+//
+//	@Description: 批量下载选项
+type BatchOptions struct {
+	// 同时下载的文件数, 小于等于0时为1
+	Workers int
+	// 成功下载多少个文件后停止(预览模式), 其余文件记录到deferred-download.txt, 小于等于0表示不限制
+	Limit int
+}
+
+// BatchResult
+//
+//	@Description: 批量下载结果, Results与传入的任务一一对应
+type BatchResult struct {
+	Results []JobResult
+	Done    int
+	Skipped int
+	// 因文件已存在而跳过的文件数
+	Existing int
+	Canceled int
+	Failed   int
+	// 达到下载数量限制而推迟的文件数
+	Deferred int
+}
+
+// Err
+//
+//	@Description: 汇总所有下载失败的错误
+//	@receiver result
+//	@return error 没有下载失败时为nil
+func (result *BatchResult) Err() error {
+	var errs []error
+	for _, r := range result.Results {
+		if r.Status == JobFailed {
+			errs = append(errs, fmt.Errorf("%s: %w", r.URL, r.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// batchSeq 自动生成批量下载任务ID的序号
+var batchSeq atomic.Int64
+
+// DownloadBatch
+//
+//	@Description: 使用工作池批量下载文件, 每个文件都经过与NewFileDownloader相同的重试与校验流程. ctx结束时取消所有未完成的下载
+//	@param ctx
+//	@param jobs
+//	@param workers 同时下载的文件数, 小于等于0时为1
+//	@return *BatchResult 每个任务的下载结果和汇总
+//	@return error 下载失败的错误汇总, ctx结束时为ctx的错误
+func DownloadBatch(ctx context.Context, jobs []DownloadJob, workers int) (*BatchResult, error) {
+	return DownloadBatchWithOptions(ctx, jobs, BatchOptions{Workers: workers})
+}
+
+// DownloadBatchWithOptions
+//
+//	@Description: 按选项批量下载文件, 设置了Limit时成功下载Limit个文件后停止, 其余文件记录到deferred-download.txt,
+//	之后可通过ResumeDeferred继续下载
+//	@param ctx
+//	@param jobs
+//	@param opts
+//	@return *BatchResult
+//	@return error
+func DownloadBatchWithOptions(ctx context.Context, jobs []DownloadJob, opts BatchOptions) (*BatchResult, error) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	//覆盖已存在的文件前汇总确认
+	jobs = confirmOverwriteBatch(jobs)
+	limiter := newDownloadLimiter(opts.Limit)
+	var deferred []DownloadJob
+	var deferredLock sync.Mutex
+	prefix := "batch-" + strconv.FormatInt(batchSeq.Add(1), 10) + "-"
+
+	result := &BatchResult{Results: make([]JobResult, len(jobs))}
+	//ctx结束时取消进行中的下载
+	stop := context.AfterFunc(ctx, func() {
+		for i := range jobs {
+			CancelJob(prefix + strconv.Itoa(i))
+		}
+	})
+	defer stop()
+
+	pool := NewWorkerPool(workers)
+	for i, job := range jobs {
+		i, job := i, job
+		result.Results[i] = JobResult{URL: job.URL, Status: JobCanceled}
+		pool.Do(func() error {
+			if err := ctx.Err(); err != nil {
+				result.Results[i].Err = err
+				return nil
+			}
+			if !limiter.reserve() {
+				result.Results[i] = JobResult{URL: job.URL, Status: JobDeferred}
+				deferredLock.Lock()
+				deferred = append(deferred, job)
+				deferredLock.Unlock()
+				return nil
+			}
+			download := NewFileDownloaderWithOptions(job.URL, job.Path, job.Filename, DownloadOptions{
+				Headers:          job.Headers,
+				Checksum:         job.Checksum,
+				SkipExisting:     job.SkipExisting,
+				Deadline:         job.Deadline,
+				Timeout:          job.Timeout,
+				Meta:             job.Meta,
+				FilenameTemplate: job.FilenameTemplate,
+				JobID:            prefix + strconv.Itoa(i),
+				OnResult: func(r JobResult) {
+					result.Results[i] = r
+				},
+			})
+			err := download()
+			limiter.release(result.Results[i].Status == JobDone)
+			return err
+		})
+	}
+	poolErr := pool.Wait()
+
+	for _, r := range result.Results {
+		switch r.Status {
+		case JobDone:
+			result.Done++
+		case JobSkipped:
+			result.Skipped++
+		case JobExists:
+			result.Existing++
+		case JobCanceled:
+			result.Canceled++
+		case JobFailed:
+			result.Failed++
+		case JobDeferred:
+			result.Deferred++
+		}
+	}
+	if len(deferred) > 0 {
+		if err := appendDeferredJobs(deferred); err != nil {
+			log.AsmrLog.Error("写入推迟下载记录失败: ", zap.String("error", err.Error()))
+		}
+	}
+	finishRun(&BatchSummary{Done: result.Done, Skipped: result.Skipped, Existing: result.Existing, Canceled: result.Canceled, Failed: result.Failed, Deferred: result.Deferred}, nil)
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if err := result.Err(); err != nil {
+		return result, err
+	}
+	return result, poolErr
+}
+
+// downloadLimiter
+//
+//	@Description: 限制批量下载成功的文件数, 正在下载的文件占用名额, 下载失败后释放名额
+type downloadLimiter struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// 小于等于0表示不限制
+	limit   int
+	done    int
+	running int
+}
+
+// newDownloadLimiter
+//
+//	@Description: 创建下载数量限制
+//	@param limit 小于等于0表示不限制
+//	@return *downloadLimiter
+func newDownloadLimiter(limit int) *downloadLimiter {
+	limiter := &downloadLimiter{limit: limit}
+	limiter.cond = sync.NewCond(&limiter.mu)
+	return limiter
+}
+
+// reserve
+//
+//	@Description: 获取下载名额, 名额被正在下载的文件占用时等待其结束
+//	@receiver l
+//	@return bool 已成功下载limit个文件时返回false
+func (l *downloadLimiter) reserve() bool {
+	if l.limit <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.done < l.limit && l.done+l.running >= l.limit {
+		l.cond.Wait()
+	}
+	if l.done >= l.limit {
+		return false
+	}
+	l.running++
+	return true
+}
+
+// release
+//
+//	@Description: 释放下载名额
+//	@receiver l
+//	@param succeeded 文件是否下载成功
+func (l *downloadLimiter) release(succeeded bool) {
+	if l.limit <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	if succeeded {
+		l.done++
+	}
+	l.cond.Broadcast()
+}
+
+// DeferredDownloadFileName 预览模式下推迟下载的文件记录, 每行一个JSON格式的DownloadJob
+const DeferredDownloadFileName = "deferred-download.txt"
+
+// deferredLock 保护推迟下载记录文件
+var deferredLock sync.Mutex
+
+// appendDeferredJobs
+//
+//	@Description: 将推迟下载的文件追加到推迟下载记录
+//	@param jobs
+//	@return error
+func appendDeferredJobs(jobs []DownloadJob) error {
+	deferredLock.Lock()
+	defer deferredLock.Unlock()
+	f, err := os.OpenFile(DeferredDownloadFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	for _, job := range jobs {
+		if err := encoder.Encode(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResumeDeferred
+//
+//	@Description: 下载预览模式推迟的所有文件, 开始前清空推迟下载记录(本次仍被推迟或失败的文件会分别重新记录)
+//	@param ctx
+//	@param workers
+//	@return *BatchResult
+//	@return error
+func ResumeDeferred(ctx context.Context, workers int) (*BatchResult, error) {
+	deferredLock.Lock()
+	var jobs []DownloadJob
+	err := iterateFailedLines(DeferredDownloadFileName, func(line string) error {
+		var job DownloadJob
+		if err := json.Unmarshal([]byte(line), &job); err != nil {
+			log.AsmrLog.Error("无法解析推迟下载记录,已跳过: ", zap.String("error", err.Error()))
+			return nil
+		}
+		jobs = append(jobs, job)
+		return nil
+	})
+	if err == nil {
+		err = os.Remove(DeferredDownloadFileName)
+	}
+	deferredLock.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return DownloadBatch(ctx, jobs, workers)
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// 支持的校验算法
+const (
+	ChecksumMD5    = "md5"
+	ChecksumSHA1   = "sha1"
+	ChecksumSHA256 = "sha256"
+	ChecksumCRC32  = "crc32"
+)
+
+// ErrChecksumMismatch 文件校验值与预期不一致
+var ErrChecksumMismatch = errors.New("文件校验值不一致")
+
+// NewHash
+//
+//	@Description: 按算法名创建哈希, 为空时使用sha256
+//	@param algorithm md5, sha1, sha256 或 crc32
+//	@return hash.Hash
+//	@return error
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumSHA1:
+		return sha1.New(), nil
+	case "", ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32:
+		return crc32.NewIEEE(), nil
+	default:
+		return nil, fmt.Errorf("不支持的校验算法: %s", algorithm)
+	}
+}
+
+// FileChecksumWith
+//
+//	@Description: 使用指定算法计算文件的校验值
+//	@param path
+//	@param algorithm
+//	@return string 十六进制校验值
+//	@return error
+func FileChecksumWith(path string, algorithm string) (string, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyFileChecksum
+//
+//	@Description: 校验文件内容, 不一致时返回包装了ErrChecksumMismatch的错误
+//	@param path
+//	@param algorithm 与来源发布的校验值一致的算法
+//	@param expected 十六进制校验值, 不区分大小写
+//	@return error
+func VerifyFileChecksum(path string, algorithm string, expected string) error {
+	checksum, err := FileChecksumWith(path, algorithm)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(checksum, strings.TrimSpace(expected)) {
+		return fmt.Errorf("%w: %s, 预期%s, 实际%s", ErrChecksumMismatch, path, expected, checksum)
+	}
+	return nil
+}
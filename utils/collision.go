@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"asmr-downloader/log"
+)
+
+// disambiguateCaseCollisions 是否为大小写/Unicode规范化冲突的文件重新命名
+var disambiguateCaseCollisions atomic.Bool
+
+// SetDisambiguateCaseCollisions
+//
+//	@Description: 设置是否处理大小写不敏感文件系统(macOS/Windows)上的文件名冲突.
+//	开启后, 目录中已存在仅大小写或Unicode规范化不同的文件时, 新文件名追加序号, 避免互相覆盖
+//	@param enabled
+func SetDisambiguateCaseCollisions(enabled bool) {
+	disambiguateCaseCollisions.Store(enabled)
+}
+
+// caseCollision
+//
+//	@Description: 查找目录中与path仅大小写或Unicode规范化不同的文件
+//	@param entries 目录中的文件
+//	@param name
+//	@return string 冲突的文件名
+//	@return bool
+func caseCollision(entries []os.DirEntry, name string) (string, bool) {
+	for _, entry := range entries {
+		if entry.Name() == name {
+			continue
+		}
+		if normalizePath(entry.Name(), true) == normalizePath(name, true) {
+			return entry.Name(), true
+		}
+	}
+	return "", false
+}
+
+// collisionHashing 是否使用来源url的哈希代替序号区分冲突的文件名
+var collisionHashing atomic.Bool
+
+// claimedPaths 开启哈希区分时, 本次运行中各保存路径对应的来源url
+var claimedPaths = struct {
+	sync.Mutex
+	urls map[string]string
+}{urls: map[string]string{}}
+
+// SetCollisionHashing
+//
+//	@Description: 设置是否使用来源url的哈希区分冲突的文件名. 开启后, 不同url得到相同的文件名(或与已存在的文件仅大小写不同)时,
+//	文件名追加来源url的SHA-256前8位(例如a (1a2b3c4d).mp3), 重复运行时文件名不会因下载顺序不同而变化
+//	@param enabled
+func SetCollisionHashing(enabled bool) {
+	collisionHashing.Store(enabled)
+	claimedPaths.Lock()
+	defer claimedPaths.Unlock()
+	claimedPaths.urls = map[string]string{}
+}
+
+// urlHash
+//
+//	@Description: 来源url的SHA-256前8位
+//	@param sourceURL
+//	@return string
+func urlHash(sourceURL string) string {
+	sum := sha256.Sum256([]byte(sourceURL))
+	return hex.EncodeToString(sum[:4])
+}
+
+// claimPath
+//
+//	@Description: 登记保存路径的来源url
+//	@param path
+//	@param sourceURL
+//	@return bool 路径已被其他url登记时为false
+func claimPath(path string, sourceURL string) bool {
+	key := NormalizePath(path)
+	claimedPaths.Lock()
+	defer claimedPaths.Unlock()
+	if owner, ok := claimedPaths.urls[key]; ok && owner != sourceURL {
+		return false
+	}
+	claimedPaths.urls[key] = sourceURL
+	return true
+}
+
+// CollisionFreePath
+//
+//	@Description: 开启冲突处理时, 若目录中存在仅大小写或Unicode规范化不同的文件, 返回追加序号后的路径(例如a (1).mp3).
+//	相同的输入总是得到相同的结果, 重复运行时可用于判断文件是否已下载
+//	@param path
+//	@return string
+func CollisionFreePath(path string) string {
+	return CollisionFreePathFor(path, "")
+}
+
+// CollisionFreePathFor
+//
+//	@Description: 同CollisionFreePath, 开启哈希区分(SetCollisionHashing)且提供了来源url时,
+//	本次运行中其他url已使用的路径与仅大小写不同的冲突都追加来源url的哈希
+//	@param path
+//	@param sourceURL 来源url
+//	@return string
+func CollisionFreePathFor(path string, sourceURL string) string {
+	hashing := collisionHashing.Load() && sourceURL != ""
+	if !disambiguateCaseCollisions.Load() && !hashing {
+		return path
+	}
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	var entries []os.DirEntry
+	existing, collided := "", false
+	if disambiguateCaseCollisions.Load() {
+		var err error
+		if entries, err = os.ReadDir(filepath.Dir(path)); err == nil {
+			existing, collided = caseCollision(entries, name)
+		}
+	}
+	if hashing {
+		if !collided && claimPath(path, sourceURL) {
+			return path
+		}
+		candidate := fmt.Sprintf("%s (%s)%s", base, urlHash(sourceURL), ext)
+		log.AsmrLog.Info(fmt.Sprintf("文件: %s 与其他来源的文件冲突, 保存为: %s", name, candidate))
+		hashed := filepath.Join(filepath.Dir(path), candidate)
+		claimPath(hashed, sourceURL)
+		return hashed
+	}
+	if !collided {
+		return path
+	}
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, collided := caseCollision(entries, candidate); collided {
+			continue
+		}
+		log.AsmrLog.Info(fmt.Sprintf("文件: %s 与已存在的文件: %s 仅大小写不同, 保存为: %s", name, existing, candidate))
+		return filepath.Join(filepath.Dir(path), candidate)
+	}
+}
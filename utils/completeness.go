@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// VerifyWorkComplete
+//
+//	@Description: 检查作品目录中是否存在预期的所有文件(按NormalizePath规范化后比较), 用于发现从未加入下载的文件,
+//	下载中的.part文件与大小为0的文件不算已下载
+//	@param dir 作品目录
+//	@param expected 预期的文件, 相对dir的路径
+//	@return []string 缺少的文件, 保持expected中的顺序
+//	@return error 无法读取目录时返回, 目录不存在时所有文件都视为缺少
+func VerifyWorkComplete(dir string, expected []string) ([]string, error) {
+	present := map[string]bool{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, PartFileSuffix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		present[NormalizePath(rel)] = true
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var missing []string
+	for _, file := range expected {
+		if !present[NormalizePath(file)] {
+			missing = append(missing, file)
+		}
+	}
+	return missing, nil
+}
+
+// SkippedByRule
+//
+//	@Description: 判断文件是否匹配文件类型的跳过规则(不会被下载)
+//	@param fileName
+//	@param kind 为空时按文件扩展名推断
+//	@return bool
+func SkippedByRule(fileName string, kind AssetKind) bool {
+	if kind == "" {
+		kind = DetectAssetKind(fileName)
+	}
+	return kindRuleFor(kind).shouldSkip(fileName)
+}
@@ -0,0 +1,239 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// ErrDirectoryListing 下载链接指向目录列表而不是文件
+var ErrDirectoryListing = errors.New("下载链接是目录列表")
+
+// directoryListingLimit 读取目录列表页面的最大字节数
+const directoryListingLimit = 4 * 1024 * 1024
+
+// directoryListingSniffBytes 判断已下载的文件是否为目录列表时读取的字节数
+const directoryListingSniffBytes = 64 * 1024
+
+// directoryListing 目录列表的处理方式
+var directoryListing = struct {
+	sync.RWMutex
+	// 解析目录列表并下载其中的文件, 为false时作为下载失败处理
+	recursive bool
+	// 进入子目录的最大层数
+	maxDepth int
+}{}
+
+// SetDirectoryListing
+//
+//	@Description: 设置下载链接指向目录(以/结尾或响应为目录列表页面)时的处理方式
+//	@param recursive 为true时解析目录列表并下载其中的文件, 否则作为下载失败处理
+//	@param maxDepth 进入子目录的最大层数, 0表示只下载该目录下的文件
+func SetDirectoryListing(recursive bool, maxDepth int) {
+	directoryListing.Lock()
+	defer directoryListing.Unlock()
+	directoryListing.recursive = recursive
+	directoryListing.maxDepth = max(maxDepth, 0)
+}
+
+// isDirectoryURL
+//
+//	@Description: 判断链接的路径是否以/结尾
+//	@param fileUrl
+//	@return bool
+func isDirectoryURL(fileUrl string) bool {
+	parsed, err := url.Parse(fileUrl)
+	return err == nil && strings.HasSuffix(parsed.Path, "/")
+}
+
+// directoryListingMarkers 目录列表页面(nginx/Apache/Caddy/python http.server等)的特征
+var directoryListingMarkers = regexp.MustCompile(`(?i)<title>\s*(index of|directory listing for)|>\s*parent directory\s*<`)
+
+// isDirectoryListingFile
+//
+//	@Description: 判断已下载的文件是否为目录列表页面, .html/.htm文件不判断
+//	@param storePath
+//	@return bool
+func isDirectoryListingFile(storePath string) bool {
+	switch strings.ToLower(filepath.Ext(storePath)) {
+	case ".html", ".htm":
+		return false
+	}
+	f, err := os.Open(storePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head, err := io.ReadAll(io.LimitReader(f, directoryListingSniffBytes))
+	if err != nil {
+		return false
+	}
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")))
+	if !bytes.HasPrefix(trimmed, []byte("<")) {
+		return false
+	}
+	return directoryListingMarkers.Match(head)
+}
+
+// hrefPattern 目录列表页面中的链接
+var hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+// parseDirectoryListing
+//
+//	@Description: 解析目录列表页面中的链接, 只保留该目录下的文件与子目录(忽略上级目录、排序链接与其他站点)
+//	@param dirUrl 目录链接 以/结尾
+//	@param page
+//	@return []string 绝对链接, 子目录以/结尾
+func parseDirectoryListing(dirUrl string, page []byte) []string {
+	base, err := url.Parse(dirUrl)
+	if err != nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	var links []string
+	for _, match := range hrefPattern.FindAllSubmatch(page, -1) {
+		href := string(bytes.Join(match[1:], nil))
+		if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(href, "?") {
+			continue
+		}
+		ref, err := url.Parse(strings.TrimSpace(href))
+		if err != nil {
+			continue
+		}
+		target := base.ResolveReference(ref)
+		target.Fragment = ""
+		if target.Host != base.Host || target.Path == base.Path || !strings.HasPrefix(target.Path, base.Path) {
+			continue
+		}
+		link := target.String()
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// fetchDirectoryListing
+//
+//	@Description: 获取并解析目录列表页面
+//	@param ctx
+//	@param dirUrl 目录链接 以/结尾
+//	@param headers 额外请求头
+//	@return []string
+//	@return error 响应不是HTML页面时返回
+func fetchDirectoryListing(ctx context.Context, dirUrl string, headers map[string]string) ([]string, error) {
+	req, err := NewRequest(ctx, http.MethodGet, dirUrl)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	client := Client.Get().(*http.Client)
+	defer Client.Put(client)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取目录列表%s失败, 状态码: %d", dirUrl, resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return nil, fmt.Errorf("%s不是目录列表页面, Content-Type: %s", dirUrl, resp.Header.Get("Content-Type"))
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, directoryListingLimit))
+	if err != nil {
+		return nil, err
+	}
+	return parseDirectoryListing(dirUrl, page), nil
+}
+
+// downloadDirectory
+//
+//	@Description: 下载目录列表中的文件, 子目录保存到同名子目录中
+//	@param ctx
+//	@param dirUrl 目录链接, 不以/结尾时补上
+//	@param dir 保存目录
+//	@param opts 下载目录时的下载选项, 文件沿用其中的请求头、下载工具等设置
+//	@return error 未开启递归下载时返回包装了ErrDirectoryListing的错误
+func downloadDirectory(ctx context.Context, dirUrl string, dir string, opts DownloadOptions) error {
+	directoryListing.RLock()
+	recursive, maxDepth := directoryListing.recursive, directoryListing.maxDepth
+	directoryListing.RUnlock()
+	if !recursive {
+		return fmt.Errorf("%w: %s, 开启follow_directory_listing后下载其中的文件", ErrDirectoryListing, dirUrl)
+	}
+	if parsed, err := url.Parse(dirUrl); err == nil && !strings.HasSuffix(parsed.Path, "/") {
+		parsed.Path += "/"
+		if parsed.RawPath != "" {
+			parsed.RawPath += "/"
+		}
+		dirUrl = parsed.String()
+	}
+	links, err := fetchDirectoryListing(ctx, dirUrl, opts.Headers)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, DirMode()); err != nil {
+		return err
+	}
+	log.AsmrLog.Info(fmt.Sprintf("解析目录列表, 共%d个链接: %s", len(links), dirUrl))
+	child := DownloadOptions{
+		Headers:      opts.Headers,
+		Engine:       opts.Engine,
+		OnResult:     opts.OnResult,
+		SkipExisting: opts.SkipExisting,
+		Timeout:      opts.Timeout,
+		Deadline:     opts.Deadline,
+		listingDepth: opts.listingDepth,
+	}
+	var errs []error
+	for _, link := range links {
+		if !isDirectoryURL(link) {
+			if err := NewFileDownloaderWithOptions(link, dir, "", child)(); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if child.listingDepth >= maxDepth {
+			log.AsmrLog.Info("超过目录最大层数, 跳过子目录: ", zap.String("info", link))
+			continue
+		}
+		sub := child
+		sub.listingDepth++
+		if err := downloadDirectory(ctx, link, filepath.Join(dir, SanitizeFileName(urlDirName(link))), sub); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// urlDirName
+//
+//	@Description: 取目录链接路径的最后一段作为目录名
+//	@param dirUrl
+//	@return string
+func urlDirName(dirUrl string) string {
+	parsed, err := url.Parse(dirUrl)
+	if err != nil {
+		return ""
+	}
+	return path.Base(strings.TrimSuffix(parsed.Path, "/"))
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DiskSpace
+//
+//	@Description: 文件系统的可用空间
+type DiskSpace struct {
+	// 可用字节数
+	FreeBytes uint64
+	// 可用inode数
+	FreeInodes uint64
+	// inode总数 为0表示文件系统不限制inode数量(如btrfs)或无法获取
+	TotalInodes uint64
+}
+
+// HasEnoughDiskSpace
+//
+//	@Description: 检查目录所在的文件系统是否有足够的可用空间与inode, 小文件很多时inode可能先于字节耗尽(如ext4/XFS的NAS)
+//	@param path 目录, 不存在时检查最近的已存在的上级目录
+//	@param bytesNeeded 需要的字节数 小于等于0时不检查
+//	@param inodesNeeded 需要的inode数(文件数+目录数) 小于等于0时不检查
+//	@return bool 空间足够或当前平台无法获取可用空间时为true
+//	@return error 空间不足时返回包装了ErrDiskFull的错误, 获取可用空间失败时返回原始错误
+func HasEnoughDiskSpace(path string, bytesNeeded int64, inodesNeeded int64) (bool, error) {
+	space, ok, err := diskSpace(existingParent(path))
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return true, nil
+	}
+	if bytesNeeded > 0 && space.FreeBytes < uint64(bytesNeeded) {
+		return false, fmt.Errorf("%w: %s 需要%.2f MB, 可用%.2f MB", ErrDiskFull, path,
+			float64(bytesNeeded)/1024/1024, float64(space.FreeBytes)/1024/1024)
+	}
+	if inodesNeeded > 0 && space.TotalInodes > 0 && space.FreeInodes < uint64(inodesNeeded) {
+		return false, fmt.Errorf("%w: %s 需要%d个inode, 可用%d个", ErrDiskFull, path, inodesNeeded, space.FreeInodes)
+	}
+	return true, nil
+}
+
+// existingParent
+//
+//	@Description: 获取路径本身或最近的已存在的上级目录
+//	@param path
+//	@return string
+func existingParent(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
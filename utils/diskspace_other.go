@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd)
+
+package utils
+
+// diskSpace
+//
+//	@Description: 当前平台不支持获取可用空间, 不做检查
+//	@param path
+//	@return DiskSpace
+//	@return bool 当前平台是否支持
+//	@return error
+func diskSpace(path string) (DiskSpace, bool, error) {
+	return DiskSpace{}, false, nil
+}
@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd
+
+package utils
+
+import "syscall"
+
+// diskSpace
+//
+//	@Description: 通过statfs获取文件系统的可用空间
+//	@param path
+//	@return DiskSpace
+//	@return bool 当前平台是否支持
+//	@return error
+func diskSpace(path string) (DiskSpace, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return DiskSpace{}, false, err
+	}
+	return DiskSpace{
+		FreeBytes:   uint64(stat.Bavail) * uint64(stat.Bsize),
+		FreeInodes:  uint64(stat.Ffree),
+		TotalInodes: uint64(stat.Files),
+	}, true, nil
+}
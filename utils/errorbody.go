@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+)
+
+// ErrErrorBody 下载得到的文件内容是错误响应(如状态码为200的{"error": "..."})
+var ErrErrorBody = errors.New("下载得到的文件是错误响应")
+
+// errorBodyMaxJSONSize 按JSON解析的文件大小上限, 错误响应一般很小
+const errorBodyMaxJSONSize = 64 * 1024
+
+// errorBodyPatternBytes 使用正则匹配的文件开头字节数
+const errorBodyPatternBytes = 1024
+
+// ErrorBodyRule
+//
+//	@Description: 错误响应检测规则, 文件为JSON对象且包含任意一个JSONKeys字段, 或文件开头匹配任意一个Patterns时视为错误响应
+type ErrorBodyRule struct {
+	// 错误JSON中的字段名 为空时为["error"]
+	JSONKeys []string `json:"json_keys"`
+	// 匹配文件开头内容的正则 为空时匹配HTML页面
+	Patterns []string `json:"patterns"`
+	// 需要检测的文件类型 为空时为audio与image
+	Kinds []AssetKind `json:"kinds"`
+}
+
+// errorBodyValidator 当前使用的错误响应检测规则
+var errorBodyValidator = struct {
+	sync.RWMutex
+	enabled  bool
+	rule     ErrorBodyRule
+	patterns []*regexp.Regexp
+}{}
+
+// SetErrorBodyRule
+//
+//	@Description: 设置下载完成后检测错误响应的规则, 检测到错误响应时删除文件并重新下载一次
+//	@param rule 为nil时关闭检测, 字段为空时使用默认值
+//	@return error 正则有误时返回
+func SetErrorBodyRule(rule *ErrorBodyRule) error {
+	if rule == nil {
+		errorBodyValidator.Lock()
+		defer errorBodyValidator.Unlock()
+		errorBodyValidator.enabled = false
+		return nil
+	}
+	copied := *rule
+	if len(copied.JSONKeys) == 0 {
+		copied.JSONKeys = []string{"error"}
+	}
+	if len(copied.Patterns) == 0 {
+		copied.Patterns = []string{`(?i)^\s*<!doctype html`, `(?i)^\s*<html`}
+	}
+	if len(copied.Kinds) == 0 {
+		copied.Kinds = []AssetKind{AssetAudio, AssetImage}
+	}
+	patterns := make([]*regexp.Regexp, 0, len(copied.Patterns))
+	for _, pattern := range copied.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("错误响应匹配规则%s有误: %w", pattern, err)
+		}
+		patterns = append(patterns, re)
+	}
+	errorBodyValidator.Lock()
+	defer errorBodyValidator.Unlock()
+	errorBodyValidator.enabled = true
+	errorBodyValidator.rule = copied
+	errorBodyValidator.patterns = patterns
+	return nil
+}
+
+// checkErrorBody
+//
+//	@Description: 检测下载得到的文件是否为错误响应
+//	@param path
+//	@param kind 文件类型, 不在检测范围内时跳过
+//	@return error 是错误响应时包装了ErrErrorBody
+func checkErrorBody(path string, kind AssetKind) error {
+	errorBodyValidator.RLock()
+	enabled, rule, patterns := errorBodyValidator.enabled, errorBodyValidator.rule, errorBodyValidator.patterns
+	errorBodyValidator.RUnlock()
+	if !enabled || !slices.Contains(rule.Kinds, kind) {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	content, err := io.ReadAll(io.LimitReader(f, errorBodyMaxJSONSize+1))
+	if err != nil {
+		return err
+	}
+	head := content[:min(len(content), errorBodyPatternBytes)]
+	for _, re := range patterns {
+		if re.Match(head) {
+			return fmt.Errorf("%w: %s, 匹配%s", ErrErrorBody, path, re.String())
+		}
+	}
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(content, []byte("\xef\xbb\xbf")))
+	if len(content) > errorBodyMaxJSONSize || !bytes.HasPrefix(trimmed, []byte("{")) {
+		return nil
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &body); err != nil {
+		return nil
+	}
+	for _, key := range rule.JSONKeys {
+		if value, ok := body[key]; ok {
+			return fmt.Errorf("%w: %s, %s: %s", ErrErrorBody, path, key, string(value))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"syscall"
+)
+
+// 下载失败的错误分类, 下载函数返回的错误可以使用errors.Is判断分类, 使用errors.As获取*DownloadError
+var (
+	// ErrThrottled 服务器限流(429/cloudflare 1015)
+	ErrThrottled = errors.New("服务器限流")
+	// ErrSizeMismatch 下载得到的文件大小与服务器返回的大小不一致
+	ErrSizeMismatch = errors.New("文件大小不一致")
+	// ErrDiskFull 磁盘空间不足
+	ErrDiskFull = errors.New("磁盘空间不足")
+	// ErrNotFound 服务器返回404/410
+	ErrNotFound = errors.New("文件不存在")
+	// ErrUnwritable 没有权限写入或文件系统只读
+	ErrUnwritable = errors.New("无法写入文件")
+)
+
+// DownloadError
+//
+//	@Description: 带分类的下载错误, errors.Is可以同时匹配分类Kind与原始错误Err
+type DownloadError struct {
+	// 错误分类 如ErrThrottled、ErrDiskFull
+	Kind error
+	URL  string
+	// 保存路径 未知时为空
+	Path string
+	// 响应状态码 没有收到响应时为0
+	StatusCode int
+	// 原始错误
+	Err error
+}
+
+// Error
+//
+//	@Description: 错误信息
+//	@receiver e
+//	@return string
+func (e *DownloadError) Error() string {
+	msg := e.Kind.Error()
+	if e.Path != "" {
+		msg += ": " + e.Path
+	} else if e.URL != "" {
+		msg += ": " + e.URL
+	}
+	if e.StatusCode > 0 {
+		msg += fmt.Sprintf(" 状态码: %d", e.StatusCode)
+	}
+	if e.Err != nil {
+		msg += ", " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap
+//
+//	@Description: 返回错误分类与原始错误, 用于errors.Is/As
+//	@receiver e
+//	@return []error
+func (e *DownloadError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// statusErrorKind
+//
+//	@Description: 按响应状态码获取错误分类
+//	@param statusCode
+//	@return error 没有对应分类时为nil
+func statusErrorKind(statusCode int) error {
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		return ErrThrottled
+	case http.StatusNotFound, http.StatusGone:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// classifyIOError
+//
+//	@Description: 将写入文件时的系统错误转换为ErrDiskFull/ErrUnwritable, 已分类或无法分类的错误原样返回
+//	@param storePath
+//	@param fileUrl
+//	@param err
+//	@return error
+func classifyIOError(storePath string, fileUrl string, err error) error {
+	var downloadErr *DownloadError
+	if err == nil || errors.As(err, &downloadErr) {
+		return err
+	}
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return &DownloadError{Kind: ErrDiskFull, URL: fileUrl, Path: storePath, Err: err}
+	case errors.Is(err, fs.ErrPermission), errors.Is(err, syscall.EROFS):
+		return &DownloadError{Kind: ErrUnwritable, URL: fileUrl, Path: storePath, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// estimateWorkers 预估下载量时并发获取文件大小的请求数
+const estimateWorkers = 8
+
+// bandwidthProbeBytes 测速时最多下载的字节数
+const bandwidthProbeBytes = 4 * 1024 * 1024
+
+// bandwidthProbeTimeout 测速的最长时间
+const bandwidthProbeTimeout = 5 * time.Second
+
+// BatchEstimate
+//
+//	@Description: 批量下载的预估结果
+type BatchEstimate struct {
+	// 文件数
+	Files int `json:"files"`
+	// 获取到大小的文件数
+	SizedFiles int `json:"sized_files"`
+	// 总字节数(只包含获取到大小的文件)
+	TotalBytes int64 `json:"total_bytes"`
+	// 测速得到的下载速度 字节/秒, 测速失败时为0
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// 预计下载时间, 测速失败时为0
+	ETA time.Duration `json:"eta"`
+}
+
+// String
+//
+//	@Description: 格式化预估结果
+//	@receiver e
+//	@return string
+func (e BatchEstimate) String() string {
+	result := fmt.Sprintf("文件数: %d, 总大小: %.2f MB", e.Files, float64(e.TotalBytes)/1024/1024)
+	if e.SizedFiles < e.Files {
+		result += fmt.Sprintf("(%d个文件大小未知)", e.Files-e.SizedFiles)
+	}
+	if e.BytesPerSecond > 0 {
+		result += fmt.Sprintf(", 下载速度: %.2f MB/s, 预计耗时: %s", e.BytesPerSecond/1024/1024, e.ETA.Round(time.Second))
+	}
+	return result
+}
+
+// EstimateBatch
+//
+//	@Description: 预估批量下载的总大小和耗时(不下载文件), 总大小来自HEAD请求, 耗时来自对最大文件的短时间测速
+//	@param ctx
+//	@param urls
+//	@return BatchEstimate
+//	@return error ctx被取消时返回
+func EstimateBatch(ctx context.Context, urls []string) (BatchEstimate, error) {
+	estimate := BatchEstimate{Files: len(urls)}
+	sizes, err := PrefetchSizes(ctx, urls, estimateWorkers)
+	if err != nil {
+		return estimate, err
+	}
+	largest := ""
+	for fileUrl, size := range sizes {
+		estimate.TotalBytes += size
+		if largest == "" || size > sizes[largest] {
+			largest = fileUrl
+		}
+	}
+	estimate.SizedFiles = len(sizes)
+	if largest == "" {
+		return estimate, nil
+	}
+	estimate.BytesPerSecond = probeBandwidth(ctx, largest)
+	if estimate.BytesPerSecond > 0 {
+		estimate.ETA = time.Duration(float64(estimate.TotalBytes) / estimate.BytesPerSecond * float64(time.Second))
+	}
+	return estimate, ctx.Err()
+}
+
+// probeBandwidth
+//
+//	@Description: 下载文件开头的一部分测量下载速度
+//	@param ctx
+//	@param fileUrl
+//	@return float64 字节/秒, 测速失败时为0
+func probeBandwidth(ctx context.Context, fileUrl string) float64 {
+	ctx, cancel := context.WithTimeout(ctx, bandwidthProbeTimeout)
+	defer cancel()
+	stopwatch := NewStopwatch()
+	n, _ := DownloadRange(ctx, fileUrl, 0, bandwidthProbeBytes-1, io.Discard)
+	elapsed := stopwatch.Elapsed()
+	if n <= 0 || elapsed <= 0 {
+		return 0
+	}
+	return float64(n) / elapsed.Seconds()
+}
+
+// ConfirmBatch
+//
+//	@Description: 预估批量下载量, 总大小超过threshold时提示用户确认是否继续
+//	@param ctx
+//	@param urls
+//	@param threshold 字节数, 小于等于0时总是提示
+//	@return bool 是否继续下载
+func ConfirmBatch(ctx context.Context, urls []string, threshold int64) bool {
+	estimate, err := EstimateBatch(ctx, urls)
+	if err != nil {
+		return false
+	}
+	if threshold > 0 && estimate.TotalBytes <= threshold {
+		return true
+	}
+	input := PromotForInput(fmt.Sprintf("即将下载 %s, 是否继续(Y/N,默认为Y)?:", estimate.String()), "Y")
+	return input == "Y" || input == "y"
+}
@@ -0,0 +1,441 @@
+package utils
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// iterateFailedLines
+//
+//	@Description: 逐行读取下载失败日志文件中的非空行, fn返回错误时停止读取并返回该错误
+//	@param path
+//	@param fn
+//	@return error
+func iterateFailedLines(path string, fn func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.Trim(scanner.Text(), "\r\n")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// IterateFailedDownloads
+//
+//	@Description: 流式读取下载失败日志文件中的记录, 内存占用与记录数量无关. 跳过格式有误的行, fn返回错误时停止读取并返回该错误
+//	@param fn
+//	@return error
+func IterateFailedDownloads(fn func(FailedRecord) error) error {
+	return iterateFailedLines(FailedDownloadFileName, func(line string) error {
+		record, err := ParseFailedRecord(line)
+		if err != nil {
+			log.AsmrLog.Warn("跳过格式有误的下载失败记录: ", zap.String("line", line))
+			return nil
+		}
+		return fn(record)
+	})
+}
+
+// ExportFailedDownloads
+//
+//	@Description: 将下载失败日志导出为csv或json, 便于统计分析
+//	@param format csv或json
+//	@param w
+//	@return error
+func ExportFailedDownloads(format string, w io.Writer) error {
+	if format != "csv" && format != "json" {
+		return fmt.Errorf("不支持的导出格式: %s, 只支持csv或json", format)
+	}
+	if format == "json" {
+		records := []FailedRecord{}
+		err := IterateFailedDownloads(func(record FailedRecord) error {
+			records = append(records, record)
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("读取下载失败日志失败: %w", err)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	}
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"time", "path", "url", "error", "kind", "category"})
+	err := IterateFailedDownloads(func(record FailedRecord) error {
+		return writer.Write([]string{record.Time, record.Path, record.URL, record.Error, string(record.Kind), record.Category})
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("读取下载失败日志失败: %w", err)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// MergeFailedDownloads
+//
+//	@Description: 合并多台机器上的下载失败日志文件, 按(文件路径, 文件url)去重并保留时间最新的记录, 写入一个文件集中重试
+//	@param dsts 需要合并的下载失败日志文件
+//	@param out 合并结果文件, 可以是dsts中的文件
+//	@return int 合并后的记录数
+//	@return error
+func MergeFailedDownloads(dsts []string, out string) (int, error) {
+	type recordKey struct {
+		path string
+		url  string
+	}
+	index := map[recordKey]int{}
+	var records []FailedRecord
+	for _, dst := range dsts {
+		err := iterateFailedLines(dst, func(line string) error {
+			record, err := ParseFailedRecord(line)
+			if err != nil {
+				log.AsmrLog.Warn("跳过格式有误的下载失败记录: ", zap.String("file", dst), zap.String("line", line))
+				return nil
+			}
+			key := recordKey{path: record.Path, url: record.URL}
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(records)
+				records = append(records, record)
+				return nil
+			}
+			//时间格式固定为2006-01-02 15:04:05 可以直接比较字符串, 时间相同时后读取的记录优先
+			if record.Time >= records[i].Time {
+				records[i] = record
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("读取下载失败日志%s失败: %w", dst, err)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time < records[j].Time })
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	writer := bufio.NewWriter(f)
+	for _, record := range records {
+		_, _ = writer.WriteString(record.String() + "\n")
+	}
+	err = writer.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, out)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, fmt.Errorf("写入合并结果%s失败: %w", out, err)
+	}
+	return len(records), nil
+}
+
+// SortFailedDownloadsByHost
+//
+//	@Description: 整理下载失败日志文件: 按(文件路径, 文件url)去重保留最新的记录, 再按url的主机分组、组内按时间排序,
+//	修复下载时逐个主机处理, 充分利用按主机的限速与冷却. 格式有误的行保留在文件末尾
+//	@return error
+func SortFailedDownloadsByHost() error {
+	failedDownloadFileLock.Lock()
+	defer failedDownloadFileLock.Unlock()
+	type recordKey struct {
+		path string
+		url  string
+	}
+	index := map[recordKey]int{}
+	var records []FailedRecord
+	var broken []string
+	err := iterateFailedLines(FailedDownloadFileName, func(line string) error {
+		record, err := ParseFailedRecord(line)
+		if err != nil {
+			broken = append(broken, line)
+			return nil
+		}
+		key := recordKey{path: record.Path, url: record.URL}
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(records)
+			records = append(records, record)
+		} else if record.Time >= records[i].Time {
+			records[i] = record
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取下载失败日志失败: %w", err)
+	}
+	hosts := make([]string, len(records))
+	for i, record := range records {
+		hosts[i] = record.URL
+		if parsed, err := url.Parse(record.URL); err == nil && parsed.Host != "" {
+			hosts[i] = strings.ToLower(parsed.Host)
+		}
+	}
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if hosts[a] != hosts[b] {
+			return hosts[a] < hosts[b]
+		}
+		return records[a].Time < records[b].Time
+	})
+	tmp := FailedDownloadFileName + ".sort"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	for _, i := range order {
+		_, _ = writer.WriteString(records[i].String() + "\n")
+	}
+	for _, line := range broken {
+		_, _ = writer.WriteString(line + "\n")
+	}
+	err = writer.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, FailedDownloadFileName)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("写入下载失败日志失败: %w", err)
+	}
+	//重命名后原文件句柄指向旧文件 需要重新打开
+	if FailedDownloadFile != nil {
+		_ = FailedDownloadFile.Close()
+	}
+	FailedDownloadFile, err = os.OpenFile(FailedDownloadFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	return err
+}
+
+// failedLogRotation 下载失败日志文件轮转策略
+var failedLogRotation struct {
+	sync.Mutex
+	// 超过该大小时轮转, 0表示不轮转
+	maxBytes int64
+	// 最多保留的压缩日志个数, 0表示全部保留
+	keep int
+}
+
+// SetFailedLogRotation
+//
+//	@Description: 设置下载失败日志文件轮转, 超过maxBytes后压缩为failed-download.<时间>.txt.gz并清空原文件
+//	@param maxBytes 小于等于0表示不轮转
+//	@param keep 最多保留的压缩日志个数, 小于等于0表示全部保留
+func SetFailedLogRotation(maxBytes int64, keep int) {
+	failedLogRotation.Lock()
+	defer failedLogRotation.Unlock()
+	failedLogRotation.maxBytes = maxBytes
+	failedLogRotation.keep = keep
+}
+
+// rotateFailedLogIfNeeded
+//
+//	@Description: 下载失败日志文件超过大小限制时进行轮转, 调用方需持有failedDownloadFileLock
+//	@return error
+func rotateFailedLogIfNeeded() error {
+	failedLogRotation.Lock()
+	maxBytes, keep := failedLogRotation.maxBytes, failedLogRotation.keep
+	failedLogRotation.Unlock()
+	if maxBytes <= 0 || FailedDownloadFile == nil {
+		return nil
+	}
+	stat, err := FailedDownloadFile.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() <= maxBytes {
+		return nil
+	}
+	base := strings.TrimSuffix(FailedDownloadFileName, filepath.Ext(FailedDownloadFileName))
+	archive := fmt.Sprintf("%s.%s%s.gz", base, time.Now().Format("20060102-150405.000"), filepath.Ext(FailedDownloadFileName))
+	if err := gzipFile(FailedDownloadFileName, archive); err != nil {
+		_ = os.Remove(archive)
+		return err
+	}
+	if err := FailedDownloadFile.Truncate(0); err != nil {
+		return err
+	}
+	log.AsmrLog.Info("下载失败日志文件已轮转: ", zap.String("info", archive))
+	if keep <= 0 {
+		return nil
+	}
+	archives, err := filepath.Glob(base + ".*" + filepath.Ext(FailedDownloadFileName) + ".gz")
+	if err != nil {
+		return err
+	}
+	//文件名中的时间戳保证字典序即时间顺序
+	sort.Strings(archives)
+	for len(archives) > keep {
+		if err := os.Remove(archives[0]); err != nil {
+			return err
+		}
+		archives = archives[1:]
+	}
+	return nil
+}
+
+// gzipFile
+//
+//	@Description: 将src压缩写入dst
+//	@param src
+//	@param dst
+//	@return error
+func gzipFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// snapshotFailedDownloadFile
+//
+//	@Description: 将下载失败日志文件重命名为snapshot并立即重新创建空的日志文件, 处理快照期间新的失败记录写入新文件
+//	@param snapshot 快照文件路径
+//	@return error
+func snapshotFailedDownloadFile(snapshot string) error {
+	failedDownloadFileLock.Lock()
+	defer failedDownloadFileLock.Unlock()
+	//上一次处理中断时遗留的快照 先将其中的记录追加回日志文件 避免被重命名覆盖
+	if FileOrDirExists(snapshot) {
+		if err := appendFailedLinesLocked(snapshot, 0); err != nil {
+			return err
+		}
+		if err := os.Remove(snapshot); err != nil {
+			return err
+		}
+	}
+	if FailedDownloadFile != nil {
+		if err := FailedDownloadFile.Close(); err != nil {
+			return err
+		}
+	}
+	renameErr := os.Rename(FailedDownloadFileName, snapshot)
+	f, err := os.OpenFile(FailedDownloadFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	FailedDownloadFile = f
+	if renameErr != nil && !os.IsNotExist(renameErr) {
+		return renameErr
+	}
+	if renameErr != nil {
+		//日志文件不存在时使用空快照
+		empty, err := os.Create(snapshot)
+		if err != nil {
+			return err
+		}
+		return empty.Close()
+	}
+	return nil
+}
+
+// restoreFailedLines
+//
+//	@Description: 将快照中未处理的记录追加回下载失败日志文件并删除快照, 处理快照中途出错时调用, 追加失败时保留快照
+//	@param snapshot 快照文件路径
+//	@param skip 已处理的记录数
+//	@return error
+func restoreFailedLines(snapshot string, skip int) error {
+	failedDownloadFileLock.Lock()
+	defer failedDownloadFileLock.Unlock()
+	if err := appendFailedLinesLocked(snapshot, skip); err != nil {
+		return err
+	}
+	return os.Remove(snapshot)
+}
+
+// appendFailedLinesLocked
+//
+//	@Description: 跳过path中前skip条非空记录, 将其余记录原样追加到下载失败日志文件, 调用方需持有failedDownloadFileLock.
+//	不限制单行长度, 超长的行同样保留
+//	@param path
+//	@param skip
+//	@return error
+func appendFailedLinesLocked(path string, skip int) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out := FailedDownloadFile
+	if out == nil {
+		f, err := os.OpenFile(FailedDownloadFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		FailedDownloadFile = f
+		out = f
+	}
+	reader := bufio.NewReader(in)
+	writer := bufio.NewWriter(out)
+	for {
+		line, readErr := reader.ReadString('\n')
+		line = strings.Trim(line, "\r\n")
+		if strings.TrimSpace(line) != "" {
+			if skip > 0 {
+				skip--
+			} else if _, err := writer.WriteString(line + "\n"); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	return writer.Flush()
+}
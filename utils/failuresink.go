@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// FailureSink
+//
+//	@Description: 下载失败记录的接收方, 下载失败时(写入下载失败日志的同时)实时收到记录, 实现需要并发安全
+type FailureSink interface {
+	// Record 收到一条下载失败记录, 不应阻塞下载
+	Record(record FailedRecord)
+	// Flush 发送缓存中的记录
+	Flush() error
+}
+
+// failureSinks 当前的下载失败记录接收方
+var failureSinks = struct {
+	sync.RWMutex
+	sinks []FailureSink
+}{}
+
+// SetFailureSinks
+//
+//	@Description: 设置下载失败记录的接收方, 替换之前设置的接收方(替换前发送其缓存中的记录, 实现了io.Closer的接收方会被关闭)
+//	@param sinks 为空时不发送
+func SetFailureSinks(sinks ...FailureSink) {
+	failureSinks.Lock()
+	old := failureSinks.sinks
+	failureSinks.sinks = sinks
+	failureSinks.Unlock()
+	for _, sink := range old {
+		flush := sink.Flush
+		if closer, ok := sink.(io.Closer); ok {
+			flush = closer.Close
+		}
+		if err := flush(); err != nil {
+			log.AsmrLog.Error("发送下载失败记录失败: ", zap.String("error", err.Error()))
+		}
+	}
+}
+
+// FlushFailureSinks
+//
+//	@Description: 发送所有接收方缓存中的记录, 程序退出前调用
+func FlushFailureSinks() {
+	failureSinks.RLock()
+	sinks := failureSinks.sinks
+	failureSinks.RUnlock()
+	for _, sink := range sinks {
+		if err := sink.Flush(); err != nil {
+			log.AsmrLog.Error("发送下载失败记录失败: ", zap.String("error", err.Error()))
+		}
+	}
+}
+
+// emitFailure
+//
+//	@Description: 将下载失败记录交给所有接收方
+//	@param record
+func emitFailure(record FailedRecord) {
+	failureSinks.RLock()
+	sinks := failureSinks.sinks
+	failureSinks.RUnlock()
+	for _, sink := range sinks {
+		sink.Record(record)
+	}
+}
+
+// 默认的批量发送设置
+const (
+	defaultFailureSinkBatchSize     = 50
+	defaultFailureSinkFlushInterval = 5 * time.Second
+	defaultFailureSinkRetry         = 3
+	failureSinkRetryBackoff         = time.Second
+	failureSinkTimeout              = 10 * time.Second
+	// 发送失败时最多缓存的记录数, 超出后丢弃最早的记录
+	failureSinkMaxPending = 10000
+)
+
+// HTTPFailureSink
+//
+//	@Description: 将下载失败记录以JSON数组POST到指定地址, 攒够BatchSize条或每隔FlushInterval发送一次, 发送失败时重试
+type HTTPFailureSink struct {
+	// 接收地址
+	URL string
+	// 每批最多发送的记录数
+	BatchSize int
+	// 发送失败时的最大重试次数
+	MaxRetry int
+
+	mu      sync.Mutex
+	pending []FailedRecord
+	// 保证同一时间只有一个批次在发送 记录按顺序到达
+	sending sync.Mutex
+	client  *http.Client
+	// 缓存攒够一批时通知后台立即发送, 容量为1, 通知不阻塞
+	wake chan struct{}
+	// 关闭后台定期发送
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewHTTPFailureSink
+//
+//	@Description: 创建HTTPFailureSink并在后台定期发送
+//	@param url 接收地址
+//	@param batchSize 小于等于0时为50
+//	@param flushInterval 小于等于0时为5秒
+//	@return *HTTPFailureSink
+func NewHTTPFailureSink(url string, batchSize int, flushInterval time.Duration) *HTTPFailureSink {
+	if batchSize <= 0 {
+		batchSize = defaultFailureSinkBatchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultFailureSinkFlushInterval
+	}
+	sink := &HTTPFailureSink{
+		URL:       url,
+		BatchSize: batchSize,
+		MaxRetry:  defaultFailureSinkRetry,
+		client:    &http.Client{Timeout: failureSinkTimeout, Transport: transportProxy{}},
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-sink.wake:
+			case <-sink.stop:
+				return
+			}
+			if err := sink.Flush(); err != nil {
+				log.AsmrLog.Error("发送下载失败记录失败: ", zap.String("error", err.Error()))
+			}
+		}
+	}()
+	return sink
+}
+
+// Close
+//
+//	@Description: 停止后台定期发送并发送缓存中的记录
+//	@receiver s
+//	@return error
+func (s *HTTPFailureSink) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	return s.Flush()
+}
+
+func (s *HTTPFailureSink) Record(record FailedRecord) {
+	s.mu.Lock()
+	s.pending = append(s.pending, record)
+	if len(s.pending) > failureSinkMaxPending {
+		s.pending = s.pending[len(s.pending)-failureSinkMaxPending:]
+	}
+	full := len(s.pending) >= s.BatchSize
+	s.mu.Unlock()
+	if full {
+		//由后台统一发送 接收方不可用时也不会为每条记录创建goroutine
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush
+//
+//	@Description: 分批发送缓存中的记录, 重试后仍然失败的批次放回缓存等待下次发送
+//	@receiver s
+//	@return error
+func (s *HTTPFailureSink) Flush() error {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	for {
+		s.mu.Lock()
+		batch := s.pending[:min(len(s.pending), s.BatchSize)]
+		s.pending = s.pending[len(batch):]
+		s.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.post(batch); err != nil {
+			s.mu.Lock()
+			s.pending = append(append([]FailedRecord{}, batch...), s.pending...)
+			if len(s.pending) > failureSinkMaxPending {
+				s.pending = s.pending[len(s.pending)-failureSinkMaxPending:]
+			}
+			s.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// post
+//
+//	@Description: 发送一批记录, 失败时按指数退避重试
+//	@receiver s
+//	@param batch
+//	@return error
+func (s *HTTPFailureSink) post(batch []FailedRecord) error {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	backoff := failureSinkRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = s.postOnce(payload)
+		if err == nil || attempt >= s.MaxRetry {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postOnce
+//
+//	@Description: 发送一次请求
+//	@receiver s
+//	@param payload
+//	@return error
+func (s *HTTPFailureSink) postOnce(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return fmt.Errorf("接收地址%s响应状态码: %d", s.URL, resp.StatusCode)
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Fault 模拟的故障类型
+type Fault int
+
+const (
+	// FaultNone 不注入故障
+	FaultNone Fault = iota
+	// Fault1015 返回cloudflare 1015限流页面(429)
+	Fault1015
+	// FaultNetwork 返回网络错误
+	FaultNetwork
+)
+
+// ErrInjectedNetwork 注入的网络错误
+var ErrInjectedNetwork = errors.New("injected network error")
+
+// TestFaultInjector
+//
+//	@Description: 测试用的故障注入器, 可以让某个主机的第N次请求返回1015页面或网络错误, 用于覆盖重试与冷却逻辑
+type TestFaultInjector struct {
+	mu sync.Mutex
+	// 各主机已发出的请求数
+	counts map[string]int
+	// key为主机, value为第N次请求(从1开始)对应的故障
+	faults map[string]map[int]Fault
+}
+
+// NewTestFaultInjector
+//
+//	@Description: 创建故障注入器
+//	@return *TestFaultInjector
+func NewTestFaultInjector() *TestFaultInjector {
+	return &TestFaultInjector{
+		counts: map[string]int{},
+		faults: map[string]map[int]Fault{},
+	}
+}
+
+// Inject
+//
+//	@Description: 让host的第nth次请求(从1开始)返回指定故障
+//	@receiver f
+//	@param host
+//	@param nth
+//	@param fault
+func (f *TestFaultInjector) Inject(host string, nth int, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.faults[host] == nil {
+		f.faults[host] = map[int]Fault{}
+	}
+	f.faults[host][nth] = fault
+}
+
+// Requests
+//
+//	@Description: 获取host已发出的请求数
+//	@receiver f
+//	@param host
+//	@return int
+func (f *TestFaultInjector) Requests(host string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[host]
+}
+
+// next
+//
+//	@Description: 记录一次请求并返回本次请求需要注入的故障
+//	@receiver f
+//	@param host
+//	@return Fault
+func (f *TestFaultInjector) next(host string) Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counts[host]++
+	return f.faults[host][f.counts[host]]
+}
+
+// faultInjector 当前生效的故障注入器 正常运行时为nil
+var faultInjector atomic.Pointer[TestFaultInjector]
+
+// SetTestFaultInjector
+//
+//	@Description: 设置故障注入器, 仅供测试使用, 传入nil关闭
+//	@param f
+func SetTestFaultInjector(f *TestFaultInjector) {
+	faultInjector.Store(f)
+}
+
+// faultRoundTripper
+//
+//	@Description: 按故障注入器的设置替换请求结果
+type faultRoundTripper struct {
+	injector *TestFaultInjector
+	next     http.RoundTripper
+}
+
+func (rt faultRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch rt.injector.next(req.URL.Host) {
+	case Fault1015:
+		const body = "error code: 1015"
+		return &http.Response{
+			Status:        "429 Too Many Requests",
+			StatusCode:    http.StatusTooManyRequests,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"text/plain"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	case FaultNetwork:
+		return nil, ErrInjectedNetwork
+	default:
+		return rt.next.RoundTrip(req)
+	}
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// LockFileSuffix 下载锁文件的后缀
+const LockFileSuffix = ".lock"
+
+// staleLockAge 无法确认持有进程是否存活时(例如其他主机的进程), 超过该时间的锁视为失效
+var staleLockAge = 6 * time.Hour
+
+// fileLocking 是否使用锁文件防止多个进程同时下载同一个文件 默认关闭
+var fileLocking atomic.Bool
+
+// SetFileLocking
+//
+//	@Description: 设置是否使用<文件名>.lock锁文件防止多个进程同时下载同一个文件, 开启后其他进程正在下载的文件会被跳过.
+//	持有进程已退出或锁文件过旧时会回收锁
+//	@param enabled
+func SetFileLocking(enabled bool) {
+	fileLocking.Store(enabled)
+}
+
+// lockFile
+//
+//	@Description: 获取文件的下载锁
+//	@param storePath
+//	@return func() 释放锁
+//	@return bool 文件是否正在被其他进程下载
+func lockFile(storePath string) (func(), bool) {
+	if !fileLocking.Load() {
+		return func() {}, true
+	}
+	path := storePath + LockFileSuffix
+	hostname, _ := os.Hostname()
+	content := fmt.Sprintf("%d %s %d", os.Getpid(), hostname, time.Now().Unix())
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.WriteString(content)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				log.AsmrLog.Error("写入锁文件失败: ", zap.String("error", err.Error()))
+			}
+			return func() { _ = os.Remove(path) }, true
+		}
+		if !errors.Is(err, os.ErrExist) {
+			//无法创建锁文件时(例如只读目录)不阻止下载
+			log.AsmrLog.Error("创建锁文件失败: ", zap.String("error", err.Error()))
+			return func() {}, true
+		}
+		if !isStaleLock(path, hostname) {
+			return nil, false
+		}
+		log.AsmrLog.Info("回收失效的锁文件: ", zap.String("info", path))
+		_ = os.Remove(path)
+	}
+	return nil, false
+}
+
+// isStaleLock
+//
+//	@Description: 判断锁文件是否已失效: 本机持有进程已退出, 或无法确认进程状态时锁文件超过staleLockAge
+//	@param path
+//	@param hostname 本机主机名
+//	@return bool
+func isStaleLock(path string, hostname string) bool {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) >= 2 && fields[1] == hostname {
+			if pid, err := strconv.Atoi(fields[0]); err == nil {
+				if alive, known := processAlive(pid); known {
+					return !alive
+				}
+			}
+		}
+	}
+	return time.Since(stat.ModTime()) > staleLockAge
+}
+
+// processAlive
+//
+//	@Description: 判断本机进程是否存活
+//	@param pid
+//	@return alive 进程是否存活
+//	@return known 是否能够确认(部分平台不支持探测)
+func processAlive(pid int) (alive bool, known bool) {
+	if pid <= 0 {
+		return false, true
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false, true
+	}
+	err = process.Signal(syscall.Signal(0))
+	switch {
+	case err == nil || errors.Is(err, syscall.EPERM):
+		return true, true
+	case errors.Is(err, os.ErrProcessDone) || errors.Is(err, syscall.ESRCH):
+		return false, true
+	}
+	return false, false
+}
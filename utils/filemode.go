@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// dirMode 创建目录时使用的权限
+var dirMode atomic.Uint32
+
+// fileMode 创建下载文件时使用的权限
+var fileMode atomic.Uint32
+
+// fileModeSet 是否调用过SetFileMode
+var fileModeSet atomic.Bool
+
+func init() {
+	dirMode.Store(0755)
+	fileMode.Store(0644)
+}
+
+// SetDirMode
+//
+//	@Description: 设置创建目录时使用的权限, 默认为0755(实际权限还受umask影响)
+//	@param mode
+func SetDirMode(mode os.FileMode) {
+	dirMode.Store(uint32(mode.Perm()))
+}
+
+// DirMode
+//
+//	@Description: 获取创建目录时使用的权限
+//	@return os.FileMode
+func DirMode() os.FileMode {
+	return os.FileMode(dirMode.Load())
+}
+
+// SetFileMode
+//
+//	@Description: 设置创建下载文件时使用的权限, 默认为0644(实际权限还受umask影响)
+//	@param mode
+func SetFileMode(mode os.FileMode) {
+	fileMode.Store(uint32(mode.Perm()))
+	fileModeSet.Store(true)
+}
+
+// FileMode
+//
+//	@Description: 获取创建下载文件时使用的权限
+//	@return os.FileMode
+func FileMode() os.FileMode {
+	return os.FileMode(fileMode.Load())
+}
+
+// applyFileMode
+//
+//	@Description: 设置了文件权限时修改由第三方库(got)创建的文件的权限, 未设置时保持umask决定的权限
+//	@param path
+//	@return error
+func applyFileMode(path string) error {
+	if !fileModeSet.Load() {
+		return nil
+	}
+	return os.Chmod(path, FileMode())
+}
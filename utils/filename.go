@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// defaultFileName 无法解析出文件名时使用的文件名
+const defaultFileName = "download"
+
+// ResolveFileName
+//
+//	@Description: 解析下载文件名, 优先使用下载响应头Content-Disposition中的filename, 其次使用url路径的最后一段, 并清理非法字符
+//	@param fileUrl
+//	@param header 下载请求的响应头, 为nil时只使用url
+//	@return string
+func ResolveFileName(fileUrl string, header http.Header) string {
+	name := ""
+	if header != nil {
+		name = contentDispositionFileName(header.Get("Content-Disposition"))
+	}
+	if name == "" {
+		name = urlFileName(fileUrl)
+	}
+	return SanitizeFileName(name)
+}
+
+// contentDispositionFileName
+//
+//	@Description: 从Content-Disposition响应头中解析文件名
+//	@param contentDisposition
+//	@return string 解析失败时返回空字符串
+func contentDispositionFileName(contentDisposition string) string {
+	if contentDisposition == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(contentDisposition)
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// urlFileName
+//
+//	@Description: 取url路径的最后一段作为文件名
+//	@param fileUrl
+//	@return string
+func urlFileName(fileUrl string) string {
+	u, err := url.Parse(fileUrl)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// SanitizeFileName
+//
+//	@Description: 清理文件名中的路径分隔符和控制字符, windows下额外替换保留字符
+//	@param name
+//	@return string
+func SanitizeFileName(name string) string {
+	replaced := []string{"/", "\\"}
+	if runtime.GOOS == "windows" {
+		replaced = append(replaced, "?", "<", ">", ":", "*", "|", "\"")
+	}
+	for _, str := range replaced {
+		name = strings.ReplaceAll(name, str, "_")
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return defaultFileName
+	}
+	return name
+}
+
+// filenameTemplate 下载任务只有元数据没有文件名时使用的默认文件名模板
+var filenameTemplate atomic.Value
+
+func init() {
+	filenameTemplate.Store("")
+}
+
+// SetFilenameTemplate
+//
+//	@Description: 设置默认的文件名模板, 下载任务没有指定文件名和模板但带有元数据时按模板生成文件名
+//	@param tmpl 如"{rj} - {title}{ext}", 为空时关闭
+//	@return error 模板格式有误时返回
+func SetFilenameTemplate(tmpl string) error {
+	if tmpl != "" {
+		if _, err := parseFilenameTemplate(tmpl); err != nil {
+			return err
+		}
+	}
+	filenameTemplate.Store(tmpl)
+	return nil
+}
+
+// FilenameFromMeta
+//
+//	@Description: 使用元数据渲染文件名模板, 模板中的{key}替换为meta[key](替换前清理路径分隔符等非法字符), "{{"与"}}"表示花括号本身
+//	@param tmpl 如"{rj} - {title}{ext}"
+//	@param meta
+//	@return string 清理后的文件名
+//	@return error 模板格式有误、元数据缺少模板中的字段或结果为空时返回
+func FilenameFromMeta(tmpl string, meta map[string]string) (string, error) {
+	parts, err := parseFilenameTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var builder strings.Builder
+	for _, part := range parts {
+		if !part.field {
+			builder.WriteString(part.text)
+			continue
+		}
+		value, ok := meta[part.text]
+		if !ok {
+			return "", fmt.Errorf("文件名模板%s中的{%s}没有对应的元数据", tmpl, part.text)
+		}
+		if value != "" {
+			value = SanitizeFileName(value)
+		}
+		builder.WriteString(value)
+	}
+	if strings.TrimSpace(builder.String()) == "" {
+		return "", fmt.Errorf("文件名模板%s生成的文件名为空", tmpl)
+	}
+	return SanitizeFileName(builder.String()), nil
+}
+
+// templatePart 文件名模板的一段: 普通文本或{key}字段
+type templatePart struct {
+	text  string
+	field bool
+}
+
+// parseFilenameTemplate
+//
+//	@Description: 解析文件名模板
+//	@param tmpl
+//	@return []templatePart
+//	@return error
+func parseFilenameTemplate(tmpl string) ([]templatePart, error) {
+	var parts []templatePart
+	var text strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		switch c := tmpl[i]; {
+		case (c == '{' || c == '}') && i+1 < len(tmpl) && tmpl[i+1] == c:
+			text.WriteByte(c)
+			i++
+		case c == '{':
+			end := strings.IndexByte(tmpl[i+1:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("文件名模板%s中的{没有闭合", tmpl)
+			}
+			key := strings.TrimSpace(tmpl[i+1 : i+1+end])
+			if key == "" || strings.ContainsRune(key, '{') {
+				return nil, fmt.Errorf("文件名模板%s中的字段名有误", tmpl)
+			}
+			if text.Len() > 0 {
+				parts = append(parts, templatePart{text: text.String()})
+				text.Reset()
+			}
+			parts = append(parts, templatePart{text: key, field: true})
+			i += end + 1
+		case c == '}':
+			return nil, fmt.Errorf("文件名模板%s中的}没有对应的{", tmpl)
+		default:
+			text.WriteByte(c)
+		}
+	}
+	if text.Len() > 0 {
+		parts = append(parts, templatePart{text: text.String()})
+	}
+	return parts, nil
+}
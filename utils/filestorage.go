@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// Storage
+//
+//	@Description: 下载文件的存储接口, 用于接入S3、SFTP或内存等存储. 默认为本地文件系统
+type Storage interface {
+	// Create 创建(或清空)文件用于写入
+	Create(path string) (io.WriteCloser, error)
+	// Exists 判断文件是否存在
+	Exists(path string) bool
+	// Remove 删除文件
+	Remove(path string) error
+	// Rename 重命名文件
+	Rename(oldPath string, newPath string) error
+}
+
+// LocalStorage
+//
+//	@Description: 本地文件系统存储
+type LocalStorage struct{}
+
+func (LocalStorage) Create(path string) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, FileMode())
+}
+
+func (LocalStorage) Exists(path string) bool {
+	return FileOrDirExists(path)
+}
+
+func (LocalStorage) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (LocalStorage) Rename(oldPath string, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+// storageHolder 包装Storage以便存入atomic.Value
+type storageHolder struct {
+	Storage
+}
+
+// fileStorage 当前使用的存储
+var fileStorage atomic.Value
+
+func init() {
+	fileStorage.Store(storageHolder{LocalStorage{}})
+}
+
+// SetStorage
+//
+//	@Description: 设置下载文件使用的存储. got多连接下载与下载后的大小/校验值检查仍需要本地文件,
+//	非本地存储时下载器改用单连接下载直接写入存储
+//	@param s 传入nil时恢复为本地文件系统
+func SetStorage(s Storage) {
+	if s == nil {
+		s = LocalStorage{}
+	}
+	fileStorage.Store(storageHolder{s})
+}
+
+// currentStorage
+//
+//	@Description: 获取当前使用的存储
+//	@return Storage
+func currentStorage() Storage {
+	return fileStorage.Load().(storageHolder).Storage
+}
+
+// isLocalStorage
+//
+//	@Description: 当前是否使用本地文件系统存储
+//	@return bool
+func isLocalStorage() bool {
+	_, ok := currentStorage().(LocalStorage)
+	return ok
+}
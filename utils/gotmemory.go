@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"context"
+	"sync"
+
+	"github.com/melbahja/got"
+)
+
+// defaultGotChunkSize 未设置分块大小上限时估算内存使用的分块大小(got的默认最小分块大小)
+const defaultGotChunkSize = 2 * 1024 * 1024
+
+// defaultGotConcurrency 未设置连接数时估算内存使用的连接数(got的默认最大连接数)
+const defaultGotConcurrency = 20
+
+// gotMemoryLimit
+//
+//	@Description: got多连接下载的内存限制
+type gotMemoryLimit struct {
+	sync.Mutex
+	// 单个下载的连接数 0表示使用got默认值
+	concurrency uint
+	// 单个分块的最大字节数 0表示使用got默认值
+	maxChunkSize uint64
+	// 所有got下载的缓冲内存上限 小于等于0表示不限制
+	limit int64
+	// 已分配的缓冲内存
+	used int64
+	// 释放内存时关闭 用于唤醒等待的下载
+	released chan struct{}
+}
+
+// gotMemory got多连接下载的内存限制
+var gotMemory = &gotMemoryLimit{released: make(chan struct{})}
+
+// SetGotLimits
+//
+//	@Description: 设置单个got下载的连接数与分块大小上限, 单个下载的缓冲内存约为连接数×分块大小
+//	@param concurrency 0表示使用got默认值(CPU核数×3, 最多20)
+//	@param maxChunkSize 0表示使用got默认值
+func SetGotLimits(concurrency uint, maxChunkSize uint64) {
+	gotMemory.Lock()
+	defer gotMemory.Unlock()
+	gotMemory.concurrency = concurrency
+	gotMemory.maxChunkSize = maxChunkSize
+}
+
+// SetGotMemoryLimit
+//
+//	@Description: 设置所有got下载同时使用的缓冲内存上限, 超出时新的下载等待其他下载结束, 用于内存较小的NAS
+//	@param maxBytes 小于等于0表示不限制
+func SetGotMemoryLimit(maxBytes int64) {
+	gotMemory.Lock()
+	defer gotMemory.Unlock()
+	gotMemory.limit = maxBytes
+	gotMemory.release()
+}
+
+// release
+//
+//	@Description: 唤醒等待内存的下载, 调用方需持有锁
+//	@receiver m
+func (m *gotMemoryLimit) release() {
+	close(m.released)
+	m.released = make(chan struct{})
+}
+
+// applyGotLimits
+//
+//	@Description: 将连接数与分块大小上限应用到got下载, 并估算其缓冲内存
+//	@param download
+//	@param size 文件大小 未知时为0
+//	@return int64 估算的缓冲内存
+func applyGotLimits(download *got.Download, size int64) int64 {
+	gotMemory.Lock()
+	defer gotMemory.Unlock()
+	download.Concurrency = gotMemory.concurrency
+	download.MaxChunkSize = gotMemory.maxChunkSize
+	concurrency := int64(gotMemory.concurrency)
+	if concurrency == 0 {
+		concurrency = defaultGotConcurrency
+	}
+	chunkSize := int64(gotMemory.maxChunkSize)
+	if chunkSize == 0 {
+		chunkSize = defaultGotChunkSize
+	}
+	cost := concurrency * chunkSize
+	if size > 0 && size < cost {
+		cost = size
+	}
+	return cost
+}
+
+// acquireGotMemory
+//
+//	@Description: 等待got下载的缓冲内存额度, 超过上限的单个下载按上限计算以保证可以单独执行
+//	@param ctx
+//	@param cost
+//	@return func() 释放额度
+//	@return error ctx结束时返回
+func acquireGotMemory(ctx context.Context, cost int64) (func(), error) {
+	for {
+		gotMemory.Lock()
+		if gotMemory.limit <= 0 {
+			gotMemory.Unlock()
+			return func() {}, nil
+		}
+		if cost > gotMemory.limit {
+			cost = gotMemory.limit
+		}
+		if gotMemory.used+cost <= gotMemory.limit {
+			gotMemory.used += cost
+			gotMemory.Unlock()
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					gotMemory.Lock()
+					defer gotMemory.Unlock()
+					gotMemory.used -= cost
+					gotMemory.release()
+				})
+			}, nil
+		}
+		released := gotMemory.released
+		gotMemory.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
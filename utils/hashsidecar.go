@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// hashSidecarSuffix 校验值文件的后缀 为空时不校验
+var hashSidecarSuffix atomic.Value
+
+// hashSidecarLimit 校验值文件的最大读取字节数
+const hashSidecarLimit = 4096
+
+func init() {
+	hashSidecarSuffix.Store("")
+}
+
+// SetHashSidecar
+//
+//	@Description: 设置下载完成后从<文件url><suffix>获取校验值并自动校验(用于发布了.sha256等文件的镜像站),
+//	校验失败时删除文件重新下载一次. 校验算法按后缀确定(.md5/.sha1/.sha256/.crc32), 其他后缀使用sha256
+//	@param suffix 如".sha256", 为空时关闭
+func SetHashSidecar(suffix string) {
+	hashSidecarSuffix.Store(suffix)
+}
+
+// hashSidecarAlgorithm
+//
+//	@Description: 按校验值文件后缀确定校验算法
+//	@param suffix
+//	@return string
+func hashSidecarAlgorithm(suffix string) string {
+	switch strings.ToLower(strings.TrimPrefix(suffix, ".")) {
+	case ChecksumMD5:
+		return ChecksumMD5
+	case ChecksumSHA1:
+		return ChecksumSHA1
+	case ChecksumCRC32:
+		return ChecksumCRC32
+	}
+	return ChecksumSHA256
+}
+
+// sidecarURL
+//
+//	@Description: 获取校验值文件的url, 后缀加在路径末尾(查询参数之前)
+//	@param fileUrl
+//	@param suffix
+//	@return string
+//	@return error
+func sidecarURL(fileUrl string, suffix string) (string, error) {
+	parsed, err := url.Parse(fileUrl)
+	if err != nil {
+		return "", err
+	}
+	parsed.Path += suffix
+	if parsed.RawPath != "" {
+		parsed.RawPath += url.PathEscape(suffix)
+	}
+	return parsed.String(), nil
+}
+
+// fetchSidecarDigest
+//
+//	@Description: 获取校验值文件中的校验值, 支持"<校验值>"与sha256sum输出的"<校验值>  <文件名>"格式
+//	@param ctx
+//	@param fileUrl
+//	@param headers 额外请求头
+//	@param suffix
+//	@return string 十六进制校验值, 镜像站没有校验值文件(404)时为空
+//	@return error
+func fetchSidecarDigest(ctx context.Context, fileUrl string, headers map[string]string, suffix string) (string, error) {
+	target, err := sidecarURL(fileUrl, suffix)
+	if err != nil {
+		return "", err
+	}
+	req, err := NewRequest(ctx, http.MethodGet, target)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	client := Client.Get().(*http.Client)
+	defer Client.Put(client)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("获取校验值文件%s失败, 状态码: %d", target, resp.StatusCode)
+	}
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, hashSidecarLimit))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		digest := strings.TrimPrefix(fields[0], "\\")
+		if _, err := hex.DecodeString(digest); err != nil {
+			return "", fmt.Errorf("校验值文件%s格式有误: %s", target, fields[0])
+		}
+		return digest, nil
+	}
+	return "", fmt.Errorf("校验值文件%s为空", target)
+}
+
+// verifyHashSidecar
+//
+//	@Description: 使用镜像站发布的校验值文件校验下载完成的文件, 未设置后缀或镜像站没有校验值文件时跳过
+//	@param ctx
+//	@param storePath
+//	@param fileUrl
+//	@param headers 额外请求头
+//	@return error 校验值不一致时包装了ErrChecksumMismatch
+func verifyHashSidecar(ctx context.Context, storePath string, fileUrl string, headers map[string]string) error {
+	suffix := hashSidecarSuffix.Load().(string)
+	if suffix == "" {
+		return nil
+	}
+	digest, err := fetchSidecarDigest(ctx, fileUrl, headers, suffix)
+	if err != nil || digest == "" {
+		return err
+	}
+	if err := VerifyFileChecksum(storePath, hashSidecarAlgorithm(suffix), digest); err != nil {
+		return err
+	}
+	log.AsmrLog.Info("文件校验通过: ", zap.String("info", storePath))
+	return nil
+}
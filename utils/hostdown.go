@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// ErrHostDown 主机连续失败次数过多, 处于冷却中且没有可用的镜像
+var ErrHostDown = errors.New("主机暂时不可用")
+
+// defaultHostDownCooldown 主机被标记为不可用后的默认冷却时间
+const defaultHostDownCooldown = 5 * time.Minute
+
+// hostHealth 按主机统计连续失败次数
+var hostHealth = struct {
+	sync.Mutex
+	// 连续失败多少次后标记为不可用 0表示不限制
+	threshold int
+	cooldown  time.Duration
+	// 连续失败次数
+	failures map[string]int
+	// 不可用状态的结束时间
+	downUntil map[string]time.Time
+	// 主机的备用镜像主机
+	mirrors map[string][]string
+}{failures: map[string]int{}, downUntil: map[string]time.Time{}, mirrors: map[string][]string{}}
+
+// SetHostFailureThreshold
+//
+//	@Description: 设置主机连续失败threshold次后在cooldown内视为不可用, 期间的下载改用备用镜像(SetHostMirrors), 没有可用镜像时推迟到deferred-download.txt
+//	@param threshold 小于等于0表示不限制
+//	@param cooldown 小于等于0时为5分钟
+func SetHostFailureThreshold(threshold int, cooldown time.Duration) {
+	if cooldown <= 0 {
+		cooldown = defaultHostDownCooldown
+	}
+	hostHealth.Lock()
+	defer hostHealth.Unlock()
+	hostHealth.threshold = threshold
+	hostHealth.cooldown = cooldown
+	hostHealth.failures = map[string]int{}
+	hostHealth.downUntil = map[string]time.Time{}
+}
+
+// SetHostMirrors
+//
+//	@Description: 设置主机的备用镜像, 主机不可用时将下载链接的主机替换为第一个可用的镜像
+//	@param host 主机名(可带端口), 大小写不敏感
+//	@param mirrors 备用镜像主机名, 为空时删除
+func SetHostMirrors(host string, mirrors []string) {
+	host = strings.ToLower(host)
+	hostHealth.Lock()
+	defer hostHealth.Unlock()
+	if len(mirrors) == 0 {
+		delete(hostHealth.mirrors, host)
+		return
+	}
+	lowered := make([]string, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		lowered = append(lowered, strings.ToLower(mirror))
+	}
+	hostHealth.mirrors[host] = lowered
+}
+
+// HostDown
+//
+//	@Description: 判断主机当前是否被标记为不可用
+//	@param host
+//	@return bool
+func HostDown(host string) bool {
+	hostHealth.Lock()
+	defer hostHealth.Unlock()
+	return hostDownLocked(strings.ToLower(host))
+}
+
+// hostDownLocked
+//
+//	@Description: 判断主机当前是否被标记为不可用, 调用方需持有hostHealth的锁
+//	@param host
+//	@return bool
+func hostDownLocked(host string) bool {
+	until, ok := hostHealth.downUntil[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(hostHealth.downUntil, host)
+		return false
+	}
+	return true
+}
+
+// recordHostOutcome
+//
+//	@Description: 记录主机的下载结果, 连续失败达到阈值时标记为不可用
+//	@param fileUrl
+//	@param failed
+func recordHostOutcome(fileUrl string, failed bool) {
+	parsed, err := url.Parse(fileUrl)
+	if err != nil {
+		return
+	}
+	host := strings.ToLower(parsed.Host)
+	hostHealth.Lock()
+	defer hostHealth.Unlock()
+	if hostHealth.threshold <= 0 {
+		return
+	}
+	if !failed {
+		delete(hostHealth.failures, host)
+		return
+	}
+	hostHealth.failures[host]++
+	if hostHealth.failures[host] < hostHealth.threshold {
+		return
+	}
+	delete(hostHealth.failures, host)
+	hostHealth.downUntil[host] = time.Now().Add(hostHealth.cooldown)
+	log.AsmrLog.Warn(fmt.Sprintf("主机连续失败%d次, %s内不再使用", hostHealth.threshold, hostHealth.cooldown), zap.String("host", host))
+}
+
+// routeAroundDownHost
+//
+//	@Description: 下载链接的主机不可用时替换为第一个可用的备用镜像
+//	@param fileUrl
+//	@return string 可以使用的下载链接
+//	@return error 主机不可用且没有可用的镜像时返回包装了ErrHostDown的错误
+func routeAroundDownHost(fileUrl string) (string, error) {
+	parsed, err := url.Parse(fileUrl)
+	if err != nil {
+		return fileUrl, nil
+	}
+	host := strings.ToLower(parsed.Host)
+	hostHealth.Lock()
+	defer hostHealth.Unlock()
+	if !hostDownLocked(host) {
+		return fileUrl, nil
+	}
+	for _, mirror := range hostHealth.mirrors[host] {
+		if !hostDownLocked(mirror) {
+			parsed.Host = mirror
+			return parsed.String(), nil
+		}
+	}
+	return fileUrl, fmt.Errorf("%w: %s", ErrHostDown, host)
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// hostLimits 按主机限制同时进行的下载数
+var hostLimits = struct {
+	sync.Mutex
+	// 每个主机的最大并发数
+	limits map[string]int
+	// 未单独设置的主机使用的并发数 0表示不限制
+	defaultLimit int
+	// 每个主机的信号量
+	sems map[string]chan struct{}
+}{limits: map[string]int{}, sems: map[string]chan struct{}{}}
+
+// SetHostConcurrency
+//
+//	@Description: 设置某个主机同时进行的最大下载数, 例如对容易触发1015的主站设为2, 对CDN设为8
+//	@param host 主机名(可带端口), 大小写不敏感
+//	@param n 小于等于0表示不限制
+func SetHostConcurrency(host string, n int) {
+	host = strings.ToLower(host)
+	hostLimits.Lock()
+	defer hostLimits.Unlock()
+	if n <= 0 {
+		delete(hostLimits.limits, host)
+	} else {
+		hostLimits.limits[host] = n
+	}
+	//容量变化后重新创建信号量, 已持有旧信号量的下载结束后释放到旧信号量
+	delete(hostLimits.sems, host)
+}
+
+// SetDefaultHostConcurrency
+//
+//	@Description: 设置未单独设置的主机同时进行的最大下载数
+//	@param n 小于等于0表示不限制
+func SetDefaultHostConcurrency(n int) {
+	hostLimits.Lock()
+	defer hostLimits.Unlock()
+	hostLimits.defaultLimit = n
+	for host := range hostLimits.sems {
+		if _, ok := hostLimits.limits[host]; !ok {
+			delete(hostLimits.sems, host)
+		}
+	}
+}
+
+// hostSemaphore
+//
+//	@Description: 获取主机对应的信号量
+//	@param host
+//	@return chan struct{} 不限制时为nil
+func hostSemaphore(host string) chan struct{} {
+	hostLimits.Lock()
+	defer hostLimits.Unlock()
+	limit, ok := hostLimits.limits[host]
+	if !ok {
+		limit = hostLimits.defaultLimit
+	}
+	if limit <= 0 {
+		return nil
+	}
+	sem, ok := hostLimits.sems[host]
+	if !ok {
+		sem = make(chan struct{}, limit)
+		hostLimits.sems[host] = sem
+	}
+	return sem
+}
+
+// acquireHost
+//
+//	@Description: 等待自适应并发控制与主机的下载名额
+//	@param ctx
+//	@param fileUrl
+//	@return func() 释放名额
+//	@return error ctx结束时返回
+func acquireHost(ctx context.Context, fileUrl string) (func(), error) {
+	release, err := acquireAdaptive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := url.Parse(fileUrl)
+	if err != nil {
+		return release, nil
+	}
+	sem := hostSemaphore(strings.ToLower(parsed.Host))
+	if sem == nil {
+		return release, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() {
+			<-sem
+			release()
+		}, nil
+	case <-ctx.Done():
+		release()
+		return nil, context.Cause(ctx)
+	}
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HostStat
+//
+//	@Description: 单个主机的连接统计
+type HostStat struct {
+	// 当前正在进行的请求数(响应体关闭前都算作活动连接)
+	Active int64 `json:"active"`
+	// 累计请求数
+	Total int64 `json:"total"`
+	// 累计失败数(网络错误或状态码>=400)
+	Failures int64 `json:"failures"`
+	// 最近一次被cloudflare 1015限流(429)的时间
+	Last1015 time.Time `json:"last_1015"`
+	// 累计接收的响应体字节数
+	Bytes int64 `json:"bytes"`
+	// 未请求续传时返回206的次数
+	UnexpectedPartial int64 `json:"unexpected_partial"`
+}
+
+// hostStats 按主机统计的连接信息
+var hostStats = struct {
+	sync.Mutex
+	hosts map[string]*HostStat
+}{hosts: map[string]*HostStat{}}
+
+// receivedBytes 所有主机累计接收的响应体字节数, 不随ResetHostStats清空
+var receivedBytes atomic.Int64
+
+// HostStats
+//
+//	@Description: 获取各主机连接统计的快照
+//	@return map[string]HostStat
+func HostStats() map[string]HostStat {
+	hostStats.Lock()
+	defer hostStats.Unlock()
+	result := make(map[string]HostStat, len(hostStats.hosts))
+	for host, stat := range hostStats.hosts {
+		result[host] = *stat
+	}
+	return result
+}
+
+// ResetHostStats
+//
+//	@Description: 清空所有主机的连接统计
+func ResetHostStats() {
+	hostStats.Lock()
+	defer hostStats.Unlock()
+	hostStats.hosts = map[string]*HostStat{}
+}
+
+// updateHostStat
+//
+//	@Description: 在锁内修改主机统计
+//	@param host
+//	@param fn
+func updateHostStat(host string, fn func(stat *HostStat)) {
+	hostStats.Lock()
+	defer hostStats.Unlock()
+	stat, ok := hostStats.hosts[host]
+	if !ok {
+		stat = &HostStat{}
+		hostStats.hosts[host] = stat
+	}
+	fn(stat)
+}
+
+// markHostThrottled
+//
+//	@Description: 记录主机返回了1015限流页面
+//	@param rawURL
+func markHostThrottled(rawURL string) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	updateHostStat(parsed.Host, func(stat *HostStat) {
+		stat.Last1015 = time.Now()
+	})
+}
+
+// trackedRoundTrip
+//
+//	@Description: 执行请求并记录主机统计, 活动连接数在响应体关闭时减少
+//	@param rt
+//	@param req
+//	@return *http.Response
+//	@return error
+func trackedRoundTrip(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	updateHostStat(host, func(stat *HostStat) {
+		stat.Active++
+		stat.Total++
+	})
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		updateHostStat(host, func(stat *HostStat) {
+			stat.Active--
+			stat.Failures++
+		})
+		return resp, err
+	}
+	if resp.StatusCode >= 400 {
+		updateHostStat(host, func(stat *HostStat) {
+			stat.Failures++
+			if resp.StatusCode == http.StatusTooManyRequests {
+				stat.Last1015 = time.Now()
+			}
+		})
+	}
+	resp.Body = &trackedBody{ReadCloser: resp.Body, host: host}
+	return resp, nil
+}
+
+// trackedBody
+//
+//	@Description: 关闭时减少主机活动连接数的响应体
+type trackedBody struct {
+	io.ReadCloser
+	host string
+	once sync.Once
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		receivedBytes.Add(int64(n))
+		updateHostStat(b.host, func(stat *HostStat) {
+			stat.Bytes += int64(n)
+		})
+	}
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		updateHostStat(b.host, func(stat *HostStat) {
+			stat.Active--
+		})
+	})
+	return err
+}
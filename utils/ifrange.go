@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ErrRemoteChanged 续传期间源文件已变化(ETag不一致或If-Range请求返回完整文件), 需要重新下载
+var ErrRemoteChanged = errors.New("源文件已变化")
+
+// rangeValidator
+//
+//	@Description: 按Range续传时确认源文件没有变化. 记录第一次响应的ETag, 之后的Range请求附加If-Range,
+//	源文件变化时服务器返回200而不是206, 此时不能把响应追加到已下载的部分
+type rangeValidator struct {
+	mu   sync.Mutex
+	etag string
+}
+
+// ifRange
+//
+//	@Description: 获取续传请求的If-Range请求头
+//	@receiver v
+//	@return string 还没有记录ETag时为空
+func (v *rangeValidator) ifRange() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.etag
+}
+
+// observe
+//
+//	@Description: 检查Range响应的ETag, 第一次收到时记录
+//	@receiver v
+//	@param fileUrl
+//	@param header
+//	@return error ETag与记录的不一致时包装了ErrRemoteChanged
+func (v *rangeValidator) observe(fileUrl string, header http.Header) error {
+	etag := strongETag(header.Get("ETag"))
+	if etag == "" {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.etag == "" {
+		v.etag = etag
+		return nil
+	}
+	if etag != v.etag {
+		return fmt.Errorf("%w: %s, ETag %s变为%s", ErrRemoteChanged, fileUrl, v.etag, etag)
+	}
+	return nil
+}
+
+// strongETag
+//
+//	@Description: 只保留强校验ETag, If-Range不能使用弱校验(W/开头)的ETag
+//	@param etag
+//	@return string 弱校验ETag返回空字符串
+func strongETag(etag string) string {
+	if strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return etag
+}
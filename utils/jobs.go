@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"asmr-downloader/log"
+)
+
+// ErrCanceled 下载任务被取消
+var ErrCanceled = errors.New("下载任务已取消")
+
+// downloadJob
+//
+//	@Description: 进行中的下载任务
+type downloadJob struct {
+	id     string
+	url    string
+	cancel context.CancelFunc
+	// 下载中打开的文件, Shutdown超时时强制关闭
+	mu      sync.Mutex
+	closers []io.Closer
+}
+
+// jobContextKey context中保存下载任务的key
+type jobContextKey struct{}
+
+// trackCloser
+//
+//	@Description: 登记下载任务打开的文件, Shutdown超时时强制关闭
+//	@param ctx 下载任务的context
+//	@param c
+func trackCloser(ctx context.Context, c io.Closer) {
+	job, ok := ctx.Value(jobContextKey{}).(*downloadJob)
+	if !ok {
+		return
+	}
+	job.mu.Lock()
+	job.closers = append(job.closers, c)
+	job.mu.Unlock()
+}
+
+// forceClose
+//
+//	@Description: 强制关闭下载任务打开的文件
+//	@receiver job
+func (job *downloadJob) forceClose() {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	for _, c := range job.closers {
+		_ = c.Close()
+	}
+	job.closers = nil
+}
+
+// jobs 进行中的下载任务, key为任务ID
+var jobs = struct {
+	sync.Mutex
+	byID map[string]*downloadJob
+}{byID: map[string]*downloadJob{}}
+
+// jobSeq 自动生成任务ID的序号
+var jobSeq atomic.Int64
+
+// failFast 是否在第一个文件下载失败时中止整个下载任务
+var failFast atomic.Bool
+
+// run 本次运行的共享context, 开启fail fast时第一个下载失败会取消所有下载任务
+var run = struct {
+	sync.Mutex
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// 中止本次运行的下载错误
+	err error
+}{ctx: context.Background(), cancel: func(error) {}}
+
+// SetFailFast
+//
+//	@Description: 设置是否开启fail fast, 开启后第一个下载失败的文件会取消所有进行中的下载并中止工作池,
+//	批量下载入口返回该错误. 默认关闭(下载失败继续下载其他文件). 每次调用都会开始新的运行
+//	@param enabled
+func SetFailFast(enabled bool) {
+	failFast.Store(enabled)
+	run.Lock()
+	defer run.Unlock()
+	run.cancel(nil)
+	run.ctx, run.cancel = context.WithCancelCause(context.Background())
+	run.err = nil
+}
+
+// FailFastError
+//
+//	@Description: 获取中止本次运行的下载错误
+//	@return error 未开启fail fast或没有下载失败时为nil
+func FailFastError() error {
+	run.Lock()
+	defer run.Unlock()
+	return run.err
+}
+
+// abortRun
+//
+//	@Description: 开启fail fast时记录下载错误并取消所有下载任务
+//	@param err
+//	@return bool 是否开启了fail fast
+func abortRun(err error) bool {
+	if !failFast.Load() {
+		return false
+	}
+	run.Lock()
+	defer run.Unlock()
+	if run.err == nil {
+		run.err = err
+		run.cancel(ErrCanceled)
+	}
+	return true
+}
+
+// startJob
+//
+//	@Description: 登记一个可取消的下载任务
+//	@param id 任务ID, 为空时自动生成
+//	@param url
+//	@return context.Context 任务取消时结束
+//	@return func() 任务结束时调用, 取消登记
+func startJob(id string, url string) (context.Context, func()) {
+	if id == "" {
+		id = "job-" + strconv.FormatInt(jobSeq.Add(1), 10)
+	}
+	run.Lock()
+	parent := run.ctx
+	run.Unlock()
+	ctx, cancel := context.WithCancelCause(parent)
+	job := &downloadJob{id: id, url: url, cancel: func() { cancel(ErrCanceled) }}
+	ctx = context.WithValue(ctx, jobContextKey{}, job)
+	jobs.Lock()
+	jobs.byID[id] = job
+	jobs.Unlock()
+	return ctx, func() {
+		jobs.Lock()
+		if jobs.byID[id] == job {
+			delete(jobs.byID, id)
+		}
+		jobs.Unlock()
+		cancel(nil)
+	}
+}
+
+// CancelJob
+//
+//	@Description: 取消进行中的下载任务, 被取消的文件不记录为下载失败
+//	@param id 任务ID, 即DownloadOptions.JobID
+//	@return bool 任务是否存在
+func CancelJob(id string) bool {
+	jobs.Lock()
+	job, ok := jobs.byID[id]
+	jobs.Unlock()
+	if ok {
+		job.cancel()
+	}
+	return ok
+}
+
+// CancelURL
+//
+//	@Description: 取消所有下载该url的进行中任务
+//	@param url
+//	@return int 取消的任务数
+func CancelURL(url string) int {
+	jobs.Lock()
+	var matched []*downloadJob
+	for _, job := range jobs.byID {
+		if job.url == url {
+			matched = append(matched, job)
+		}
+	}
+	jobs.Unlock()
+	for _, job := range matched {
+		job.cancel()
+	}
+	return len(matched)
+}
+
+// isCanceled
+//
+//	@Description: 判断任务是否被CancelJob/CancelURL取消
+//	@param ctx
+//	@return bool
+func isCanceled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrCanceled)
+}
+
+// shutdownPollInterval Shutdown检查下载任务是否结束的间隔
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown
+//
+//	@Description: 取消所有进行中的下载并等待结束, 之后开始的下载会直接取消(调用SetFailFast开始新的运行).
+//	ctx到期时强制关闭仍未结束的下载打开的文件并返回context.DeadlineExceeded
+//	@param ctx
+//	@return int 被中断的下载数
+//	@return error
+func Shutdown(ctx context.Context) (int, error) {
+	run.Lock()
+	run.cancel(ErrCanceled)
+	run.Unlock()
+
+	jobs.Lock()
+	interrupted := len(jobs.byID)
+	jobs.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		jobs.Lock()
+		remaining := make([]*downloadJob, 0, len(jobs.byID))
+		for _, job := range jobs.byID {
+			remaining = append(remaining, job)
+		}
+		jobs.Unlock()
+		if len(remaining) == 0 {
+			return interrupted, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			for _, job := range remaining {
+				job.forceClose()
+			}
+			log.AsmrLog.Warn(fmt.Sprintf("等待下载任务结束超时, 已强制关闭%d个下载任务", len(remaining)))
+			return interrupted, context.DeadlineExceeded
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/melbahja/got"
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// ManifestEntry
+//
+//	@Description: 下载清单中的一条记录, 清单文件每行为一个JSON对象, 同一路径以最后一条为准
+type ManifestEntry struct {
+	Path     string `json:"path"`
+	URL      string `json:"url"`
+	Checksum string `json:"checksum,omitempty"`
+	// 校验算法 为空时为sha256, 兼容只提供md5等校验值的旧清单
+	Algorithm string `json:"algorithm,omitempty"`
+	// 服务器返回的ETag, 用于条件请求
+	ETag string `json:"etag,omitempty"`
+	// 服务器返回的Last-Modified, 用于条件请求
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// manifestLock 保护清单文件的并发写入
+var manifestLock sync.Mutex
+
+// checksumManifest 下载成功后记录文件校验值的下载清单, 供FixCorruptFiles使用, 为空时不记录
+var checksumManifest atomic.Value
+
+// SetChecksumManifest
+//
+//	@Description: 设置记录文件校验值的下载清单, 每个文件下载成功后追加一条记录. 传入空字符串关闭
+//	@param manifest 清单文件路径
+func SetChecksumManifest(manifest string) {
+	checksumManifest.Store(manifest)
+}
+
+// recordChecksum
+//
+//	@Description: 计算下载成功文件的校验值并追加到下载清单
+//	@param storePath
+//	@param url
+//	@param algorithm 为空时为sha256
+func recordChecksum(storePath string, url string, algorithm string) {
+	manifest, _ := checksumManifest.Load().(string)
+	if manifest == "" {
+		return
+	}
+	if algorithm == "" {
+		algorithm = ChecksumSHA256
+	}
+	checksum, err := FileChecksumWith(storePath, algorithm)
+	if err != nil {
+		log.AsmrLog.Error("计算文件校验值失败: ", zap.String("error", err.Error()))
+		return
+	}
+	entry := ManifestEntry{Path: storePath, URL: url, Checksum: checksum, Algorithm: algorithm}
+	conditionalGet.Lock()
+	if conditionalGet.manifest == manifest {
+		//与条件请求共用清单时 保留已记录的ETag/Last-Modified
+		if previous, ok := conditionalGet.entries[url]; ok && previous.Path == storePath {
+			entry.ETag = previous.ETag
+			entry.LastModified = previous.LastModified
+		}
+		conditionalGet.entries[url] = entry
+	}
+	conditionalGet.Unlock()
+	if err := AppendManifestEntry(manifest, entry); err != nil {
+		log.AsmrLog.Error("写入下载清单失败: ", zap.String("error", err.Error()))
+	}
+}
+
+// conditionalGet 条件请求(If-None-Match/If-Modified-Since)使用的下载清单
+var conditionalGet struct {
+	sync.Mutex
+	manifest string
+	// key为文件url
+	entries map[string]ManifestEntry
+}
+
+// SetConditionalGetManifest
+//
+//	@Description: 设置条件请求使用的下载清单, 下载时对已存在的文件发送If-None-Match/If-Modified-Since,
+//	服务器返回304时跳过下载, 下载成功后记录ETag/Last-Modified. 传入空字符串关闭
+//	@param manifest 清单文件路径
+//	@return error
+func SetConditionalGetManifest(manifest string) error {
+	entries := make(map[string]ManifestEntry)
+	if manifest != "" {
+		records, err := ReadManifest(manifest)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range records {
+			entries[entry.URL] = entry
+		}
+	}
+	conditionalGet.Lock()
+	defer conditionalGet.Unlock()
+	conditionalGet.manifest = manifest
+	conditionalGet.entries = entries
+	return nil
+}
+
+// conditionalGetEntry
+//
+//	@Description: 查找url对应的条件请求记录
+//	@param url
+//	@return ManifestEntry
+//	@return bool 是否开启了条件请求且存在记录
+func conditionalGetEntry(url string) (ManifestEntry, bool) {
+	conditionalGet.Lock()
+	defer conditionalGet.Unlock()
+	if conditionalGet.manifest == "" {
+		return ManifestEntry{}, false
+	}
+	entry, ok := conditionalGet.entries[url]
+	return entry, ok
+}
+
+// conditionalGetHeaders
+//
+//	@Description: 本地文件已存在且清单中有记录时, 生成If-None-Match/If-Modified-Since请求头
+//	@param url
+//	@param storePath
+//	@return []got.GotHeader
+func conditionalGetHeaders(url string, storePath string) []got.GotHeader {
+	cached, ok := conditionalGetEntry(url)
+	if !ok || !currentStorage().Exists(storePath) {
+		return nil
+	}
+	var headers []got.GotHeader
+	if cached.ETag != "" {
+		headers = append(headers, got.GotHeader{Key: "If-None-Match", Value: cached.ETag})
+	}
+	if cached.LastModified != "" {
+		headers = append(headers, got.GotHeader{Key: "If-Modified-Since", Value: cached.LastModified})
+	}
+	return headers
+}
+
+// NeedsRevalidation
+//
+//	@Description: 判断已存在的文件是否需要向服务器确认是否有更新, 开启条件请求且清单中记录了ETag/Last-Modified时返回true
+//	@param url
+//	@return bool
+func NeedsRevalidation(url string) bool {
+	cached, ok := conditionalGetEntry(url)
+	return ok && (cached.ETag != "" || cached.LastModified != "")
+}
+
+// rememberConditionalGet
+//
+//	@Description: 记录下载成功文件的ETag/Last-Modified到清单
+//	@param entry
+func rememberConditionalGet(entry ManifestEntry) {
+	if entry.ETag == "" && entry.LastModified == "" {
+		return
+	}
+	conditionalGet.Lock()
+	manifest := conditionalGet.manifest
+	if manifest == "" {
+		conditionalGet.Unlock()
+		return
+	}
+	//保留已有的校验值 避免覆盖FixCorruptFiles使用的记录
+	if previous, ok := conditionalGet.entries[entry.URL]; ok && previous.Path == entry.Path {
+		entry.Checksum = previous.Checksum
+		entry.Algorithm = previous.Algorithm
+	}
+	conditionalGet.entries[entry.URL] = entry
+	conditionalGet.Unlock()
+	if err := AppendManifestEntry(manifest, entry); err != nil {
+		log.AsmrLog.Error("写入下载清单失败: ", zap.String("error", err.Error()))
+	}
+}
+
+// ReadManifest
+//
+//	@Description: 读取下载清单
+//	@param manifest 清单文件路径
+//	@return []ManifestEntry
+//	@return error
+func ReadManifest(manifest string) ([]ManifestEntry, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ManifestEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry ManifestEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("清单文件%s第%d行格式有误: %w", manifest, lineNo, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// AppendManifestEntry
+//
+//	@Description: 向下载清单追加一条记录
+//	@param manifest 清单文件路径
+//	@param entry
+//	@return error
+func AppendManifestEntry(manifest string, entry ManifestEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+	f, err := os.OpenFile(manifest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// FileChecksum
+//
+//	@Description: 计算文件的SHA-256校验值
+//	@param path
+//	@return string 十六进制校验值
+//	@return error
+func FileChecksum(path string) (string, error) {
+	return FileChecksumWith(path, ChecksumSHA256)
+}
+
+// FixCorruptFiles
+//
+//	@Description: 按下载清单重新计算文件校验值, 只重新下载校验值不一致的文件.
+//	与FixBrokenDownloadFile处理下载失败/缺失的文件不同, 这里处理的是已下载但内容损坏的文件
+//	@param manifest 清单文件路径
+//	@param maxRetry 每个损坏文件的最大重试次数
+//	@return *FixResult
+//	@return error
+func FixCorruptFiles(manifest string, maxRetry int) (*FixResult, error) {
+	result := &FixResult{}
+	entries, err := ReadManifest(manifest)
+	if err != nil {
+		log.AsmrLog.Error("读取下载清单失败: ", zap.String("error", err.Error()))
+		return result, err
+	}
+	//同一路径以最后一条记录为准
+	latest := make(map[string]ManifestEntry, len(entries))
+	var paths []string
+	for _, entry := range entries {
+		if _, ok := latest[entry.Path]; !ok {
+			paths = append(paths, entry.Path)
+		}
+		latest[entry.Path] = entry
+	}
+
+	log.AsmrLog.Info(fmt.Sprintf("正在校验下载清单中的%d个文件,请稍后...", len(paths)))
+	for _, path := range paths {
+		entry := latest[path]
+		if entry.Checksum == "" {
+			continue
+		}
+		err := VerifyFileChecksum(entry.Path, entry.Algorithm, entry.Checksum)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrChecksumMismatch) {
+			//文件缺失由FixBrokenDownloadFile处理
+			log.AsmrLog.Info(fmt.Sprintf("文件: %s 无法校验, 跳过: %s", entry.Path, err.Error()))
+			continue
+		}
+		log.AsmrLog.Info(fmt.Sprintf("文件: %s 校验值不一致, 正在重新下载...", entry.Path))
+		recovered := false
+		for i := 0; i < maxRetry; i++ {
+			if err := discardFailedArtifact(entry.Path, entry.Path); err != nil {
+				log.AsmrLog.Error("清理损坏文件失败: ", zap.String("error", err.Error()))
+			}
+			if _, err := DownloadFile(entry.Path, entry.URL); err != nil {
+				log.AsmrLog.Error(fmt.Sprintf("文件: %s下载失败: %s", entry.Path, err.Error()))
+				continue
+			}
+			if VerifyFileChecksum(entry.Path, entry.Algorithm, entry.Checksum) == nil {
+				recovered = true
+				break
+			}
+			log.AsmrLog.Info(fmt.Sprintf("文件: %s 重新下载后校验值仍不一致,重试中(剩余重试次数: %d)...", entry.Path, maxRetry-i-1))
+		}
+		if recovered {
+			result.Recovered++
+			log.AsmrLog.Info("损坏文件修复成功: ", zap.String("info", entry.Path))
+			continue
+		}
+		record := FailedRecord{Time: GetCurrentDateTime(), Path: entry.Path, URL: entry.URL, Error: "文件校验值不一致", Kind: DetectAssetKind(entry.Path)}
+		result.StillFailing++
+		result.PermanentlyFailed = append(result.PermanentlyFailed, record)
+		recordFailedDownload(record)
+	}
+	log.AsmrLog.Info(fmt.Sprintf("损坏文件校验修复完成! 成功: %d, 仍然失败: %d", result.Recovered, result.StillFailing))
+	return result, nil
+}
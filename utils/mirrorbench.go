@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// MirrorResult
+//
+//	@Description: 单个镜像的测速结果
+type MirrorResult struct {
+	URL string `json:"url"`
+	// 成功的采样次数
+	Samples int `json:"samples"`
+	// 失败的采样次数
+	Failures int           `json:"failures"`
+	Min      time.Duration `json:"min"`
+	Median   time.Duration `json:"median"`
+	P95      time.Duration `json:"p95"`
+	// 平均吞吐量 字节/秒
+	Throughput float64 `json:"throughput"`
+}
+
+// measureMirror
+//
+//	@Description: 对单个镜像采样多次并统计延迟与吞吐量
+//	@param url
+//	@param samples
+//	@return MirrorResult
+func measureMirror(url string, samples int) MirrorResult {
+	result := MirrorResult{URL: url}
+	var durations []time.Duration
+	var totalBytes int64
+	var totalTime time.Duration
+	client := Client.Get().(*http.Client)
+	defer Client.Put(client)
+	for i := 0; i < samples; i++ {
+		stopwatch := NewStopwatch()
+		resp, err := client.Get(url)
+		if err != nil {
+			result.Failures++
+			continue
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		elapsed := stopwatch.Elapsed()
+		if err != nil || resp.StatusCode >= 400 {
+			result.Failures++
+			continue
+		}
+		durations = append(durations, elapsed)
+		totalBytes += n
+		totalTime += elapsed
+	}
+	result.Samples = len(durations)
+	if len(durations) == 0 {
+		return result
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	result.Min = durations[0]
+	result.Median = durations[len(durations)/2]
+	result.P95 = durations[(len(durations)*95+99)/100-1]
+	if totalTime > 0 {
+		result.Throughput = float64(totalBytes) / totalTime.Seconds()
+	}
+	return result
+}
+
+// BenchmarkMirrors
+//
+//	@Description: 对每个镜像请求samples次, 统计最小/中位/P95延迟与平均吞吐量, 按中位延迟从快到慢写出报告
+//	@param urls
+//	@param samples 每个镜像的采样次数
+//	@param out
+//	@return error
+func BenchmarkMirrors(urls []string, samples int, out io.Writer) error {
+	if len(urls) == 0 {
+		return fmt.Errorf("没有需要测速的镜像")
+	}
+	if samples < 1 {
+		return fmt.Errorf("采样次数必须大于0, 当前为%d", samples)
+	}
+	results := make([]MirrorResult, 0, len(urls))
+	for _, url := range urls {
+		results = append(results, measureMirror(url, samples))
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		//全部失败的镜像排在最后
+		if (results[i].Samples == 0) != (results[j].Samples == 0) {
+			return results[j].Samples == 0
+		}
+		return results[i].Median < results[j].Median
+	})
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "URL\tMIN\tMEDIAN\tP95\tTHROUGHPUT\tFAILURES")
+	for _, result := range results {
+		if result.Samples == 0 {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t%d/%d\n", result.URL, result.Failures, samples)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.1f KB/s\t%d/%d\n", result.URL,
+			result.Min.Round(time.Millisecond), result.Median.Round(time.Millisecond), result.P95.Round(time.Millisecond),
+			result.Throughput/1024, result.Failures, samples)
+	}
+	return w.Flush()
+}
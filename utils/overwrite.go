@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// 覆盖已存在文件前的确认方式
+const (
+	// OverwriteConfirmOff 不确认, 直接覆盖(默认)
+	OverwriteConfirmOff = ""
+	// OverwriteConfirmEach 覆盖每个文件前逐个确认
+	OverwriteConfirmEach = "each"
+	// OverwriteConfirmBatch 批量下载开始前汇总确认一次
+	OverwriteConfirmBatch = "batch"
+)
+
+// overwriteConfirm 覆盖确认设置
+var overwriteConfirm = struct {
+	sync.Mutex
+	mode string
+	// 无法交互(没有终端)或直接回车时的默认回答
+	defaultYes bool
+}{}
+
+// overwritePrompt 询问用户的方法
+var overwritePrompt = PromotForInput
+
+// stdinInteractive
+//
+//	@Description: 标准输入是否为终端, 不是终端(如cron、管道)时无法询问用户
+//	@return bool
+var stdinInteractive = func() bool {
+	stat, err := os.Stdin.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// SetOverwriteConfirm
+//
+//	@Description: 设置覆盖已存在的文件(未设置跳过已存在文件)前是否需要确认, 防止误操作导致文件丢失
+//	@param mode OverwriteConfirmOff, OverwriteConfirmEach 或 OverwriteConfirmBatch
+//	@param defaultYes 没有终端或直接回车时的回答, false表示不覆盖
+//	@return error
+func SetOverwriteConfirm(mode string, defaultYes bool) error {
+	switch mode {
+	case OverwriteConfirmOff, OverwriteConfirmEach, OverwriteConfirmBatch:
+	default:
+		return fmt.Errorf("不支持的覆盖确认方式: %s, 只支持each或batch", mode)
+	}
+	overwriteConfirm.Lock()
+	defer overwriteConfirm.Unlock()
+	overwriteConfirm.mode = mode
+	overwriteConfirm.defaultYes = defaultYes
+	return nil
+}
+
+// askOverwrite
+//
+//	@Description: 询问用户是否覆盖, 调用方需持有overwriteConfirm的锁(同一时间只显示一个提示)
+//	@param message
+//	@return bool
+func askOverwrite(message string) bool {
+	defaultAnswer := "N"
+	if overwriteConfirm.defaultYes {
+		defaultAnswer = "Y"
+	}
+	if !stdinInteractive() {
+		log.AsmrLog.Info(fmt.Sprintf("%s 无法交互, 使用默认回答: %s", message, defaultAnswer))
+		return overwriteConfirm.defaultYes
+	}
+	input := overwritePrompt(fmt.Sprintf("%s(Y/N,默认为%s)?:", message, defaultAnswer), defaultAnswer)
+	return strings.EqualFold(input, "Y")
+}
+
+// confirmOverwrite
+//
+//	@Description: 逐个确认模式下询问是否覆盖已存在的文件
+//	@param storePath
+//	@return bool 是否覆盖
+func confirmOverwrite(storePath string) bool {
+	overwriteConfirm.Lock()
+	defer overwriteConfirm.Unlock()
+	if overwriteConfirm.mode != OverwriteConfirmEach {
+		return true
+	}
+	return askOverwrite(fmt.Sprintf("文件: %s 已存在, 是否覆盖", storePath))
+}
+
+// confirmOverwriteBatch
+//
+//	@Description: 汇总确认模式下统计会被覆盖的文件并询问一次, 不覆盖时这些文件改为跳过
+//	@param jobs
+//	@return []DownloadJob 不修改传入的切片
+func confirmOverwriteBatch(jobs []DownloadJob) []DownloadJob {
+	overwriteConfirm.Lock()
+	defer overwriteConfirm.Unlock()
+	if overwriteConfirm.mode != OverwriteConfirmBatch {
+		return jobs
+	}
+	var existing []int
+	for i, job := range jobs {
+		if job.SkipExisting {
+			continue
+		}
+		name := job.Filename
+		if name == "" {
+			name = ResolveFileName(job.URL, nil)
+		}
+		if FileOrDirExists(StorePathFor(job.Path, name, DetectAssetKind(name))) {
+			existing = append(existing, i)
+		}
+	}
+	if len(existing) == 0 || askOverwrite(fmt.Sprintf("即将覆盖%d个已存在的文件, 是否继续", len(existing))) {
+		return jobs
+	}
+	log.AsmrLog.Info("已取消覆盖, 跳过已存在的文件: ", zap.Int("count", len(existing)))
+	confirmed := append([]DownloadJob(nil), jobs...)
+	for _, i := range existing {
+		confirmed[i].SkipExisting = true
+	}
+	return confirmed
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// PartFileSuffix 下载中文件的后缀, 下载完成后才会移动到最终路径
+const PartFileSuffix = ".part"
+
+// tempDir 存放.part文件的临时目录 为空时与最终文件放在同一目录
+var tempDir atomic.Value
+
+// SetTempDir
+//
+//	@Description: 设置.part文件的临时目录(例如SSD), 下载完成后再移动到最终路径, 传入空字符串恢复默认
+//	@param dir
+//	@return error
+func SetTempDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, DirMode()); err != nil {
+			return fmt.Errorf("创建临时目录%s失败: %w", dir, err)
+		}
+	}
+	tempDir.Store(dir)
+	return nil
+}
+
+// partPath
+//
+//	@Description: 获取下载中文件的路径, 同一个最终路径总是得到相同的.part路径
+//	@param storePath
+//	@return string
+func partPath(storePath string) string {
+	dir, _ := tempDir.Load().(string)
+	if dir == "" {
+		return storePath + PartFileSuffix
+	}
+	//不同作品可能存在同名文件 使用最终路径的哈希区分
+	sum := sha1.Sum([]byte(storePath))
+	return filepath.Join(dir, hex.EncodeToString(sum[:4])+"-"+filepath.Base(storePath)+PartFileSuffix)
+}
+
+// finalizePart
+//
+//	@Description: 将下载完成的.part文件移动到最终路径. 跨文件系统无法直接重命名时,
+//	先复制为最终目录下的.part文件再重命名, 保证最终路径上不会出现不完整的文件
+//	@param part
+//	@param storePath
+//	@return error
+func finalizePart(part string, storePath string) error {
+	err := currentStorage().Rename(part, storePath)
+	if err == nil {
+		return nil
+	}
+	if _, statErr := os.Stat(part); statErr != nil {
+		return err
+	}
+	log.AsmrLog.Info("无法直接移动文件, 改为复制: ", zap.String("info", storePath), zap.String("reason", err.Error()))
+	staging := storePath + PartFileSuffix
+	//复制中断时保留已复制的部分 下次从断点继续复制
+	if err := ResumableCopyFile(part, staging); err != nil {
+		return fmt.Errorf("复制下载文件%s失败: %w", part, err)
+	}
+	if err := os.Rename(staging, storePath); err != nil {
+		_ = os.Remove(staging)
+		return err
+	}
+	return os.Remove(part)
+}
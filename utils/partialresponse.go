@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// ErrUnexpectedPartial 服务器对完整文件的请求返回了206, 响应只包含文件的一部分
+var ErrUnexpectedPartial = errors.New("服务器返回了部分内容")
+
+// 未请求续传时收到206的处理方式
+const (
+	// PartialPolicyRetry 使用Range: bytes=0-重新请求完整文件一次, 仍然不完整时按下载失败处理(默认)
+	PartialPolicyRetry = "retry"
+	// PartialPolicyFail 直接按下载失败处理, 之后通过失败记录重试
+	PartialPolicyFail = "fail"
+	// PartialPolicyAccept 保存收到的内容(旧版本的行为)
+	PartialPolicyAccept = "accept"
+)
+
+// unexpectedPartialPolicy 未请求续传时收到206的处理方式
+var unexpectedPartialPolicy atomic.Value
+
+func init() {
+	unexpectedPartialPolicy.Store(PartialPolicyRetry)
+}
+
+// SetUnexpectedPartialPolicy
+//
+//	@Description: 设置未请求续传时服务器返回206(且Content-Range不是完整文件)的处理方式
+//	@param policy retry(或为空)、fail 或 accept
+//	@return error
+func SetUnexpectedPartialPolicy(policy string) error {
+	switch policy {
+	case "":
+		policy = PartialPolicyRetry
+	case PartialPolicyRetry, PartialPolicyFail, PartialPolicyAccept:
+	default:
+		return fmt.Errorf("不支持的206处理方式: %s, 只支持retry、fail或accept", policy)
+	}
+	unexpectedPartialPolicy.Store(policy)
+	return nil
+}
+
+// contentRangeCoversWhole
+//
+//	@Description: 判断Content-Range是否覆盖完整文件, 如"bytes 0-99/100"
+//	@param contentRange
+//	@return bool 格式有误或文件大小未知时为false
+func contentRangeCoversWhole(contentRange string) bool {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(contentRange), "bytes ")
+	if !ok {
+		return false
+	}
+	byteRange, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return false
+	}
+	first, last, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		return false
+	}
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	size, err3 := strconv.ParseInt(total, 10, 64)
+	return err1 == nil && err2 == nil && err3 == nil && start == 0 && end == size-1
+}
+
+// recordUnexpectedPartial
+//
+//	@Description: 记录主机在未请求续传时返回了206
+//	@param fileUrl
+//	@param contentRange
+func recordUnexpectedPartial(fileUrl string, contentRange string) {
+	host := fileUrl
+	if parsed, err := url.Parse(fileUrl); err == nil {
+		host = parsed.Host
+	}
+	updateHostStat(host, func(stat *HostStat) {
+		stat.UnexpectedPartial++
+	})
+	log.AsmrLog.Warn("服务器在未请求续传时返回了206: ", zap.String("host", host), zap.String("url", fileUrl),
+		zap.String("content_range", contentRange))
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// caseFoldPaths 比较路径时是否忽略大小写
+var caseFoldPaths atomic.Bool
+
+// SetCaseFoldPaths
+//
+//	@Description: 设置比较路径时是否忽略大小写, 用于大小写不敏感的文件系统(macOS/Windows). 默认区分大小写
+//	@param fold
+func SetCaseFoldPaths(fold bool) {
+	caseFoldPaths.Store(fold)
+}
+
+// NormalizePath
+//
+//	@Description: 规范化路径用于比较: Unicode NFC规范化、统一使用/分隔符并清理多余的分隔符, 开启忽略大小写时转为小写
+//	@param p
+//	@return string
+func NormalizePath(p string) string {
+	return normalizePath(p, caseFoldPaths.Load())
+}
+
+// PathsEqual
+//
+//	@Description: 按NormalizePath的规则比较两个路径是否指向同一文件
+//	@param a
+//	@param b
+//	@return bool
+func PathsEqual(a string, b string) bool {
+	return NormalizePath(a) == NormalizePath(b)
+}
+
+// normalizePath
+//
+//	@Description: 规范化路径
+//	@param p
+//	@param fold 是否转为小写
+//	@return string
+func normalizePath(p string, fold bool) string {
+	p = norm.NFC.String(p)
+	p = path.Clean(strings.ReplaceAll(p, "\\", "/"))
+	if fold {
+		p = strings.ToLower(p)
+	}
+	return p
+}
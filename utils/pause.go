@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	//没有系统时区数据(如Windows)时使用内置的时区数据
+	_ "time/tzdata"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// pauseState 暂停下载状态, 暂停期间新的文件在开始下载前等待, 正在下载的文件不受影响
+var pauseState = struct {
+	sync.Mutex
+	// 通过Pause手动暂停
+	manual bool
+	// 处于静默时段
+	quiet bool
+	// 恢复下载时关闭并重新创建 用于唤醒等待的下载
+	resumed chan struct{}
+}{resumed: make(chan struct{})}
+
+// Pause
+//
+//	@Description: 暂停下载, 正在下载的文件继续下载, 之后的文件等待Resume
+func Pause() {
+	pauseState.Lock()
+	defer pauseState.Unlock()
+	pauseState.manual = true
+}
+
+// Resume
+//
+//	@Description: 恢复通过Pause暂停的下载(静默时段内仍然暂停)
+func Resume() {
+	setPaused(func() { pauseState.manual = false })
+}
+
+// Paused
+//
+//	@Description: 当前是否暂停下载(手动暂停或处于静默时段)
+//	@return bool
+func Paused() bool {
+	pauseState.Lock()
+	defer pauseState.Unlock()
+	return pauseState.manual || pauseState.quiet
+}
+
+// setPaused
+//
+//	@Description: 修改暂停状态, 不再暂停时唤醒等待的下载
+//	@param update
+func setPaused(update func()) {
+	pauseState.Lock()
+	defer pauseState.Unlock()
+	update()
+	if !pauseState.manual && !pauseState.quiet {
+		close(pauseState.resumed)
+		pauseState.resumed = make(chan struct{})
+	}
+}
+
+// waitIfPaused
+//
+//	@Description: 暂停期间等待恢复下载
+//	@param ctx
+//	@return error ctx结束时返回
+func waitIfPaused(ctx context.Context) error {
+	for {
+		pauseState.Lock()
+		paused := pauseState.manual || pauseState.quiet
+		resumed := pauseState.resumed
+		pauseState.Unlock()
+		if !paused {
+			return nil
+		}
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// quietHoursCheckInterval 检查是否处于静默时段的间隔
+var quietHoursCheckInterval = time.Minute
+
+// quietHours 静默时段设置
+var quietHours = struct {
+	sync.Mutex
+	// 关闭检查静默时段的协程
+	stop chan struct{}
+}{}
+
+// SetQuietHours
+//
+//	@Description: 设置每天的静默时段, 时段内暂停下载(已开始的文件继续下载), 进入与离开时发送Webhook通知.
+//	结束时间早于开始时间表示跨越午夜, 例如22:00-07:00
+//	@param start 开始时间 HH:MM, 与end均为空时关闭
+//	@param end 结束时间 HH:MM
+//	@param tz 时区 如Asia/Shanghai, 为空时使用本地时区
+//	@return error
+func SetQuietHours(start string, end string, tz string) error {
+	quietHours.Lock()
+	defer quietHours.Unlock()
+	if quietHours.stop != nil {
+		close(quietHours.stop)
+		quietHours.stop = nil
+	}
+	setPaused(func() { pauseState.quiet = false })
+	if start == "" && end == "" {
+		return nil
+	}
+	startMinute, err := parseClock(start)
+	if err != nil {
+		return err
+	}
+	endMinute, err := parseClock(end)
+	if err != nil {
+		return err
+	}
+	loc := time.Local
+	if tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return fmt.Errorf("无效的时区: %s", tz)
+		}
+	}
+	stop := make(chan struct{})
+	quietHours.stop = stop
+	go func() {
+		ticker := time.NewTicker(quietHoursCheckInterval)
+		defer ticker.Stop()
+		quiet := false
+		for {
+			if now := inQuietHours(time.Now().In(loc), startMinute, endMinute); now != quiet {
+				quiet = now
+				setPaused(func() { pauseState.quiet = quiet })
+				message := fmt.Sprintf("进入静默时段(%s-%s), 暂停下载", start, end)
+				if !quiet {
+					message = fmt.Sprintf("离开静默时段(%s-%s), 继续下载", start, end)
+				}
+				log.AsmrLog.Info(message)
+				if err := log.DiscordWebhook.Send(message); err != nil {
+					log.AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// parseClock
+//
+//	@Description: 解析HH:MM格式的时间
+//	@param clock
+//	@return int 从0点开始的分钟数
+//	@return error
+func parseClock(clock string) (int, error) {
+	hour, minute, ok := strings.Cut(clock, ":")
+	h, hourErr := strconv.Atoi(hour)
+	m, minuteErr := strconv.Atoi(minute)
+	if !ok || hourErr != nil || minuteErr != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("时间格式有误: %s, 应为HH:MM", clock)
+	}
+	return h*60 + m, nil
+}
+
+// inQuietHours
+//
+//	@Description: 判断时间是否处于静默时段
+//	@param now
+//	@param start 开始时间 从0点开始的分钟数
+//	@param end 结束时间 从0点开始的分钟数
+//	@return bool
+func inQuietHours(now time.Time, start int, end int) bool {
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	//跨越午夜
+	return minute >= start || minute < end
+}
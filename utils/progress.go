@@ -0,0 +1,369 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// BatchProgress
+//
+//	@Description: 多文件批量下载的整体进度统计, 并发安全
+type BatchProgress struct {
+	totalFiles  atomic.Int64
+	doneFiles   atomic.Int64
+	failedFiles atomic.Int64
+	// 被取消的文件数
+	canceledFiles atomic.Int64
+	// 因文件已存在而跳过的文件数(同时计入已完成)
+	existingFiles atomic.Int64
+	// 主机不可用而推迟下载的文件数
+	deferredFiles atomic.Int64
+	bytesDone     atomic.Int64
+	totalBytes    atomic.Int64
+	stopwatch     *Stopwatch
+	notify        progressNotify
+}
+
+// progressNotify 下载进度通知设置
+type progressNotify struct {
+	sync.Mutex
+	notifier   log.Notifier
+	everyFiles int64
+	every      time.Duration
+	// 上一次通知时已完成的文件数
+	lastFiles int64
+	lastTime  time.Time
+}
+
+// progressNotifyMinInterval 两次进度通知的最小间隔, 避免文件较小时频繁通知
+const progressNotifyMinInterval = 30 * time.Second
+
+// BatchProgressSnapshot
+//
+//	@Description: 批量下载进度快照
+type BatchProgressSnapshot struct {
+	TotalFiles  int64 `json:"total_files"`
+	DoneFiles   int64 `json:"done_files"`
+	FailedFiles int64 `json:"failed_files"`
+	// 被取消的文件数
+	CanceledFiles int64 `json:"canceled_files"`
+	// 因文件已存在而跳过的文件数(同时计入已完成)
+	ExistingFiles int64 `json:"existing_files"`
+	// 主机不可用而推迟下载的文件数
+	DeferredFiles int64 `json:"deferred_files"`
+	BytesDone     int64 `json:"bytes_done"`
+	// 预先获取到的总字节数 未知时为0
+	TotalBytes int64         `json:"total_bytes"`
+	Elapsed    time.Duration `json:"elapsed"`
+}
+
+// NewBatchProgress
+//
+//	@Description: 创建批量下载进度统计
+//	@return *BatchProgress
+func NewBatchProgress() *BatchProgress {
+	return &BatchProgress{stopwatch: NewStopwatch()}
+}
+
+// activeBatchProgress 当前下载任务使用的进度统计
+var activeBatchProgress atomic.Pointer[BatchProgress]
+
+// SetBatchProgress
+//
+//	@Description: 设置当前使用的批量进度统计, 之后创建的下载任务都会向其登记并更新进度, 传入nil关闭
+//	@param p
+func SetBatchProgress(p *BatchProgress) {
+	activeBatchProgress.Store(p)
+}
+
+// currentBatchProgress
+//
+//	@Description: 获取当前使用的批量进度统计
+//	@return *BatchProgress 未设置时为nil
+func currentBatchProgress() *BatchProgress {
+	return activeBatchProgress.Load()
+}
+
+// ContentLength
+//
+//	@Description: 发送HEAD请求获取文件大小
+//	@param fileUrl
+//	@param headers 额外请求头
+//	@return int64 获取失败或服务器未返回Content-Length时为0
+func ContentLength(fileUrl string, headers map[string]string) int64 {
+	size, _ := contentLength(context.Background(), fileUrl, headers)
+	return size
+}
+
+// contentLength
+//
+//	@Description: 发送HEAD请求获取文件大小
+//	@param ctx
+//	@param fileUrl
+//	@param headers 额外请求头
+//	@return int64 服务器未返回Content-Length时为0
+//	@return error
+func contentLength(ctx context.Context, fileUrl string, headers map[string]string) (int64, error) {
+	req, err := NewRequest(ctx, "HEAD", fileUrl)
+	if err != nil {
+		return 0, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	client := Client.Get().(*http.Client)
+	defer Client.Put(client)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("获取文件大小失败, 状态码: %d", resp.StatusCode)
+	}
+	if resp.ContentLength < 0 {
+		return 0, nil
+	}
+	return resp.ContentLength, nil
+}
+
+// PrefetchSizes
+//
+//	@Description: 并发发送HEAD请求预先获取一批文件的大小, 用于显示准确的总大小和检查磁盘空间
+//	@param ctx
+//	@param urls
+//	@param workers 并发数, 小于1时为1
+//	@return map[string]int64 url对应的文件大小, 获取失败或大小未知的url不在结果中
+//	@return error ctx被取消时返回
+func PrefetchSizes(ctx context.Context, urls []string, workers int) (map[string]int64, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	sizes := make(map[string]int64, len(urls))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	limiter := make(chan struct{}, workers)
+	for _, fileUrl := range urls {
+		select {
+		case limiter <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return sizes, ctx.Err()
+		}
+		wg.Add(1)
+		go func(fileUrl string) {
+			defer wg.Done()
+			defer func() { <-limiter }()
+			size, err := contentLength(ctx, fileUrl, nil)
+			if err != nil {
+				log.AsmrLog.Warn("获取文件大小失败: ", zap.String("url", fileUrl), zap.String("error", err.Error()))
+				return
+			}
+			if size <= 0 {
+				return
+			}
+			lock.Lock()
+			sizes[fileUrl] = size
+			lock.Unlock()
+		}(fileUrl)
+	}
+	wg.Wait()
+	return sizes, ctx.Err()
+}
+
+// AddFile
+//
+//	@Description: 登记一个待下载文件
+//	@receiver p
+func (p *BatchProgress) AddFile() {
+	p.totalFiles.Add(1)
+}
+
+// AddTotalBytes
+//
+//	@Description: 累加预先获取到的文件大小(例如Content-Length)
+//	@receiver p
+//	@param n
+func (p *BatchProgress) AddTotalBytes(n int64) {
+	p.totalBytes.Add(n)
+}
+
+// AddBytes
+//
+//	@Description: 累加已下载的字节数
+//	@receiver p
+//	@param n
+func (p *BatchProgress) AddBytes(n int64) {
+	p.bytesDone.Add(n)
+}
+
+// FileDone
+//
+//	@Description: 标记一个文件下载完成
+//	@receiver p
+func (p *BatchProgress) FileDone() {
+	p.doneFiles.Add(1)
+	p.maybeNotify()
+}
+
+// NotifyEvery
+//
+//	@Description: 每完成everyFiles个文件或每隔every时间(以先到者为准)发送一次进度通知, 两次通知至少间隔30秒
+//	@receiver p
+//	@param notifier 为nil时关闭
+//	@param everyFiles 小于等于0表示不按文件数通知
+//	@param every 小于等于0表示不按时间通知
+func (p *BatchProgress) NotifyEvery(notifier log.Notifier, everyFiles int, every time.Duration) {
+	p.notify.Lock()
+	defer p.notify.Unlock()
+	p.notify.notifier = notifier
+	p.notify.everyFiles = int64(everyFiles)
+	p.notify.every = every
+	p.notify.lastFiles = p.doneFiles.Load()
+	p.notify.lastTime = time.Now()
+}
+
+// maybeNotify
+//
+//	@Description: 达到通知条件时发送进度通知
+//	@receiver p
+func (p *BatchProgress) maybeNotify() {
+	p.notify.Lock()
+	n := &p.notify
+	if n.notifier == nil || (n.everyFiles <= 0 && n.every <= 0) {
+		n.Unlock()
+		return
+	}
+	done := p.doneFiles.Load()
+	since := time.Since(n.lastTime)
+	reached := (n.everyFiles > 0 && done-n.lastFiles >= n.everyFiles) || (n.every > 0 && since >= n.every)
+	if !reached || since < progressNotifyMinInterval {
+		n.Unlock()
+		return
+	}
+	n.lastFiles = done
+	n.lastTime = time.Now()
+	notifier := n.notifier
+	n.Unlock()
+	if err := notifier.Send("当前下载进度: " + p.Snapshot().String()); err != nil {
+		log.AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
+	}
+}
+
+// FileFailed
+//
+//	@Description: 标记一个文件下载失败
+//	@receiver p
+func (p *BatchProgress) FileFailed() {
+	p.failedFiles.Add(1)
+}
+
+// FileCanceled
+//
+//	@Description: 标记一个文件被取消下载
+//	@receiver p
+func (p *BatchProgress) FileCanceled() {
+	p.canceledFiles.Add(1)
+}
+
+// FileExisting
+//
+//	@Description: 标记一个文件因已存在而跳过下载, 同时计入已完成
+//	@receiver p
+func (p *BatchProgress) FileExisting() {
+	p.existingFiles.Add(1)
+	p.FileDone()
+}
+
+// FileDeferred
+//
+//	@Description: 标记一个文件因主机不可用而推迟下载
+//	@receiver p
+func (p *BatchProgress) FileDeferred() {
+	p.deferredFiles.Add(1)
+}
+
+// Snapshot
+//
+//	@Description: 获取当前进度快照
+//	@receiver p
+//	@return BatchProgressSnapshot
+func (p *BatchProgress) Snapshot() BatchProgressSnapshot {
+	return BatchProgressSnapshot{
+		TotalFiles:    p.totalFiles.Load(),
+		DoneFiles:     p.doneFiles.Load(),
+		FailedFiles:   p.failedFiles.Load(),
+		CanceledFiles: p.canceledFiles.Load(),
+		ExistingFiles: p.existingFiles.Load(),
+		DeferredFiles: p.deferredFiles.Load(),
+		BytesDone:     p.bytesDone.Load(),
+		TotalBytes:    p.totalBytes.Load(),
+		Elapsed:       p.stopwatch.Elapsed(),
+	}
+}
+
+// StartReporting
+//
+//	@Description: 按固定间隔回调当前进度快照
+//	@receiver p
+//	@param interval
+//	@param fn
+//	@return func() 停止回调
+func (p *BatchProgress) StartReporting(interval time.Duration, fn func(BatchProgressSnapshot)) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn(p.Snapshot())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// BytesPercent
+//
+//	@Description: 字节进度百分比, 总字节数未知时返回-1
+//	@receiver s
+//	@return float64
+func (s BatchProgressSnapshot) BytesPercent() float64 {
+	if s.TotalBytes <= 0 {
+		return -1
+	}
+	return float64(s.BytesDone) * 100 / float64(s.TotalBytes)
+}
+
+// String
+//
+//	@Description: 格式化进度 例如: 文件: 142/500, 失败: 3, 字节进度: 61.00%
+//	@receiver s
+//	@return string
+func (s BatchProgressSnapshot) String() string {
+	result := fmt.Sprintf("文件: %d/%d, 失败: %d", s.DoneFiles, s.TotalFiles, s.FailedFiles)
+	if s.CanceledFiles > 0 {
+		result += fmt.Sprintf(", 已取消: %d", s.CanceledFiles)
+	}
+	if s.ExistingFiles > 0 {
+		result += fmt.Sprintf(", 已存在: %d", s.ExistingFiles)
+	}
+	if s.DeferredFiles > 0 {
+		result += fmt.Sprintf(", 已推迟: %d", s.DeferredFiles)
+	}
+	if percent := s.BytesPercent(); percent >= 0 {
+		result += fmt.Sprintf(", 字节进度: %.2f%%", percent)
+	}
+	return result
+}
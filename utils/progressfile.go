@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// ProgressFileSuffix 记录大文件下载进度的附属文件后缀
+const ProgressFileSuffix = ".progress"
+
+// progressSaveInterval 更新进度文件的间隔
+var progressSaveInterval = 5 * time.Second
+
+// progressSidecarMinSize 写入进度文件的最小文件大小 小于等于0表示不写入
+var progressSidecarMinSize atomic.Int64
+
+// SetProgressSidecar
+//
+//	@Description: 设置大文件的进度文件, 不小于minSize的文件下载时定期将已写入的字节数和ETag记录到<name>.progress,
+//	程序崩溃后再次下载时若ETag一致则从.part文件中已写入的位置继续下载, 否则重新下载
+//	@param minSize 小于等于0表示不记录
+func SetProgressSidecar(minSize int64) {
+	progressSidecarMinSize.Store(minSize)
+}
+
+// progressRecord 进度文件内容
+type progressRecord struct {
+	URL   string `json:"url"`
+	ETag  string `json:"etag"`
+	Bytes int64  `json:"bytes"`
+}
+
+// progressPath
+//
+//	@Description: 获取进度文件路径, 与.part文件放在同一目录
+//	@param storePath
+//	@return string
+func progressPath(storePath string) string {
+	return strings.TrimSuffix(partPath(storePath), PartFileSuffix) + ProgressFileSuffix
+}
+
+// useProgressSidecar
+//
+//	@Description: 判断指定大小的文件是否需要记录进度文件
+//	@param size
+//	@return bool
+func useProgressSidecar(size int64) bool {
+	minSize := progressSidecarMinSize.Load()
+	return minSize > 0 && size >= minSize && isLocalStorage()
+}
+
+// loadProgress
+//
+//	@Description: 读取可用于续传的进度记录, 进度文件不存在、无效或.part文件小于记录的字节数时返回nil
+//	@param storePath
+//	@return *progressRecord
+func loadProgress(storePath string) *progressRecord {
+	if progressSidecarMinSize.Load() <= 0 || !isLocalStorage() {
+		return nil
+	}
+	data, err := os.ReadFile(progressPath(storePath))
+	if err != nil {
+		return nil
+	}
+	var record progressRecord
+	if err := json.Unmarshal(data, &record); err != nil || record.ETag == "" || record.Bytes <= 0 {
+		removeProgress(storePath)
+		return nil
+	}
+	stat, err := os.Stat(partPath(storePath))
+	if err != nil || stat.Size() < record.Bytes {
+		removeProgress(storePath)
+		return nil
+	}
+	return &record
+}
+
+// saveProgress
+//
+//	@Description: 写入进度文件, 先写临时文件再重命名, 避免崩溃时留下不完整的进度文件
+//	@param storePath
+//	@param record
+//	@return error
+func saveProgress(storePath string, record progressRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	path := progressPath(storePath)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// removeProgress
+//
+//	@Description: 删除进度文件
+//	@param storePath
+func removeProgress(storePath string) {
+	if err := os.Remove(progressPath(storePath)); err != nil && !os.IsNotExist(err) {
+		log.AsmrLog.Error("删除进度文件失败: ", zap.String("error", err.Error()))
+	}
+}
+
+// syncEvery 下载时每写入多少字节同步一次磁盘 小于等于0表示不主动同步
+var syncEvery atomic.Int64
+
+// SetSyncEvery
+//
+//	@Description: 设置下载时每写入n字节调用一次fsync, 断电时最多丢失n字节已写入的数据. 同时记录进度文件时按相同频率更新进度文件.
+//	默认关闭以保证下载速度
+//	@param n 小于等于0表示关闭
+func SetSyncEvery(n int64) {
+	syncEvery.Store(n)
+}
+
+// syncer 支持同步到磁盘的文件
+type syncer interface {
+	Sync() error
+}
+
+// syncWriter 每写入一定字节数同步一次磁盘的Writer
+type syncWriter struct {
+	io.WriteCloser
+	file     syncer
+	every    int64
+	unsynced int64
+}
+
+// withPeriodicSync
+//
+//	@Description: 开启定期同步且文件支持Sync时, 包装为每写入一定字节数同步一次磁盘的Writer
+//	@param w
+//	@return io.WriteCloser
+func withPeriodicSync(w io.WriteCloser) io.WriteCloser {
+	every := syncEvery.Load()
+	file, ok := w.(syncer)
+	if every <= 0 || !ok {
+		return w
+	}
+	return &syncWriter{WriteCloser: w, file: file, every: every}
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.unsynced += int64(n)
+	if err == nil && w.unsynced >= w.every {
+		w.unsynced = 0
+		err = w.file.Sync()
+	}
+	return n, err
+}
+
+// progressWriter 写入.part文件并定期同步到磁盘后更新进度文件
+type progressWriter struct {
+	file      *os.File
+	storePath string
+	record    progressRecord
+	lastSave  time.Time
+	// 上次更新进度文件后写入的字节数
+	unsaved int64
+}
+
+// shouldSave
+//
+//	@Description: 判断是否需要同步并更新进度文件, 设置了SetSyncEvery时按字节数, 否则按时间间隔
+//	@receiver w
+//	@return bool
+func (w *progressWriter) shouldSave() bool {
+	if every := syncEvery.Load(); every > 0 {
+		return w.unsaved >= every
+	}
+	return time.Since(w.lastSave) >= progressSaveInterval
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.record.Bytes += int64(n)
+	w.unsaved += int64(n)
+	if err == nil && w.shouldSave() {
+		w.lastSave = time.Now()
+		w.unsaved = 0
+		//先同步数据再记录进度 保证进度文件中的字节数已经写入磁盘
+		if syncErr := w.file.Sync(); syncErr == nil {
+			if saveErr := saveProgress(w.storePath, w.record); saveErr != nil {
+				log.AsmrLog.Error("写入进度文件失败: ", zap.String("error", saveErr.Error()))
+			}
+		}
+	}
+	return n, err
+}
+
+func (w *progressWriter) Close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// rangedChunkSize 分块校验下载的分块大小
+var rangedChunkSize int64 = 8 * 1024 * 1024
+
+// rangedConcurrency 分块校验下载同时下载的分块数
+const rangedConcurrency = 4
+
+// rangedChunkAttempts 单个分块校验失败或下载失败时的最多尝试次数
+const rangedChunkAttempts = 3
+
+// chunkDigest 服务器为分块返回的校验值
+type chunkDigest struct {
+	algorithm string
+	expected  []byte
+	newHash   func() hash.Hash
+}
+
+// parseChunkDigest
+//
+//	@Description: 从分块响应头中获取服务器提供的分块校验值, 支持Content-Digest(RFC 9530)、Content-MD5与x-goog-hash
+//	@param header
+//	@return *chunkDigest 服务器未提供时为nil
+func parseChunkDigest(header http.Header) *chunkDigest {
+	candidates := map[string]string{}
+	for _, value := range header.Values("Content-Digest") {
+		//sha-256=:<base64>:, sha-512=:<base64>:
+		for _, item := range strings.Split(value, ",") {
+			name, encoded, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if ok {
+				candidates[strings.ToLower(name)] = strings.Trim(encoded, ":")
+			}
+		}
+	}
+	for _, value := range header.Values("x-goog-hash") {
+		//crc32c=<base64>,md5=<base64>
+		for _, item := range strings.Split(value, ",") {
+			name, encoded, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if ok {
+				candidates["goog-"+strings.ToLower(name)] = encoded
+			}
+		}
+	}
+	if value := header.Get("Content-MD5"); value != "" {
+		candidates["md5"] = value
+	}
+	algorithms := []struct {
+		name    string
+		newHash func() hash.Hash
+	}{
+		{"sha-512", sha512.New},
+		{"sha-256", sha256.New},
+		{"md5", md5.New},
+		{"goog-md5", md5.New},
+		{"goog-crc32c", func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+	}
+	for _, algorithm := range algorithms {
+		encoded, ok := candidates[algorithm.name]
+		if !ok {
+			continue
+		}
+		expected, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(expected) != algorithm.newHash().Size() {
+			continue
+		}
+		return &chunkDigest{algorithm: algorithm.name, expected: expected, newHash: algorithm.newHash}
+	}
+	return nil
+}
+
+// downloadRangedVerified
+//
+//	@Description: 多连接分块下载到本地文件, 服务器为分块提供校验值时校验每个分块, 不一致时只重新下载该分块
+//	@param ctx
+//	@param path 下载保存的(.part)文件
+//	@param fileUrl
+//	@param headers
+//	@param size 文件大小 小于等于0时通过HEAD请求获取
+//	@return error 无法获取文件大小或服务器不支持分块下载时包装了ErrRangeNotSupported
+func downloadRangedVerified(ctx context.Context, path string, fileUrl string, headers map[string]string, size int64) (err error) {
+	defer func() {
+		err = classifyIOError(path, fileUrl, err)
+	}()
+	if size <= 0 {
+		size = ContentLength(fileUrl, headers)
+	}
+	if size <= 0 {
+		return fmt.Errorf("%w: 无法获取文件大小 %s", ErrRangeNotSupported, fileUrl)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, FileMode())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	starts := make(chan int64)
+	//各分块必须来自同一版本的源文件
+	validator := &rangeValidator{}
+	var wg sync.WaitGroup
+	for i := 0; i < rangedConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range starts {
+				end := min(start+rangedChunkSize, size) - 1
+				if err := fetchVerifiedChunk(ctx, f, fileUrl, headers, validator, start, end); err != nil {
+					cancel(err)
+				}
+			}
+		}()
+	}
+	for start := int64(0); start < size && ctx.Err() == nil; start += rangedChunkSize {
+		select {
+		case starts <- start:
+		case <-ctx.Done():
+		}
+	}
+	close(starts)
+	wg.Wait()
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// fetchVerifiedChunk
+//
+//	@Description: 下载一个分块并写入文件, 校验失败或下载失败时重试该分块
+//	@param ctx
+//	@param f
+//	@param fileUrl
+//	@param headers
+//	@param validator
+//	@param start
+//	@param end 包含
+//	@return error
+func fetchVerifiedChunk(ctx context.Context, f *os.File, fileUrl string, headers map[string]string, validator *rangeValidator, start int64, end int64) error {
+	var err error
+	for attempt := 1; attempt <= rangedChunkAttempts; attempt++ {
+		var chunk []byte
+		chunk, err = fetchChunk(ctx, fileUrl, headers, validator, start, end)
+		if err == nil {
+			_, err = f.WriteAt(chunk, start)
+			return err
+		}
+		if ctx.Err() != nil || errors.Is(err, ErrRangeNotSupported) || errors.Is(err, ErrRemoteChanged) || isPermanentFailure(err) {
+			return err
+		}
+		log.AsmrLog.Warn(fmt.Sprintf("分块%d-%d下载失败(第%d次), 重新下载该分块", start, end, attempt), zap.String("error", err.Error()))
+	}
+	return err
+}
+
+// fetchChunk
+//
+//	@Description: 下载一个分块, 服务器提供校验值时校验分块内容
+//	@param ctx
+//	@param fileUrl
+//	@param headers
+//	@param validator 确认各分块来自同一版本的源文件
+//	@param start
+//	@param end 包含
+//	@return []byte
+//	@return error 校验失败时包装了ErrChecksumMismatch, 源文件已变化时包装了ErrRemoteChanged
+func fetchChunk(ctx context.Context, fileUrl string, headers map[string]string, validator *rangeValidator, start int64, end int64) ([]byte, error) {
+	req, err := NewRequest(ctx, "GET", fileUrl)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	ifRange := validator.ifRange()
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+	client := Client.Get().(*http.Client)
+	defer Client.Put(client)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		if err := validator.observe(fileUrl, resp.Header); err != nil {
+			return nil, err
+		}
+	case resp.StatusCode == http.StatusOK && ifRange != "":
+		return nil, fmt.Errorf("%w: %s", ErrRemoteChanged, fileUrl)
+	case resp.StatusCode == http.StatusOK:
+		return nil, fmt.Errorf("%w: %s", ErrRangeNotSupported, fileUrl)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, &DownloadError{Kind: ErrThrottled, URL: fileUrl, StatusCode: resp.StatusCode, Err: fmt.Errorf("分块%d-%d被限流", start, end)}
+	default:
+		if err := permanentStatusError(fileUrl, resp.StatusCode, nil, nil); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("下载%s分块%d-%d失败, 状态码: %d", fileUrl, start, end, resp.StatusCode)
+	}
+	want := end - start + 1
+	chunk, err := io.ReadAll(io.LimitReader(resp.Body, want+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(chunk)) != want {
+		return nil, &DownloadError{Kind: ErrSizeMismatch, URL: fileUrl, Err: fmt.Errorf("分块%d-%d预期%d字节, 实际%d字节", start, end, want, len(chunk))}
+	}
+	if digest := parseChunkDigest(resp.Header); digest != nil {
+		h := digest.newHash()
+		h.Write(chunk)
+		if actual := h.Sum(nil); !bytes.Equal(actual, digest.expected) {
+			return nil, fmt.Errorf("%w: 分块%d-%d %s 预期%s, 实际%s", ErrChecksumMismatch, start, end, digest.algorithm,
+				base64.StdEncoding.EncodeToString(digest.expected), base64.StdEncoding.EncodeToString(actual))
+		}
+	}
+	return chunk, nil
+}
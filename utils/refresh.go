@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// ErrURLExpired 下载链接已失效(服务器返回403)
+var ErrURLExpired = errors.New("下载链接已失效")
+
+// maxURLRefresh 单个文件最多刷新下载链接的次数
+const maxURLRefresh = 3
+
+// maxResumeFailures 没有任何进展时最多连续续传失败的次数
+const maxResumeFailures = 3
+
+// downloadWithRefresh
+//
+//	@Description: 单连接下载到part文件, 链接失效时调用refresh获取新链接, 中断时按Range从已下载的位置继续,
+//	续传时使用If-Range确认源文件没有变化, 已变化时清空part文件重新下载
+//	@param ctx
+//	@param part
+//	@param fileUrl
+//	@param refresh
+//	@return error
+func downloadWithRefresh(ctx context.Context, part string, fileUrl string, refresh func(oldURL string) (string, error)) error {
+	out, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE|os.O_TRUNC, FileMode())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	trackCloser(ctx, out)
+
+	var offset int64
+	refreshed := 0
+	failures := 0
+	validator := &rangeValidator{}
+	for {
+		n, err := downloadValidatedRange(ctx, fileUrl, offset, -1, validator, out)
+		offset += n
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if errors.Is(err, ErrRemoteChanged) {
+			//已下载的部分属于旧文件 不能继续追加
+			failures++
+			if failures >= maxResumeFailures {
+				return err
+			}
+			log.AsmrLog.Warn("源文件已变化, 重新下载: ", zap.String("info", part), zap.String("error", err.Error()))
+			if err := restartPart(out); err != nil {
+				return err
+			}
+			offset = 0
+			validator = &rangeValidator{}
+			continue
+		}
+		if errors.Is(err, ErrURLExpired) {
+			if refreshed >= maxURLRefresh {
+				return fmt.Errorf("刷新下载链接%d次后仍然失效: %w", refreshed, err)
+			}
+			refreshed++
+			newURL, refreshErr := refresh(fileUrl)
+			if refreshErr != nil {
+				return fmt.Errorf("刷新下载链接失败: %w", refreshErr)
+			}
+			log.AsmrLog.Info("下载链接已失效, 使用新链接继续下载: ", zap.String("info", part), zap.Int64("offset", offset))
+			fileUrl = newURL
+			continue
+		}
+		if n > 0 {
+			failures = 0
+		} else {
+			failures++
+		}
+		if failures >= maxResumeFailures || errors.Is(err, ErrRangeNotSupported) {
+			return err
+		}
+		log.AsmrLog.Info("下载中断, 从已下载的位置继续: ", zap.String("info", part), zap.Int64("offset", offset), zap.String("error", err.Error()))
+	}
+}
+
+// restartPart
+//
+//	@Description: 清空part文件以便重新下载
+//	@param out
+//	@return error
+func restartPart(out *os.File) error {
+	if err := out.Truncate(0); err != nil {
+		return err
+	}
+	_, err := out.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,297 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 内置的进度显示方式
+const (
+	RendererSilent = "silent"
+	RendererBar    = "bar"
+	RendererJSON   = "json"
+)
+
+// FileProgress
+//
+//	@Description: 单个文件的下载进度
+type FileProgress struct {
+	URL  string `json:"url"`
+	Path string `json:"path"`
+	// 已下载的字节数
+	Bytes int64 `json:"bytes"`
+	// 文件大小 未知时为0
+	Total int64 `json:"total"`
+}
+
+// ProgressRenderer
+//
+//	@Description: 下载进度显示, 由下载任务调用, 实现需要并发安全
+type ProgressRenderer interface {
+	// FileStarted 文件开始下载
+	FileStarted(p FileProgress)
+	// FileProgress 文件下载进度更新
+	FileProgress(p FileProgress)
+	// FileFinished 文件下载结束
+	FileFinished(p FileProgress, status JobStatus, err error)
+	// Batch 批量下载整体进度更新
+	Batch(s BatchProgressSnapshot)
+}
+
+// silentRenderer 不显示进度
+type silentRenderer struct{}
+
+func (silentRenderer) FileStarted(FileProgress)                    {}
+func (silentRenderer) FileProgress(FileProgress)                   {}
+func (silentRenderer) FileFinished(FileProgress, JobStatus, error) {}
+func (silentRenderer) Batch(BatchProgressSnapshot)                 {}
+
+// rendererHolder 保存接口值 使atomic.Value中的类型一致
+type rendererHolder struct {
+	renderer ProgressRenderer
+}
+
+// activeRenderer 当前使用的进度显示
+var activeRenderer atomic.Value
+
+func init() {
+	activeRenderer.Store(rendererHolder{renderer: silentRenderer{}})
+}
+
+// SetProgressRenderer
+//
+//	@Description: 设置下载进度显示, 传入nil时不显示
+//	@param renderer
+func SetProgressRenderer(renderer ProgressRenderer) {
+	if renderer == nil {
+		renderer = silentRenderer{}
+	}
+	activeRenderer.Store(rendererHolder{renderer: renderer})
+}
+
+// currentRenderer
+//
+//	@Description: 获取当前使用的进度显示
+//	@return ProgressRenderer
+func currentRenderer() ProgressRenderer {
+	return activeRenderer.Load().(rendererHolder).renderer
+}
+
+// renderingEnabled
+//
+//	@Description: 是否设置了进度显示, 未设置时不统计单个文件的进度
+//	@return bool
+func renderingEnabled() bool {
+	_, silent := currentRenderer().(silentRenderer)
+	return !silent
+}
+
+// NewProgressRenderer
+//
+//	@Description: 按名称创建内置的进度显示
+//	@param name silent(或为空)、bar 或 json
+//	@param w 输出位置
+//	@return ProgressRenderer
+//	@return error
+func NewProgressRenderer(name string, w io.Writer) (ProgressRenderer, error) {
+	switch name {
+	case "", RendererSilent:
+		return silentRenderer{}, nil
+	case RendererBar:
+		return NewBarRenderer(w), nil
+	case RendererJSON:
+		return NewJSONRenderer(w), nil
+	}
+	return nil, fmt.Errorf("不支持的进度显示方式: %s, 只支持silent、bar或json", name)
+}
+
+// barRendererInterval 进度条两次刷新的最小间隔
+const barRendererInterval = 200 * time.Millisecond
+
+// barWidth 进度条宽度
+const barWidth = 30
+
+// BarRenderer
+//
+//	@Description: 终端进度条, 在一行中显示整体进度与最近更新的文件, 下载失败的文件单独输出一行
+type BarRenderer struct {
+	mu        sync.Mutex
+	w         io.Writer
+	batch     BatchProgressSnapshot
+	file      FileProgress
+	lastDraw  time.Time
+	lineWidth int
+}
+
+// NewBarRenderer
+//
+//	@Description: 创建终端进度条
+//	@param w 一般为os.Stderr
+//	@return *BarRenderer
+func NewBarRenderer(w io.Writer) *BarRenderer {
+	return &BarRenderer{w: w}
+}
+
+func (r *BarRenderer) FileStarted(p FileProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.file = p
+	r.draw(false)
+}
+
+func (r *BarRenderer) FileProgress(p FileProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.file = p
+	r.draw(false)
+}
+
+func (r *BarRenderer) FileFinished(p FileProgress, status JobStatus, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if status == JobFailed && err != nil {
+		r.clear()
+		_, _ = fmt.Fprintf(r.w, "下载失败: %s: %s\n", filepath.Base(p.Path), err.Error())
+	}
+	r.draw(true)
+}
+
+func (r *BarRenderer) Batch(s BatchProgressSnapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batch = s
+	r.draw(true)
+}
+
+// clear
+//
+//	@Description: 清除当前行, 调用方需持有锁
+//	@receiver r
+func (r *BarRenderer) clear() {
+	if r.lineWidth > 0 {
+		_, _ = fmt.Fprintf(r.w, "\r%s\r", strings.Repeat(" ", r.lineWidth))
+		r.lineWidth = 0
+	}
+}
+
+// draw
+//
+//	@Description: 刷新进度条, 调用方需持有锁
+//	@receiver r
+//	@param force 忽略刷新间隔
+func (r *BarRenderer) draw(force bool) {
+	if !force && time.Since(r.lastDraw) < barRendererInterval {
+		return
+	}
+	r.lastDraw = time.Now()
+	percent := r.batch.BytesPercent()
+	if percent < 0 && r.batch.TotalFiles > 0 {
+		percent = float64(r.batch.DoneFiles) * 100 / float64(r.batch.TotalFiles)
+	}
+	filled := 0
+	if percent > 0 {
+		filled = min(int(percent*barWidth/100), barWidth)
+	}
+	line := fmt.Sprintf("[%s%s] %6.2f%% %d/%d", strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled),
+		max(percent, 0), r.batch.DoneFiles, r.batch.TotalFiles)
+	if r.file.Path != "" {
+		line += " " + filepath.Base(r.file.Path)
+		if r.file.Total > 0 {
+			line += fmt.Sprintf(" %.1f%%", float64(r.file.Bytes)*100/float64(r.file.Total))
+		}
+	}
+	padding := ""
+	if width := len([]rune(line)); width < r.lineWidth {
+		padding = strings.Repeat(" ", r.lineWidth-width)
+	} else {
+		r.lineWidth = width
+	}
+	_, _ = fmt.Fprint(r.w, "\r"+line+padding)
+}
+
+// JSONRenderer
+//
+//	@Description: 每个进度事件输出一行JSON, 便于其他程序解析
+type JSONRenderer struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// progressEvent JSONRenderer输出的一行
+type progressEvent struct {
+	Event  string                 `json:"event"`
+	Time   time.Time              `json:"time"`
+	File   *FileProgress          `json:"file,omitempty"`
+	Status JobStatus              `json:"status,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+	Batch  *BatchProgressSnapshot `json:"batch,omitempty"`
+}
+
+// NewJSONRenderer
+//
+//	@Description: 创建JSON行格式的进度输出
+//	@param w
+//	@return *JSONRenderer
+func NewJSONRenderer(w io.Writer) *JSONRenderer {
+	return &JSONRenderer{encoder: json.NewEncoder(w)}
+}
+
+// emit
+//
+//	@Description: 输出一个进度事件
+//	@receiver r
+//	@param event
+func (r *JSONRenderer) emit(event progressEvent) {
+	event.Time = time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_ = r.encoder.Encode(event)
+}
+
+func (r *JSONRenderer) FileStarted(p FileProgress) {
+	r.emit(progressEvent{Event: "file_started", File: &p})
+}
+
+func (r *JSONRenderer) FileProgress(p FileProgress) {
+	r.emit(progressEvent{Event: "file_progress", File: &p})
+}
+
+func (r *JSONRenderer) FileFinished(p FileProgress, status JobStatus, err error) {
+	event := progressEvent{Event: "file_finished", File: &p, Status: status}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	r.emit(event)
+}
+
+func (r *JSONRenderer) Batch(s BatchProgressSnapshot) {
+	r.emit(progressEvent{Event: "batch", Batch: &s})
+}
+
+// fileProgressInterval 单连接下载时两次进度更新的最小间隔
+const fileProgressInterval = 500 * time.Millisecond
+
+// renderReader
+//
+//	@Description: 读取响应体时向进度显示报告单个文件的进度
+type renderReader struct {
+	io.Reader
+	progress FileProgress
+	last     time.Time
+}
+
+func (r *renderReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.progress.Bytes += int64(n)
+	if time.Since(r.last) >= fileProgressInterval || err == io.EOF {
+		r.last = time.Now()
+		currentRenderer().FileProgress(r.progress)
+	}
+	return n, err
+}
@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// 下载失败分类
+const (
+	FailurePermanent      = "permanent"
+	FailureChecksum       = "checksum"
+	FailureEmpty          = "empty"
+	FailureURLExpired     = "url_expired"
+	FailureRangeIgnored   = "range_not_supported"
+	FailureTimeout        = "timeout"
+	FailureDeadline       = "deadline"
+	FailureThrottled      = "throttled"
+	FailureSizeMismatch   = "size_mismatch"
+	FailureDiskFull       = "disk_full"
+	FailureUnwritable     = "unwritable"
+	FailureErrorBody      = "error_body"
+	FailureNetwork        = "network"
+	FailureRetryExhausted = "retry_exhausted"
+	FailureOther          = "other"
+)
+
+// runStats 本次运行的统计, 用于生成运行报告
+var runStats = struct {
+	sync.Mutex
+	start    time.Time
+	failures map[string]int64
+	batch    *BatchSummary
+	fix      *FixResult
+	// 运行报告保存目录 为空时不保存
+	reportDir string
+}{start: time.Now(), failures: map[string]int64{}}
+
+// BatchSummary
+//
+//	@Description: 批量下载结果汇总
+type BatchSummary struct {
+	Done     int `json:"done"`
+	Skipped  int `json:"skipped"`
+	Existing int `json:"existing"`
+	Canceled int `json:"canceled"`
+	Failed   int `json:"failed"`
+	Deferred int `json:"deferred"`
+}
+
+// RunReport
+//
+//	@Description: 运行报告, 用于记录镜像站的健康状况
+type RunReport struct {
+	// 当前批量下载进度 未设置时为nil
+	Progress *BatchProgressSnapshot `json:"progress,omitempty"`
+	// 最近一次DownloadBatch的结果
+	Batch *BatchSummary `json:"batch,omitempty"`
+	// 最近一次修复下载失败文件的结果
+	Fix               *FixResult          `json:"fix,omitempty"`
+	Hosts             map[string]HostStat `json:"hosts"`
+	FailureCategories map[string]int64    `json:"failure_categories"`
+	// 所有主机累计接收的字节数
+	TotalBytes     int64   `json:"total_bytes"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// 平均下载速度 字节/秒
+	AverageThroughput float64 `json:"average_throughput"`
+}
+
+// SetRunReportDir
+//
+//	@Description: 设置运行报告保存目录, DownloadBatch与FixBrokenDownloadFile结束时写入run-report-<时间>.json, 传入空字符串关闭
+//	@param dir
+func SetRunReportDir(dir string) {
+	runStats.Lock()
+	defer runStats.Unlock()
+	runStats.reportDir = dir
+}
+
+// ResetRunStats
+//
+//	@Description: 清空运行统计(包括主机统计)并重新开始计时
+func ResetRunStats() {
+	runStats.Lock()
+	runStats.start = time.Now()
+	runStats.failures = map[string]int64{}
+	runStats.batch = nil
+	runStats.fix = nil
+	runStats.Unlock()
+	ResetHostStats()
+}
+
+// isFailureCategory
+//
+//	@Description: 判断是否为支持的下载失败分类
+//	@param category
+//	@return bool
+func isFailureCategory(category string) bool {
+	switch category {
+	case FailurePermanent, FailureChecksum, FailureEmpty, FailureURLExpired, FailureRangeIgnored, FailureTimeout,
+		FailureDeadline, FailureThrottled, FailureSizeMismatch, FailureDiskFull, FailureUnwritable, FailureErrorBody, FailureNetwork,
+		FailureRetryExhausted, FailureOther:
+		return true
+	}
+	return false
+}
+
+// failureCategory
+//
+//	@Description: 获取下载错误的分类
+//	@param err
+//	@return string
+func failureCategory(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrPermanentFailure):
+		return FailurePermanent
+	case errors.Is(err, ErrChecksumMismatch):
+		return FailureChecksum
+	case errors.Is(err, ErrEmptyFile):
+		return FailureEmpty
+	case errors.Is(err, ErrURLExpired):
+		return FailureURLExpired
+	case errors.Is(err, ErrRangeNotSupported):
+		return FailureRangeIgnored
+	case errors.Is(err, ErrFileDeadline):
+		return FailureDeadline
+	case errors.Is(err, ErrThrottled):
+		return FailureThrottled
+	case errors.Is(err, ErrSizeMismatch):
+		return FailureSizeMismatch
+	case errors.Is(err, ErrDiskFull):
+		return FailureDiskFull
+	case errors.Is(err, ErrUnwritable):
+		return FailureUnwritable
+	case errors.Is(err, ErrErrorBody):
+		return FailureErrorBody
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return FailureTimeout
+	case errors.As(err, &netErr):
+		return FailureNetwork
+	}
+	return FailureOther
+}
+
+// recordFailureCategory
+//
+//	@Description: 按分类统计下载失败次数
+//	@param category
+func recordFailureCategory(category string) {
+	runStats.Lock()
+	defer runStats.Unlock()
+	runStats.failures[category]++
+}
+
+// BuildRunReport
+//
+//	@Description: 生成当前的运行报告
+//	@return RunReport
+func BuildRunReport() RunReport {
+	report := RunReport{Hosts: HostStats(), FailureCategories: map[string]int64{}}
+	if progress := currentBatchProgress(); progress != nil {
+		snapshot := progress.Snapshot()
+		report.Progress = &snapshot
+	}
+	runStats.Lock()
+	for category, n := range runStats.failures {
+		report.FailureCategories[category] = n
+	}
+	report.Batch = runStats.batch
+	report.Fix = runStats.fix
+	elapsed := time.Since(runStats.start)
+	runStats.Unlock()
+	for _, stat := range report.Hosts {
+		report.TotalBytes += stat.Bytes
+	}
+	report.ElapsedSeconds = elapsed.Seconds()
+	if report.ElapsedSeconds > 0 {
+		report.AverageThroughput = float64(report.TotalBytes) / report.ElapsedSeconds
+	}
+	return report
+}
+
+// WriteRunReport
+//
+//	@Description: 将运行报告以JSON格式写入w
+//	@param w
+//	@return error
+func WriteRunReport(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(BuildRunReport())
+}
+
+// finishRun
+//
+//	@Description: 记录批量下载或修复的结果, 设置了运行报告目录时写入运行报告, 设置了带宽采样CSV时写入带宽采样
+//	@param batch
+//	@param fix
+func finishRun(batch *BatchSummary, fix *FixResult) {
+	runStats.Lock()
+	if batch != nil {
+		runStats.batch = batch
+	}
+	if fix != nil {
+		runStats.fix = fix
+	}
+	dir := runStats.reportDir
+	runStats.Unlock()
+	saveBandwidthCSV()
+	if dir == "" {
+		return
+	}
+	if err := saveRunReport(dir); err != nil {
+		log.AsmrLog.Error("写入运行报告失败: ", zap.String("error", err.Error()))
+	}
+}
+
+// saveRunReport
+//
+//	@Description: 将运行报告写入dir下的run-report-<时间>.json
+//	@param dir
+//	@return error
+func saveRunReport(dir string) error {
+	if err := os.MkdirAll(dir, DirMode()); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("run-report-%s.json", time.Now().Format("20060102-150405.000")))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteRunReport(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.AsmrLog.Info("运行报告已写入: ", zap.String("info", path))
+	return nil
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/melbahja/got"
+)
+
+// requestDefaults 所有下载请求共用的默认请求头
+var requestDefaults = struct {
+	sync.RWMutex
+	userAgent     string
+	headers       map[string]string
+	authorization string
+}{userAgent: DefaultUserAgent}
+
+// SetRequestDefaults
+//
+//	@Description: 设置所有下载请求共用的User-Agent、额外请求头和Authorization
+//	@param userAgent 为空时使用DefaultUserAgent
+//	@param headers 额外请求头
+//	@param authorization 为空时不发送Authorization
+func SetRequestDefaults(userAgent string, headers map[string]string, authorization string) {
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	copied := make(map[string]string, len(headers))
+	for key, value := range headers {
+		copied[key] = value
+	}
+	requestDefaults.Lock()
+	defer requestDefaults.Unlock()
+	requestDefaults.userAgent = userAgent
+	requestDefaults.headers = copied
+	requestDefaults.authorization = authorization
+}
+
+// defaultHeaders
+//
+//	@Description: 获取默认请求头
+//	@return map[string]string
+func defaultHeaders() map[string]string {
+	requestDefaults.RLock()
+	defer requestDefaults.RUnlock()
+	result := make(map[string]string, len(requestDefaults.headers)+2)
+	result["User-Agent"] = requestDefaults.userAgent
+	for key, value := range requestDefaults.headers {
+		result[key] = value
+	}
+	if requestDefaults.authorization != "" {
+		result["Authorization"] = requestDefaults.authorization
+	}
+	return result
+}
+
+// NewRequest
+//
+//	@Description: 创建请求并设置默认的User-Agent、额外请求头和Authorization, 所有下载相关的请求都应使用该方法创建
+//	@param ctx
+//	@param method
+//	@param url
+//	@return *http.Request
+//	@return error
+func NewRequest(ctx context.Context, method string, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range defaultHeaders() {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+// gotHeaders
+//
+//	@Description: 将默认请求头与额外请求头转换为got使用的请求头, 额外请求头优先
+//	@param headers
+//	@return []got.GotHeader
+func gotHeaders(headers map[string]string) []got.GotHeader {
+	merged := defaultHeaders()
+	for key, value := range headers {
+		merged[key] = value
+	}
+	result := make([]got.GotHeader, 0, len(merged))
+	for key, value := range merged {
+		result = append(result, got.GotHeader{Key: key, Value: value})
+	}
+	return result
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// resumeCopyVerifyBytes 续传复制前比较已复制部分开头与结尾的字节数
+const resumeCopyVerifyBytes = 1024 * 1024
+
+// ResumableCopyFile
+//
+//	@Description: 可续传的复制文件, 目标文件比源文件小且已复制部分与源文件一致时从断点继续复制, 否则重新复制
+//	@param src
+//	@param dst
+//	@return error
+func ResumableCopyFile(src, dst string) error {
+	return ResumableCopyFileOpts(src, dst, DefaultCopyOptions)
+}
+
+// ResumableCopyFileOpts
+//
+//	@Description: 按选项可续传地复制文件, 用于复制GB级文件时中断后下次运行继续复制. 非本地存储时重新复制
+//	@param src
+//	@param dst
+//	@param opts
+//	@return err
+func ResumableCopyFileOpts(src, dst string, opts CopyOptions) (err error) {
+	if !isLocalStorage() {
+		return CopyFileOpts(src, dst, opts)
+	}
+	si, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	di, err := os.Stat(dst)
+	if err != nil || !di.Mode().IsRegular() || di.Size() == 0 || di.Size() > si.Size() {
+		return CopyFileOpts(src, dst, opts)
+	}
+	offset := di.Size()
+	match, err := copyPrefixMatches(src, dst, offset)
+	if err != nil {
+		return err
+	}
+	if !match {
+		log.AsmrLog.Info("已复制部分与源文件不一致, 重新复制", zap.String("file", dst))
+		return CopyFileOpts(src, dst, opts)
+	}
+	if offset < si.Size() {
+		log.AsmrLog.Info(fmt.Sprintf("从%d字节处继续复制", offset), zap.String("file", dst))
+		if err := appendFrom(src, dst, offset, opts); err != nil {
+			return err
+		}
+	}
+	if opts.PreserveMode {
+		if err := os.Chmod(dst, si.Mode()); err != nil {
+			return err
+		}
+	}
+	if opts.PreserveTimes {
+		if err := os.Chtimes(dst, si.ModTime(), si.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendFrom
+//
+//	@Description: 从offset处将源文件剩余部分追加到目标文件
+//	@param src
+//	@param dst
+//	@param offset
+//	@param opts
+//	@return err
+func appendFrom(src, dst string, offset int64, opts CopyOptions) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY, FileMode())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := out.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if opts.BufferSize > 0 {
+		_, err = io.CopyBuffer(out, in, make([]byte, opts.BufferSize))
+	} else {
+		_, err = io.Copy(out, in)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Sync {
+		return out.Sync()
+	}
+	return nil
+}
+
+// copyPrefixMatches
+//
+//	@Description: 比较目标文件与源文件前size字节的开头与结尾部分是否一致
+//	@param src
+//	@param dst
+//	@param size 目标文件大小
+//	@return bool
+//	@return error
+func copyPrefixMatches(src, dst string, size int64) (bool, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	out, err := os.Open(dst)
+	if err != nil {
+		return false, err
+	}
+	defer out.Close()
+	window := min(size, resumeCopyVerifyBytes)
+	for _, offset := range []int64{0, size - window} {
+		a := make([]byte, window)
+		b := make([]byte, window)
+		if _, err := in.ReadAt(a, offset); err != nil {
+			return false, err
+		}
+		if _, err := out.ReadAt(b, offset); err != nil {
+			return false, err
+		}
+		if !bytes.Equal(a, b) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
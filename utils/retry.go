@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// RetryPredicate
+//
+//	@Description: 判断下载失败是否可以重试
+//	@param statusCode 响应状态码, 没有收到响应时为0
+//	@param body 错误响应的前retryBodyLimit字节, 无法获取时为nil
+//	@param err 下载错误, 仅根据状态码判断时为nil
+//	@return bool 返回false时按永久失败处理, 不再重试
+type RetryPredicate func(statusCode int, body []byte, err error) bool
+
+// retryBodyLimit 传给RetryPredicate的错误响应最大字节数
+const retryBodyLimit = 4096
+
+// retryPredicate 当前使用的RetryPredicate
+var retryPredicate atomic.Value
+
+// DefaultRetryPredicate
+//
+//	@Description: 默认的RetryPredicate, 404/410不重试, 其他失败(包括1015限流和Content-Length错误)均重试
+//	@param statusCode
+//	@param body
+//	@param err
+//	@return bool
+func DefaultRetryPredicate(statusCode int, body []byte, err error) bool {
+	return statusCode != http.StatusNotFound && statusCode != http.StatusGone
+}
+
+// SetRetryPredicate
+//
+//	@Description: 设置判断下载失败是否可以重试的方法, 用于处理镜像站的特殊错误, 传入nil恢复DefaultRetryPredicate
+//	@param predicate
+func SetRetryPredicate(predicate RetryPredicate) {
+	if predicate == nil {
+		predicate = DefaultRetryPredicate
+	}
+	retryPredicate.Store(predicate)
+}
+
+// isRetryable
+//
+//	@Description: 使用当前的RetryPredicate判断下载失败是否可以重试
+//	@param statusCode
+//	@param body
+//	@param err
+//	@return bool
+func isRetryable(statusCode int, body []byte, err error) bool {
+	predicate, ok := retryPredicate.Load().(RetryPredicate)
+	if !ok {
+		predicate = DefaultRetryPredicate
+	}
+	return predicate(statusCode, body, err)
+}
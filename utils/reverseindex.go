@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"asmr-downloader/log"
+)
+
+// reverseIndexBaseURL 重建来源链接时使用的API地址
+var reverseIndexBaseURL atomic.Value
+
+// defaultReverseIndexBaseURL 未设置API地址时使用的默认地址
+const defaultReverseIndexBaseURL = "https://api.asmr.one"
+
+// SetReverseIndexBaseURL
+//
+//	@Description: 设置ReverseIndex重建来源链接时使用的API地址
+//	@param baseURL 为空时使用https://api.asmr.one
+func SetReverseIndexBaseURL(baseURL string) {
+	reverseIndexBaseURL.Store(strings.TrimRight(baseURL, "/"))
+}
+
+// ReverseEntry
+//
+//	@Description: 从磁盘重建的文件来源
+type ReverseEntry struct {
+	Path string `json:"path"`
+	// 来源链接: 下载记录中的原始链接, 或形如<API地址>/api/tracks/<作品ID>#<音轨相对路径>的音轨链接
+	URL string `json:"url"`
+	// RJ号 无法确定时为空
+	WorkID string `json:"work_id,omitempty"`
+	// 是否来自下载记录(否则为按目录结构推断)
+	FromRecord bool `json:"from_record"`
+	// 推断结果是否存在歧义, 存在歧义时Candidates为所有可能的来源
+	Ambiguous  bool     `json:"ambiguous"`
+	Candidates []string `json:"candidates,omitempty"`
+}
+
+// ReverseIndex
+//
+//	@Description: 遍历下载目录, 尽可能重建文件路径到来源链接的映射, 用于丢失清单后重新校验或重新下载. 存在歧义的结果会输出警告日志
+//	@param root 下载目录
+//	@return map[string]string key为文件路径, value为来源链接
+//	@return error
+func ReverseIndex(root string) (map[string]string, error) {
+	entries, err := ReverseIndexEntries(root)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if entry.Ambiguous {
+			log.AsmrLog.Warn(fmt.Sprintf("文件: %s 的来源存在歧义: %s", entry.Path, strings.Join(entry.Candidates, ", ")))
+		}
+		if entry.URL != "" {
+			result[entry.Path] = entry.URL
+		}
+	}
+	return result, nil
+}
+
+// ReverseIndexEntries
+//
+//	@Description: 遍历下载目录重建每个文件的来源. 优先使用下载失败记录、已存在文件记录和下载清单中的原始链接,
+//	否则按RJ号目录结构推断音轨链接. 路径可能由扩展名路由、文件类型目录或同名文件编号生成时标记为存在歧义
+//	@param root 下载目录
+//	@return []ReverseEntry
+//	@return error
+func ReverseIndexEntries(root string) ([]ReverseEntry, error) {
+	recorded := recordedSources()
+	var entries []ReverseEntry
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || isDownloadArtifact(d.Name()) {
+			return nil
+		}
+		entries = append(entries, reverseEntry(root, path, recorded[NormalizePath(path)]))
+		return nil
+	})
+	return entries, err
+}
+
+// isDownloadArtifact
+//
+//	@Description: 判断是否为下载过程中产生的附属文件
+//	@param name
+//	@return bool
+func isDownloadArtifact(name string) bool {
+	for _, suffix := range []string{PartFileSuffix, ProgressFileSuffix, LockFileSuffix, ".failed"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordedSources
+//
+//	@Description: 从下载记录与下载清单中收集文件路径对应的原始链接
+//	@return map[string][]string key为规范化后的文件路径
+func recordedSources() map[string][]string {
+	result := map[string][]string{}
+	add := func(path string, fileUrl string) {
+		key := NormalizePath(path)
+		for _, existing := range result[key] {
+			if existing == fileUrl {
+				return
+			}
+		}
+		result[key] = append(result[key], fileUrl)
+	}
+	for _, name := range []string{FailedDownloadFileName, PermanentlyFailedFileName, SkippedExistingFileName} {
+		_ = iterateFailedLines(name, func(line string) error {
+			if record, err := ParseFailedRecord(line); err == nil {
+				add(record.Path, record.URL)
+			}
+			return nil
+		})
+	}
+	checksum, _ := checksumManifest.Load().(string)
+	conditionalGet.Lock()
+	conditional := conditionalGet.manifest
+	conditionalGet.Unlock()
+	for _, manifest := range []string{checksum, conditional} {
+		if manifest == "" {
+			continue
+		}
+		records, _ := ReadManifest(manifest)
+		for _, entry := range records {
+			add(entry.Path, entry.URL)
+		}
+	}
+	return result
+}
+
+// reverseEntry
+//
+//	@Description: 重建单个文件的来源
+//	@param root
+//	@param path
+//	@param recorded 下载记录中该文件的原始链接
+//	@return ReverseEntry
+func reverseEntry(root string, path string, recorded []string) ReverseEntry {
+	entry := ReverseEntry{Path: path}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		rel = path
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	//最后一个RJ号目录为作品目录
+	workIndex := -1
+	//作品目录名为"RJ"+作品ID, 链接中使用目录中的作品ID
+	var workID string
+	for i, part := range parts[:len(parts)-1] {
+		if code, err := NormalizeRJCode(part); err == nil && strings.HasPrefix(strings.ToUpper(part), "RJ") {
+			entry.WorkID = code
+			workID = part[2:]
+			workIndex = i
+		}
+	}
+	if len(recorded) > 0 {
+		entry.FromRecord = true
+		entry.URL = recorded[len(recorded)-1]
+		if len(recorded) > 1 {
+			entry.Ambiguous = true
+			entry.Candidates = recorded
+		}
+		return entry
+	}
+	if workIndex < 0 {
+		//不在作品目录中 无法推断
+		entry.Ambiguous = true
+		return entry
+	}
+	trackPath := parts[workIndex+1:]
+	candidates := [][]string{trackPath}
+	name := trackPath[len(trackPath)-1]
+	//文件所在目录可能由扩展名路由或文件类型规则生成
+	if len(trackPath) > 1 {
+		parent := trackPath[len(trackPath)-2]
+		generated := kindRuleFor(DetectAssetKind(name)).Folder
+		if route, ok := routeForFile(name); ok {
+			generated = route
+		}
+		if generated != "" && PathsEqual(parent, filepath.Base(generated)) {
+			withoutDir := append(append([]string{}, trackPath[:len(trackPath)-2]...), name)
+			candidates = append(candidates, withoutDir)
+		}
+	}
+	//文件名可能由同名文件编号生成: <name> (n).ext
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if i := strings.LastIndex(base, " ("); i > 0 && strings.HasSuffix(base, ")") {
+		original := base[:i] + ext
+		for _, candidate := range append([][]string{}, candidates...) {
+			renamed := append(append([]string{}, candidate[:len(candidate)-1]...), original)
+			candidates = append(candidates, renamed)
+		}
+	}
+	baseURL, _ := reverseIndexBaseURL.Load().(string)
+	if baseURL == "" {
+		baseURL = defaultReverseIndexBaseURL
+	}
+	for _, candidate := range candidates {
+		escaped := make([]string, len(candidate))
+		for i, part := range candidate {
+			escaped[i] = url.PathEscape(part)
+		}
+		trackURL := fmt.Sprintf("%s/api/tracks/%s#%s", baseURL, workID, strings.Join(escaped, "/"))
+		entry.Candidates = append(entry.Candidates, trackURL)
+	}
+	entry.URL = entry.Candidates[0]
+	if len(entry.Candidates) > 1 {
+		entry.Ambiguous = true
+	} else {
+		entry.Candidates = nil
+	}
+	return entry
+}
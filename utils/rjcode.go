@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// rjCodePattern RJ号格式: 可选的RJ前缀加数字
+var rjCodePattern = regexp.MustCompile(`^(?i:RJ)?(\d{1,8})$`)
+
+// NormalizeRJCode
+//
+//	@Description: 校验并规范化RJ号, 不足6位的数字补零到6位, 7位的数字补零到8位(新RJ号为8位)
+//	@param rjCode RJ号, 可省略RJ前缀
+//	@return string 形如RJ123456或RJ01234567
+//	@return error
+func NormalizeRJCode(rjCode string) (string, error) {
+	matches := rjCodePattern.FindStringSubmatch(strings.TrimSpace(rjCode))
+	if matches == nil {
+		return "", fmt.Errorf("无效的RJ号: %s", rjCode)
+	}
+	digits := matches[1]
+	width := 6
+	if len(digits) > 6 {
+		width = 8
+	}
+	return "RJ" + strings.Repeat("0", width-len(digits)) + digits, nil
+}
+
+// RJFolderPath
+//
+//	@Description: 以RJ号作为顶层目录构建作品保存路径, 其余路径片段会被清理
+//	@param base 下载根目录
+//	@param rjCode RJ号
+//	@param rest 作品目录下的子路径片段
+//	@return string RJ号无效时返回空字符串
+func RJFolderPath(base string, rjCode string, rest ...string) string {
+	code, err := NormalizeRJCode(rjCode)
+	if err != nil {
+		return ""
+	}
+	parts := make([]string, 0, len(rest)+2)
+	parts = append(parts, base, code)
+	for _, part := range rest {
+		parts = append(parts, SanitizeFileName(part))
+	}
+	return filepath.Join(parts...)
+}
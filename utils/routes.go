@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// extensionRoutes 按扩展名将文件保存到下载目录下的子目录
+var extensionRoutes = struct {
+	sync.RWMutex
+	// key为小写且带.的扩展名
+	routes map[string]string
+}{routes: map[string]string{}}
+
+// SetExtensionRoutes
+//
+//	@Description: 设置按扩展名路由的子目录, 例如{"mp3": "audio", ".jpg": "images"}, 未匹配的扩展名使用默认路径. 优先于文件类型规则中的目录
+//	@param routes key为扩展名(大小写不敏感, 可省略.), value为下载目录下的相对子目录
+//	@return error 子目录为绝对路径或包含..时返回错误
+func SetExtensionRoutes(routes map[string]string) error {
+	normalized := make(map[string]string, len(routes))
+	for ext, dir := range routes {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" || dir == "" {
+			continue
+		}
+		if err := ValidateSubDir(dir); err != nil {
+			return fmt.Errorf("扩展名%s的路由有误: %w", ext, err)
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		normalized[ext] = dir
+	}
+	extensionRoutes.Lock()
+	defer extensionRoutes.Unlock()
+	extensionRoutes.routes = normalized
+	return nil
+}
+
+// ValidateSubDir
+//
+//	@Description: 检查子目录是否为下载目录下的相对路径, 避免文件被保存到下载目录之外
+//	@param dir
+//	@return error
+func ValidateSubDir(dir string) error {
+	if filepath.IsAbs(dir) || strings.HasPrefix(dir, "/") || strings.HasPrefix(dir, "\\") || filepath.VolumeName(dir) != "" {
+		return fmt.Errorf("子目录%s不能为绝对路径", dir)
+	}
+	for _, segment := range strings.FieldsFunc(dir, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return fmt.Errorf("子目录%s不能包含..", dir)
+		}
+	}
+	return nil
+}
+
+// routeForFile
+//
+//	@Description: 获取文件名对应的路由子目录
+//	@param fileName
+//	@return string
+//	@return bool
+func routeForFile(fileName string) (string, bool) {
+	extensionRoutes.RLock()
+	defer extensionRoutes.RUnlock()
+	dir, ok := extensionRoutes.routes[strings.ToLower(filepath.Ext(fileName))]
+	return dir, ok
+}
+
+// StorePathFor
+//
+//	@Description: 计算文件的最终保存路径, 依次应用扩展名路由与文件类型规则中的目录
+//	@param dir 默认下载目录
+//	@param fileName
+//	@param kind 为空时按文件扩展名推断
+//	@return string
+func StorePathFor(dir string, fileName string, kind AssetKind) string {
+	if kind == "" {
+		kind = DetectAssetKind(fileName)
+	}
+	subDir := kindRuleFor(kind).Folder
+	if route, ok := routeForFile(fileName); ok {
+		subDir = route
+	}
+	return filepath.Join(dir, subDir, fileName)
+}
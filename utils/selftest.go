@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// selfTestTimeout 自检中每项网络检查的超时时间
+const selfTestTimeout = 15 * time.Second
+
+// TestProxy
+//
+//	@Description: 按当前Transport的代理设置(默认为环境变量HTTP_PROXY/HTTPS_PROXY/NO_PROXY)确定访问targetURL使用的代理,
+//	先测试能否连接代理, 再通过代理请求targetURL. 收到任意HTTP响应即视为连通
+//	@param ctx
+//	@param targetURL
+//	@return proxyUsed 使用的代理(已隐藏密码), 直连时为空
+//	@return err
+func TestProxy(ctx context.Context, targetURL string) (proxyUsed string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	req, err := NewRequest(ctx, http.MethodHead, targetURL)
+	if err != nil {
+		return "", err
+	}
+	transport := sharedTransport.Load()
+	if transport.Proxy != nil {
+		proxyURL, err := transport.Proxy(req)
+		if err != nil {
+			return "", fmt.Errorf("代理设置有误: %w", err)
+		}
+		if proxyURL != nil {
+			proxyUsed = proxyURL.Redacted()
+			addr := proxyURL.Host
+			if proxyURL.Port() == "" {
+				port := "80"
+				switch proxyURL.Scheme {
+				case "https":
+					port = "443"
+				case "socks5", "socks5h":
+					port = "1080"
+				}
+				addr = net.JoinHostPort(proxyURL.Hostname(), port)
+			}
+			dialer := &net.Dialer{}
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return proxyUsed, fmt.Errorf("无法连接代理%s: %w", proxyUsed, err)
+			}
+			_ = conn.Close()
+		}
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		if proxyUsed != "" {
+			return proxyUsed, fmt.Errorf("通过代理%s访问%s失败: %w", proxyUsed, targetURL, err)
+		}
+		return "", fmt.Errorf("访问%s失败: %w", targetURL, err)
+	}
+	_ = resp.Body.Close()
+	return proxyUsed, nil
+}
+
+// SelfTest
+//
+//	@Description: 开始下载前检查网络环境(代理是否可用), 尽早发现配置问题
+//	@param ctx
+//	@param targetURL 用于测试连通性的地址, 一般为站点API地址
+//	@return error
+func SelfTest(ctx context.Context, targetURL string) error {
+	proxyUsed, err := TestProxy(ctx, targetURL)
+	if err != nil {
+		return err
+	}
+	if proxyUsed != "" {
+		log.AsmrLog.Info("代理连接正常: ", zap.String("info", proxyUsed))
+	}
+	return nil
+}
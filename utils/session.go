@@ -0,0 +1,353 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSessionMiss 回放会话中没有与请求匹配的记录
+var ErrSessionMiss = errors.New("回放会话中没有匹配的请求")
+
+// sessionRedactedHeaders 记录请求头时隐去的敏感请求头, SetRequestDefaults设置的额外请求头同样隐去
+var sessionRedactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// SessionEntry 会话文件中的一次请求记录, 会话文件每行一条
+type SessionEntry struct {
+	// 请求发出的顺序, 回放时同一请求的多条记录按该顺序依次返回
+	Seq int64 `json:"seq"`
+	// 请求发出的时间
+	Time string `json:"time"`
+	// 请求方法
+	Method string `json:"method"`
+	// 请求url, 原样记录(包括签名等查询参数)
+	URL string `json:"url"`
+	// 请求头, 不包含Authorization、Cookie、Proxy-Authorization与SetRequestDefaults设置的额外请求头
+	RequestHeader http.Header `json:"request_header,omitempty"`
+	// 响应状态码, 请求失败时为0
+	StatusCode int `json:"status_code,omitempty"`
+	// 响应头, 不包含Set-Cookie
+	Header http.Header `json:"header,omitempty"`
+	// 实际读取到的响应体的sha256
+	BodySHA256 string `json:"body_sha256,omitempty"`
+	// 实际读取到的响应体字节数
+	BodySize int64 `json:"body_size"`
+	// 响应体是否保存在会话文件旁的<会话文件>.bodies/<sha256>, 超过大小限制的响应体只记录sha256
+	BodySaved bool `json:"body_saved,omitempty"`
+	// 请求失败时的错误信息
+	Error string `json:"error,omitempty"`
+}
+
+// sessionBodyDir
+//
+//	@Description: 获取会话文件对应的响应体目录
+//	@param path 会话文件
+//	@return string
+func sessionBodyDir(path string) string {
+	return path + ".bodies"
+}
+
+// sessionKey
+//
+//	@Description: 回放时匹配请求使用的key, 同一url的不同Range视为不同请求
+//	@param method
+//	@param rawURL
+//	@param rangeHeader
+//	@return string
+func sessionKey(method string, rawURL string, rangeHeader string) string {
+	return method + " " + rawURL + " " + rangeHeader
+}
+
+// sessionRecorder
+//
+//	@Description: 将经过的请求与响应写入会话文件
+type sessionRecorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	bodyDir string
+	// 保存响应体的大小上限
+	maxBodySize int64
+	seq         atomic.Int64
+}
+
+// activeRecorder 当前的会话记录器 未开启记录时为nil
+var activeRecorder atomic.Pointer[sessionRecorder]
+
+// activeReplay 当前的回放会话 未开启回放时为nil
+var activeReplay atomic.Pointer[sessionReplay]
+
+// SetSessionRecord
+//
+//	@Description: 记录之后所有请求的url、请求头、响应状态码、响应头与响应体sha256到会话文件, 用于离线复现限流、文件损坏等偶发问题.
+//	凭据类请求头与Set-Cookie不会记录, 但url原样记录, 其中的签名等查询参数需要分享前自行处理.
+//	不超过maxBodySize的响应体按sha256保存在<会话文件>.bodies目录下(相同内容只保存一份), 回放时只能返回已保存的响应体
+//	@param path 会话文件, 已存在时追加, 为空时停止记录
+//	@param maxBodySize 保存响应体的大小上限, 小于等于0时只记录sha256
+//	@return error
+func SetSessionRecord(path string, maxBodySize int64) error {
+	var recorder *sessionRecorder
+	if path != "" {
+		bodyDir := sessionBodyDir(path)
+		if err := os.MkdirAll(bodyDir, 0755); err != nil {
+			return fmt.Errorf("创建会话响应体目录%s失败: %w", bodyDir, err)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("打开会话文件%s失败: %w", path, err)
+		}
+		recorder = &sessionRecorder{file: f, bodyDir: bodyDir, maxBodySize: max(maxBodySize, 0)}
+	}
+	if old := activeRecorder.Swap(recorder); old != nil {
+		old.mu.Lock()
+		defer old.mu.Unlock()
+		return old.file.Close()
+	}
+	return nil
+}
+
+// write
+//
+//	@Description: 写入一条会话记录
+//	@receiver r
+//	@param entry
+func (r *sessionRecorder) write(entry SessionEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, _ = r.file.Write(append(line, '\n'))
+}
+
+// roundTrip
+//
+//	@Description: 执行请求并记录, 响应体在关闭时写入会话文件
+//	@receiver r
+//	@param next
+//	@param req
+//	@return *http.Response
+//	@return error
+func (r *sessionRecorder) roundTrip(next http.RoundTripper, req *http.Request) (*http.Response, error) {
+	entry := SessionEntry{
+		Seq:           r.seq.Add(1),
+		Time:          time.Now().Format("2006-01-02 15:04:05"),
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		RequestHeader: req.Header.Clone(),
+	}
+	for _, key := range sessionRedactedHeaders {
+		entry.RequestHeader.Del(key)
+	}
+	for key := range defaultHeaders() {
+		if key != "User-Agent" {
+			entry.RequestHeader.Del(key)
+		}
+	}
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		entry.Error = err.Error()
+		r.write(entry)
+		return resp, err
+	}
+	entry.StatusCode = resp.StatusCode
+	entry.Header = resp.Header.Clone()
+	entry.Header.Del("Set-Cookie")
+	body := &recordedBody{ReadCloser: resp.Body, recorder: r, entry: entry, hash: sha256.New()}
+	if r.maxBodySize > 0 {
+		//无法创建临时文件时只记录sha256
+		body.tmp, _ = os.CreateTemp(r.bodyDir, "body-*.tmp")
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// recordedBody
+//
+//	@Description: 读取时同时计算sha256并保存内容(不超过大小上限时)的响应体, 关闭时写入会话记录
+type recordedBody struct {
+	io.ReadCloser
+	recorder *sessionRecorder
+	entry    SessionEntry
+	tmp      *os.File
+	hash     hash.Hash
+	once     sync.Once
+}
+
+func (b *recordedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		_, _ = b.hash.Write(p[:n])
+		b.entry.BodySize += int64(n)
+		if b.tmp != nil && b.entry.BodySize > b.recorder.maxBodySize {
+			//超过大小上限 不再保存
+			b.discardTmp()
+		}
+		if b.tmp != nil {
+			_, _ = b.tmp.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// discardTmp
+//
+//	@Description: 删除保存响应体的临时文件
+//	@receiver b
+func (b *recordedBody) discardTmp() {
+	_ = b.tmp.Close()
+	_ = os.Remove(b.tmp.Name())
+	b.tmp = nil
+}
+
+func (b *recordedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.entry.BodySHA256 = hex.EncodeToString(b.hash.Sum(nil))
+		if b.tmp != nil {
+			_ = b.tmp.Close()
+			if renameErr := os.Rename(b.tmp.Name(), filepath.Join(b.recorder.bodyDir, b.entry.BodySHA256)); renameErr == nil {
+				b.entry.BodySaved = true
+			} else {
+				_ = os.Remove(b.tmp.Name())
+			}
+		}
+		b.recorder.write(b.entry)
+	})
+	return err
+}
+
+// sessionReplay
+//
+//	@Description: 按会话文件返回记录的响应, 不发出任何网络请求
+type sessionReplay struct {
+	mu      sync.Mutex
+	bodyDir string
+	// key为sessionKey, value为按发出顺序排列的记录
+	entries map[string][]SessionEntry
+	// 各key已返回的记录数
+	served map[string]int
+}
+
+// ReplaySession
+//
+//	@Description: 加载会话文件, 之后的请求不再访问网络, 而是按记录的顺序返回相同请求的响应, 用于离线复现问题.
+//	同一请求的记录用完后重复返回最后一条, 没有记录的请求返回ErrSessionMiss
+//	@param path 由SetSessionRecord记录的会话文件, 为空时停止回放
+//	@return error
+func ReplaySession(path string) error {
+	if path == "" {
+		activeReplay.Store(nil)
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("打开会话文件%s失败: %w", path, err)
+	}
+	defer f.Close()
+	replay := &sessionReplay{bodyDir: sessionBodyDir(path), entries: map[string][]SessionEntry{}, served: map[string]int{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry SessionEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("会话文件%s第%d行格式有误: %w", path, line, err)
+		}
+		key := sessionKey(entry.Method, entry.URL, entry.RequestHeader.Get("Range"))
+		replay.entries[key] = append(replay.entries[key], entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("读取会话文件%s失败: %w", path, err)
+	}
+	//响应体关闭时才写入记录 按请求发出的顺序重新排列
+	for _, entries := range replay.entries {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	}
+	activeReplay.Store(replay)
+	return nil
+}
+
+func (s *sessionReplay) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := sessionKey(req.Method, req.URL.String(), req.Header.Get("Range"))
+	s.mu.Lock()
+	entries := s.entries[key]
+	if len(entries) == 0 {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s %s", ErrSessionMiss, req.Method, req.URL.String())
+	}
+	entry := entries[min(s.served[key], len(entries)-1)]
+	s.served[key]++
+	s.mu.Unlock()
+	if entry.Error != "" {
+		return nil, errors.New(entry.Error)
+	}
+	if entry.BodySize > 0 && !entry.BodySaved {
+		return nil, fmt.Errorf("%w: %s %s 的响应体超过大小限制未保存", ErrSessionMiss, req.Method, req.URL.String())
+	}
+	var body io.ReadCloser = http.NoBody
+	if entry.BodySaved {
+		f, err := os.Open(filepath.Join(s.bodyDir, entry.BodySHA256))
+		if err != nil {
+			return nil, fmt.Errorf("读取会话响应体失败: %w", err)
+		}
+		body = f
+	}
+	contentLength := int64(-1)
+	if value, err := strconv.ParseInt(entry.Header.Get("Content-Length"), 10, 64); err == nil {
+		contentLength = value
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Header.Clone(),
+		Body:          body,
+		ContentLength: contentLength,
+		Request:       req,
+	}, nil
+}
+
+// recordRoundTripper
+//
+//	@Description: 将请求交给next执行并写入会话记录
+type recordRoundTripper struct {
+	recorder *sessionRecorder
+	next     http.RoundTripper
+}
+
+func (rt recordRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return rt.recorder.roundTrip(rt.next, req)
+}
+
+// sessionRoundTripper
+//
+//	@Description: 按当前的会话设置包装Transport: 回放时替换为回放会话, 记录时包装为记录器
+//	@param rt
+//	@return http.RoundTripper
+func sessionRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	if replay := activeReplay.Load(); replay != nil {
+		return replay
+	}
+	if recorder := activeRecorder.Load(); recorder != nil {
+		return recordRoundTripper{recorder: recorder, next: rt}
+	}
+	return rt
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// SkippedExistingFileName 因文件已存在而跳过下载的记录
+const SkippedExistingFileName = "skipped-existing.txt"
+
+// logSkippedExisting 是否将因文件已存在而跳过的下载写入skipped-existing.txt 默认关闭
+var logSkippedExisting atomic.Bool
+
+// skippedExistingLock 保护skipped-existing.txt的并发写入
+var skippedExistingLock sync.Mutex
+
+// SetSkippedExistingLog
+//
+//	@Description: 设置是否将因文件已存在而跳过的下载记录到skipped-existing.txt, 用于确认增量下载中有多少文件是新内容
+//	@param enabled
+func SetSkippedExistingLog(enabled bool) {
+	logSkippedExisting.Store(enabled)
+}
+
+// recordSkippedExisting
+//
+//	@Description: 记录因文件已存在而跳过的下载, 与下载失败和匹配跳过规则的文件分开统计
+//	@param storePath
+//	@param fileUrl
+func recordSkippedExisting(storePath string, fileUrl string) {
+	log.AsmrLog.Info(fmt.Sprintf("文件: %s 已存在, 跳过下载...", storePath))
+	if !logSkippedExisting.Load() {
+		return
+	}
+	skippedExistingLock.Lock()
+	defer skippedExistingLock.Unlock()
+	f, err := os.OpenFile(SkippedExistingFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.AsmrLog.Error("写入已存在文件记录失败: ", zap.String("error", err.Error()))
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(GetCurrentDateTime() + "|" + storePath + "|" + fileUrl + "\n"); err != nil {
+		log.AsmrLog.Error("写入已存在文件记录失败: ", zap.String("error", err.Error()))
+	}
+}
+
+// SkipIfExists
+//
+//	@Description: 文件已存在且不需要重新验证(清单中没有ETag/Last-Modified记录)时记录并返回true, 调用方跳过下载
+//	@param storePath
+//	@param fileUrl
+//	@return bool
+func SkipIfExists(storePath string, fileUrl string) bool {
+	if !FileOrDirExists(storePath) || NeedsRevalidation(fileUrl) {
+		return false
+	}
+	recordSkippedExisting(storePath, fileUrl)
+	if progress := currentBatchProgress(); progress != nil {
+		progress.AddFile()
+		progress.FileExisting()
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// stagingDir 作品下载暂存目录 为空时直接下载到最终目录
+var stagingDir atomic.Value
+
+func init() {
+	stagingDir.Store("")
+}
+
+// SetStagingDir
+//
+//	@Description: 设置作品下载暂存目录, 作品先下载到暂存目录, 校验完整后通过FinalizeWork移动到最终目录,
+//	避免媒体服务器扫描到未下载完成的作品. 传入空字符串关闭
+//	@param dir
+//	@return error
+func SetStagingDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, DirMode()); err != nil {
+			return fmt.Errorf("创建暂存目录%s失败: %w", dir, err)
+		}
+	}
+	stagingDir.Store(dir)
+	return nil
+}
+
+// StagingEnabled
+//
+//	@Description: 是否设置了作品下载暂存目录
+//	@return bool
+func StagingEnabled() bool {
+	return stagingDir.Load().(string) != ""
+}
+
+// StagingPathFor
+//
+//	@Description: 获取作品在暂存目录中的下载路径, 同一个最终目录总是得到相同的暂存路径
+//	@param workDir 作品的最终目录
+//	@return string 未设置暂存目录时返回workDir
+func StagingPathFor(workDir string) string {
+	dir := stagingDir.Load().(string)
+	if dir == "" {
+		return workDir
+	}
+	//不同下载目录中可能存在同名作品 使用最终目录的哈希区分
+	sum := sha1.Sum([]byte(filepath.Clean(workDir)))
+	return filepath.Join(dir, hex.EncodeToString(sum[:4])+"-"+filepath.Base(workDir))
+}
+
+// FinalizeWork
+//
+//	@Description: 将暂存目录中下载完成的作品移动到最终目录. 最终目录不存在时整体移动(跨文件系统时先复制到最终目录旁的临时目录再重命名),
+//	已存在时逐个文件移动并覆盖同名文件. 调用前应通过VerifyWorkComplete确认作品完整
+//	@param workDir 作品的最终目录
+//	@return error
+func FinalizeWork(workDir string) error {
+	staged := StagingPathFor(workDir)
+	if staged == workDir {
+		return nil
+	}
+	if _, err := os.Stat(staged); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(workDir), DirMode()); err != nil {
+		return err
+	}
+	if _, err := os.Stat(workDir); os.IsNotExist(err) {
+		if err := os.Rename(staged, workDir); err == nil {
+			log.AsmrLog.Info("作品已移动到最终目录: ", zap.String("info", workDir))
+			return nil
+		}
+		//跨文件系统 先完整复制到同一文件系统的临时目录 再通过重命名一次性出现在最终目录
+		tmp := workDir + ".staging"
+		_ = os.RemoveAll(tmp)
+		if err := moveTree(staged, tmp); err != nil {
+			return fmt.Errorf("移动作品%s失败: %w", workDir, err)
+		}
+		if err := os.Rename(tmp, workDir); err != nil {
+			return fmt.Errorf("移动作品%s失败: %w", workDir, err)
+		}
+	} else if err := moveTree(staged, workDir); err != nil {
+		return fmt.Errorf("移动作品%s失败: %w", workDir, err)
+	}
+	if err := os.RemoveAll(staged); err != nil {
+		log.AsmrLog.Warn("删除暂存目录失败: ", zap.String("error", err.Error()))
+	}
+	log.AsmrLog.Info("作品已移动到最终目录: ", zap.String("info", workDir))
+	return nil
+}
+
+// moveTree
+//
+//	@Description: 将src目录中的文件逐个移动到dst目录的相同位置, 无法重命名时复制后删除源文件
+//	@param src
+//	@param dst
+//	@return error
+func moveTree(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, DirMode())
+		}
+		if err := os.Rename(path, target); err == nil {
+			return nil
+		}
+		//跨文件系统时复制为.part文件后重命名 保证目标位置不会出现不完整的文件
+		staging := target + PartFileSuffix
+		if err := ResumableCopyFile(path, staging); err != nil {
+			return err
+		}
+		if err := os.Rename(staging, target); err != nil {
+			_ = os.Remove(staging)
+			return err
+		}
+		return os.Remove(path)
+	})
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// DownloadToStdout
+//
+//	@Description: 下载文件并直接写入标准输出(不创建文件), 用于通过管道交给ffprobe、播放器等工具. 调用后控制台日志改为输出到标准错误
+//	@param ctx
+//	@param url
+//	@return error
+func DownloadToStdout(ctx context.Context, url string) error {
+	log.SetConsoleOutput(os.Stderr)
+	return DownloadToWriter(ctx, url, os.Stdout)
+}
+
+// DownloadToWriter
+//
+//	@Description: 下载文件并写入w, 使用默认的User-Agent与请求头, 中断时按Range从已写入的位置继续(If-Range确认源文件未变化)
+//	@param ctx
+//	@param url
+//	@param w
+//	@return error
+func DownloadToWriter(ctx context.Context, url string, w io.Writer) error {
+	out := &writeErrorRecorder{w: w}
+	var offset int64
+	failures := 0
+	validator := &rangeValidator{}
+	for {
+		if err := waitIfPaused(ctx); err != nil {
+			return err
+		}
+		n, err := downloadValidatedRange(ctx, url, offset, -1, validator, out)
+		offset += n
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if out.err != nil {
+			//写入失败(如管道另一端已关闭)时重试没有意义
+			return out.err
+		}
+		if n > 0 {
+			failures = 0
+		} else {
+			failures++
+		}
+		//已写出的内容无法撤回 服务器不支持续传时只能失败
+		if failures >= maxResumeFailures || errors.Is(err, ErrRangeNotSupported) || errors.Is(err, ErrRemoteChanged) {
+			return err
+		}
+		log.AsmrLog.Info("下载中断, 从已下载的位置继续: ", zap.String("info", url), zap.Int64("offset", offset), zap.String("error", err.Error()))
+	}
+}
+
+// writeErrorRecorder
+//
+//	@Description: 记录写入错误, 用于区分下载失败与写入失败
+type writeErrorRecorder struct {
+	w   io.Writer
+	err error
+}
+
+func (r *writeErrorRecorder) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
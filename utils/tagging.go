@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bogem/id3v2/v2"
+	"github.com/go-flac/flacvorbis"
+	flac "github.com/go-flac/go-flac"
+)
+
+// ErrUnsupportedTagFormat 不支持写入标签的文件格式
+var ErrUnsupportedTagFormat = errors.New("不支持写入标签的文件格式")
+
+// AudioTags
+//
+//	@Description: 写入音频文件的标签, 为空的字段不写入(保留文件中原有的值)
+type AudioTags struct {
+	// 标题
+	Title string `json:"title,omitempty"`
+	// 艺术家(声优)
+	Artist string `json:"artist,omitempty"`
+	// 专辑(作品名)
+	Album string `json:"album,omitempty"`
+	// 音轨号 0表示不写入
+	Track int `json:"track,omitempty"`
+}
+
+// TagAudioFile
+//
+//	@Description: 写入音频文件的标签, MP3写入ID3v2标签, FLAC写入Vorbis注释, 保留文件中的其他标签(如封面)
+//	@param path
+//	@param tags
+//	@return error 其他格式返回ErrUnsupportedTagFormat, 原有ID3标签无法无损改写时返回ErrUnsupportedID3Tag(不修改文件)
+func TagAudioFile(path string, tags AudioTags) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		return rewriteHeader(path, func(r *bufio.Reader) ([]byte, error) { return buildID3v2(r, tags) })
+	case ".flac":
+		return rewriteHeader(path, func(r *bufio.Reader) ([]byte, error) { return buildFLACMetadata(r, tags) })
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedTagFormat, path)
+}
+
+// rewriteHeader
+//
+//	@Description: 替换文件开头的元数据部分, 写入临时文件后替换原文件
+//	@param path
+//	@param build 读取原有的元数据并返回新的元数据, 返回后r位于音频数据开头
+//	@return err
+func rewriteHeader(path string, build func(r *bufio.Reader) ([]byte, error)) (err error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	reader := bufio.NewReader(in)
+	header, err := build(reader)
+	if err != nil {
+		return fmt.Errorf("写入标签失败: %s, %w", path, err)
+	}
+	tmp := path + ".tagging"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FileMode())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+	}()
+	if _, err = out.Write(header); err == nil {
+		_, err = io.Copy(out, reader)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	_ = in.Close()
+	return os.Rename(tmp, path)
+}
+
+// ErrUnsupportedID3Tag 原有ID3标签使用了unsynchronisation、扩展头、帧压缩等特性或为v2.2, 为避免丢失原有标签不写入
+var ErrUnsupportedID3Tag = errors.New("原有ID3标签格式不支持改写")
+
+// buildID3v2
+//
+//	@Description: 生成新的ID3v2标签, 保留原有标签(v2.3/v2.4)中的其他帧(如APIC封面), 没有原有标签时新建v2.3标签
+//	@param r 位于文件开头, 返回后跳过原有的标签
+//	@param tags
+//	@return []byte
+//	@return error 原有标签无法无损改写时返回ErrUnsupportedID3Tag, 文件不做修改
+func buildID3v2(r *bufio.Reader, tags AudioTags) ([]byte, error) {
+	tag := id3v2.NewEmptyTag()
+	tag.SetVersion(3)
+	tag.SetDefaultEncoding(id3v2.EncodingUTF16)
+	if head, err := r.Peek(10); err == nil && string(head[:3]) == "ID3" {
+		size := int(syncsafe(head[6:10])) + 10
+		if head[5]&0x10 != 0 {
+			//标签末尾的footer
+			size += 10
+		}
+		raw := make([]byte, size)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, err
+		}
+		if !id3TagRewritable(raw) {
+			return nil, ErrUnsupportedID3Tag
+		}
+		tag, err = id3v2.ParseReader(bytes.NewReader(raw), id3v2.Options{Parse: true})
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUnsupportedID3Tag, err)
+		}
+	}
+	if tags.Title != "" {
+		tag.SetTitle(tags.Title)
+	}
+	if tags.Artist != "" {
+		tag.SetArtist(tags.Artist)
+	}
+	if tags.Album != "" {
+		tag.SetAlbum(tags.Album)
+	}
+	if tags.Track > 0 {
+		tag.AddTextFrame(tag.CommonID("Track number/Position in set"), tag.DefaultEncoding(), strconv.Itoa(tags.Track))
+	}
+	var buf bytes.Buffer
+	if _, err := tag.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// id3TagRewritable
+//
+//	@Description: 判断原有ID3标签能否被解析后无损写回: 只支持v2.3/v2.4, 且标签与各帧都没有使用unsynchronisation、扩展头、压缩、加密等特性
+//	@param raw 完整的原有标签
+//	@return bool
+func id3TagRewritable(raw []byte) bool {
+	version, flags := raw[3], raw[5]
+	if (version != 3 && version != 4) || flags&0xc0 != 0 {
+		return false
+	}
+	//v2.3的帧格式标志为压缩、加密、分组 v2.4还包括unsynchronisation与数据长度
+	formatFlags := byte(0xe0)
+	if version == 4 {
+		formatFlags = 0x4f
+	}
+	body := raw[10 : 10+int(syncsafe(raw[6:10]))]
+	for len(body) >= 10 && body[0] != 0 {
+		size := int(binary.BigEndian.Uint32(body[4:8]))
+		if version == 4 {
+			size = int(syncsafe(body[4:8]))
+		}
+		if body[9]&formatFlags != 0 || size < 0 || 10+size > len(body) {
+			return false
+		}
+		body = body[10+size:]
+	}
+	return true
+}
+
+// syncsafe
+//
+//	@Description: 解析ID3v2的syncsafe整数(每个字节只使用低7位)
+//	@param b
+//	@return uint32
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+// buildFLACMetadata
+//
+//	@Description: 生成新的FLAC元数据块, 合并原有的Vorbis注释(覆盖设置的字段), 其他元数据块(如封面)保持不变
+//	@param r 位于文件开头, 返回后位于音频帧开头
+//	@param tags
+//	@return []byte
+//	@return error
+func buildFLACMetadata(r *bufio.Reader, tags AudioTags) ([]byte, error) {
+	//只读取元数据 音频帧由rewriteHeader直接复制
+	file, err := flac.ParseMetadata(r)
+	if err != nil {
+		return nil, fmt.Errorf("不是有效的FLAC文件: %w", err)
+	}
+	if len(file.Meta) == 0 || file.Meta[0].Type != flac.StreamInfo {
+		return nil, fmt.Errorf("FLAC文件缺少STREAMINFO")
+	}
+	comment := flacvorbis.New()
+	index := -1
+	for i, block := range file.Meta {
+		if block.Type == flac.VorbisComment {
+			if comment, err = flacvorbis.ParseFromMetaDataBlock(*block); err != nil {
+				return nil, err
+			}
+			index = i
+			break
+		}
+	}
+	fields := map[string]string{"TITLE": tags.Title, "ARTIST": tags.Artist, "ALBUM": tags.Album}
+	if tags.Track > 0 {
+		fields["TRACKNUMBER"] = strconv.Itoa(tags.Track)
+	}
+	kept := comment.Comments[:0]
+	for _, item := range comment.Comments {
+		key, _, _ := strings.Cut(item, "=")
+		if fields[strings.ToUpper(key)] == "" {
+			kept = append(kept, item)
+		}
+	}
+	comment.Comments = kept
+	for _, key := range []string{"TITLE", "ARTIST", "ALBUM", "TRACKNUMBER"} {
+		if value := fields[key]; value != "" {
+			if err := comment.Add(key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	block := comment.Marshal()
+	if index >= 0 {
+		file.Meta[index] = &block
+	} else {
+		//Vorbis注释放在STREAMINFO之后
+		file.Meta = append(file.Meta[:1], append([]*flac.MetaDataBlock{&block}, file.Meta[1:]...)...)
+	}
+	return file.Marshal(), nil
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"asmr-downloader/log"
+)
+
+// traceRequests 是否记录请求各阶段耗时
+var traceRequests atomic.Bool
+
+// SetTraceRequests
+//
+//	@Description: 设置是否记录每个请求的DNS解析、建立连接、TLS握手和首字节耗时(debug级别日志), 用于排查下载慢或被限流的问题
+//	@param enabled
+func SetTraceRequests(enabled bool) {
+	traceRequests.Store(enabled)
+}
+
+// requestTrace
+//
+//	@Description: 单个请求各阶段的时间点
+type requestTrace struct {
+	mu         sync.Mutex
+	start      time.Time
+	dnsStart   time.Time
+	dns        time.Duration
+	connStart  time.Time
+	connect    time.Duration
+	tlsStart   time.Time
+	tls        time.Duration
+	reused     bool
+	firstByte  time.Duration
+	remoteAddr string
+}
+
+// withRequestTrace
+//
+//	@Description: 为请求安装httptrace.ClientTrace
+//	@param req
+//	@return *http.Request
+//	@return *requestTrace
+func withRequestTrace(req *http.Request) (*http.Request, *requestTrace) {
+	t := &requestTrace{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.dns = time.Since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			t.connStart = time.Now()
+			t.mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			t.connect = time.Since(t.connStart)
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			t.tls = time.Since(t.tlsStart)
+			t.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.reused = info.Reused
+			if info.Conn != nil {
+				t.remoteAddr = info.Conn.RemoteAddr().String()
+			}
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.firstByte = time.Since(t.start)
+			t.mu.Unlock()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+// log
+//
+//	@Description: 输出请求各阶段耗时
+//	@receiver t
+//	@param req
+func (t *requestTrace) log(req *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	log.AsmrLog.Debug("请求耗时: ",
+		zap.String("method", req.Method),
+		zap.String("url", req.URL.String()),
+		zap.String("remote", t.remoteAddr),
+		zap.Bool("reused", t.reused),
+		zap.Duration("dns", t.dns),
+		zap.Duration("connect", t.connect),
+		zap.Duration("tls", t.tls),
+		zap.Duration("first_byte", t.firstByte),
+	)
+}
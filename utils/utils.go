@@ -2,15 +2,24 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/melbahja/got"
@@ -23,6 +32,9 @@ import (
 
 const FailedDownloadFileName = "failed-download.txt"
 
+// DefaultUserAgent 下载文件时使用的默认User-Agent
+const DefaultUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/136.0.0.0 Safari/537.36"
+
 var FailedDownloadFile *os.File
 
 func init() {
@@ -33,17 +45,410 @@ func init() {
 	FailedDownloadFile = f
 }
 
+// keepFailedArtifacts 是否保留下载失败的文件 默认删除
+var keepFailedArtifacts atomic.Bool
+
+// SetKeepFailedArtifacts
+//
+//	@Description: 设置是否保留下载失败的文件, 开启后失败的文件会重命名为<name>.failed而不是直接删除, 便于排查问题
+//	@param keep
+func SetKeepFailedArtifacts(keep bool) {
+	keepFailedArtifacts.Store(keep)
+}
+
+// discardFailedArtifact
+//
+//	@Description: 清理下载失败的文件碎片, 保留模式下统一重命名为<storePath>.failed(.part文件或临时目录中的文件也会移动到下载目录)
+//	@param artifact 文件碎片路径
+//	@param storePath 文件最终保存路径
+//	@return error
+func discardFailedArtifact(artifact string, storePath string) error {
+	if keepFailedArtifacts.Load() {
+		return finalizePart(artifact, storePath+".failed")
+	}
+	return currentStorage().Remove(artifact)
+}
+
+// FailedRecord
+//
+//	@Description: 下载失败记录, 对应下载失败日志文件中的一行: 时间|文件路径|文件url|错误信息|文件类型|失败分类
+type FailedRecord struct {
+	Time string `json:"time"`
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	// 失败原因 旧格式的记录中没有该字段
+	Error string `json:"error,omitempty"`
+	// 文件类型 旧格式的记录中没有该字段
+	Kind AssetKind `json:"kind,omitempty"`
+	// 失败分类 如FailureThrottled, 旧格式的记录中没有该字段
+	Category string `json:"category,omitempty"`
+}
+
+// ParseFailedRecord
+//
+//	@Description: 解析下载失败日志文件中的一行记录, 支持|分隔与JSON两种格式
+//	@param line
+//	@return FailedRecord
+//	@return error
+func ParseFailedRecord(line string) (FailedRecord, error) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		var record FailedRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil || record.Path == "" || record.URL == "" {
+			return FailedRecord{}, fmt.Errorf("下载失败记录格式有误: %s", line)
+		}
+		return record, nil
+	}
+	fields := strings.Split(line, "|")
+	if len(fields) < 3 {
+		return FailedRecord{}, fmt.Errorf("下载失败记录格式有误: %s", line)
+	}
+	record := FailedRecord{Time: fields[0], Path: fields[1], URL: fields[2]}
+	switch {
+	case len(fields) == 4:
+		record.Error = fields[3]
+	case len(fields) > 5 && isFailureCategory(fields[len(fields)-1]):
+		//文件类型与失败分类固定在最后两列 错误信息中可能包含|
+		record.Error = strings.Join(fields[3:len(fields)-2], "|")
+		record.Kind = AssetKind(fields[len(fields)-2])
+		record.Category = fields[len(fields)-1]
+	case len(fields) > 4:
+		//文件类型固定在最后一列 错误信息中可能包含|
+		record.Error = strings.Join(fields[3:len(fields)-1], "|")
+		record.Kind = AssetKind(fields[len(fields)-1])
+	}
+	return record, nil
+}
+
+// String
+//
+//	@Description: 格式化为下载失败日志文件中的一行(不含换行符)
+//	@receiver r
+//	@return string
+func (r FailedRecord) String() string {
+	line := r.Time + "|" + r.Path + "|" + r.URL
+	if r.Error != "" || r.Kind != "" || r.Category != "" {
+		//错误信息中的换行会破坏按行读取
+		line += "|" + strings.NewReplacer("\r", " ", "\n", " ").Replace(r.Error) + "|" + string(r.Kind)
+	}
+	if r.Category != "" {
+		line += "|" + r.Category
+	}
+	return line
+}
+
+// failedDownloadFileLock 保护下载失败日志文件的并发写入
+var failedDownloadFileLock sync.Mutex
+
+// recordFailedDownload
+//
+//	@Description: 将下载失败记录追加到下载失败日志文件
+//	@param record
+func recordFailedDownload(record FailedRecord) {
+	failedDownloadFileLock.Lock()
+	defer failedDownloadFileLock.Unlock()
+	write := bufio.NewWriter(FailedDownloadFile)
+	_, _ = write.WriteString(record.String() + "\n")
+	//Flush将缓存的文件真正写入到文件中
+	if err := write.Flush(); err != nil {
+		log.AsmrLog.Error("写入下载失败日志文件失败: ", zap.String("error", err.Error()))
+	}
+	if err := rotateFailedLogIfNeeded(); err != nil {
+		log.AsmrLog.Error("下载失败日志文件轮转失败: ", zap.String("error", err.Error()))
+	}
+}
+
+// HTTP协议协商方式
+const (
+	protocolAuto int32 = iota
+	protocolHTTP1
+	protocolHTTP2
+)
+
+// IP协议偏好
+const (
+	IPPreferenceAuto = "auto"
+	IPPreferenceIPv4 = "ipv4"
+	IPPreferenceIPv6 = "ipv6"
+)
+
+// transportSettings
+//
+//	@Description: 共享Transport的配置
+type transportSettings struct {
+	// HTTP协议协商方式
+	protocol int32
+	// IP协议偏好
+	ipPreference string
+	// 代理地址 为nil时使用环境变量HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+	proxy *url.URL
+	// 跳过TLS证书校验
+	insecureSkipVerify bool
+	// 所有主机最多保留的空闲连接数 0表示不限制
+	maxIdleConns int
+	// 每个主机最多保留的空闲连接数 0表示使用默认值2
+	maxIdleConnsPerHost int
+	// 空闲连接保留时间 0表示不限制
+	idleConnTimeout time.Duration
+}
+
+// transportConfig 共享Transport的当前配置, 修改配置与重建Transport在同一把锁内完成, 避免并发修改时旧配置覆盖新配置
+var transportConfig = struct {
+	sync.Mutex
+	settings transportSettings
+}{settings: transportSettings{ipPreference: IPPreferenceAuto}}
+
+// sharedTransport 所有请求共用的Transport, 池中的Client在请求时读取, 修改配置后立即对之后的请求生效
+var sharedTransport atomic.Pointer[http.Transport]
+
+func init() {
+	sharedTransport.Store(newTransport(transportConfig.settings))
+}
+
+// newTransport
+//
+//	@Description: 按配置创建Transport
+//	@param settings
+//	@return *http.Transport
+func newTransport(settings transportSettings) *http.Transport {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{
+			//update tls version,version 12 may cause error on cf worker
+			MaxVersion:         tls.VersionTLS13,
+			InsecureSkipVerify: settings.insecureSkipVerify,
+		},
+		MaxIdleConns:        settings.maxIdleConns,
+		MaxIdleConnsPerHost: settings.maxIdleConnsPerHost,
+		IdleConnTimeout:     settings.idleConnTimeout,
+	}
+	if settings.proxy != nil {
+		transport.Proxy = http.ProxyURL(settings.proxy)
+	}
+	switch settings.protocol {
+	case protocolHTTP1:
+		//非nil的空TLSNextProto会禁用HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case protocolHTTP2:
+		//自定义了TLSClientConfig时需要显式开启HTTP/2
+		transport.ForceAttemptHTTP2 = true
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	switch settings.ipPreference {
+	case IPPreferenceIPv4:
+		transport.DialContext = func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp4", addr)
+		}
+	case IPPreferenceIPv6:
+		transport.DialContext = func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp6", addr)
+		}
+	default:
+		transport.DialContext = dialer.DialContext
+	}
+	return transport
+}
+
+// updateTransport
+//
+//	@Description: 修改共享Transport的配置, 重建Transport并关闭旧Transport的空闲连接
+//	@param update 修改配置 返回false表示配置未变化, 不需要重建
+func updateTransport(update func(settings *transportSettings) bool) {
+	transportConfig.Lock()
+	defer transportConfig.Unlock()
+	if !update(&transportConfig.settings) {
+		return
+	}
+	old := sharedTransport.Swap(newTransport(transportConfig.settings))
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// SetIPPreference
+//
+//	@Description: 设置连接使用的IP协议, 部分镜像的IPv6线路较差时可强制使用IPv4
+//	@param preference auto, ipv4 或 ipv6
+//	@return error
+func SetIPPreference(preference string) error {
+	switch preference {
+	case "":
+		preference = IPPreferenceAuto
+	case IPPreferenceAuto, IPPreferenceIPv4, IPPreferenceIPv6:
+	default:
+		return fmt.Errorf("不支持的IP偏好: %s, 只支持auto、ipv4或ipv6", preference)
+	}
+	updateTransport(func(settings *transportSettings) bool {
+		settings.ipPreference = preference
+		return true
+	})
+	return nil
+}
+
+// SetForceHTTP1
+//
+//	@Description: 强制使用HTTP/1.1, 传入false时恢复默认协商
+//	@param force
+func SetForceHTTP1(force bool) {
+	updateTransport(func(settings *transportSettings) bool {
+		if force {
+			settings.protocol = protocolHTTP1
+		} else if settings.protocol == protocolHTTP1 {
+			settings.protocol = protocolAuto
+		} else {
+			return false
+		}
+		return true
+	})
+}
+
+// SetForceHTTP2
+//
+//	@Description: 尝试使用HTTP/2(服务器不支持时回退到HTTP/1.1), 传入false时恢复默认协商
+//	@param force
+func SetForceHTTP2(force bool) {
+	updateTransport(func(settings *transportSettings) bool {
+		if force {
+			settings.protocol = protocolHTTP2
+		} else if settings.protocol == protocolHTTP2 {
+			settings.protocol = protocolAuto
+		} else {
+			return false
+		}
+		return true
+	})
+}
+
+// SetProxy
+//
+//	@Description: 设置所有请求使用的代理, 对之后的请求立即生效
+//	@param rawURL 代理地址, 如http://127.0.0.1:7890或socks5://127.0.0.1:1080, 为空时使用环境变量
+//	@return error
+func SetProxy(rawURL string) error {
+	var proxyURL *url.URL
+	if rawURL != "" {
+		parsed, err := url.Parse(rawURL)
+		if err != nil || parsed.Host == "" {
+			return fmt.Errorf("代理地址有误: %s", rawURL)
+		}
+		proxyURL = parsed
+	}
+	updateTransport(func(settings *transportSettings) bool {
+		settings.proxy = proxyURL
+		return true
+	})
+	return nil
+}
+
+// SetInsecureSkipVerify
+//
+//	@Description: 设置是否跳过TLS证书校验(仅用于使用自签名证书的镜像站), 对之后的请求立即生效
+//	@param skip
+func SetInsecureSkipVerify(skip bool) {
+	updateTransport(func(settings *transportSettings) bool {
+		settings.insecureSkipVerify = skip
+		return true
+	})
+}
+
+// SetMaxIdleConns
+//
+//	@Description: 设置所有主机最多保留的空闲连接数, 对之后的请求立即生效
+//	@param n 小于等于0表示不限制
+func SetMaxIdleConns(n int) {
+	updateTransport(func(settings *transportSettings) bool {
+		settings.maxIdleConns = max(n, 0)
+		return true
+	})
+}
+
+// SetMaxIdleConnsPerHost
+//
+//	@Description: 设置每个主机最多保留的空闲连接数, 对之后的请求立即生效.
+//	应不小于该主机的并发下载数(SetHostConcurrency), 否则并发下载结束后多出的连接会被关闭, 下一批下载需要重新建立连接(含TLS握手);
+//	同时受SetMaxIdleConns限制, 镜像主机较多时需要一起调大
+//	@param n 小于等于0时使用默认值2
+func SetMaxIdleConnsPerHost(n int) {
+	updateTransport(func(settings *transportSettings) bool {
+		settings.maxIdleConnsPerHost = max(n, 0)
+		return true
+	})
+}
+
+// SetIdleConnTimeout
+//
+//	@Description: 设置空闲连接的保留时间, 对之后的请求立即生效. 应小于服务器的keep-alive超时, 避免复用已被服务器关闭的连接
+//	@param timeout 小于等于0表示不限制
+func SetIdleConnTimeout(timeout time.Duration) {
+	updateTransport(func(settings *transportSettings) bool {
+		settings.idleConnTimeout = max(timeout, 0)
+		return true
+	})
+}
+
+// transportProxy
+//
+//	@Description: 将请求转发给当前的共享Transport, 使切换协议对池中已有的Client同样生效
+type transportProxy struct{}
+
+func (transportProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := sessionRoundTripper(sharedTransport.Load())
+	if injector := faultInjector.Load(); injector != nil {
+		rt = faultRoundTripper{injector: injector, next: rt}
+	}
+	if !traceRequests.Load() {
+		return trackedRoundTrip(rt, req)
+	}
+	req, trace := withRequestTrace(req)
+	resp, err := trackedRoundTrip(rt, req)
+	trace.log(req)
+	return resp, err
+}
+
+// responseRecorder
+//
+//	@Description: 记录最近一次响应的状态码和响应头, 用于从got实际发出的下载请求中读取ETag等信息
+type responseRecorder struct {
+	next   http.RoundTripper
+	mu     sync.Mutex
+	status int
+	header http.Header
+}
+
+func (r *responseRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.next.RoundTrip(req)
+	if err == nil {
+		r.mu.Lock()
+		r.status = resp.StatusCode
+		r.header = resp.Header.Clone()
+		r.mu.Unlock()
+	}
+	return resp, err
+}
+
+// last
+//
+//	@Description: 获取最近一次响应的状态码和响应头
+//	@return int
+//	@return http.Header 没有响应时为空
+func (r *responseRecorder) last() (int, http.Header) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.header == nil {
+		return r.status, http.Header{}
+	}
+	return r.status, r.header
+}
+
 // Client httpClient
+//
+//	池中的Client不保存任何配置, 请求时通过transportProxy使用当前的共享Transport,
+//	User-Agent等默认请求头由NewRequest在创建请求时设置, 因此修改配置后对已在池中的Client同样生效.
+//	取出的Client不要修改字段(如Timeout), 需要时使用context控制超时
 var Client = sync.Pool{
 	New: func() interface{} {
 		return &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				TLSClientConfig: &tls.Config{
-					//update tls version,version 12 may cause error on cf worker
-					MaxVersion: tls.VersionTLS13,
-				},
-			},
+			Transport: transportProxy{},
 		}
 	},
 }
@@ -58,167 +463,1238 @@ func FileOrDirExists(path string) bool {
 	}
 
 	for _, file := range files {
-		if norm.NFC.String(file.Name()) == norm.NFC.String(filepath.Base(path)) {
+		if PathsEqual(file.Name(), filepath.Base(path)) {
+			if file.Type()&os.ModeSymlink != 0 && followSymlinks.Load() {
+				//链接目标不存在时视为文件不存在
+				_, err := os.Stat(filepath.Join(filepath.Dir(path), file.Name()))
+				return err == nil
+			}
+			return true
+		}
+	}
+	return false
+
+}
+
+// followSymlinks 检查文件是否存在时是否解析符号链接 默认不解析
+var followSymlinks atomic.Bool
+
+// SetFollowSymlinks
+//
+//	@Description: 设置检查文件是否存在时是否解析符号链接, 开启后目标不存在的符号链接视为文件不存在, 会重新下载
+//	@param follow
+func SetFollowSymlinks(follow bool) {
+	followSymlinks.Store(follow)
+}
+
+// PromotForInput 获取用户输入
+func PromotForInput(message string, defaultValue string) string {
+	log.AsmrLog.Info(message)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	value := scanner.Text()
+	err := scanner.Err()
+	if err != nil {
+		log.AsmrLog.Info(fmt.Sprintf("输入有误: %s", value))
+		os.Exit(0)
+	}
+	if value == "" {
+		return defaultValue
+	}
+	all := strings.ReplaceAll(value, "\n", "")
+	return strings.TrimSpace(all)
+}
+
+// NewWorkerPool 工作池
+func NewWorkerPool(maxWorkerCount int) *workpool.WorkPool {
+	return workpool.New(maxWorkerCount)
+}
+
+// MosaicStr 模糊字符串
+func MosaicStr(inputStr string, mosaicStrTmp string) string {
+	if mosaicStrTmp == "" {
+		mosaicStrTmp = "*"
+	}
+	var result = strings.Builder{}
+	size := len(inputStr)
+	for i := 0; i < size; i++ {
+		result.WriteString(mosaicStrTmp)
+	}
+	return result.String()
+}
+
+// GenerateReqSeed 生成请求种子 seed参数
+func GenerateReqSeed() int {
+	return GenerateReqSeedRange(0, 100)
+}
+
+// GenerateReqSeedRange
+//
+//	@Description: 生成指定范围[min, max)内的请求种子, 使用并发安全的全局随机源
+//	@param min 最小值(包含)
+//	@param max 最大值(不包含)
+//	@return int
+func GenerateReqSeedRange(min int, max int) int {
+	if min >= max {
+		panic("min必须小于max")
+	}
+	return min + rand.Intn(max-min)
+}
+
+// CalculateMaxPage
+//
+//	@Description: 计算最大页数
+//	@param totalCount 总数据
+//	@param pageSize 每页数据
+//	@return int 最大页数
+func CalculateMaxPage(totalCount int, pageSize int) int {
+	if totalCount < 0 || pageSize <= 0 {
+		panic("totalCount必须大于等于0, pageSize必须大于0")
+	}
+	if totalCount == 0 {
+		return 1
+	}
+	i := totalCount / pageSize
+	padding := totalCount % pageSize
+	if padding != 0 {
+		i += 1
+	}
+	return i
+}
+
+// ForEachPage
+//
+//	@Description: 按页遍历数据, 依次对第1页到最大页调用fn, fn返回错误时立即停止
+//	@param totalCount 总数据
+//	@param pageSize 每页数据
+//	@param fn 参数依次为页码(从1开始)、当前页数据偏移量、当前页数据条数
+//	@return error fn返回的第一个错误
+func ForEachPage(totalCount int, pageSize int, fn func(page int, offset int, limit int) error) error {
+	maxPage := CalculateMaxPage(totalCount, pageSize)
+	for page := 1; page <= maxPage; page++ {
+		offset := (page - 1) * pageSize
+		limit := pageSize
+		if offset+limit > totalCount {
+			limit = totalCount - offset
+		}
+		if err := fn(page, offset, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stopwatch
+//
+//	@Description: 计时器, 统一耗时统计方式
+type Stopwatch struct {
+	start time.Time
+}
+
+// NewStopwatch
+//
+//	@Description: 创建并立即开始计时
+//	@return *Stopwatch
+func NewStopwatch() *Stopwatch {
+	return &Stopwatch{start: time.Now()}
+}
+
+// Start
+//
+//	@Description: 重新开始计时
+//	@receiver s
+func (s *Stopwatch) Start() {
+	s.start = time.Now()
+}
+
+// Elapsed
+//
+//	@Description: 自开始计时以来经过的时间
+//	@receiver s
+//	@return time.Duration
+func (s *Stopwatch) Elapsed() time.Duration {
+	return time.Since(s.start)
+}
+
+// Engine 下载使用的工具
+type Engine string
+
+const (
+	// EngineAuto 优先使用got多连接下载, got下载失败时改用net/http重试一次
+	EngineAuto Engine = "auto"
+	// EngineGot 只使用got多连接下载
+	EngineGot Engine = "got"
+	// EngineNetHTTP 只使用net/http单连接下载, 适用于多连接容易触发限流的站点
+	EngineNetHTTP Engine = "nethttp"
+	// EngineRanged 多连接分块下载, 服务器为分块提供校验值(Content-Digest/Content-MD5/x-goog-hash)时校验每个分块,
+	// 不一致时只重新下载该分块. 服务器不支持Range请求时改用net/http
+	EngineRanged Engine = "ranged"
+)
+
+// defaultEngine 下载选项未指定下载工具时使用的下载工具
+var defaultEngine atomic.Value
+
+// SetDefaultEngine
+//
+//	@Description: 设置默认的下载工具
+//	@param engine auto, got, nethttp或ranged, 为空时为auto
+//	@return error
+func SetDefaultEngine(engine Engine) error {
+	switch engine {
+	case "":
+		engine = EngineAuto
+	case EngineAuto, EngineGot, EngineNetHTTP, EngineRanged:
+	default:
+		return fmt.Errorf("不支持的下载工具: %s", engine)
+	}
+	defaultEngine.Store(engine)
+	return nil
+}
+
+// resolveEngine
+//
+//	@Description: 确定下载使用的下载工具
+//	@param engine 下载选项中指定的下载工具, 为空时使用默认值
+//	@return Engine
+func resolveEngine(engine Engine) Engine {
+	if engine != "" {
+		return engine
+	}
+	if engine, ok := defaultEngine.Load().(Engine); ok {
+		return engine
+	}
+	return EngineAuto
+}
+
+// ErrEmptyFile 下载得到的文件为空
+var ErrEmptyFile = errors.New("下载得到的文件为空")
+
+// allowEmptyFiles 是否允许下载得到空文件 默认视为下载失败
+var allowEmptyFiles atomic.Bool
+
+// SetAllowEmptyFiles
+//
+//	@Description: 设置是否允许下载得到0字节的文件, 默认0字节的成功响应也视为下载失败并记录重试
+//	@param allow
+func SetAllowEmptyFiles(allow bool) {
+	allowEmptyFiles.Store(allow)
+}
+
+// checkDownloadedSize
+//
+//	@Description: 检查下载完成的文件大小, 0字节(未允许空文件时)或小于minSize都视为下载失败
+//	@param path
+//	@param kind
+//	@param minSize
+//	@return error
+func checkDownloadedSize(path string, kind AssetKind, minSize int64) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 && !allowEmptyFiles.Load() {
+		return fmt.Errorf("%w: %s", ErrEmptyFile, path)
+	}
+	if minSize > 0 && stat.Size() < minSize {
+		return fmt.Errorf("文件大小%d字节小于%s类型的最小值%d字节", stat.Size(), kind, minSize)
+	}
+	return nil
+}
+
+// DownloadOptions
+//
+//	@Description: 单个文件下载任务的选项
+type DownloadOptions struct {
+	// 额外请求头(会覆盖默认请求头)
+	Headers map[string]string
+	// 文件类型 为空时按文件扩展名推断
+	Kind AssetKind
+	// 预期校验值(十六进制) 为空时不校验
+	Checksum string
+	// 校验算法: md5, sha1, sha256, crc32, 为空时为sha256
+	ChecksumAlgorithm string
+	// 任务ID, 用于CancelJob取消下载, 为空时自动生成
+	JobID string
+	// 下载链接失效(403)时获取新的下载链接, 之后从已下载的位置继续下载. 为nil时不刷新
+	RefreshURL func(oldURL string) (string, error)
+	// 下载工具 为空时使用SetDefaultEngine设置的下载工具
+	Engine Engine
+	// 下载结束(完成、跳过、取消或失败)时调用 为nil时不回调
+	OnResult func(result JobResult)
+	// 文件已存在(且不需要重新验证)时跳过下载
+	SkipExisting bool
+	// 单个文件的下载截止时间 为零值时不限制
+	Deadline time.Time
+	// 单个文件的最长下载时间 小于等于0时不限制, 与Deadline同时设置时以较早者为准
+	Timeout time.Duration
+	// 下载完成后写入的音频标签(MP3/FLAC) 为nil时不写入
+	Tags *AudioTags
+	// 元数据 没有指定文件名时用于渲染文件名模板
+	Meta map[string]string
+	// 文件名模板 为空时使用SetFilenameTemplate设置的模板
+	FilenameTemplate string
+	// 递归下载目录列表时当前所在的子目录层数
+	listingDepth int
+}
+
+// ErrFileDeadline 单个文件超过下载截止时间
+var ErrFileDeadline = errors.New("文件下载超时")
+
+// withFileDeadline
+//
+//	@Description: 按下载选项为单个文件设置截止时间, 超时后ctx的Cause为ErrFileDeadline
+//	@param ctx
+//	@param opts
+//	@return context.Context
+//	@return context.CancelFunc
+func withFileDeadline(ctx context.Context, opts DownloadOptions) (context.Context, context.CancelFunc) {
+	deadline := opts.Deadline
+	if opts.Timeout > 0 {
+		if timeout := time.Now().Add(opts.Timeout); deadline.IsZero() || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	if deadline.IsZero() {
+		return ctx, func() {}
+	}
+	return context.WithDeadlineCause(ctx, deadline, ErrFileDeadline)
+}
+
+// DownloadFile
+//
+//	@Description: 使用net/http单连接下载文件
+//	@param storePath
+//	@param fileUrl
+//	@return time.Duration 下载耗时
+//	@return error
+func DownloadFile(storePath string, fileUrl string) (time.Duration, error) {
+	return DownloadFileWithHeaders(storePath, fileUrl, nil)
+}
+
+// DownloadFileWithHeaders
+//
+//	@Description: 使用net/http单连接下载文件, 并附加额外的请求头(会覆盖默认请求头)
+//	@param storePath
+//	@param fileUrl
+//	@param headers 额外请求头
+//	@return time.Duration 下载耗时
+//	@return error
+func DownloadFileWithHeaders(storePath string, fileUrl string, headers map[string]string) (time.Duration, error) {
+	return downloadFileWithContext(context.Background(), storePath, fileUrl, headers)
+}
+
+// downloadFileWithContext
+//
+//	@Description: 使用net/http单连接下载文件, ctx结束时中止下载
+//	@param ctx
+//	@param storePath
+//	@param fileUrl
+//	@param headers 额外请求头
+//	@return time.Duration 下载耗时
+//	@return error 可以使用errors.Is判断ErrThrottled、ErrNotFound、ErrSizeMismatch、ErrDiskFull、ErrUnwritable等分类
+func downloadFileWithContext(ctx context.Context, storePath string, fileUrl string, headers map[string]string) (elapsed time.Duration, err error) {
+	defer func() {
+		err = classifyIOError(storePath, fileUrl, err)
+	}()
+	stopwatch := NewStopwatch()
+	client := Client.Get().(*http.Client)
+	defer Client.Put(client)
+
+	req, err := NewRequest(ctx, "GET", fileUrl)
+	if err != nil {
+		return stopwatch.Elapsed(), err
+	}
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	//存在进度文件时 仅在源文件ETag未变化时从已写入的位置继续下载
+	resume := loadProgress(storePath)
+	if resume != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resume.Bytes))
+		req.Header.Set("If-Range", resume.ETag)
+	} else {
+		//本地文件已存在时 使用清单中记录的ETag/Last-Modified发起条件请求
+		for _, header := range conditionalGetHeaders(fileUrl, storePath) {
+			req.Header.Set(header.Key, header.Value)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return stopwatch.Elapsed(), err
+	}
+	defer resp.Body.Close()
+
+	if resume != nil && (resp.StatusCode != http.StatusPartialContent || resp.Header.Get("ETag") != resume.ETag) {
+		//源文件已变化或服务器不支持续传 重新下载
+		resume = nil
+		removeProgress(storePath)
+		if resp.StatusCode == http.StatusPartialContent {
+			_ = resp.Body.Close()
+			return downloadFileWithContext(ctx, storePath, fileUrl, headers)
+		}
+	}
+
+	if resume == nil && resp.StatusCode == http.StatusPartialContent && !contentRangeCoversWhole(resp.Header.Get("Content-Range")) {
+		//没有续传却只收到部分内容 直接保存会得到不完整的文件
+		contentRange := resp.Header.Get("Content-Range")
+		recordUnexpectedPartial(fileUrl, contentRange)
+		switch policy := unexpectedPartialPolicy.Load().(string); {
+		case policy == PartialPolicyRetry && headers["Range"] == "":
+			_ = resp.Body.Close()
+			full := make(map[string]string, len(headers)+2)
+			for key, value := range headers {
+				full[key] = value
+			}
+			full["Range"] = "bytes=0-"
+			full["Cache-Control"] = "no-cache"
+			return downloadFileWithContext(ctx, storePath, fileUrl, full)
+		case policy != PartialPolicyAccept:
+			return stopwatch.Elapsed(), &DownloadError{Kind: ErrSizeMismatch, URL: fileUrl, Path: storePath, StatusCode: resp.StatusCode,
+				Err: fmt.Errorf("%w, Content-Range: %s", ErrUnexpectedPartial, contentRange)}
+		}
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		log.AsmrLog.Info("文件未修改, 跳过下载: ", zap.String("info", storePath))
+		return stopwatch.Elapsed(), nil
+	}
+	var body io.Reader = resp.Body
+	if resp.StatusCode >= http.StatusBadRequest {
+		//读取错误响应的开头用于判断是否可以重试 之后仍然完整写入文件(用于检测1015限流页面)
+		head := make([]byte, retryBodyLimit)
+		n, _ := io.ReadFull(resp.Body, head)
+		head = head[:n]
+		if err := permanentStatusError(fileUrl, resp.StatusCode, head, nil); err != nil {
+			return stopwatch.Elapsed(), err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return stopwatch.Elapsed(), &DownloadError{Kind: ErrThrottled, URL: fileUrl, Path: storePath, StatusCode: resp.StatusCode, Err: errors.New(strings.TrimSpace(string(head)))}
+		}
+		body = io.MultiReader(bytes.NewReader(head), resp.Body)
+	}
+
+	if renderingEnabled() {
+		rendered := &renderReader{Reader: body, progress: FileProgress{URL: fileUrl, Path: storePath}}
+		if resume != nil {
+			rendered.progress.Bytes = resume.Bytes
+		}
+		if resp.ContentLength > 0 {
+			rendered.progress.Total = rendered.progress.Bytes + resp.ContentLength
+		}
+		body = rendered
+	}
+	//先写入.part文件 完成后再移动到最终路径
+	part := partPath(storePath)
+	out, err := openPart(part, storePath, fileUrl, resp, resume)
+	if err != nil {
+		return stopwatch.Elapsed(), err
+	}
+	trackCloser(ctx, out)
+
+	written, err := io.Copy(out, body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && resp.StatusCode < http.StatusBadRequest && resp.ContentLength >= 0 && written != resp.ContentLength {
+		err = &DownloadError{Kind: ErrSizeMismatch, URL: fileUrl, Path: storePath, Err: fmt.Errorf("预期%d字节, 实际%d字节", resp.ContentLength, written)}
+	}
+	if resume != nil {
+		written += resume.Bytes
+	}
+	elapsed = stopwatch.Elapsed()
+	if err == nil && written == 0 && !allowEmptyFiles.Load() {
+		err = fmt.Errorf("%w: %s", ErrEmptyFile, storePath)
+	}
+	removeProgress(storePath)
+	if err != nil {
+		_ = discardFailedArtifact(part, storePath)
+		return elapsed, err
+	}
+	if err := finalizePart(part, storePath); err != nil {
+		return elapsed, err
+	}
+	log.AsmrLog.Info("文件下载耗时: ", zap.String("info", storePath), zap.Duration("elapsed", elapsed))
+	if resp.StatusCode == http.StatusOK || resume != nil {
+		rememberConditionalGet(ManifestEntry{
+			Path:         storePath,
+			URL:          fileUrl,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		})
+	}
+	return elapsed, nil
+}
+
+// openPart
+//
+//	@Description: 打开用于写入的.part文件. 续传时保留已写入的部分, 大文件会同时记录进度文件
+//	@param part
+//	@param storePath
+//	@param fileUrl
+//	@param resp
+//	@param resume 续传的进度记录, 为nil时重新下载
+//	@return io.WriteCloser
+//	@return error
+func openPart(part string, storePath string, fileUrl string, resp *http.Response, resume *progressRecord) (io.WriteCloser, error) {
+	//续传时需要通过If-Range确认源文件未变化 弱校验ETag不能用于If-Range
+	etag := strongETag(resp.Header.Get("ETag"))
+	var offset int64
+	if resume != nil {
+		offset = resume.Bytes
+	}
+	if resume == nil && (etag == "" || !useProgressSidecar(resp.ContentLength)) {
+		out, err := currentStorage().Create(part)
+		if err != nil {
+			return nil, err
+		}
+		return withPeriodicSync(out), nil
+	}
+	file, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, FileMode())
+	if err != nil {
+		return nil, err
+	}
+	//丢弃最后一次记录进度之后写入的数据
+	if err := file.Truncate(offset); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if resume != nil {
+		log.AsmrLog.Info("从进度文件记录的位置继续下载: ", zap.String("info", storePath), zap.Int64("offset", offset))
+	}
+	record := progressRecord{URL: fileUrl, ETag: etag, Bytes: offset}
+	if err := saveProgress(storePath, record); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &progressWriter{file: file, storePath: storePath, record: record, lastSave: time.Now()}, nil
+}
+
+// ErrRangeNotSupported 服务器不支持Range请求
+var ErrRangeNotSupported = errors.New("服务器不支持Range请求")
+
+// DownloadRange
+//
+//	@Description: 下载文件的指定字节范围并写入w, 用于io.Writer等非本地文件的存储从中断处续传
+//	@param ctx
+//	@param fileUrl
+//	@param start 起始偏移(包含)
+//	@param end 结束偏移(包含), 小于0表示到文件末尾
+//	@param w
+//	@return int64 写入的字节数
+//	@return error
+func DownloadRange(ctx context.Context, fileUrl string, start int64, end int64, w io.Writer) (int64, error) {
+	return downloadValidatedRange(ctx, fileUrl, start, end, nil, w)
+}
+
+// downloadValidatedRange
+//
+//	@Description: 下载文件的指定字节范围并写入w, 续传时使用If-Range确认源文件没有变化
+//	@param ctx
+//	@param fileUrl
+//	@param start 起始偏移(包含)
+//	@param end 结束偏移(包含), 小于0表示到文件末尾
+//	@param validator 为nil时不校验
+//	@param w
+//	@return int64 写入的字节数
+//	@return error 源文件已变化时包装了ErrRemoteChanged, 此时没有写入任何内容
+func downloadValidatedRange(ctx context.Context, fileUrl string, start int64, end int64, validator *rangeValidator, w io.Writer) (int64, error) {
+	if start < 0 || (end >= 0 && end < start) {
+		return 0, fmt.Errorf("无效的下载范围: %d-%d", start, end)
+	}
+	req, err := NewRequest(ctx, "GET", fileUrl)
+	if err != nil {
+		return 0, err
+	}
+	rangeHeader := fmt.Sprintf("bytes=%d-", start)
+	if end >= 0 {
+		rangeHeader += strconv.FormatInt(end, 10)
+	}
+	req.Header.Set("Range", rangeHeader)
+	ifRange := ""
+	if validator != nil && start > 0 {
+		if ifRange = validator.ifRange(); ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+
+	client := Client.Get().(*http.Client)
+	defer Client.Put(client)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && start == 0 && end < 0:
+		//请求完整文件时服务器可能直接返回200
+	case resp.StatusCode == http.StatusOK && ifRange != "":
+		//If-Range不匹配时服务器返回完整文件
+		return 0, fmt.Errorf("%w: %s", ErrRemoteChanged, fileUrl)
+	case resp.StatusCode == http.StatusOK:
+		return 0, fmt.Errorf("%w: %s", ErrRangeNotSupported, fileUrl)
+	case resp.StatusCode == http.StatusForbidden:
+		return 0, fmt.Errorf("%w: %s", ErrURLExpired, fileUrl)
+	default:
+		return 0, fmt.Errorf("下载%s失败, 状态码: %d", fileUrl, resp.StatusCode)
+	}
+	if validator != nil {
+		if err := validator.observe(fileUrl, resp.Header); err != nil {
+			return 0, err
+		}
+	}
+	return io.Copy(w, resp.Body)
+}
+
+// NewFileDownloader
+//
+//	@Description: 下载文件
+//	@param url
+//	@param path
+//	@param filename
+//	@return func()
+func NewFileDownloader(url string, path string, filename string) func() error {
+	return NewFileDownloaderWithHeaders(url, path, filename, nil)
+}
+
+// NewFileDownloaderWithHeaders
+//
+//	@Description: 下载文件, 每个请求都会附加额外的请求头(会覆盖默认请求头)
+//	@param url
+//	@param path
+//	@param filename
+//	@param headers 额外请求头
+//	@return func() error
+func NewFileDownloaderWithHeaders(url string, path string, filename string, headers map[string]string) func() error {
+	return NewFileDownloaderWithOptions(url, path, filename, DownloadOptions{Headers: headers})
+}
+
+// NewFileDownloaderWithOptions
+//
+//	@Description: 按下载选项下载文件, 会应用文件类型对应的下载规则
+//	@param url
+//	@param path
+//	@param filename
+//	@param opts
+//	@return func() error
+func NewFileDownloaderWithOptions(url string, path string, filename string, opts DownloadOptions) func() error {
+	headers := opts.Headers
+	progress := currentBatchProgress()
+	var preflightSize int64
+	if progress != nil {
+		progress.AddFile()
+		//预先获取文件大小 用于计算整体字节进度
+		preflightSize = ContentLength(url, headers)
+		progress.AddTotalBytes(preflightSize)
+	}
+	return func() error {
+		var fileUrl = url
+		var filePathToStore = path
+		var fileName = filename
+		var storePath string
+		report := func(status JobStatus, err error) {
+			renderer := currentRenderer()
+			renderer.FileFinished(FileProgress{URL: url, Path: storePath, Total: preflightSize}, status, err)
+			if progress != nil {
+				renderer.Batch(progress.Snapshot())
+			}
+			if opts.OnResult != nil {
+				opts.OnResult(JobResult{URL: url, Path: storePath, Status: status, Err: err})
+			}
+		}
+		//链接指向目录时 按设置解析目录列表下载其中的文件或作为失败处理, 不把目录页面保存为文件
+		finishDirectory := func(ctx context.Context, dirUrl string) error {
+			err := downloadDirectory(ctx, dirUrl, filePathToStore, opts)
+			if err != nil {
+				log.AsmrLog.Error(fmt.Sprintf("下载目录%s失败: %s", dirUrl, err.Error()))
+				if progress != nil {
+					progress.FileFailed()
+				}
+				report(JobFailed, err)
+				return nil
+			}
+			if progress != nil {
+				progress.FileDone()
+			}
+			report(JobDone, nil)
+			return nil
+		}
+		if isDirectoryURL(fileUrl) {
+			return finishDirectory(context.Background(), fileUrl)
+		}
+		//未指定文件名但带有元数据时 按模板生成文件名
+		if fileName == "" && len(opts.Meta) > 0 {
+			tmpl := opts.FilenameTemplate
+			if tmpl == "" {
+				tmpl = filenameTemplate.Load().(string)
+			}
+			if tmpl != "" {
+				name, err := FilenameFromMeta(tmpl, opts.Meta)
+				if err != nil {
+					log.AsmrLog.Error("生成文件名失败: ", zap.String("error", err.Error()), zap.String("url", fileUrl))
+					if progress != nil {
+						progress.FileFailed()
+					}
+					report(JobFailed, err)
+					return nil
+				}
+				fileName = name
+			}
+		}
+		//未指定文件名时 先使用url中的文件名下载, 下载后按响应头Content-Disposition修正
+		resolveFileName := fileName == ""
+		if resolveFileName {
+			fileName = ResolveFileName(fileUrl, nil)
+		}
+		var kind AssetKind
+		var rule KindRule
+		//按文件名确定文件类型、下载规则和保存路径 返回false表示匹配跳过规则
+		prepare := func() bool {
+			kind = opts.Kind
+			if kind == "" {
+				kind = DetectAssetKind(fileName)
+			}
+			rule = kindRuleFor(kind)
+			if rule.shouldSkip(fileName) {
+				log.AsmrLog.Info(fmt.Sprintf("文件: %s 匹配%s类型的跳过规则, 跳过下载", fileName, kind))
+				if progress != nil {
+					progress.FileDone()
+				}
+				return false
+			}
+			storePath = StorePathFor(filePathToStore, fileName, kind)
+			if filepath.Dir(storePath) != filepath.Clean(filePathToStore) {
+				//按规则保存到子目录
+				if err := os.MkdirAll(filepath.Dir(storePath), DirMode()); err != nil {
+					log.AsmrLog.Error("创建目录失败: ", zap.String("error", err.Error()))
+				}
+			}
+			storePath = CollisionFreePathFor(storePath, url)
 			return true
 		}
+		if !prepare() {
+			report(JobSkipped, nil)
+			return nil
+		}
+		//清单中有ETag/Last-Modified记录时 发起条件请求确认文件是否有更新
+		if opts.SkipExisting && FileOrDirExists(storePath) && !NeedsRevalidation(fileUrl) {
+			//已在创建下载任务时登记到进度统计
+			recordSkippedExisting(storePath, fileUrl)
+			if progress != nil {
+				progress.AddBytes(preflightSize)
+				progress.FileExisting()
+			}
+			report(JobExists, nil)
+			return nil
+		}
+		if !opts.SkipExisting && FileOrDirExists(storePath) && !confirmOverwrite(storePath) {
+			log.AsmrLog.Info("不覆盖已存在的文件, 跳过下载: ", zap.String("info", storePath))
+			if progress != nil {
+				progress.AddBytes(preflightSize)
+				progress.FileExisting()
+			}
+			report(JobExists, nil)
+			return nil
+		}
+		unlock, ok := lockFile(storePath)
+		if !ok {
+			log.AsmrLog.Info("文件正在被其他进程下载, 跳过: ", zap.String("info", storePath))
+			if progress != nil {
+				progress.FileDone()
+			}
+			report(JobSkipped, nil)
+			return nil
+		}
+		defer unlock()
+		//主机连续失败过多时改用备用镜像 没有可用镜像时推迟下载
+		routedUrl, routeErr := routeAroundDownHost(fileUrl)
+		if routeErr != nil {
+			log.AsmrLog.Info("主机暂时不可用, 推迟下载: ", zap.String("info", storePath))
+			job := DownloadJob{URL: url, Path: path, Filename: filename, Headers: headers, Checksum: opts.Checksum, SkipExisting: opts.SkipExisting,
+				Meta: opts.Meta, FilenameTemplate: opts.FilenameTemplate}
+			if err := appendDeferredJobs([]DownloadJob{job}); err != nil {
+				log.AsmrLog.Error("写入推迟下载记录失败: ", zap.String("error", err.Error()))
+			}
+			if progress != nil {
+				progress.FileDeferred()
+			}
+			report(JobDeferred, routeErr)
+			return nil
+		}
+		fileUrl = routedUrl
+		ctx, finishJob := startJob(opts.JobID, fileUrl)
+		defer finishJob()
+		ctx, cancelDeadline := withFileDeadline(ctx, opts)
+		defer cancelDeadline()
+		//暂停或静默时段内在开始下载前等待
+		err := waitIfPaused(ctx)
+		var releaseHost func()
+		if err == nil {
+			releaseHost, err = acquireHost(ctx, fileUrl)
+		}
+		if err != nil {
+			log.AsmrLog.Info("文件下载已取消: ", zap.String("info", storePath))
+			if progress != nil {
+				progress.FileCanceled()
+			}
+			report(JobCanceled, err)
+			return nil
+		}
+		//下载目录列表中的文件前需要提前释放
+		releaseHost = sync.OnceFunc(releaseHost)
+		defer releaseHost()
+		stopwatch := NewStopwatch()
+		rendering := renderingEnabled()
+		if rendering {
+			currentRenderer().FileStarted(FileProgress{URL: fileUrl, Path: storePath, Total: preflightSize})
+		}
+		fileClient := got.New()
+		//已计入整体进度的字节数
+		var reported atomic.Int64
+		if progress != nil || rendering {
+			fileClient.ProgressFunc = func(d *got.Download) {
+				if rendering {
+					currentRenderer().FileProgress(FileProgress{URL: fileUrl, Path: storePath, Bytes: int64(d.Size()), Total: int64(d.TotalSize())})
+				}
+				if progress == nil {
+					return
+				}
+				if preflightSize <= 0 && d.TotalSize() > 0 && reported.Load() == 0 {
+					//预先获取文件大小失败时 使用下载时获取的大小
+					preflightSize = int64(d.TotalSize())
+					progress.AddTotalBytes(preflightSize)
+				}
+				size := int64(d.Size())
+				progress.AddBytes(size - reported.Swap(size))
+			}
+		}
+		//got多连接下载需要本地文件 非本地存储或指定net/http时使用单连接下载直接写入存储
+		local := isLocalStorage()
+		engine := resolveEngine(opts.Engine)
+		usedEngine := EngineNetHTTP
+		//需要记录进度文件的大文件使用单连接下载 以便崩溃后续传
+		resumable := engine == EngineAuto && (useProgressSidecar(preflightSize) || loadProgress(storePath) != nil)
+		if local && engine == EngineRanged {
+			usedEngine = EngineRanged
+			part := partPath(storePath)
+			err = downloadRangedVerified(ctx, part, fileUrl, headers, preflightSize)
+			if errors.Is(err, ErrRemoteChanged) && ctx.Err() == nil {
+				//下载期间源文件发生变化 已下载的分块不可用, 重新获取大小后从头下载
+				log.AsmrLog.Warn("源文件已变化, 重新下载: ", zap.String("info", storePath))
+				err = downloadRangedVerified(ctx, part, fileUrl, headers, 0)
+			}
+			if errors.Is(err, ErrRangeNotSupported) {
+				log.AsmrLog.Info("服务器不支持分块下载, 改用net/http: ", zap.String("info", storePath))
+				_ = os.Remove(part)
+				usedEngine = EngineNetHTTP
+				_, err = downloadFileWithContext(ctx, storePath, fileUrl, headers)
+			} else {
+				if err == nil {
+					err = applyFileMode(part)
+				}
+				if err == nil {
+					err = finalizePart(part, storePath)
+				}
+			}
+		} else if local && engine != EngineNetHTTP && !resumable {
+			usedEngine = EngineGot
+			recorder := &responseRecorder{next: transportProxy{}}
+			part := partPath(storePath)
+			download := got.NewDownload(ctx, fileUrl, part)
+			download.Client = &http.Client{Transport: recorder}
+			download.Header = append(gotHeaders(headers), conditionalGetHeaders(fileUrl, storePath)...)
+			releaseMemory, memErr := acquireGotMemory(ctx, applyGotLimits(download, preflightSize))
+			if memErr != nil {
+				err = memErr
+			} else {
+				err = fileClient.Do(download)
+				releaseMemory()
+			}
+			status, respHeader := recorder.last()
+			if err != nil && status == http.StatusNotModified {
+				//本地文件未修改 保留原文件
+				_ = os.Remove(part)
+				log.AsmrLog.Info("文件未修改, 跳过下载: ", zap.String("info", storePath))
+				if progress != nil {
+					progress.FileDone()
+				}
+				report(JobSkipped, nil)
+				return nil
+			}
+			if err != nil && status == http.StatusForbidden && opts.RefreshURL != nil && !isCanceled(ctx) {
+				//下载链接失效 获取新链接后单连接续传
+				_ = os.Remove(part)
+				err = downloadWithRefresh(ctx, part, fileUrl, opts.RefreshURL)
+				respHeader = http.Header{}
+			}
+			if err != nil {
+				if permanentErr := permanentStatusError(fileUrl, status, nil, err); permanentErr != nil {
+					err = permanentErr
+				} else if status == http.StatusTooManyRequests {
+					err = &DownloadError{Kind: ErrThrottled, URL: fileUrl, Path: storePath, StatusCode: status, Err: err}
+				}
+			}
+			if err == nil && download.TotalSize() > 0 {
+				if stat, statErr := os.Stat(part); statErr == nil && uint64(stat.Size()) != download.TotalSize() {
+					err = &DownloadError{Kind: ErrSizeMismatch, URL: fileUrl, Path: storePath, Err: fmt.Errorf("预期%d字节, 实际%d字节", download.TotalSize(), stat.Size())}
+				}
+			}
+			if err == nil && resolveFileName {
+				if name := ResolveFileName(fileUrl, respHeader); name != fileName {
+					fileName = name
+					if !prepare() {
+						_ = os.Remove(part)
+						report(JobSkipped, nil)
+						return nil
+					}
+				}
+			}
+			if err == nil {
+				//got创建的文件不使用设置的文件权限
+				err = applyFileMode(part)
+			}
+			if err == nil {
+				err = finalizePart(part, storePath)
+			}
+			if err == nil {
+				rememberConditionalGet(ManifestEntry{
+					Path:         storePath,
+					URL:          fileUrl,
+					ETag:         respHeader.Get("ETag"),
+					LastModified: respHeader.Get("Last-Modified"),
+				})
+			}
+		} else {
+			_, err = downloadFileWithContext(ctx, storePath, fileUrl, headers)
+		}
+
+		//got下载失败时使用net/http重试一次, 两种下载方式的失败原因通常不同
+		if err != nil && usedEngine == EngineGot && engine == EngineAuto && ctx.Err() == nil && !isPermanentFailure(err) {
+			log.AsmrLog.Info(fmt.Sprintf("got下载失败, 改用net/http重试: %s, %s", storePath, err.Error()))
+			_ = os.Remove(partPath(storePath))
+			if progress != nil {
+				progress.AddBytes(-reported.Swap(0))
+			}
+			usedEngine = EngineNetHTTP
+			_, err = downloadFileWithContext(ctx, storePath, fileUrl, headers)
+		}
+		if err != nil && errors.Is(context.Cause(ctx), ErrFileDeadline) {
+			err = fmt.Errorf("%w: %s, %s", ErrFileDeadline, storePath, err.Error())
+		}
+		if err != nil && isCanceled(ctx) {
+			//主动取消的任务不记录为下载失败
+			log.AsmrLog.Info("文件下载已取消: ", zap.String("info", storePath))
+			_ = currentStorage().Remove(partPath(storePath))
+			if progress != nil {
+				progress.AddBytes(-reported.Swap(0))
+				progress.FileCanceled()
+			}
+			report(JobCanceled, err)
+			return nil
+		}
+		if err == nil && local && isDirectoryListingFile(storePath) {
+			//响应是目录列表页面(如服务器将目录链接重定向到以/结尾的链接)
+			_ = os.Remove(storePath)
+			//目录中的文件各自占用主机并发数
+			releaseHost()
+			return finishDirectory(ctx, fileUrl)
+		}
+		//大小/校验值检查与完成回调需要读取本地文件
+		if err == nil && local {
+			err = checkDownloadedSize(storePath, kind, rule.MinSize)
+		}
+		if err == nil && local {
+			err = checkErrorBody(storePath, kind)
+			if errors.Is(err, ErrErrorBody) && ctx.Err() == nil {
+				//源站返回了状态码为200的错误响应 删除后重新下载一次
+				log.AsmrLog.Warn("下载得到错误响应, 重新下载: ", zap.String("error", err.Error()))
+				_ = os.Remove(storePath)
+				if _, err = downloadFileWithContext(ctx, storePath, fileUrl, headers); err == nil {
+					err = checkErrorBody(storePath, kind)
+				}
+			}
+		}
+		if err == nil && local && opts.Checksum != "" {
+			err = VerifyFileChecksum(storePath, opts.ChecksumAlgorithm, opts.Checksum)
+		}
+		if err == nil && local && opts.Checksum == "" {
+			err = verifyHashSidecar(ctx, storePath, fileUrl, headers)
+			if errors.Is(err, ErrChecksumMismatch) && ctx.Err() == nil {
+				//与镜像站发布的校验值不一致 删除后重新下载一次
+				log.AsmrLog.Warn("文件校验失败, 重新下载: ", zap.String("error", err.Error()))
+				_ = os.Remove(storePath)
+				if _, err = downloadFileWithContext(ctx, storePath, fileUrl, headers); err == nil {
+					err = verifyHashSidecar(ctx, storePath, fileUrl, headers)
+				}
+			}
+		}
+		if err == nil && local && opts.Tags != nil {
+			//校验通过后再写入标签 写入失败不影响下载结果
+			if tagErr := TagAudioFile(storePath, *opts.Tags); tagErr != nil && !errors.Is(tagErr, ErrUnsupportedTagFormat) {
+				log.AsmrLog.Warn("写入音频标签失败: ", zap.String("error", tagErr.Error()))
+			}
+		}
+		if err == nil && local {
+			err = runOnComplete(storePath, fileUrl, stopwatch.Elapsed())
+		}
+		if err != nil {
+			err = classifyIOError(storePath, fileUrl, err)
+			//404等永久失败与来源的承受能力无关
+			recordAdaptiveOutcome(!isPermanentFailure(err))
+			recordHostOutcome(fileUrl, !isPermanentFailure(err))
+			handleDownloadFailure(storePath, fileUrl, kind, err)
+			if progress != nil {
+				//扣除失败文件已计入的字节数
+				progress.AddBytes(-reported.Swap(0))
+				progress.FileFailed()
+			}
+			report(JobFailed, err)
+			if abortRun(err) {
+				//返回错误使工作池停止执行剩余任务
+				return err
+			}
+			return nil
+		}
+		recordAdaptiveOutcome(false)
+		recordHostOutcome(fileUrl, false)
+		log.AsmrLog.Info("文件下载成功: ", zap.String("info", fileName), zap.String("engine", string(usedEngine)))
+		if local {
+			recordChecksum(storePath, fileUrl, opts.ChecksumAlgorithm)
+		}
+		if progress != nil {
+			if stat, err := os.Stat(storePath); err == nil {
+				progress.AddBytes(stat.Size() - reported.Swap(stat.Size()))
+			}
+			progress.FileDone()
+		}
+		if local {
+			if err := extractDownloadedArchive(storePath); err != nil {
+				//压缩包已无法使用 记录为下载失败以便重新下载
+				handleDownloadFailure(storePath, fileUrl, kind, err)
+				report(JobFailed, err)
+				return nil
+			}
+		}
+		report(JobDone, nil)
+		return nil
 	}
-	return false
 
 }
 
-// PromotForInput 获取用户输入
-func PromotForInput(message string, defaultValue string) string {
-	log.AsmrLog.Info(message)
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Scan()
-	value := scanner.Text()
-	err := scanner.Err()
-	if err != nil {
-		log.AsmrLog.Info(fmt.Sprintf("输入有误: %s", value))
-		os.Exit(0)
+// handleDownloadFailure
+//
+//	@Description: 处理下载失败: 记录日志、发送通知、记录失败文件并清理文件碎片
+//	@param storePath
+//	@param fileUrl
+//	@param kind
+//	@param err
+func handleDownloadFailure(storePath string, fileUrl string, kind AssetKind, err error) {
+	log.AsmrLog.Error(err.Error())
+	//fmt.Printf("文件: %s下载失败: %s\n", fileName, fileUrl)
+	log.AsmrLog.Error(fmt.Sprintf("文件(%s): %s下载失败: %s", kind, filepath.Base(storePath), err.Error()))
+
+	if err := log.DiscordWebhook.Send(fmt.Sprintf("文件(%s): %s下载失败: %s", kind, storePath, err.Error())); err != nil {
+		log.AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
 	}
-	if value == "" {
-		return defaultValue
+
+	category := failureCategory(err)
+	recordFailureCategory(category)
+	//记录失败文件  时间, 文件路径，文件url
+	record := FailedRecord{Time: GetCurrentDateTime(), Path: storePath, URL: fileUrl, Error: err.Error(), Kind: kind, Category: category}
+	emitFailure(record)
+	if isPermanentFailure(err) {
+		//404/410重试也不会成功 不加入重试记录
+		if err := appendPermanentlyFailed(record); err != nil {
+			log.AsmrLog.Error("写入永久失败记录失败: ", zap.String("error", err.Error()))
+		}
+	} else {
+		recordFailedDownload(record)
+	}
+	runOnFailure(record)
+	//清理下载失败的文件碎片 下载中失败时碎片为.part文件
+	store := currentStorage()
+	artifact := partPath(storePath)
+	if !store.Exists(artifact) {
+		artifact = storePath
+	}
+	if !store.Exists(artifact) {
+		return
+	}
+	err2 := discardFailedArtifact(artifact, storePath)
+	if err2 != nil {
+		log.AsmrLog.Error("删除碎片文件失败文件失败:", zap.String("error", err2.Error()))
 	}
-	all := strings.ReplaceAll(value, "\n", "")
-	return strings.TrimSpace(all)
 }
 
-// NewWorkerPool 工作池
-func NewWorkerPool(maxWorkerCount int) *workpool.WorkPool {
-	return workpool.New(maxWorkerCount)
+// FileResult
+//
+//	@Description: 单个文件下载结果, 传递给下载完成回调
+type FileResult struct {
+	URL string `json:"url"`
+	// 文件大小
+	Bytes int64 `json:"bytes"`
+	// 文件SHA-256校验值
+	Checksum string `json:"checksum"`
+	// 下载耗时
+	Elapsed time.Duration `json:"elapsed"`
 }
 
-// MosaicStr 模糊字符串
-func MosaicStr(inputStr string, mosaicStrTmp string) string {
-	if mosaicStrTmp == "" {
-		mosaicStrTmp = "*"
-	}
-	var result = strings.Builder{}
-	size := len(inputStr)
-	for i := 0; i < size; i++ {
-		result.WriteString(mosaicStrTmp)
-	}
-	return result.String()
+// hooks 下载过程中的扩展回调
+var hooks struct {
+	sync.RWMutex
+	onComplete func(path string, info FileResult) error
+	onFailure  func(rec FailedRecord) error
 }
 
-// GenerateReqSeed 生成请求种子 seed参数
-func GenerateReqSeed() int {
-	rand.Seed(time.Now().UnixNano())
-	result := int(100 * rand.Float64())
-	return result
+// SetOnComplete
+//
+//	@Description: 设置文件下载成功后的回调, 可用于转码、写标签等后处理. 回调返回错误时该文件按下载失败处理
+//	@param fn 传入nil取消回调
+func SetOnComplete(fn func(path string, info FileResult) error) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.onComplete = fn
 }
 
-// CalculateMaxPage
+// SetOnFailure
 //
-//	@Description: 计算最大页数
-//	@param totalCount 总数据
-//	@param pageSize 每页数据
-//	@return int 最大页数
-func CalculateMaxPage(totalCount int, pageSize int) int {
-	if totalCount < 0 || pageSize <= 0 {
-		panic("totalCount必须大于等于0, pageSize必须大于0")
-	}
-	if totalCount == 0 {
-		return 1
+//	@Description: 设置下载失败后的回调, 在失败记录写入之后、下一次重试之前同步调用(例如切换VPN节点),
+//	下载任务等待回调返回. 回调返回的错误只记录日志, 不影响之后的下载
+//	@param fn 传入nil取消回调
+func SetOnFailure(fn func(rec FailedRecord) error) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.onFailure = fn
+}
+
+// runOnFailure
+//
+//	@Description: 执行下载失败回调
+//	@param record
+func runOnFailure(record FailedRecord) {
+	hooks.RLock()
+	onFailure := hooks.onFailure
+	hooks.RUnlock()
+	if onFailure == nil {
+		return
 	}
-	i := totalCount / pageSize
-	padding := totalCount % pageSize
-	if padding != 0 {
-		i += 1
+	if err := onFailure(record); err != nil {
+		log.AsmrLog.Error("下载失败回调处理失败: ", zap.String("error", err.Error()), zap.String("url", record.URL))
 	}
-	return i
 }
 
-func DownloadFile(storePath string, fileUrl string) error {
-	client := &http.Client{}
+// CommandFailureHook
+//
+//	@Description: 创建执行外部命令的下载失败回调, 参数中的{url}、{path}、{error}、{category}替换为失败记录的对应字段,
+//	例如"./switch-vpn.sh {category}"
+//	@param command
+//	@return func(rec FailedRecord) error
+func CommandFailureHook(command string) func(rec FailedRecord) error {
+	return func(rec FailedRecord) error {
+		fields := strings.Fields(command)
+		if len(fields) == 0 {
+			return fmt.Errorf("下载失败命令为空")
+		}
+		replacer := strings.NewReplacer("{url}", rec.URL, "{path}", rec.Path, "{error}", rec.Error, "{category}", rec.Category)
+		for i := range fields {
+			fields[i] = replacer.Replace(fields[i])
+		}
+		output, err := exec.Command(fields[0], fields[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("执行下载失败命令失败: %w, %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+}
 
-	req, err := http.NewRequest("GET", fileUrl, nil)
+// runOnComplete
+//
+//	@Description: 执行下载完成回调
+//	@param storePath
+//	@param fileUrl
+//	@param elapsed
+//	@return error
+func runOnComplete(storePath string, fileUrl string, elapsed time.Duration) error {
+	hooks.RLock()
+	onComplete := hooks.onComplete
+	hooks.RUnlock()
+	if onComplete == nil {
+		return nil
+	}
+	stat, err := os.Stat(storePath)
 	if err != nil {
 		return err
 	}
-
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/136.0.0.0 Safari/537.36")
-
-	resp, err := client.Do(req)
+	checksum, err := FileChecksum(storePath)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	out, err := os.Create(storePath)
+	err = onComplete(storePath, FileResult{URL: fileUrl, Bytes: stat.Size(), Checksum: checksum, Elapsed: elapsed})
 	if err != nil {
-		return err
+		return fmt.Errorf("下载完成回调处理失败: %w", err)
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	return err
+	return nil
 }
 
-// NewFileDownloader
+// GetCurrentDateTime
 //
-//	@Description: 下载文件
-//	@param url
-//	@param path
-//	@param filename
-//	@return func()
-func NewFileDownloader(url string, path string, filename string) func() error {
-	return func() error {
-		var fileUrl = url
-		var filePathToStore = path
-		var fileName = filename
-		var storePath = filepath.Join(filePathToStore, fileName)
-		fileClient := got.New()
-		err := fileClient.Download(fileUrl, storePath)
-
-		if err != nil {
-			// Retry with http.Get
-			if strings.Contains(err.Error(), "Content-Length") {
-				err = DownloadFile(storePath, fileUrl)
-			}
-			if err == nil {
-				log.AsmrLog.Info("文件下载成功: ", zap.String("info", fileName))
-				return nil
-			}
+//	@Description: 获取当前时间
+//	@return string
+func GetCurrentDateTime() string {
+	now := time.Now()
+	// Format the time using the standard format string
+	currentTimeStr := now.Format("2006-01-02 15:04:05")
+	return currentTimeStr
+}
 
-			log.AsmrLog.Error(err.Error())
-			//fmt.Printf("文件: %s下载失败: %s\n", fileName, fileUrl)
-			log.AsmrLog.Error(fmt.Sprintf("文件: %s下载失败: %s", fileName, err.Error()))
+const (
+	// DateBucketNone 不按日期分目录(默认)
+	DateBucketNone = ""
+	// DateBucketDaily 按天分目录 例如 2024-06-01
+	DateBucketDaily = "daily"
+	// DateBucketMonthly 按月分目录 例如 2024-06
+	DateBucketMonthly = "monthly"
+)
 
-			if err := log.DiscordWebhook.Send(fmt.Sprintf("文件: %s下载失败: %s", storePath, err.Error())); err != nil {
-				log.AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
-			}
+// dateBucketGranularity 日期分目录粒度
+var dateBucketGranularity atomic.Value
 
-			//记录失败文件  时间, 文件路径，文件url
-			logStr := GetCurrentDateTime() + "|" + storePath + "|" + fileUrl + "\n"
-			write := bufio.NewWriter(FailedDownloadFile)
-			_, _ = write.WriteString(logStr)
-			//Flush将缓存的文件真正写入到文件中
-			write.Flush()
-			//清理下载失败的文件碎片
-			err2 := os.Remove(storePath)
-			if err2 != nil {
-				log.AsmrLog.Error("删除碎片文件失败文件失败:", zap.String("error", err2.Error()))
-			}
-		} else {
-			log.AsmrLog.Info("文件下载成功: ", zap.String("info", fileName))
-			//fmt.Println("文件下载成功: ", filePathToStore)
-		}
+// SetDateBucket
+//
+//	@Description: 设置下载目录按日期分目录的粒度, 便于区分每次增量同步下载的内容
+//	@param granularity DateBucketNone/DateBucketDaily/DateBucketMonthly
+//	@return error
+func SetDateBucket(granularity string) error {
+	switch granularity {
+	case DateBucketNone, DateBucketDaily, DateBucketMonthly:
+		dateBucketGranularity.Store(granularity)
 		return nil
+	default:
+		return fmt.Errorf("不支持的日期分目录粒度: %s", granularity)
 	}
-
 }
 
-// GetCurrentDateTime
+// DateBucketPath
 //
-//	@Description: 获取当前时间
+//	@Description: 在存储路径后追加当前日期目录, 未开启日期分目录时原样返回
+//	@param basePath
 //	@return string
-func GetCurrentDateTime() string {
-	now := time.Now()
-	// Format the time using the standard format string
-	currentTimeStr := now.Format("2006-01-02 15:04:05")
-	return currentTimeStr
+func DateBucketPath(basePath string) string {
+	granularity, _ := dateBucketGranularity.Load().(string)
+	currentDateTime := GetCurrentDateTime()
+	switch granularity {
+	case DateBucketDaily:
+		return filepath.Join(basePath, currentDateTime[:len("2006-01-02")])
+	case DateBucketMonthly:
+		return filepath.Join(basePath, currentDateTime[:len("2006-01")])
+	default:
+		return basePath
+	}
 }
 
 // NewFixFileDownloader
@@ -229,30 +1705,40 @@ func GetCurrentDateTime() string {
 //		@param storePath
 //		@param resultLines
 //		@return []string
-//		@return error
+//		@return error 服务器返回404/410时为ErrPermanentFailure
 func NewFixFileDownloader(url string, storePath string, resultLines []string) ([]string, error) {
 	//确保路径存在
 	exists := FileOrDirExists(storePath)
 	if !exists {
 		dir := filepath.Dir(storePath)
-		err := os.MkdirAll(dir, os.ModePerm)
+		err := os.MkdirAll(dir, DirMode())
 		if err != nil {
 			log.AsmrLog.Error(fmt.Sprintf("自动创建上一次下载失败文件目录失败: %s", err))
 			return nil, nil
 		}
 	}
 	// Remove the file if there exists 1015 error
-	content, err := os.ReadFile(storePath)
-	if err == nil && string(content) == "error code: 1015" {
-		_ = os.Remove(storePath)
+	_, err := os.Stat(storePath)
+	if err == nil && isThrottledFile(storePath) {
+		_ = discardFailedArtifact(storePath, storePath)
 
 		// Don't download again if file exists
 	} else if err == nil {
 		return resultLines, nil
 	}
+	unlock, ok := lockFile(storePath)
+	if !ok {
+		log.AsmrLog.Info("文件正在被其他进程下载, 跳过: ", zap.String("info", storePath))
+		return resultLines, nil
+	}
+	defer unlock()
 
-	err = DownloadFile(storePath, url)
-	if err != nil {
+	elapsed, err := DownloadFile(storePath, url)
+	if err == nil && !isThrottledFile(storePath) {
+		err = runOnComplete(storePath, url, elapsed)
+	}
+	throttled := errors.Is(err, ErrThrottled) || (err == nil && isThrottledFile(storePath))
+	if err != nil && !throttled {
 		log.AsmrLog.Error(err.Error())
 		//fmt.Printf("文件: %s下载失败: %s\n", fileName, url)
 		log.AsmrLog.Error(fmt.Sprintf("文件: %s下载失败: %s", storePath, err.Error()))
@@ -260,71 +1746,259 @@ func NewFixFileDownloader(url string, storePath string, resultLines []string) ([
 		if err := log.DiscordWebhook.Send(fmt.Sprintf("文件: %s下载失败: %s", storePath, err.Error())); err != nil {
 			log.AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
 		}
+		//清理下载失败的文件碎片 避免下次重试时误认为文件已存在
+		if _, statErr := os.Stat(storePath); statErr == nil {
+			_ = discardFailedArtifact(storePath, storePath)
+		}
+		if isPermanentFailure(err) {
+			if err := appendPermanentlyFailed(FailedRecord{Time: GetCurrentDateTime(), Path: storePath, URL: url, Error: err.Error()}); err != nil {
+				log.AsmrLog.Error("写入永久失败记录失败: ", zap.String("error", err.Error()))
+			}
+			return resultLines, err
+		}
 		//记录失败文件  时间, 文件路径，文件url
 		logStr := GetCurrentDateTime() + "|" + storePath + "|" + url
 		resultLines = append(resultLines, logStr)
 	} else {
 		// Handle cloudflare 1015 error
-		content, err := os.ReadFile(storePath)
-		if err == nil && string(content) == "error code: 1015" {
+		if throttled {
+			markHostThrottled(url)
 			log.AsmrLog.Error(fmt.Sprintf("文件: %s 下载遇到了 1015 错误，休眠10秒后重试。", storePath))
 			if err := log.DiscordWebhook.Send(fmt.Sprintf("文件: %s 下载遇到了 1015 错误，休眠10秒后重试。", storePath)); err != nil {
 				log.AsmrLog.Error("发送Discord Webhook失败: ", zap.String("error", err.Error()))
 			}
-			time.Sleep(time.Second * 10)
+			time.Sleep(throttleCooldown)
 			resultLines = append(resultLines, GetCurrentDateTime()+"|"+storePath+"|"+url)
 			return resultLines, nil
 		}
 
 		log.AsmrLog.Info("文件下载成功: ", zap.String("info", storePath))
+		recordChecksum(storePath, url, "")
 	}
 	return resultLines, nil
 }
 
+// throttleCooldown 重试下载遇到1015错误后的休眠时间
+var throttleCooldown = time.Second * 10
+
+// FixResult
+//
+//	@Description: 修复下载失败文件的执行结果
+type FixResult struct {
+	// 重试后下载成功的文件数
+	Recovered int `json:"recovered"`
+	// 重试次数用尽后仍然失败的文件数
+	StillFailing int `json:"still_failing"`
+	// 无需重试直接清理的记录数(文件已存在或记录格式错误)
+	Pruned int `json:"pruned"`
+	// 重试次数用尽后仍然失败的记录
+	PermanentlyFailed []FailedRecord `json:"permanently_failed"`
+	// 超过最大记录时长不再重试的记录数
+	Expired int `json:"expired"`
+	// 服务器返回404/410, 移动到permanently-failed.txt不再重试的记录数
+	Permanent int `json:"permanent"`
+	// 按记录的失败分类统计的重试结果
+	Categories map[string]*CategoryFixResult `json:"categories,omitempty"`
+}
+
+// CategoryFixResult
+//
+//	@Description: 某一失败分类的重试结果
+type CategoryFixResult struct {
+	Recovered    int `json:"recovered"`
+	StillFailing int `json:"still_failing"`
+	Permanent    int `json:"permanent"`
+}
+
+// category
+//
+//	@Description: 获取失败分类的重试结果统计, 不存在时创建
+//	@receiver r
+//	@param category
+//	@return *CategoryFixResult
+func (r *FixResult) category(category string) *CategoryFixResult {
+	if r.Categories == nil {
+		r.Categories = map[string]*CategoryFixResult{}
+	}
+	stat, ok := r.Categories[category]
+	if !ok {
+		stat = &CategoryFixResult{}
+		r.Categories[category] = stat
+	}
+	return stat
+}
+
+// PermanentlyFailedFileName 超过最大记录时长或服务器返回404/410, 不再重试的下载失败记录
+const PermanentlyFailedFileName = "permanently-failed.txt"
+
+// ErrPermanentFailure 服务器返回404/410, 重试也不会成功
+var ErrPermanentFailure = errors.New("文件不存在, 不再重试")
+
+// retryPermanentFailures 是否仍然重试404/410的文件
+var retryPermanentFailures atomic.Bool
+
+// RetryPermanentFailures
+//
+//	@Description: 设置是否重试服务器返回404/410的文件, 默认不重试, 记录到permanently-failed.txt
+//	@param retry
+func RetryPermanentFailures(retry bool) {
+	retryPermanentFailures.Store(retry)
+}
+
+// permanentStatusError
+//
+//	@Description: RetryPredicate判断不可重试时(默认为状态码404/410)返回ErrPermanentFailure
+//	@param fileUrl
+//	@param statusCode
+//	@param body 错误响应内容
+//	@param err 下载错误
+//	@return error 可以重试时返回nil
+func permanentStatusError(fileUrl string, statusCode int, body []byte, err error) error {
+	if isRetryable(statusCode, body, err) {
+		return nil
+	}
+	if kind := statusErrorKind(statusCode); kind != nil {
+		return &DownloadError{Kind: kind, URL: fileUrl, StatusCode: statusCode, Err: ErrPermanentFailure}
+	}
+	return fmt.Errorf("%w: %s 状态码: %d", ErrPermanentFailure, fileUrl, statusCode)
+}
+
+// isPermanentFailure
+//
+//	@Description: 判断下载错误是否按永久失败处理(不再重试)
+//	@param err
+//	@return bool
+func isPermanentFailure(err error) bool {
+	return errors.Is(err, ErrPermanentFailure) && !retryPermanentFailures.Load()
+}
+
+// isStaleRecord
+//
+//	@Description: 判断下载失败记录是否超过最大记录时长, 时间无法解析时视为未过期
+//	@param record
+//	@param maxAge 小于等于0表示不限制
+//	@return bool
+func isStaleRecord(record FailedRecord, maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+	recordTime, err := time.ParseInLocation("2006-01-02 15:04:05", record.Time, time.Local)
+	if err != nil {
+		return false
+	}
+	return time.Since(recordTime) > maxAge
+}
+
+// appendPermanentlyFailed
+//
+//	@Description: 将记录追加到permanently-failed.txt
+//	@param record
+//	@return error
+func appendPermanentlyFailed(record FailedRecord) error {
+	f, err := os.OpenFile(PermanentlyFailedFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(record.String() + "\n")
+	return err
+}
+
 // FixBrokenDownloadFile
 //
 //	@Description: 以最大重试方式修复下载出错的文件
 //	@param maxRetry
-func FixBrokenDownloadFile(maxRetry int) {
+//	@return *FixResult 修复结果统计
+//	@return error
+func FixBrokenDownloadFile(maxRetry int) (*FixResult, error) {
+	return FixBrokenDownloadFileWithMaxAge(maxRetry, 0)
+}
+
+// FixBrokenDownloadFileWithMaxAge
+//
+//	@Description: 以最大重试方式修复下载出错的文件, 早于maxAge的记录(来源可能已失效)不再重试, 移动到permanently-failed.txt
+//	@param maxRetry
+//	@param maxAge 小于等于0表示不限制
+//	@return *FixResult 修复结果统计
+//	@return error
+func FixBrokenDownloadFileWithMaxAge(maxRetry int, maxAge time.Duration) (*FixResult, error) {
+	return fixBrokenDownloadFile(maxRetry, maxAge, "")
+}
+
+// FixBrokenDownloadFileByCategory
+//
+//	@Description: 只重试指定失败分类的下载失败记录(如只重试throttled/network, 不处理404), 其他记录保留在下载失败日志中.
+//	旧格式的记录没有失败分类, 按FailureOther处理
+//	@param category 失败分类 如FailureThrottled
+//	@param maxRetry
+//	@return *FixResult 修复结果统计, Categories中为该分类的重试结果
+//	@return error
+func FixBrokenDownloadFileByCategory(category string, maxRetry int) (*FixResult, error) {
+	if !isFailureCategory(category) {
+		return &FixResult{}, fmt.Errorf("不支持的失败分类: %s", category)
+	}
+	return fixBrokenDownloadFile(maxRetry, 0, category)
+}
+
+// fixBrokenDownloadFile
+//
+//	@Description: 以最大重试方式修复下载出错的文件
+//	@param maxRetry
+//	@param maxAge 小于等于0表示不限制
+//	@param category 只重试该失败分类的记录, 为空时重试全部记录
+//	@return *FixResult
+//	@return error
+func fixBrokenDownloadFile(maxRetry int, maxAge time.Duration, category string) (*FixResult, error) {
 	log.AsmrLog.Info("正在自动处理下载失败的媒体文件,请稍后...")
-	//复制下载出错的日志文件
+	result := &FixResult{}
+	//将下载出错的日志文件重命名为快照, 处理期间新的失败记录写入重新创建的日志文件
 	var FailedDownloadFileNameTemp = FailedDownloadFileName + ".tmp"
-	err := CopyFile(FailedDownloadFileName, FailedDownloadFileName+".tmp")
-	if err != nil {
-		log.AsmrLog.Error(fmt.Sprintf("复制文件: %s失败: %s", FailedDownloadFileName, err.Error()))
-		return
-	}
-	fi, err := os.Open(FailedDownloadFileNameTemp)
+	err := snapshotFailedDownloadFile(FailedDownloadFileNameTemp)
 	if err != nil {
-		log.AsmrLog.Error(fmt.Sprintf("Error: %s", err))
-		return
+		log.AsmrLog.Error(fmt.Sprintf("创建文件快照: %s失败: %s", FailedDownloadFileName, err.Error()))
+		return result, err
 	}
-
-	br := bufio.NewReader(fi)
-	var resultLine = []string{}
-	for {
-		line, _, c := br.ReadLine()
-		if c == io.EOF {
-			break
+	index := -1
+	err = iterateFailedLines(FailedDownloadFileNameTemp, func(brokenLine string) error {
+		index++
+		record, err := ParseFailedRecord(brokenLine)
+		if err != nil {
+			log.AsmrLog.Error("无法解析下载失败记录,已跳过: ", zap.String("error", err.Error()))
+			result.Pruned++
+			return nil
 		}
-		if len(strings.Trim(string(line), "\r\n")) > 0 {
-			resultLine = append(resultLine, string(line))
+		recordCategory := record.Category
+		if recordCategory == "" {
+			recordCategory = FailureOther
 		}
-	}
-	fi.Close()
-	var resultContainer = []string{}
-	var lastSuccessIndex = -1
-	for index, brokenLine := range resultLine {
+		if category != "" && recordCategory != category {
+			//其他分类的记录原样保留
+			recordFailedDownload(record)
+			return nil
+		}
+		//文件已经存在且不是1015错误页面 无需重试
+		if FileOrDirExists(record.Path) && !isThrottledFile(record.Path) {
+			result.Pruned++
+			return nil
+		}
+		if isStaleRecord(record, maxAge) {
+			if err := appendPermanentlyFailed(record); err != nil {
+				log.AsmrLog.Error("写入永久失败记录失败: ", zap.String("error", err.Error()))
+			}
+			result.Expired++
+			return nil
+		}
+		recovered := false
+		permanent := false
 		for i := 0; i < maxRetry; i++ {
-			if index == lastSuccessIndex {
+			log.AsmrLog.Info(fmt.Sprintf("index: %d,line: %s", index, brokenLine))
+			failedLines, fixErr := NewFixFileDownloader(record.URL, record.Path, nil)
+			if isPermanentFailure(fixErr) {
+				permanent = true
 				break
 			}
-			log.AsmrLog.Info(fmt.Sprintf("index: %d,line: %s", index, brokenLine))
-			fileInfos := strings.Split(brokenLine, "|")
-			downloader, _ := NewFixFileDownloader(fileInfos[2], fileInfos[1], resultContainer)
-			resultContainer = downloader
-			if len(resultContainer) <= 0 {
-				lastSuccessIndex = index
+			if len(failedLines) <= 0 {
+				recovered = true
 				break
 			}
 			if err := log.DiscordWebhook.Send(fmt.Sprintf("重试下载文件再次出错,重试中(剩余重试次数: %d)...", maxRetry-i-1)); err != nil {
@@ -332,21 +2006,40 @@ func FixBrokenDownloadFile(maxRetry int) {
 			}
 			log.AsmrLog.Info(fmt.Sprintf("重试下载文件再次出错,重试中(剩余重试次数: %d)...", maxRetry-i-1))
 		}
+		stat := result.category(recordCategory)
+		if permanent {
+			result.Permanent++
+			stat.Permanent++
+			recordFailureCategory(FailurePermanent)
+		} else if recovered {
+			result.Recovered++
+			stat.Recovered++
+		} else {
+			result.StillFailing++
+			stat.StillFailing++
+			recordFailureCategory(FailureRetryExhausted)
+			result.PermanentlyFailed = append(result.PermanentlyFailed, record)
+		}
+		return nil
+	})
+	if err != nil {
+		log.AsmrLog.Error(fmt.Sprintf("Error: %s", err))
+		//未处理的记录放回日志文件 下次继续重试
+		if restoreErr := restoreFailedLines(FailedDownloadFileNameTemp, index+1); restoreErr != nil {
+			log.AsmrLog.Error("恢复未处理的下载失败记录失败: ", zap.String("error", restoreErr.Error()))
+		}
+		return result, err
 	}
 	//删除temp文件
 	err2 := os.Remove(FailedDownloadFileNameTemp)
 	if err2 != nil {
 		log.AsmrLog.Error("删除临时文件失败:", zap.String("error", err2.Error()))
-		return
-	}
-	//清理文件
-	err = FailedDownloadFile.Truncate(0)
-	if err != nil {
-		log.AsmrLog.Error("清空下载失败日志文件失败:", zap.String("error", err.Error()))
-		return
+		return result, err2
 	}
-	log.AsmrLog.Info("重试下载失败媒体文件已处理完成!")
-
+	log.AsmrLog.Info(fmt.Sprintf("重试下载失败媒体文件已处理完成! 成功: %d, 仍然失败: %d, 已清理: %d, 已过期: %d, 文件不存在: %d",
+		result.Recovered, result.StillFailing, result.Pruned, result.Expired, result.Permanent))
+	finishRun(nil, result)
+	return result, nil
 }
 
 // CheckIfNeedFixBrokenDownloadFile
@@ -355,24 +2048,53 @@ func FixBrokenDownloadFile(maxRetry int) {
 //	@Description: 检测是否需要修复下载出错的文件
 //	@return bool
 func CheckIfNeedFixBrokenDownloadFile() bool {
-	file, err := os.OpenFile(FailedDownloadFileName, os.O_RDONLY, 0666)
-	defer file.Close()
-	if err != nil {
+	found := false
+	errFound := errors.New("found")
+	err := iterateFailedLines(FailedDownloadFileName, func(string) error {
+		found = true
+		return errFound
+	})
+	if err != nil && err != errFound {
 		log.AsmrLog.Error(fmt.Sprintf("打开文件失败: %s", err.Error()))
 		return false
 	}
-	br := bufio.NewReader(file)
-	var resultLine = []string{}
-	for {
-		line, _, c := br.ReadLine()
-		if c == io.EOF {
-			break
-		}
-		if len(strings.Trim(string(line), "\r\n")) > 0 {
-			resultLine = append(resultLine, string(line))
-		}
+	return found
+}
+
+// isThrottledFile
+//
+//	@Description: 判断下载得到的文件是否为cloudflare 1015限流页面
+//	@param path
+//	@return bool
+func isThrottledFile(path string) bool {
+	const throttledBody = "error code: 1015"
+	//只有大小一致时才读取内容 避免读取大文件
+	stat, err := os.Stat(path)
+	if err != nil || stat.Size() != int64(len(throttledBody)) {
+		return false
 	}
-	return len(resultLine) != 0
+	content, err := os.ReadFile(path)
+	return err == nil && string(content) == throttledBody
+}
+
+// CopyOptions
+//
+//	@Description: 复制文件选项
+type CopyOptions struct {
+	// 复制缓冲区大小 小于等于0时使用io.Copy默认缓冲区
+	BufferSize int
+	// 复制完成后是否fsync落盘
+	Sync bool
+	// 是否保留源文件权限
+	PreserveMode bool
+	// 是否保留源文件修改时间
+	PreserveTimes bool
+}
+
+// DefaultCopyOptions 默认复制选项 与CopyFile保持一致: 落盘并保留权限
+var DefaultCopyOptions = CopyOptions{
+	Sync:         true,
+	PreserveMode: true,
 }
 
 // CopyFile
@@ -382,48 +2104,84 @@ func CheckIfNeedFixBrokenDownloadFile() bool {
 //	@param dst
 //	@return err
 func CopyFile(src, dst string) (err error) {
+	return CopyFileOpts(src, dst, DefaultCopyOptions)
+}
+
+// CopyFileOpts
+//
+//	@Description: 按选项复制文件
+//	@param src
+//	@param dst
+//	@param opts
+//	@return err
+func CopyFileOpts(src, dst string, opts CopyOptions) (err error) {
 	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
 
-	out, err := os.Create(dst)
+	out, err := currentStorage().Create(dst)
 	if err != nil {
 		return err
 	}
 	defer func() {
-		if e := out.Close(); e != nil {
+		if e := out.Close(); e != nil && err == nil {
 			err = e
 		}
 	}()
 
-	_, err = io.Copy(out, in)
+	if opts.BufferSize > 0 {
+		_, err = io.CopyBuffer(out, in, make([]byte, opts.BufferSize))
+	} else {
+		_, err = io.Copy(out, in)
+	}
 	if err != nil {
 		return err
 	}
 
-	err = out.Sync()
-	if err != nil {
-		return err
+	if syncer, ok := out.(interface{ Sync() error }); ok && opts.Sync {
+		err = syncer.Sync()
+		if err != nil {
+			return err
+		}
 	}
 
+	//权限与修改时间只对本地文件有效
+	if (!opts.PreserveMode && !opts.PreserveTimes) || !isLocalStorage() {
+		return nil
+	}
 	si, err := os.Stat(src)
 	if err != nil {
 		return err
 	}
-	err = os.Chmod(dst, si.Mode())
-	if err != nil {
-		return err
+	if opts.PreserveMode {
+		err = os.Chmod(dst, si.Mode())
+		if err != nil {
+			return err
+		}
 	}
-	return err
+	if opts.PreserveTimes {
+		err = os.Chtimes(dst, si.ModTime(), si.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func FastFetch(url string, wg *sync.WaitGroup, ch chan<- string) {
 	defer wg.Done()
 
-	startTime := time.Now()
-	resp, err := http.Get(url)
+	stopwatch := NewStopwatch()
+	req, err := NewRequest(context.Background(), "GET", url)
+	if err != nil {
+		fmt.Printf("Error fetching %s: %v\n", url, err)
+		return
+	}
+	client := Client.Get().(*http.Client)
+	defer Client.Put(client)
+	resp, err := client.Do(req)
 	if err != nil {
 		fmt.Printf("Error fetching %s: %v\n", url, err)
 		return
@@ -436,6 +2194,5 @@ func FastFetch(url string, wg *sync.WaitGroup, ch chan<- string) {
 		return
 	}
 
-	duration := time.Since(startTime)
-	ch <- fmt.Sprintf("%s|%s", url, duration)
+	ch <- fmt.Sprintf("%s|%s", url, stopwatch.Elapsed())
 }
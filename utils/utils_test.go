@@ -1,18 +1,2550 @@
 package utils
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/bogem/id3v2/v2"
+	"github.com/go-flac/flacvorbis"
+	flac "github.com/go-flac/go-flac"
+	"github.com/melbahja/got"
 )
 
-func TestCalculatePage(t *testing.T) {
-	CalculateMaxPage(10, 23)
+func TestCalculatePage(t *testing.T) {
+	CalculateMaxPage(10, 23)
+}
+
+func TestGenerateReqSeedRange(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		seed := GenerateReqSeedRange(10, 20)
+		if seed < 10 || seed >= 20 {
+			t.Fatalf("seed超出范围: %d", seed)
+		}
+	}
+}
+
+func TestForEachPage(t *testing.T) {
+	cases := []struct {
+		totalCount int
+		pageSize   int
+		limits     []int
+	}{
+		{0, 10, []int{0}},
+		{20, 10, []int{10, 10}},
+		{23, 10, []int{10, 10, 3}},
+	}
+	for _, c := range cases {
+		var limits []int
+		err := ForEachPage(c.totalCount, c.pageSize, func(page int, offset int, limit int) error {
+			if offset != (page-1)*c.pageSize {
+				t.Fatalf("第%d页偏移量错误: %d", page, offset)
+			}
+			limits = append(limits, limit)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(limits) != fmt.Sprint(c.limits) {
+			t.Fatalf("totalCount=%d pageSize=%d 期望 %v 实际 %v", c.totalCount, c.pageSize, c.limits, limits)
+		}
+	}
+
+	stop := fmt.Errorf("stop")
+	visited := 0
+	err := ForEachPage(50, 10, func(page int, offset int, limit int) error {
+		visited++
+		if page == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || visited != 2 {
+		t.Fatalf("遇到错误后未停止遍历: visited=%d err=%v", visited, err)
+	}
+}
+
+func TestParseFailedRecord(t *testing.T) {
+	legacy, err := ParseFailedRecord("2024-01-01 00:00:00|data/RJ01/a.mp3|https://example.com/a.mp3")
+	if err != nil || legacy.URL != "https://example.com/a.mp3" || legacy.Error != "" {
+		t.Fatalf("legacy record: %+v, %v", legacy, err)
+	}
+	record := FailedRecord{Time: "2024-01-01 00:00:00", Path: "data/RJ01/a.mp3", URL: "https://example.com/a.mp3", Error: "status 503 | retry"}
+	parsed, err := ParseFailedRecord(record.String())
+	if err != nil || parsed != record {
+		t.Fatalf("round trip: %+v, %v", parsed, err)
+	}
+	record.Kind = AssetAudio
+	parsed, err = ParseFailedRecord(record.String())
+	if err != nil || parsed != record {
+		t.Fatalf("round trip with kind: %+v, %v", parsed, err)
+	}
+	record.Category = FailureThrottled
+	parsed, err = ParseFailedRecord(record.String())
+	if err != nil || parsed != record {
+		t.Fatalf("round trip with category: %+v, %v", parsed, err)
+	}
+	parsed, err = ParseFailedRecord(`{"time":"t","path":"p","url":"u","error":"e"}`)
+	if err != nil || parsed != (FailedRecord{Time: "t", Path: "p", URL: "u", Error: "e"}) {
+		t.Fatalf("json record: %+v, %v", parsed, err)
+	}
+	if _, err := ParseFailedRecord("broken"); err == nil {
+		t.Fatal("expected error for malformed record")
+	}
+}
+
+func TestVerifyFileChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "abc.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		ChecksumMD5:    "900150983cd24fb0d6963f7d28e17f72",
+		ChecksumSHA1:   "a9993e364706816aba3e25717850c26c9cd0d89d",
+		ChecksumSHA256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		ChecksumCRC32:  "352441c2",
+	}
+	for algorithm, expected := range cases {
+		if err := VerifyFileChecksum(path, algorithm, strings.ToUpper(expected)); err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+		}
+	}
+	if err := VerifyFileChecksum(path, ChecksumMD5, cases[ChecksumSHA1]); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected mismatch, got %v", err)
+	}
+	if _, err := NewHash("blake3"); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+}
+
+func TestDownloadFileWithInjectedFaults(t *testing.T) {
+	injector := NewTestFaultInjector()
+	injector.Inject("fault.invalid", 1, FaultNetwork)
+	injector.Inject("fault.invalid", 2, Fault1015)
+	SetTestFaultInjector(injector)
+	defer SetTestFaultInjector(nil)
+	ResetHostStats()
+
+	storePath := filepath.Join(t.TempDir(), "a.mp3")
+	if _, err := DownloadFile(storePath, "http://fault.invalid/a.mp3"); !errors.Is(err, ErrInjectedNetwork) {
+		t.Fatalf("expected injected network error, got %v", err)
+	}
+	_, err := DownloadFile(storePath, "http://fault.invalid/a.mp3")
+	var downloadErr *DownloadError
+	if !errors.Is(err, ErrThrottled) || !errors.As(err, &downloadErr) || downloadErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected throttled error, got %v", err)
+	}
+	if FileOrDirExists(storePath) {
+		t.Fatal("expected 1015 body not to be written")
+	}
+	if injector.Requests("fault.invalid") != 2 {
+		t.Fatalf("expected 2 requests, got %d", injector.Requests("fault.invalid"))
+	}
+	stat := HostStats()["fault.invalid"]
+	if stat.Total != 2 || stat.Failures != 2 || stat.Active != 0 || stat.Last1015.IsZero() {
+		t.Fatalf("unexpected host stat: %+v", stat)
+	}
+}
+
+func TestConditionalGetOnGotPath(t *testing.T) {
+	var conditional int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "a.mp3", time.Time{}, strings.NewReader("audio"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	if err := SetConditionalGetManifest(filepath.Join(dir, "manifest.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	defer SetConditionalGetManifest("")
+
+	url := server.URL + "/a.mp3"
+	if NeedsRevalidation(url) {
+		t.Fatal("expected no manifest entry before the first download")
+	}
+	if err := NewFileDownloader(url, dir, "a.mp3")(); err != nil {
+		t.Fatal(err)
+	}
+	if !NeedsRevalidation(url) {
+		t.Fatal("expected ETag to be recorded after the first download")
+	}
+	if err := NewFileDownloader(url, dir, "a.mp3")(); err != nil {
+		t.Fatal(err)
+	}
+	if conditional != 1 {
+		t.Fatalf("expected 1 conditional request, got %d", conditional)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "a.mp3")); err != nil || string(data) != "audio" {
+		t.Fatalf("expected file to be kept, got %q %v", data, err)
+	}
+}
+
+func TestBatchProgress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "a.mp3", time.Time{}, strings.NewReader("audio"))
+	}))
+	defer server.Close()
+
+	progress := NewBatchProgress()
+	SetBatchProgress(progress)
+	defer SetBatchProgress(nil)
+	if err := NewFileDownloader(server.URL+"/a.mp3", t.TempDir(), "a.mp3")(); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := progress.Snapshot()
+	if snapshot.TotalFiles != 1 || snapshot.DoneFiles != 1 || snapshot.TotalBytes != 5 || snapshot.BytesDone != 5 {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+}
+
+func TestKeepFailedArtifacts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	SetKeepFailedArtifacts(true)
+	defer SetKeepFailedArtifacts(false)
+	storePath := filepath.Join(t.TempDir(), "a.mp3")
+	if _, err := DownloadFile(storePath, server.URL+"/a.mp3"); !errors.Is(err, ErrEmptyFile) {
+		t.Fatalf("expected empty file error, got %v", err)
+	}
+	if !FileOrDirExists(storePath + ".failed") {
+		t.Fatal("expected part file to be kept as .failed")
+	}
+	if FileOrDirExists(partPath(storePath)) {
+		t.Fatal("expected part file to be moved")
+	}
+}
+
+func TestFixBrokenDownloadFileWithInjectedFaults(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	injector := NewTestFaultInjector()
+	injector.Inject(host, 1, FaultNetwork)
+	injector.Inject(host, 2, Fault1015)
+	SetTestFaultInjector(injector)
+	defer SetTestFaultInjector(nil)
+	ResetHostStats()
+	cooldown := throttleCooldown
+	throttleCooldown = 0
+	defer func() { throttleCooldown = cooldown }()
+
+	if err := FailedDownloadFile.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	storePath := filepath.Join(t.TempDir(), "a.mp3")
+	recordFailedDownload(FailedRecord{Time: GetCurrentDateTime(), Path: storePath, URL: server.URL + "/a.mp3"})
+
+	result, err := FixBrokenDownloadFile(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Recovered != 1 || result.StillFailing != 0 {
+		t.Fatalf("unexpected fix result: %+v", result)
+	}
+	if injector.Requests(host) != 3 {
+		t.Fatalf("expected 3 requests, got %d", injector.Requests(host))
+	}
+	if data, err := os.ReadFile(storePath); err != nil || string(data) != "audio" {
+		t.Fatalf("expected recovered file, got %q %v", data, err)
+	}
+	stat := HostStats()[host]
+	if stat.Total != 3 || stat.Failures != 2 || stat.Last1015.IsZero() {
+		t.Fatalf("unexpected host stat: %+v", stat)
+	}
+}
+
+func TestContentDispositionFileName(t *testing.T) {
+	var heads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads++
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="track 01.mp3"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("audio"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	if err := NewFileDownloader(server.URL+"/download?id=1", dir, "")(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "track 01.mp3")); err != nil || string(data) != "audio" {
+		t.Fatalf("expected file named from Content-Disposition, got %q %v", data, err)
+	}
+	if FileOrDirExists(filepath.Join(dir, "download")) || FileOrDirExists(partPath(filepath.Join(dir, "download"))) {
+		t.Fatal("expected provisional file to be renamed")
+	}
+	if heads != 0 {
+		t.Fatalf("expected no HEAD request, got %d", heads)
+	}
+}
+
+func TestSetExtensionRoutes(t *testing.T) {
+	defer SetExtensionRoutes(nil)
+	for _, dir := range []string{"../..", "audio/../../x", "/tmp"} {
+		if err := SetExtensionRoutes(map[string]string{"mp3": dir}); err == nil {
+			t.Fatalf("expected route %q to be rejected", dir)
+		}
+	}
+	if err := SetExtensionRoutes(map[string]string{"MP3": "audio/mp3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := StorePathFor("dl", "a.mp3", ""); got != filepath.Join("dl", "audio", "mp3", "a.mp3") {
+		t.Fatalf("unexpected store path: %s", got)
+	}
+}
+
+func TestPrefetchSizes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(r.URL.Path))
+	}))
+	defer server.Close()
+
+	sizes, err := PrefetchSizes(context.Background(), []string{server.URL + "/a", server.URL + "/abc", server.URL + "/missing"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 2 || sizes[server.URL+"/a"] != 2 || sizes[server.URL+"/abc"] != 4 {
+		t.Fatalf("unexpected sizes: %v", sizes)
+	}
+}
+
+func TestCollisionFreePath(t *testing.T) {
+	SetDisambiguateCaseCollisions(true)
+	defer SetDisambiguateCaseCollisions(false)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "Track.mp3"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if got := CollisionFreePath(filepath.Join(dir, "Track.mp3")); got != filepath.Join(dir, "Track.mp3") {
+		t.Fatalf("expected same name to be kept, got %s", got)
+	}
+	if got := CollisionFreePath(filepath.Join(dir, "track.mp3")); got != filepath.Join(dir, "track (1).mp3") {
+		t.Fatalf("expected collision to be renamed, got %s", got)
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	defer server.Close()
+
+	var buf strings.Builder
+	n, err := DownloadRange(context.Background(), server.URL, 3, 5, &buf)
+	if err != nil || n != 3 || buf.String() != "345" {
+		t.Fatalf("unexpected range result: %d %q %v", n, buf.String(), err)
+	}
+	buf.Reset()
+	if _, err := DownloadRange(context.Background(), server.URL, 7, -1, &buf); err != nil || buf.String() != "789" {
+		t.Fatalf("unexpected open range result: %q %v", buf.String(), err)
+	}
+}
+
+// memStorage 测试用的内存存储
+type memStorage struct {
+	sync.Mutex
+	files map[string]*strings.Builder
+}
+
+type memFile struct {
+	*strings.Builder
+}
+
+func (memFile) Close() error { return nil }
+
+func (m *memStorage) Create(path string) (io.WriteCloser, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.files[path] = &strings.Builder{}
+	return memFile{m.files[path]}, nil
+}
+
+func (m *memStorage) Exists(path string) bool {
+	m.Lock()
+	defer m.Unlock()
+	_, ok := m.files[path]
+	return ok
+}
+
+func (m *memStorage) Remove(path string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.files, path)
+	return nil
+}
+
+func (m *memStorage) Rename(oldPath string, newPath string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.files[newPath] = m.files[oldPath]
+	delete(m.files, oldPath)
+	return nil
+}
+
+func TestStorage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+
+	store := &memStorage{files: map[string]*strings.Builder{}}
+	SetStorage(store)
+	defer SetStorage(nil)
+	if err := NewFileDownloader(server.URL+"/a.mp3", "mem", "a.mp3")(); err != nil {
+		t.Fatal(err)
+	}
+	file, ok := store.files[filepath.Join("mem", "a.mp3")]
+	if !ok || file.String() != "audio" || len(store.files) != 1 {
+		t.Fatalf("unexpected storage content: %v", store.files)
+	}
+}
+
+func TestPermanentFailures(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	if err := FailedDownloadFile.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	storePath := filepath.Join(t.TempDir(), "a.mp3")
+	recordFailedDownload(FailedRecord{Time: GetCurrentDateTime(), Path: storePath, URL: server.URL + "/a.mp3"})
+	result, err := FixBrokenDownloadFile(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Permanent != 1 || requests != 1 {
+		t.Fatalf("expected a single attempt for 404, got %+v after %d requests", result, requests)
+	}
+	if _, err := DownloadFile(storePath, server.URL+"/a.mp3"); !errors.Is(err, ErrPermanentFailure) {
+		t.Fatalf("expected permanent failure, got %v", err)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	started := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	progress := NewBatchProgress()
+	SetBatchProgress(progress)
+	defer SetBatchProgress(nil)
+	done := make(chan error)
+	go func() {
+		done <- NewFileDownloaderWithOptions(server.URL+"/a.mp3", t.TempDir(), "a.mp3", DownloadOptions{JobID: "cancel-me"})()
+	}()
+	<-started
+	if !CancelJob("cancel-me") {
+		t.Fatal("expected job to be registered")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if snapshot := progress.Snapshot(); snapshot.CanceledFiles != 1 || snapshot.FailedFiles != 0 {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+	if CancelJob("cancel-me") {
+		t.Fatal("expected job to be unregistered")
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	SetFailFast(true)
+	defer SetFailFast(false)
+	err := NewFileDownloader(server.URL+"/a.mp3", t.TempDir(), "a.mp3")()
+	if !errors.Is(err, ErrEmptyFile) || !errors.Is(FailFastError(), ErrEmptyFile) {
+		t.Fatalf("expected run to be aborted by the empty file, got %v / %v", err, FailFastError())
+	}
+	progress := NewBatchProgress()
+	SetBatchProgress(progress)
+	defer SetBatchProgress(nil)
+	if err := NewFileDownloader(server.URL+"/b.mp3", t.TempDir(), "b.mp3")(); err != nil {
+		t.Fatal(err)
+	}
+	if progress.Snapshot().CanceledFiles != 1 {
+		t.Fatalf("expected later downloads to be canceled: %+v", progress.Snapshot())
+	}
+}
+
+func TestPathsEqual(t *testing.T) {
+	nfd := "\u30cf\u309a" // パ(NFD)
+	if !PathsEqual("a/"+nfd+".mp3", "a\\\u30d1.mp3") || !PathsEqual("a//b/", "a/b") {
+		t.Fatal("expected normalized paths to be equal")
+	}
+	if PathsEqual("A.mp3", "a.mp3") {
+		t.Fatal("expected case to matter by default")
+	}
+	SetCaseFoldPaths(true)
+	defer SetCaseFoldPaths(false)
+	if !PathsEqual("A.mp3", "a.mp3") {
+		t.Fatal("expected case to be folded")
+	}
+}
+
+func TestRefreshURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") != "fresh" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("audio"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	opts := DownloadOptions{RefreshURL: func(oldURL string) (string, error) {
+		return server.URL + "/a.mp3?sig=fresh", nil
+	}}
+	if err := NewFileDownloaderWithOptions(server.URL+"/a.mp3?sig=old", dir, "a.mp3", opts)(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "a.mp3")); err != nil || string(data) != "audio" {
+		t.Fatalf("expected download with refreshed url, got %q %v", data, err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	//Shutdown后开始新的运行
+	defer SetFailFast(false)
+
+	done := make(chan error)
+	go func() {
+		done <- NewFileDownloader(server.URL+"/a.mp3", t.TempDir(), "a.mp3")()
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	interrupted, err := Shutdown(ctx)
+	if err != nil || interrupted != 1 {
+		t.Fatalf("unexpected shutdown result: %d %v", interrupted, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostConcurrency(t *testing.T) {
+	var lock sync.Mutex
+	active := map[string]int{}
+	maxActive := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		active[r.URL.Path]++
+		if len(active) > maxActive {
+			maxActive = len(active)
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		if active[r.URL.Path]--; active[r.URL.Path] == 0 {
+			delete(active, r.URL.Path)
+		}
+		lock.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("audio"))
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	SetHostConcurrency(host, 1)
+	defer SetHostConcurrency(host, 0)
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			_ = NewFileDownloader(server.URL+"/"+name, dir, name)()
+		}(name)
+	}
+	wg.Wait()
+	if maxActive != 1 {
+		t.Fatalf("expected at most 1 file downloading at a time, got %d", maxActive)
+	}
+}
+
+func TestEstimateBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(strings.Repeat("a", 1024)))
+	}))
+	defer server.Close()
+
+	estimate, err := EstimateBatch(context.Background(), []string{server.URL + "/a", server.URL + "/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Files != 2 || estimate.SizedFiles != 2 || estimate.TotalBytes != 2048 || estimate.BytesPerSecond <= 0 {
+		t.Fatalf("unexpected estimate: %+v", estimate)
+	}
+}
+
+func TestEngineNetHTTP(t *testing.T) {
+	var ranged int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranged++
+		}
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	if err := NewFileDownloaderWithOptions(server.URL+"/a.mp3", dir, "a.mp3", DownloadOptions{Engine: EngineNetHTTP})(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "a.mp3")); err != nil || string(data) != "audio" || ranged != 0 {
+		t.Fatalf("expected single connection download, got %q %v ranged=%d", data, err, ranged)
+	}
+}
+
+func TestNewRequestAppliesDefaults(t *testing.T) {
+	SetRequestDefaults("test-agent", map[string]string{"X-Extra": "1"}, "Bearer token")
+	defer SetRequestDefaults("", nil, "")
+
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Content-Length", "3")
+		_, _ = w.Write([]byte("abc"))
+	}))
+	defer server.Close()
+
+	storePath := filepath.Join(t.TempDir(), "file.bin")
+	if _, err := downloadFileWithContext(context.Background(), storePath, server.URL, nil); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if got.Get("User-Agent") != "test-agent" || got.Get("X-Extra") != "1" || got.Get("Authorization") != "Bearer token" {
+		t.Fatalf("unexpected headers: %v", got)
+	}
+}
+
+func TestFixBrokenDownloadFileKeepsNewFailures(t *testing.T) {
+	newRecord := FailedRecord{Time: GetCurrentDateTime(), Path: filepath.Join(t.TempDir(), "new.mp3"), URL: "http://example.invalid/new.mp3"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//模拟修复期间其他下载写入新的失败记录
+		recordFailedDownload(newRecord)
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+
+	if err := FailedDownloadFile.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	storePath := filepath.Join(t.TempDir(), "a.mp3")
+	recordFailedDownload(FailedRecord{Time: GetCurrentDateTime(), Path: storePath, URL: server.URL + "/a.mp3"})
+	if _, err := FixBrokenDownloadFile(1); err != nil {
+		t.Fatal(err)
+	}
+	if FileOrDirExists(FailedDownloadFileName + ".tmp") {
+		t.Fatal("expected snapshot to be removed")
+	}
+	data, err := os.ReadFile(FailedDownloadFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), newRecord.URL) || strings.Contains(string(data), server.URL) {
+		t.Fatalf("unexpected failed log content: %q", data)
+	}
+	if err := FailedDownloadFile.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRJFolderPath(t *testing.T) {
+	cases := map[string]string{
+		"RJ123456":  filepath.Join("base", "RJ123456", "a_b"),
+		"rj1234":    filepath.Join("base", "RJ001234", "a_b"),
+		"1234567":   filepath.Join("base", "RJ01234567", "a_b"),
+		"RJ":        "",
+		"RJ12a":     "",
+		"123456789": "",
+	}
+	for code, want := range cases {
+		if got := RJFolderPath("base", code, "a/b"); got != want {
+			t.Errorf("RJFolderPath(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestNewFileDownloaderFallsBackToNetHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			//got的请求均带Range请求头
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	if err := NewFileDownloader(server.URL+"/a.mp3", dir, "a.mp3")(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "a.mp3")); err != nil || string(data) != "audio" {
+		t.Fatalf("expected net/http fallback to succeed, got %q %v", data, err)
+	}
+}
+
+func TestFileOrDirExistsBrokenSymlink(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "a.mp3")
+	if err := os.Symlink(filepath.Join(dir, "missing.mp3"), link); err != nil {
+		t.Skip(err)
+	}
+	if !FileOrDirExists(link) {
+		t.Fatal("expected broken symlink to exist by default")
+	}
+	SetFollowSymlinks(true)
+	defer SetFollowSymlinks(false)
+	if FileOrDirExists(link) {
+		t.Fatal("expected broken symlink to be treated as missing")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "missing.mp3"), []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !FileOrDirExists(link) {
+		t.Fatal("expected symlink with target to exist")
+	}
+}
+
+func TestDownloadResumesFromProgressFile(t *testing.T) {
+	SetProgressSidecar(1)
+	defer SetProgressSidecar(0)
+	content := strings.Repeat("0123456789", 10)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "a.mp3", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	for _, etag := range []string{`"v1"`, `"v0"`} {
+		ranges = nil
+		storePath := filepath.Join(t.TempDir(), "a.mp3")
+		//模拟崩溃: .part文件中记录进度之后还有未同步的脏数据
+		if err := os.WriteFile(partPath(storePath), []byte(content[:30]+"garbage"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveProgress(storePath, progressRecord{URL: server.URL, ETag: etag, Bytes: 30}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := downloadFileWithContext(context.Background(), storePath, server.URL, nil); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := os.ReadFile(storePath); err != nil || string(data) != content {
+			t.Fatalf("etag %s: unexpected content %q %v", etag, data, err)
+		}
+		if len(ranges) != 1 || ranges[0] != "bytes=30-" {
+			t.Fatalf("etag %s: unexpected requests %v", etag, ranges)
+		}
+		if FileOrDirExists(progressPath(storePath)) {
+			t.Fatal("expected progress file to be removed")
+		}
+	}
+}
+
+func TestDownloadBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "missing.mp3") {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	jobs := []DownloadJob{
+		{URL: server.URL + "/a.mp3", Path: dir, Filename: "a.mp3"},
+		{URL: server.URL + "/missing.mp3", Path: dir, Filename: "missing.mp3"},
+		{URL: server.URL + "/b.mp3", Path: dir, Filename: "b.mp3", Checksum: "0000"},
+	}
+	result, err := DownloadBatch(context.Background(), jobs, 2)
+	if err == nil || !errors.Is(err, ErrPermanentFailure) {
+		t.Fatalf("expected aggregated error, got %v", err)
+	}
+	if result.Done != 1 || result.Failed != 2 {
+		t.Fatalf("unexpected batch result: %+v", result)
+	}
+	if result.Results[0].Status != JobDone || result.Results[0].Path != filepath.Join(dir, "a.mp3") {
+		t.Fatalf("unexpected first result: %+v", result.Results[0])
+	}
+	if result.Results[1].Status != JobFailed || result.Results[2].Status != JobFailed {
+		t.Fatalf("unexpected results: %+v", result.Results)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err = DownloadBatch(ctx, jobs[:1], 1)
+	if !errors.Is(err, context.Canceled) || result.Canceled != 1 {
+		t.Fatalf("expected canceled batch, got %+v %v", result, err)
+	}
+}
+
+func TestDownloadBatchLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "missing.mp3") {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+	t.Chdir(t.TempDir())
+
+	dir := t.TempDir()
+	jobs := []DownloadJob{
+		{URL: server.URL + "/missing.mp3", Path: dir, Filename: "missing.mp3"},
+		{URL: server.URL + "/a.mp3", Path: dir, Filename: "a.mp3"},
+		{URL: server.URL + "/b.mp3", Path: dir, Filename: "b.mp3"},
+		{URL: server.URL + "/c.mp3", Path: dir, Filename: "c.mp3"},
+	}
+	result, _ := DownloadBatchWithOptions(context.Background(), jobs, BatchOptions{Workers: 1, Limit: 2})
+	if result.Done != 2 || result.Failed != 1 || result.Deferred != 1 {
+		t.Fatalf("unexpected limited batch result: %+v", result)
+	}
+	if result.Results[3].Status != JobDeferred {
+		t.Fatalf("expected last job deferred, got %+v", result.Results)
+	}
+
+	result, err := ResumeDeferred(context.Background(), 1)
+	if err != nil || result.Done != 1 || result.Results[0].Path != filepath.Join(dir, "c.mp3") {
+		t.Fatalf("unexpected resumed result: %+v %v", result, err)
+	}
+	if _, err := os.Stat(DeferredDownloadFileName); !os.IsNotExist(err) {
+		t.Fatalf("expected deferred log removed, got %v", err)
+	}
+}
+
+func TestDownloadErrorKinds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "missing.mp3"):
+			http.NotFound(w, r)
+		case strings.HasSuffix(r.URL.Path, "short.mp3"):
+			w.Header().Set("Content-Length", "10")
+			_, _ = w.Write([]byte("audio"))
+		default:
+			_, _ = w.Write([]byte("audio"))
+		}
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+
+	_, err := DownloadFile(filepath.Join(dir, "missing.mp3"), server.URL+"/missing.mp3")
+	if !errors.Is(err, ErrNotFound) || !errors.Is(err, ErrPermanentFailure) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if _, err := DownloadFile(filepath.Join(dir, "short.mp3"), server.URL+"/short.mp3"); err == nil {
+		t.Fatal("expected truncated body to fail")
+	}
+
+	readOnly := filepath.Join(dir, "readonly")
+	if err := os.Mkdir(readOnly, 0555); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := os.Create(filepath.Join(readOnly, "probe")); err == nil {
+		_ = f.Close()
+		t.Skip("directory permissions are not enforced")
+	}
+	_, err = DownloadFile(filepath.Join(readOnly, "a.mp3"), server.URL+"/a.mp3")
+	if !errors.Is(err, ErrUnwritable) || failureCategory(err) != FailureUnwritable {
+		t.Fatalf("expected unwritable error, got %v", err)
+	}
+}
+
+func TestFixBrokenDownloadFileByCategory(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+	if err := FailedDownloadFile.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = FailedDownloadFile.Truncate(0) }()
+
+	dir := t.TempDir()
+	throttled := FailedRecord{Time: GetCurrentDateTime(), Path: filepath.Join(dir, "a.mp3"), URL: server.URL + "/a.mp3", Error: "429", Kind: AssetAudio, Category: FailureThrottled}
+	missing := FailedRecord{Time: GetCurrentDateTime(), Path: filepath.Join(dir, "b.mp3"), URL: server.URL + "/b.mp3", Error: "404", Kind: AssetAudio, Category: FailurePermanent}
+	recordFailedDownload(throttled)
+	recordFailedDownload(missing)
+
+	if _, err := FixBrokenDownloadFileByCategory("unknown", 1); err == nil {
+		t.Fatal("expected error for unknown category")
+	}
+	result, err := FixBrokenDownloadFileByCategory(FailureThrottled, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Recovered != 1 || result.Categories[FailureThrottled].Recovered != 1 || result.Categories[FailurePermanent] != nil {
+		t.Fatalf("unexpected fix result: %+v", result)
+	}
+	var remaining []FailedRecord
+	if err := IterateFailedDownloads(func(record FailedRecord) error {
+		remaining = append(remaining, record)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0] != missing {
+		t.Fatalf("expected other categories to be kept, got %+v", remaining)
+	}
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	SetAdaptiveConcurrency(AdaptiveOptions{MaxConcurrency: 4, Window: 4, DelayStep: 10 * time.Millisecond})
+	defer SetAdaptiveConcurrency(AdaptiveOptions{})
+
+	recordAdaptiveOutcome(true)
+	recordAdaptiveOutcome(true)
+	if state := AdaptiveConcurrencyState(); state.Limit != 2 || state.Delay != 10*time.Millisecond {
+		t.Fatalf("expected ramp-down, got %+v", state)
+	}
+	recordAdaptiveOutcome(true)
+	recordAdaptiveOutcome(true)
+	if state := AdaptiveConcurrencyState(); state.Limit != 1 || state.Delay != 20*time.Millisecond {
+		t.Fatalf("expected second ramp-down, got %+v", state)
+	}
+
+	release, err := acquireAdaptive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := acquireAdaptive(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected acquire to wait for the only slot, got %v", err)
+	}
+	release()
+
+	for i := 0; i < 3; i++ {
+		recordAdaptiveOutcome(false)
+	}
+	if state := AdaptiveConcurrencyState(); state.Limit != 2 || state.Delay != 0 {
+		t.Fatalf("expected gradual recovery, got %+v", state)
+	}
+}
+
+func TestTestProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	if proxyUsed, err := TestProxy(context.Background(), server.URL); err != nil || proxyUsed != "" {
+		t.Fatalf("expected direct connection, got %q %v", proxyUsed, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadProxy := "http://" + listener.Addr().String()
+	_ = listener.Close()
+	if err := SetProxy("127.0.0.1"); err == nil {
+		t.Fatal("expected error for proxy without scheme")
+	}
+	//设置前已在池中的Client同样使用新的代理
+	client := Client.Get().(*http.Client)
+	defer Client.Put(client)
+	if err := SetProxy(deadProxy); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = SetProxy("") }()
+	if resp, err := client.Get(server.URL); err == nil {
+		_ = resp.Body.Close()
+		t.Fatal("expected pooled client to use the new proxy")
+	}
+
+	proxyUsed, err := TestProxy(context.Background(), server.URL)
+	if err == nil || proxyUsed != deadProxy {
+		t.Fatalf("expected dead proxy error, got %q %v", proxyUsed, err)
+	}
+	if err := SelfTest(context.Background(), server.URL); err == nil {
+		t.Fatal("expected self test to fail")
+	}
+}
+
+func TestHashSidecar(t *testing.T) {
+	sum := sha256.Sum256([]byte("audio"))
+	digest := hex.EncodeToString(sum[:])
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.mp3.sha256":
+			_, _ = w.Write([]byte(digest + "  a.mp3\n"))
+		case "/bad.mp3.sha256":
+			_, _ = w.Write([]byte(strings.Repeat("0", 64)))
+		case "/none.mp3.sha256":
+			http.NotFound(w, r)
+		default:
+			requests.Add(1)
+			_, _ = w.Write([]byte("audio"))
+		}
+	}))
+	defer server.Close()
+	SetHashSidecar(".sha256")
+	defer SetHashSidecar("")
+	t.Chdir(t.TempDir())
+
+	dir := t.TempDir()
+	opts := DownloadOptions{Engine: EngineNetHTTP}
+	for _, name := range []string{"a.mp3", "none.mp3"} {
+		if err := NewFileDownloaderWithOptions(server.URL+"/"+name, dir, name, opts)(); err != nil {
+			t.Fatal(err)
+		}
+		if !FileOrDirExists(filepath.Join(dir, name)) {
+			t.Fatalf("expected %s to be downloaded", name)
+		}
+	}
+	requests.Store(0)
+	var result JobResult
+	opts.OnResult = func(r JobResult) { result = r }
+	_ = NewFileDownloaderWithOptions(server.URL+"/bad.mp3", dir, "bad.mp3", opts)()
+	if !errors.Is(result.Err, ErrChecksumMismatch) || requests.Load() != 2 {
+		t.Fatalf("expected mismatch after one retry, got %+v with %d requests", result, requests.Load())
+	}
+}
+
+func TestProgressRenderer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+	if _, err := NewProgressRenderer("fancy", io.Discard); err == nil {
+		t.Fatal("expected error for unknown renderer")
+	}
+	progress := NewBatchProgress()
+	SetBatchProgress(progress)
+	defer SetBatchProgress(nil)
+	defer SetProgressRenderer(nil)
+
+	var buf strings.Builder
+	SetProgressRenderer(NewJSONRenderer(&buf))
+	dir := t.TempDir()
+	if err := NewFileDownloaderWithOptions(server.URL+"/a.mp3", dir, "a.mp3", DownloadOptions{Engine: EngineNetHTTP})(); err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	scanner := bufio.NewScanner(strings.NewReader(buf.String()))
+	for scanner.Scan() {
+		var event progressEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event.Event)
+		if event.Event == "file_progress" && event.File.Bytes != 5 {
+			t.Fatalf("unexpected file progress: %+v", event.File)
+		}
+	}
+	if strings.Join(events, ",") != "file_started,file_progress,file_finished,batch" {
+		t.Fatalf("unexpected events: %v", events)
+	}
+
+	var bar strings.Builder
+	SetProgressRenderer(NewBarRenderer(&bar))
+	if err := NewFileDownloaderWithOptions(server.URL+"/b.mp3", dir, "b.mp3", DownloadOptions{Engine: EngineNetHTTP})(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bar.String(), "2/2") || !strings.Contains(bar.String(), "b.mp3") {
+		t.Fatalf("unexpected progress bar: %q", bar.String())
+	}
+}
+
+func TestErrorBodyRule(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/error.mp3":
+			_, _ = w.Write([]byte(`{"error": "token expired"}`))
+		case "/page.jpg":
+			_, _ = w.Write([]byte("<!DOCTYPE html><html></html>"))
+		default:
+			_, _ = w.Write([]byte(`{"title": "metadata"}`))
+		}
+	}))
+	defer server.Close()
+	if err := SetErrorBodyRule(&ErrorBodyRule{Patterns: []string{"("}}); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+	if err := SetErrorBodyRule(&ErrorBodyRule{}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = SetErrorBodyRule(nil) }()
+
+	dir := t.TempDir()
+	for _, name := range []string{"error.mp3", "page.jpg"} {
+		requests.Store(0)
+		var result JobResult
+		opts := DownloadOptions{Engine: EngineNetHTTP, OnResult: func(r JobResult) { result = r }}
+		_ = NewFileDownloaderWithOptions(server.URL+"/"+name, dir, name, opts)()
+		if !errors.Is(result.Err, ErrErrorBody) || requests.Load() != 2 || FileOrDirExists(filepath.Join(dir, name)) {
+			t.Fatalf("expected %s to be rejected after one retry, got %+v with %d requests", name, result, requests.Load())
+		}
+	}
+	//metadata类型不检测
+	if err := NewFileDownloaderWithOptions(server.URL+"/work.json", dir, "work.json", DownloadOptions{Engine: EngineNetHTTP})(); err != nil {
+		t.Fatal(err)
+	}
+	if !FileOrDirExists(filepath.Join(dir, "work.json")) {
+		t.Fatal("expected metadata to be kept")
+	}
+}
+
+func TestHostFailureThreshold(t *testing.T) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer mirror.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downHost := listener.Addr().String()
+	_ = listener.Close()
+	SetHostFailureThreshold(2, time.Minute)
+	defer SetHostFailureThreshold(0, 0)
+	SetHostMirrors(downHost, []string{strings.TrimPrefix(mirror.URL, "http://")})
+	defer SetHostMirrors(downHost, nil)
+	t.Chdir(t.TempDir())
+
+	dir := t.TempDir()
+	download := func(name string) JobResult {
+		var result JobResult
+		opts := DownloadOptions{Engine: EngineNetHTTP, OnResult: func(r JobResult) { result = r }}
+		_ = NewFileDownloaderWithOptions("http://"+downHost+"/"+name, dir, name, opts)()
+		return result
+	}
+	for _, name := range []string{"a.mp3", "b.mp3"} {
+		if result := download(name); result.Status != JobFailed {
+			t.Fatalf("expected %s to fail, got %+v", name, result)
+		}
+	}
+	if !HostDown(downHost) {
+		t.Fatal("expected host to be marked down")
+	}
+	if result := download("c.mp3"); result.Status != JobDone {
+		t.Fatalf("expected download from mirror, got %+v", result)
+	}
+
+	SetHostMirrors(downHost, nil)
+	if result := download("d.mp3"); result.Status != JobDeferred || !errors.Is(result.Err, ErrHostDown) {
+		t.Fatalf("expected deferred download, got %+v", result)
+	}
+	data, err := os.ReadFile(DeferredDownloadFileName)
+	if err != nil || !strings.Contains(string(data), "d.mp3") {
+		t.Fatalf("expected deferred record, got %q %v", data, err)
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	at := func(clock string) time.Time {
+		parsed, _ := time.Parse("15:04", clock)
+		return parsed
+	}
+	if !inQuietHours(at("10:00"), 9*60, 17*60) || inQuietHours(at("17:00"), 9*60, 17*60) {
+		t.Fatal("unexpected daytime window")
+	}
+	if !inQuietHours(at("23:30"), 22*60, 7*60) || !inQuietHours(at("06:59"), 22*60, 7*60) || inQuietHours(at("12:00"), 22*60, 7*60) {
+		t.Fatal("unexpected overnight window")
+	}
+	Pause()
+	done := make(chan error, 1)
+	go func() { done <- waitIfPaused(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	Resume()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Resume to wake waiting downloads")
+	}
+	if err := SetQuietHours("25:00", "07:00", ""); err == nil {
+		t.Fatal("expected error for invalid clock")
+	}
+	if err := SetQuietHours("22:00", "07:00", "Mars/Olympus"); err == nil {
+		t.Fatal("expected error for invalid timezone")
+	}
+	//全天静默
+	if err := SetQuietHours("00:00", "23:59", "UTC"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = SetQuietHours("", "", "") }()
+	deadline := time.Now().Add(time.Second)
+	for !Paused() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !Paused() {
+		t.Skip("outside the quiet window")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := waitIfPaused(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected wait to respect context, got %v", err)
+	}
+}
+
+func TestHasEnoughDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	ok, err := HasEnoughDiskSpace(filepath.Join(dir, "RJ01000000", "sub"), 1, 1)
+	if !ok || err != nil {
+		t.Fatalf("expected enough space, got %v %v", ok, err)
+	}
+	ok, err = HasEnoughDiskSpace(dir, math.MaxInt64, 0)
+	if ok || !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("expected ErrDiskFull for bytes, got %v %v", ok, err)
+	}
+	space, supported, err := diskSpace(dir)
+	if err != nil || !supported || space.TotalInodes == 0 {
+		t.Skip("filesystem does not report inodes")
+	}
+	ok, err = HasEnoughDiskSpace(dir, 0, math.MaxInt64)
+	if ok || !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("expected ErrDiskFull for inodes, got %v %v", ok, err)
+	}
+}
+
+func TestResumableCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.wav")
+	dst := filepath.Join(dir, "dst.wav")
+	content := bytes.Repeat([]byte("0123456789"), 300*1024)
+	if err := os.WriteFile(src, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	//中断的复制: 目标文件为源文件的前一部分
+	if err := os.WriteFile(dst, content[:len(content)/3], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResumableCopyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dst); !bytes.Equal(got, content) {
+		t.Fatalf("resumed copy mismatch: %d bytes", len(got))
+	}
+	//已复制部分与源文件不一致时重新复制
+	corrupt := append([]byte("xxxx"), content[4:len(content)/2]...)
+	if err := os.WriteFile(dst, corrupt, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResumableCopyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dst); !bytes.Equal(got, content) {
+		t.Fatalf("recopy mismatch: %d bytes", len(got))
+	}
+}
+
+func TestAutoTuneConcurrency(t *testing.T) {
+	var active, requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//超过2个连接同时下载时限流
+		defer active.Add(-1)
+		requests.Add(1)
+		if active.Add(1) > 2 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write(make([]byte, 64*1024))
+	}))
+	defer server.Close()
+	measurements, err := MeasureConcurrency(context.Background(), server.URL, []int{1, 2, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := measurements[len(measurements)-1]; last.Concurrency != 4 || !last.Throttled {
+		t.Fatalf("expected throttling at 4, got %+v", measurements)
+	}
+	if n := pickConcurrency(measurements); n != 2 {
+		t.Fatalf("expected concurrency 2, got %d (%+v)", n, measurements)
+	}
+}
+
+func TestDownloadRangedVerified(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefghij"), 1000)
+	var corrupted atomic.Bool
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content)
+			return
+		}
+		requests.Add(1)
+		chunk := append([]byte(nil), content[start:end+1]...)
+		sum := md5.Sum(chunk)
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		if start == 4096 && corrupted.CompareAndSwap(false, true) {
+			//传输中损坏 只有该分块需要重新下载
+			chunk[0] ^= 0xff
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(chunk)
+	}))
+	defer server.Close()
+	defer func(size int64) { rangedChunkSize = size }(rangedChunkSize)
+	rangedChunkSize = 4096
+	path := filepath.Join(t.TempDir(), "voice.wav.part")
+	if err := downloadRangedVerified(context.Background(), path, server.URL+"/voice.wav", nil, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, content) {
+		t.Fatal("downloaded content mismatch")
+	}
+	if !corrupted.Load() || requests.Load() != 4 {
+		t.Fatalf("expected 3 chunks plus 1 re-fetch, got %d requests", requests.Load())
+	}
+	if digest := parseChunkDigest(http.Header{"Content-Digest": {"sha-256=:" + base64.StdEncoding.EncodeToString(make([]byte, 32)) + ":"}}); digest == nil || digest.algorithm != "sha-256" {
+		t.Fatalf("expected sha-256 digest, got %+v", digest)
+	}
+}
+
+func TestMergeFailedDownloads(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	out := filepath.Join(dir, "merged.txt")
+	_ = os.WriteFile(a, []byte("2024-06-01 10:00:00|/data/RJ1/a.mp3|http://x/a|timeout|audio\n"+
+		"2024-06-01 11:00:00|/data/RJ1/b.mp3|http://x/b|timeout|audio\n"), 0o644)
+	_ = os.WriteFile(b, []byte("2024-06-02 09:00:00|/data/RJ1/a.mp3|http://x/a|状态码: 429|audio|throttled\n"+
+		"2024-05-30 09:00:00|/data/RJ1/b.mp3|http://x/b|old|audio\n"+
+		"broken line\n"), 0o644)
+	count, err := MergeFailedDownloads([]string{a, b}, out)
+	if err != nil || count != 2 {
+		t.Fatalf("expected 2 records, got %d %v", count, err)
+	}
+	content, _ := os.ReadFile(out)
+	want := "2024-06-01 11:00:00|/data/RJ1/b.mp3|http://x/b|timeout|audio\n" +
+		"2024-06-02 09:00:00|/data/RJ1/a.mp3|http://x/a|状态码: 429|audio|throttled\n"
+	if string(content) != want {
+		t.Fatalf("unexpected merge result:\n%s", content)
+	}
+}
+
+func TestDownloadToWriter(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			//第一次请求中途断开
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content[:4000])
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "voice.mp3", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	var out bytes.Buffer
+	if err := DownloadToWriter(context.Background(), server.URL+"/voice.mp3", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Fatalf("expected resumed stream of %d bytes, got %d", len(content), out.Len())
+	}
+}
+
+func TestIdleConnSettings(t *testing.T) {
+	defer SetIdleConnTimeout(0)
+	defer SetMaxIdleConnsPerHost(0)
+	defer SetMaxIdleConns(0)
+	SetMaxIdleConns(64)
+	SetMaxIdleConnsPerHost(8)
+	SetIdleConnTimeout(90 * time.Second)
+	transport := sharedTransport.Load()
+	if transport.MaxIdleConns != 64 || transport.MaxIdleConnsPerHost != 8 || transport.IdleConnTimeout != 90*time.Second {
+		t.Fatalf("unexpected idle settings: %d %d %s", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+}
+
+func TestStartAutoFix(t *testing.T) {
+	var runs atomic.Int32
+	defer func(run func(int) (*FixResult, error)) { autoFixRun = run }(autoFixRun)
+	autoFixRun = func(maxRetry int) (*FixResult, error) {
+		runs.Add(1)
+		return &FixResult{Recovered: 1}, FailedDownloadFile.Truncate(0)
+	}
+	if err := FailedDownloadFile.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	StartAutoFix(ctx, 10*time.Millisecond, 1)
+	//没有下载失败记录时跳过
+	time.Sleep(50 * time.Millisecond)
+	if runs.Load() != 0 {
+		t.Fatalf("expected no runs without failures, got %d", runs.Load())
+	}
+	recordFailedDownload(FailedRecord{Time: GetCurrentDateTime(), Path: filepath.Join(t.TempDir(), "a.mp3"), URL: "http://example.invalid/a.mp3"})
+	deadline := time.Now().Add(2 * time.Second)
+	for runs.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runs.Load() != 1 {
+		t.Fatalf("expected one fix run, got %d", runs.Load())
+	}
+}
+
+func TestCollisionHashing(t *testing.T) {
+	SetCollisionHashing(true)
+	defer SetCollisionHashing(false)
+	path := filepath.Join(t.TempDir(), "track.mp3")
+	first := CollisionFreePathFor(path, "http://a.example/1/track.mp3")
+	second := CollisionFreePathFor(path, "http://a.example/2/track.mp3")
+	if first != path {
+		t.Fatalf("expected first url to keep the name, got %s", first)
+	}
+	want := filepath.Join(filepath.Dir(path), "track ("+urlHash("http://a.example/2/track.mp3")+").mp3")
+	if second != want {
+		t.Fatalf("expected hashed name %s, got %s", want, second)
+	}
+	if again := CollisionFreePathFor(path, "http://a.example/2/track.mp3"); again != second {
+		t.Fatalf("expected stable name, got %s", again)
+	}
+}
+
+func TestHTTPFailureSink(t *testing.T) {
+	var mu sync.Mutex
+	var received []FailedRecord
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			//第一次发送失败 之后重试
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []FailedRecord
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		received = append(received, batch...)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	sink := NewHTTPFailureSink(server.URL, 10, time.Hour)
+	sink.MaxRetry = 0
+	SetFailureSinks(sink)
+	defer SetFailureSinks()
+	emitFailure(FailedRecord{Time: "2024-06-01 10:00:00", Path: "/data/a.mp3", URL: "http://x/a", Category: FailureNetwork})
+	emitFailure(FailedRecord{Time: "2024-06-01 10:00:01", Path: "/data/b.mp3", URL: "http://x/b"})
+	if err := sink.Flush(); err == nil {
+		t.Fatal("expected first flush to fail")
+	}
+	FlushFailureSinks()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0].URL != "http://x/a" || received[0].Category != FailureNetwork {
+		t.Fatalf("unexpected records: %+v", received)
+	}
+}
+
+func TestConfirmOverwriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.mp3"), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jobs := []DownloadJob{{URL: "http://x/a.mp3", Path: dir}, {URL: "http://x/b.mp3", Path: dir}}
+	defer func(prompt func(string, string) string, interactive func() bool) {
+		overwritePrompt, stdinInteractive = prompt, interactive
+		_ = SetOverwriteConfirm(OverwriteConfirmOff, false)
+	}(overwritePrompt, stdinInteractive)
+	var prompts []string
+	overwritePrompt = func(message string, defaultValue string) string {
+		prompts = append(prompts, message)
+		return "n"
+	}
+	stdinInteractive = func() bool { return true }
+	if err := SetOverwriteConfirm(OverwriteConfirmBatch, true); err != nil {
+		t.Fatal(err)
+	}
+	confirmed := confirmOverwriteBatch(jobs)
+	if len(prompts) != 1 || !strings.Contains(prompts[0], "1个") {
+		t.Fatalf("expected one summary prompt, got %v", prompts)
+	}
+	if !confirmed[0].SkipExisting || confirmed[1].SkipExisting || jobs[0].SkipExisting {
+		t.Fatalf("unexpected jobs after decline: %+v", confirmed)
+	}
+	//没有终端时不询问 使用默认回答
+	stdinInteractive = func() bool { return false }
+	if err := SetOverwriteConfirm(OverwriteConfirmEach, false); err != nil {
+		t.Fatal(err)
+	}
+	if confirmOverwrite(filepath.Join(dir, "a.mp3")) || len(prompts) != 1 {
+		t.Fatalf("expected default answer without prompt, prompts: %v", prompts)
+	}
+}
+
+func TestExtractZip(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "RJ01000000.zip")
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for name, content := range map[string]string{"voice/01.mp3": "track1", "../escape.txt": "evil", "cover.jpg": "image"} {
+		w, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte(content))
+	}
+	_ = writer.Close()
+	if err := os.WriteFile(archive, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	count, err := ExtractZip(archive, filepath.Join(dir, "out"), true)
+	if err != nil || count != 3 {
+		t.Fatalf("expected 3 files, got %d %v", count, err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "out", "voice", "01.mp3")); string(content) != "track1" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+	if FileOrDirExists(filepath.Join(dir, "escape.txt")) {
+		t.Fatal("member escaped destination")
+	}
+	if stat, _ := os.Stat(archive); stat.Size() >= int64(buf.Len()) {
+		t.Fatalf("expected archive to be truncated, size %d", stat.Size())
+	}
+}
+
+func TestExtractZipTruncateOrder(t *testing.T) {
+	build := func(reorder bool) []byte {
+		var buf bytes.Buffer
+		writer := zip.NewWriter(&buf)
+		for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+			w, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = w.Write([]byte(strings.Repeat(name, 100)))
+		}
+		_ = writer.Close()
+		data := buf.Bytes()
+		if !reorder {
+			return data
+		}
+		//将文件目录的顺序改为与数据顺序不同: c, a, b
+		eocd := data[len(data)-22:]
+		cdSize := int(binary.LittleEndian.Uint32(eocd[12:16]))
+		cdOffset := int(binary.LittleEndian.Uint32(eocd[16:20]))
+		var records [][]byte
+		for rest := data[cdOffset : cdOffset+cdSize]; len(rest) > 0; {
+			n := 46 + int(binary.LittleEndian.Uint16(rest[28:30])) + int(binary.LittleEndian.Uint16(rest[30:32])) + int(binary.LittleEndian.Uint16(rest[32:34]))
+			records = append(records, rest[:n])
+			rest = rest[n:]
+		}
+		reordered := append([]byte{}, data[:cdOffset]...)
+		for _, i := range []int{2, 0, 1} {
+			reordered = append(reordered, records[i]...)
+		}
+		return append(reordered, eocd...)
+	}
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "reordered.zip")
+	if err := os.WriteFile(archive, build(true), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	count, err := ExtractZip(archive, filepath.Join(dir, "out"), true)
+	if err != nil || count != 3 {
+		t.Fatalf("expected 3 files, got %d %v", count, err)
+	}
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		if content, _ := os.ReadFile(filepath.Join(dir, "out", name)); string(content) != strings.Repeat(name, 100) {
+			t.Fatalf("unexpected content of %s: %d bytes", name, len(content))
+		}
+	}
+
+	//内容损坏时在截断前失败 压缩包保持完整
+	corrupt := build(false)
+	index := bytes.Index(corrupt, []byte("a.mp3a.mp3"))
+	corrupt[index+50] = 'x'
+	archive = filepath.Join(dir, "corrupt.zip")
+	if err := os.WriteFile(archive, corrupt, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExtractZip(archive, filepath.Join(dir, "corrupt"), true); err == nil || errors.Is(err, ErrArchiveTruncated) {
+		t.Fatalf("expected a verification error before truncating, got %v", err)
+	}
+	if stat, _ := os.Stat(archive); stat.Size() != int64(len(corrupt)) {
+		t.Fatalf("expected the archive to be kept intact, size %d", stat.Size())
+	}
+}
+
+func TestTagAudioFile(t *testing.T) {
+	dir := t.TempDir()
+	mp3 := filepath.Join(dir, "a.mp3")
+	//原有的v2.4标签: 封面、评论与TPE1应保留 TIT2被替换
+	cover := []byte("\xff\xd8\xff\xe0cover\xff\xd9")
+	old := id3v2.NewEmptyTag()
+	old.SetVersion(4)
+	old.SetDefaultEncoding(id3v2.EncodingUTF8)
+	old.SetTitle("old")
+	old.SetArtist("artist")
+	old.AddAttachedPicture(id3v2.PictureFrame{Encoding: id3v2.EncodingUTF8, MimeType: "image/jpeg",
+		PictureType: id3v2.PTFrontCover, Description: "cover", Picture: cover})
+	old.AddCommentFrame(id3v2.CommentFrame{Encoding: id3v2.EncodingUTF8, Language: "jpn", Description: "c", Text: "コメント"})
+	var original bytes.Buffer
+	if _, err := old.WriteTo(&original); err != nil {
+		t.Fatal(err)
+	}
+	audio := append([]byte{0xff, 0xfb, 0x90, 0x64}, make([]byte, 413)...)
+	if err := os.WriteFile(mp3, append(original.Bytes(), audio...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := TagAudioFile(mp3, AudioTags{Title: "タイトル", Album: "作品", Track: 2}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(mp3)
+	if !bytes.HasSuffix(content, audio) {
+		t.Fatal("audio data should be kept")
+	}
+	tag, err := id3v2.ParseReader(bytes.NewReader(content), id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Version() != 4 || tag.Title() != "タイトル" || tag.Artist() != "artist" || tag.Album() != "作品" ||
+		tag.GetTextFrame("TRCK").Text != "2" {
+		t.Fatalf("unexpected tag: v%d %q %q %q", tag.Version(), tag.Title(), tag.Artist(), tag.Album())
+	}
+	pictures := tag.GetFrames("APIC")
+	if len(pictures) != 1 || !bytes.Equal(pictures[0].(id3v2.PictureFrame).Picture, cover) || len(tag.GetFrames("COMM")) != 1 {
+		t.Fatalf("expected the cover and comment to be kept, got %d pictures", len(pictures))
+	}
+
+	//使用unsynchronisation的标签不改写
+	unsync := append([]byte{}, original.Bytes()...)
+	unsync[5] |= 0x80
+	unsyncPath := filepath.Join(dir, "unsync.mp3")
+	if err := os.WriteFile(unsyncPath, append(unsync, audio...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := TagAudioFile(unsyncPath, AudioTags{Title: "t"}); !errors.Is(err, ErrUnsupportedID3Tag) {
+		t.Fatalf("expected ErrUnsupportedID3Tag, got %v", err)
+	}
+	if content, _ := os.ReadFile(unsyncPath); !bytes.Equal(content, append(unsync, audio...)) {
+		t.Fatal("file with an unsupported tag should be left untouched")
+	}
+
+	//没有标签的文件新建v2.3标签
+	bare := filepath.Join(dir, "bare.mp3")
+	if err := os.WriteFile(bare, audio, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := TagAudioFile(bare, AudioTags{Title: "t"}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ = os.ReadFile(bare)
+	if tag, err := id3v2.ParseReader(bytes.NewReader(content), id3v2.Options{Parse: true}); err != nil || tag.Version() != 3 || tag.Title() != "t" {
+		t.Fatalf("expected a new v2.3 tag, got %v", err)
+	}
+
+	flacPath := filepath.Join(dir, "b.flac")
+	picture := flac.MetaDataBlock{Type: flac.Picture, Data: []byte("picture")}
+	frames := append([]byte{0xff, 0xf8}, "frames"...)
+	source := flac.File{
+		Meta:   []*flac.MetaDataBlock{{Type: flac.StreamInfo, Data: make([]byte, 34)}, &picture},
+		Frames: frames,
+	}
+	if err := os.WriteFile(flacPath, source.Marshal(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := TagAudioFile(flacPath, AudioTags{Title: "t", Artist: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ = os.ReadFile(flacPath)
+	parsed, err := flac.ParseBytes(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Meta) != 3 || parsed.Meta[1].Type != flac.VorbisComment || parsed.Meta[2].Type != flac.Picture ||
+		!bytes.Equal(parsed.Frames, frames) {
+		t.Fatalf("unexpected flac layout: %d blocks", len(parsed.Meta))
+	}
+	comment, err := flacvorbis.ParseFromMetaDataBlock(*parsed.Meta[1])
+	if err != nil || strings.Join(comment.Comments, ",") != "TITLE=t,ARTIST=a" {
+		t.Fatalf("unexpected comments: %v %v", comment, err)
+	}
+
+	if err := TagAudioFile(filepath.Join(dir, "c.wav"), AudioTags{Title: "t"}); !errors.Is(err, ErrUnsupportedTagFormat) {
+		t.Fatalf("expected ErrUnsupportedTagFormat, got %v", err)
+	}
+}
+
+func TestDirectoryListing(t *testing.T) {
+	pages := map[string]string{
+		"/files/":            `<html><title>Index of /files/</title><a href="../">Parent Directory</a><a href="?C=N;O=D">Name</a><a href="a.mp3">a.mp3</a><a href="sub/">sub/</a><a href="https://other.example/x.mp3">x</a></html>`,
+		"/files/sub/":        `<html><title>Index of /files/sub/</title><a href="b.txt">b.txt</a><a href="deeper/">deeper/</a></html>`,
+		"/files/sub/deeper/": `<html><title>Index of /files/sub/deeper/</title><a href="c.txt">c.txt</a></html>`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if path == "/files" {
+			//不以/结尾的目录链接 响应内容为目录列表
+			path = "/files/"
+		}
+		if page, ok := pages[path]; ok {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = io.WriteString(w, page)
+			return
+		}
+		http.ServeContent(w, r, path, time.Time{}, strings.NewReader("content of "+r.URL.Path))
+	}))
+	defer server.Close()
+
+	var failed error
+	onResult := func(result JobResult) {
+		if result.Status == JobFailed {
+			failed = result.Err
+		}
+	}
+	dir := t.TempDir()
+	SetDirectoryListing(false, 0)
+	if err := NewFileDownloaderWithOptions(server.URL+"/files/", dir, "", DownloadOptions{OnResult: onResult})(); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(failed, ErrDirectoryListing) {
+		t.Fatalf("expected ErrDirectoryListing, got %v", failed)
+	}
+
+	SetDirectoryListing(true, 1)
+	defer SetDirectoryListing(false, 0)
+	for _, target := range []string{"/files/", "/files"} {
+		dir := t.TempDir()
+		failed = nil
+		if err := NewFileDownloaderWithOptions(server.URL+target, dir, "", DownloadOptions{OnResult: onResult})(); err != nil {
+			t.Fatal(err)
+		}
+		if failed != nil {
+			t.Fatalf("%s: unexpected failure: %v", target, failed)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "a.mp3")); err != nil || string(data) != "content of /files/a.mp3" {
+			t.Fatalf("%s: unexpected a.mp3: %q %v", target, data, err)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "sub", "b.txt")); err != nil || string(data) != "content of /files/sub/b.txt" {
+			t.Fatalf("%s: unexpected sub/b.txt: %q %v", target, data, err)
+		}
+		if FileOrDirExists(filepath.Join(dir, "sub", "deeper")) || FileOrDirExists(filepath.Join(dir, "files")) {
+			t.Fatalf("%s: unexpected files beyond max depth or listing page saved", target)
+		}
+	}
+}
+
+func TestResumeRestartsWhenRemoteChanged(t *testing.T) {
+	var requests atomic.Int32
+	var ifRange string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			//第一次响应中途断开
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", "11")
+			_, _ = io.WriteString(w, "old-c")
+			return
+		}
+		if r.Header.Get("If-Range") != "" {
+			ifRange = r.Header.Get("If-Range")
+		}
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "a.mp3", time.Time{}, strings.NewReader("new-content"))
+	}))
+	defer server.Close()
+
+	part := filepath.Join(t.TempDir(), "a.mp3.part")
+	refresh := func(string) (string, error) { return "", errors.New("unexpected refresh") }
+	if err := downloadWithRefresh(context.Background(), part, server.URL+"/a.mp3", refresh); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(part); err != nil || string(data) != "new-content" {
+		t.Fatalf("expected a clean restart, got %q %v", data, err)
+	}
+	if ifRange != `"v1"` || requests.Load() != 3 {
+		t.Fatalf("unexpected If-Range %q or request count %d", ifRange, requests.Load())
+	}
+}
+
+func TestFilenameFromMeta(t *testing.T) {
+	meta := map[string]string{"rj": "RJ01234567", "title": "a/b", "ext": ".mp3"}
+	name, err := FilenameFromMeta("{rj} - {title} {{x}}{ext}", meta)
+	if err != nil || name != "RJ01234567 - a_b {x}.mp3" {
+		t.Fatalf("unexpected name %q %v", name, err)
+	}
+	for _, tmpl := range []string{"{missing}", "{rj", "rj}", "{}"} {
+		if _, err := FilenameFromMeta(tmpl, meta); err == nil {
+			t.Fatalf("expected error for %q", tmpl)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "x", time.Time{}, strings.NewReader("audio"))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	if err := SetFilenameTemplate("{rj}{ext}"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetFilenameTemplate("")
+	result, err := DownloadBatch(context.Background(), []DownloadJob{
+		{URL: server.URL + "/x", Path: dir, Meta: meta},
+		{URL: server.URL + "/y", Path: dir, Meta: meta, FilenameTemplate: "{title}.txt"},
+	}, 1)
+	if err != nil || result.Done != 2 {
+		t.Fatalf("unexpected result %+v %v", result, err)
+	}
+	for _, name := range []string{"RJ01234567.mp3", "a_b.txt"} {
+		if !FileOrDirExists(filepath.Join(dir, name)) {
+			t.Fatalf("expected %s to be downloaded", name)
+		}
+	}
+}
+
+func TestSetOnFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	var records []FailedRecord
+	SetOnFailure(func(rec FailedRecord) error {
+		records = append(records, rec)
+		return errors.New("hook failed")
+	})
+	defer SetOnFailure(nil)
+	dir := t.TempDir()
+	result, _ := DownloadBatch(context.Background(), []DownloadJob{{URL: server.URL + "/a.mp3", Path: dir}}, 1)
+	if result.Failed != 1 {
+		t.Fatalf("expected the download to fail, got %+v", result)
+	}
+	if len(records) != 1 || records[0].URL != server.URL+"/a.mp3" {
+		t.Fatalf("unexpected hook calls: %+v", records)
+	}
+
+	if err := CommandFailureHook("")(records[0]); err == nil {
+		t.Fatal("expected an error for an empty command")
+	}
+}
+
+func TestVerifyWorkComplete(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a.mp3": "a", "sub/b.mp3": "b", "sub/c.mp3.part": "c", "empty.mp3": ""} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"a.mp3", filepath.Join("sub", "c.mp3"), "sub/b.mp3", "empty.mp3", "d.mp3"}
+	missing, err := VerifyWorkComplete(dir, expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(missing, ",") != strings.Join([]string{filepath.Join("sub", "c.mp3"), "empty.mp3", "d.mp3"}, ",") {
+		t.Fatalf("unexpected missing files: %v", missing)
+	}
+	missing, err = VerifyWorkComplete(filepath.Join(dir, "none"), []string{"a.mp3"})
+	if err != nil || len(missing) != 1 {
+		t.Fatalf("expected all files missing for a nonexistent dir, got %v %v", missing, err)
+	}
+}
+
+func TestFinalizeWork(t *testing.T) {
+	root := t.TempDir()
+	if err := SetStagingDir(filepath.Join(root, "staging")); err != nil {
+		t.Fatal(err)
+	}
+	defer SetStagingDir("")
+	workDir := filepath.Join(root, "library", "RJ01234567")
+	staged := StagingPathFor(workDir)
+	if staged == workDir || !strings.HasPrefix(staged, filepath.Join(root, "staging")) {
+		t.Fatalf("unexpected staging path %s", staged)
+	}
+	write := func(path string, content string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(staged, "sub", "a.mp3"), "a")
+	if err := FinalizeWork(workDir); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(workDir, "sub", "a.mp3")); err != nil || string(data) != "a" {
+		t.Fatalf("unexpected published file %q %v", data, err)
+	}
+	if FileOrDirExists(staged) {
+		t.Fatal("staging dir should be removed")
+	}
+
+	//最终目录已存在时合并
+	write(filepath.Join(staged, "b.mp3"), "b")
+	if err := FinalizeWork(workDir); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join("sub", "a.mp3"), "b.mp3"} {
+		if !FileOrDirExists(filepath.Join(workDir, name)) {
+			t.Fatalf("expected %s after merge", name)
+		}
+	}
+	if err := moveTree(filepath.Join(root, "none"), filepath.Join(root, "x")); err == nil {
+		t.Fatal("expected an error for a missing source")
+	}
+}
+
+func TestUnexpectedPartialResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes=0-" {
+			w.Header().Set("Content-Range", "bytes 0-4/5")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte("audio"))
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 0-1/5")
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write([]byte("au"))
+	}))
+	defer server.Close()
+
+	storePath := filepath.Join(t.TempDir(), "a.mp3")
+	if _, err := downloadFileWithContext(context.Background(), storePath, server.URL+"/a.mp3", map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(storePath); err != nil || string(data) != "audio" {
+		t.Fatalf("expected the full file after retrying, got %q %v", data, err)
+	}
+
+	if err := SetUnexpectedPartialPolicy(PartialPolicyFail); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = SetUnexpectedPartialPolicy("") }()
+	storePath = filepath.Join(t.TempDir(), "a.mp3")
+	_, err := downloadFileWithContext(context.Background(), storePath, server.URL+"/a.mp3", map[string]string{})
+	if !errors.Is(err, ErrUnexpectedPartial) || !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("expected an unexpected partial error, got %v", err)
+	}
+	if err := SetUnexpectedPartialPolicy("ignore"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+	if !contentRangeCoversWhole("bytes 0-99/100") || contentRangeCoversWhole("bytes 0-99/*") || contentRangeCoversWhole("bytes 10-99/100") {
+		t.Fatal("unexpected Content-Range check result")
+	}
+}
+
+func TestSortFailedDownloadsByHost(t *testing.T) {
+	if err := FailedDownloadFile.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = FailedDownloadFile.Truncate(0) }()
+	recordFailedDownload(FailedRecord{Time: "2024-06-02 10:00:00", Path: "/data/a.mp3", URL: "http://b.example/a", Error: "timeout"})
+	recordFailedDownload(FailedRecord{Time: "2024-06-01 10:00:00", Path: "/data/b.mp3", URL: "http://a.example/b", Error: "timeout"})
+	recordFailedDownload(FailedRecord{Time: "2024-06-01 09:00:00", Path: "/data/c.mp3", URL: "http://b.example/c", Error: "timeout"})
+	recordFailedDownload(FailedRecord{Time: "2024-06-03 10:00:00", Path: "/data/a.mp3", URL: "http://b.example/a", Error: "reset"})
+	if err := SortFailedDownloadsByHost(); err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	if err := IterateFailedDownloads(func(record FailedRecord) error {
+		urls = append(urls, record.URL+"@"+record.Time)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://a.example/b@2024-06-01 10:00:00", "http://b.example/c@2024-06-01 09:00:00", "http://b.example/a@2024-06-03 10:00:00"}
+	if strings.Join(urls, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected order: %v", urls)
+	}
+	//重新打开后新的失败记录写入整理后的文件
+	recordFailedDownload(FailedRecord{Time: "2024-06-04 10:00:00", Path: "/data/d.mp3", URL: "http://c.example/d"})
+	if content, _ := os.ReadFile(FailedDownloadFileName); !strings.Contains(string(content), "http://c.example/d") {
+		t.Fatalf("expected new records to be appended, got:\n%s", content)
+	}
+}
+
+func TestSessionRecordAndReplay(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big.mp3" {
+			_, _ = w.Write(bytes.Repeat([]byte("a"), 2048))
+			return
+		}
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte("error code: 1015"))
+			return
+		}
+		w.Header().Set("Content-Length", "5")
+		w.Header().Set("Set-Cookie", "session=cookie-secret")
+		_, _ = w.Write([]byte("audio"))
+	}))
+	SetRequestDefaults("", map[string]string{"X-Api-Key": "key-secret"}, "")
+	defer SetRequestDefaults("", nil, "")
+	session := filepath.Join(t.TempDir(), "session.jsonl")
+	if err := SetSessionRecord(session, 1024); err != nil {
+		t.Fatal(err)
+	}
+	fetchPath := func(path string) (int, string, error) {
+		req, err := NewRequest(context.Background(), http.MethodGet, server.URL+path)
+		if err != nil {
+			return 0, "", err
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Proxy-Authorization", "Basic proxy-secret")
+		client := Client.Get().(*http.Client)
+		defer Client.Put(client)
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), err
+	}
+	fetch := func() (int, string, error) { return fetchPath("/a.mp3") }
+	for _, path := range []string{"/a.mp3", "/a.mp3", "/big.mp3"} {
+		if _, _, err := fetchPath(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetSessionRecord("", 0); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	if content, _ := os.ReadFile(session); strings.Contains(string(content), "secret") {
+		t.Fatalf("expected credentials to be redacted:\n%s", content)
+	}
+	//超过大小上限的响应体只记录sha256
+	if bodies, _ := os.ReadDir(sessionBodyDir(session)); len(bodies) != 2 {
+		t.Fatalf("expected only the small bodies to be saved, got %d files", len(bodies))
+	}
+
+	if err := ReplaySession(session); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ReplaySession("") }()
+	for i, want := range []string{"429:error code: 1015", "200:audio", "200:audio"} {
+		status, body, err := fetch()
+		if err != nil || fmt.Sprintf("%d:%s", status, body) != want {
+			t.Fatalf("replay %d: expected %s, got %d:%s %v", i, want, status, body, err)
+		}
+	}
+	for _, path := range []string{"/b.mp3", "/big.mp3"} {
+		if _, _, err := fetchPath(path); !errors.Is(err, ErrSessionMiss) {
+			t.Fatalf("expected a session miss for %s, got %v", path, err)
+		}
+	}
+}
+
+func TestHTTPFailureSinkOutage(t *testing.T) {
+	release := make(chan struct{})
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	defer close(release)
+	sink := NewHTTPFailureSink(server.URL, 1, time.Hour)
+	sink.MaxRetry = 0
+	defer func() { sink.stopOnce.Do(func() { close(sink.stop) }) }()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 500; i++ {
+		sink.Record(FailedRecord{URL: "http://x/" + strconv.Itoa(i)})
+	}
+	time.Sleep(100 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before+20 || requests.Load() != 1 {
+		t.Fatalf("expected a single background sender, goroutines %d -> %d, requests %d", before, after, requests.Load())
+	}
+}
+
+func TestHTTPFailureSinkRequeueCapped(t *testing.T) {
+	var sink *HTTPFailureSink
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//发送期间继续产生失败记录 放回缓存后不能超出上限
+		for i := 0; i < failureSinkMaxPending; i++ {
+			sink.Record(FailedRecord{URL: "http://x/" + strconv.Itoa(i)})
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	sink = NewHTTPFailureSink(server.URL, failureSinkMaxPending+1, time.Hour)
+	sink.MaxRetry = 0
+	defer func() { sink.stopOnce.Do(func() { close(sink.stop) }) }()
+	sink.Record(FailedRecord{URL: "http://x/first"})
+	if err := sink.Flush(); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	if len(sink.pending) != failureSinkMaxPending {
+		t.Fatalf("expected pending to be capped at %d, got %d", failureSinkMaxPending, len(sink.pending))
+	}
+}
+
+func TestSnapshotKeepsLeftoverRecords(t *testing.T) {
+	if err := FailedDownloadFile.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = FailedDownloadFile.Truncate(0) }()
+	snapshot := FailedDownloadFileName + ".tmp"
+	defer os.Remove(snapshot)
+	//上一次处理中断遗留的快照
+	leftover := "2024-06-01 10:00:00|/data/a.mp3|http://x/a|timeout|audio\n"
+	if err := os.WriteFile(snapshot, []byte(leftover), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	recordFailedDownload(FailedRecord{Time: "2024-06-02 10:00:00", Path: "/data/b.mp3", URL: "http://x/b", Error: "timeout"})
+	if err := snapshotFailedDownloadFile(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(snapshot)
+	if !strings.Contains(string(content), "http://x/a") || !strings.Contains(string(content), "http://x/b") {
+		t.Fatalf("expected leftover and live records in the snapshot, got:\n%s", content)
+	}
+
+	//处理中途出错时未处理的记录放回日志文件
+	existing := filepath.Join(t.TempDir(), "done.mp3")
+	if err := os.WriteFile(existing, []byte("audio"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	huge := "2024-06-03 10:00:00|/data/c.mp3|http://x/c?" + strings.Repeat("q", 2*1024*1024) + "|timeout|audio"
+	_ = os.Remove(snapshot)
+	if err := FailedDownloadFile.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	recordFailedDownload(FailedRecord{Time: "2024-06-03 09:00:00", Path: existing, URL: "http://x/done", Error: "timeout"})
+	if _, err := FailedDownloadFile.WriteString(huge + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fixBrokenDownloadFile(1, 0, ""); err == nil {
+		t.Fatal("expected the oversized line to stop processing")
+	}
+	content, _ = os.ReadFile(FailedDownloadFileName)
+	if strings.Contains(string(content), "http://x/done") || !strings.Contains(string(content), huge) {
+		t.Fatalf("expected only the unprocessed record to be restored, got %d bytes", len(content))
+	}
+	if FileOrDirExists(snapshot) {
+		t.Fatal("expected the snapshot to be removed after restoring")
+	}
+}
+
+func TestSetRetryPredicate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("work removed"))
+	}))
+	defer server.Close()
+	storePath := filepath.Join(t.TempDir(), "a.mp3")
+
+	if _, err := DownloadFile(storePath, server.URL); errors.Is(err, ErrPermanentFailure) {
+		t.Fatalf("expected 503 to be retryable by default, got %v", err)
+	}
+	SetRetryPredicate(func(statusCode int, body []byte, err error) bool {
+		return !strings.Contains(string(body), "removed")
+	})
+	defer SetRetryPredicate(nil)
+	if _, err := DownloadFile(storePath, server.URL); !errors.Is(err, ErrPermanentFailure) {
+		t.Fatalf("expected custom predicate to mark failure permanent, got %v", err)
+	}
+}
+
+func TestWriteRunReport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "missing.mp3") {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+	ResetRunStats()
+	reportDir := t.TempDir()
+	SetRunReportDir(reportDir)
+	defer SetRunReportDir("")
+
+	dir := t.TempDir()
+	_, _ = DownloadBatch(context.Background(), []DownloadJob{
+		{URL: server.URL + "/a.mp3", Path: dir, Filename: "a.mp3"},
+		{URL: server.URL + "/missing.mp3", Path: dir, Filename: "missing.mp3"},
+	}, 1)
+
+	reports, _ := filepath.Glob(filepath.Join(reportDir, "run-report-*.json"))
+	if len(reports) != 1 {
+		t.Fatalf("expected a saved run report, got %v", reports)
+	}
+	var buf strings.Builder
+	if err := WriteRunReport(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var report RunReport
+	if err := json.Unmarshal([]byte(buf.String()), &report); err != nil {
+		t.Fatal(err)
+	}
+	host := strings.TrimPrefix(server.URL, "http://")
+	if report.Batch == nil || report.Batch.Done != 1 || report.Batch.Failed != 1 {
+		t.Fatalf("unexpected batch summary: %+v", report.Batch)
+	}
+	if report.FailureCategories[FailurePermanent] != 1 || report.Hosts[host].Bytes < 5 || report.TotalBytes < 5 {
+		t.Fatalf("unexpected run report: %s", buf.String())
+	}
+}
+
+func TestAcquireGotMemory(t *testing.T) {
+	SetGotLimits(2, 3)
+	SetGotMemoryLimit(10)
+	defer SetGotLimits(0, 0)
+	defer SetGotMemoryLimit(0)
+
+	download := got.NewDownload(context.Background(), "http://example.invalid/a.mp3", "a.mp3")
+	cost := applyGotLimits(download, 0)
+	if cost != 6 || download.Concurrency != 2 || download.MaxChunkSize != 3 {
+		t.Fatalf("unexpected limits: cost %d, %+v", cost, download)
+	}
+	release, err := acquireGotMemory(context.Background(), cost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := acquireGotMemory(ctx, cost); err == nil {
+		t.Fatal("expected second download to wait for memory")
+	}
+	acquired := make(chan struct{})
+	go func() {
+		release2, err := acquireGotMemory(context.Background(), cost)
+		if err == nil {
+			release2()
+		}
+		close(acquired)
+	}()
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("expected released memory to wake waiting download")
+	}
+}
+
+func TestFileLocking(t *testing.T) {
+	SetFileLocking(true)
+	defer SetFileLocking(false)
+	storePath := filepath.Join(t.TempDir(), "a.mp3")
+
+	unlock, ok := lockFile(storePath)
+	if !ok {
+		t.Fatal("expected to acquire lock")
+	}
+	if _, ok := lockFile(storePath); ok {
+		t.Fatal("expected lock held by running process to block")
+	}
+	unlock()
+	if FileOrDirExists(storePath + LockFileSuffix) {
+		t.Fatal("expected lock file to be removed")
+	}
+
+	//持有进程已退出的锁会被回收
+	hostname, _ := os.Hostname()
+	if err := os.WriteFile(storePath+LockFileSuffix, []byte(fmt.Sprintf("%d %s 0", 1<<30, hostname)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unlock, ok = lockFile(storePath)
+	if !ok {
+		t.Fatal("expected stale lock to be reclaimed")
+	}
+	unlock()
+
+	//其他主机的锁在超过staleLockAge后回收
+	if err := os.WriteFile(storePath+LockFileSuffix, []byte("1 other-host 0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lockFile(storePath); ok {
+		t.Fatal("expected fresh lock from another host to block")
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(storePath+LockFileSuffix, old, old); err != nil {
+		t.Fatal(err)
+	}
+	unlock, ok = lockFile(storePath)
+	if !ok {
+		t.Fatal("expected old lock to be reclaimed")
+	}
+	unlock()
+}
+
+func TestSkippedExisting(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+	SetSkippedExistingLog(true)
+	defer SetSkippedExistingLog(false)
+	defer os.Remove(SkippedExistingFileName)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.mp3"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := DownloadBatch(context.Background(), []DownloadJob{
+		{URL: server.URL + "/a.mp3", Path: dir, Filename: "a.mp3", SkipExisting: true},
+		{URL: server.URL + "/b.mp3", Path: dir, Filename: "b.mp3", SkipExisting: true},
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Existing != 1 || result.Done != 1 || result.Results[0].Status != JobExists {
+		t.Fatalf("unexpected batch result: %+v", result)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "a.mp3")); err != nil || string(data) != "old" {
+		t.Fatalf("expected existing file to be kept, got %q %v", data, err)
+	}
+	data, err := os.ReadFile(SkippedExistingFileName)
+	if err != nil || !strings.Contains(string(data), server.URL+"/a.mp3") || strings.Contains(string(data), "b.mp3") {
+		t.Fatalf("unexpected skipped-existing log: %q %v", data, err)
+	}
+}
+
+// countingSyncFile 记录Sync次数的文件
+type countingSyncFile struct {
+	strings.Builder
+	syncs int
+}
+
+func (f *countingSyncFile) Sync() error {
+	f.syncs++
+	return nil
+}
+
+func (f *countingSyncFile) Close() error {
+	return nil
+}
+
+func TestPeriodicSync(t *testing.T) {
+	file := &countingSyncFile{}
+	if w := withPeriodicSync(file); w != io.WriteCloser(file) {
+		t.Fatal("expected no wrapping when periodic sync is disabled")
+	}
+	SetSyncEvery(4)
+	defer SetSyncEvery(0)
+	w := withPeriodicSync(file)
+	for i := 0; i < 4; i++ {
+		_, _ = w.Write([]byte("abc"))
+	}
+	if file.syncs != 2 || file.String() != strings.Repeat("abc", 4) {
+		t.Fatalf("expected 2 syncs, got %d", file.syncs)
+	}
+
+	storePath := filepath.Join(t.TempDir(), "a.mp3")
+	part, err := os.Create(partPath(storePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := &progressWriter{file: part, storePath: storePath, record: progressRecord{ETag: `"v1"`}, lastSave: time.Now()}
+	_, _ = pw.Write([]byte("abcde"))
+	_ = pw.Close()
+	data, err := os.ReadFile(progressPath(storePath))
+	if err != nil || !strings.Contains(string(data), `"bytes":5`) {
+		t.Fatalf("expected progress file to be saved after sync, got %q %v", data, err)
+	}
+}
+
+func TestReverseIndex(t *testing.T) {
+	root := t.TempDir()
+	files := []string{
+		filepath.Join("subtitle", "RJ123456", "SE無し", "01 intro.mp3"),
+		filepath.Join("RJ654321", "a (1).mp3"),
+		filepath.Join("RJ654321", "a.mp3.part"),
+		filepath.Join("loose", "b.mp3"),
+	}
+	for _, file := range files {
+		path := filepath.Join(root, file)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("audio"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetReverseIndexBaseURL("https://api.example.com/")
+	defer SetReverseIndexBaseURL("")
+
+	entries, err := ReverseIndexEntries(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byPath := map[string]ReverseEntry{}
+	for _, entry := range entries {
+		byPath[entry.Path] = entry
+	}
+	if len(byPath) != 3 {
+		t.Fatalf("expected download artifacts to be skipped, got %+v", entries)
+	}
+	intro := byPath[filepath.Join(root, files[0])]
+	if intro.WorkID != "RJ123456" || intro.Ambiguous || intro.URL != "https://api.example.com/api/tracks/123456#SE%E7%84%A1%E3%81%97/01%20intro.mp3" {
+		t.Fatalf("unexpected entry: %+v", intro)
+	}
+	numbered := byPath[filepath.Join(root, files[1])]
+	if !numbered.Ambiguous || len(numbered.Candidates) != 2 || !strings.HasSuffix(numbered.Candidates[1], "#a.mp3") {
+		t.Fatalf("expected numbered file to be ambiguous: %+v", numbered)
+	}
+	if loose := byPath[filepath.Join(root, files[3])]; !loose.Ambiguous || loose.URL != "" {
+		t.Fatalf("expected file outside a work folder to be unresolved: %+v", loose)
+	}
+	index, err := ReverseIndex(root)
+	if err != nil || len(index) != 2 {
+		t.Fatalf("unexpected reverse index: %v %v", index, err)
+	}
+}
+
+func TestDownloadJobTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	result, err := DownloadBatch(context.Background(), []DownloadJob{
+		{URL: server.URL + "/a.mp3", Path: t.TempDir(), Filename: "a.mp3", Timeout: 100 * time.Millisecond},
+	}, 1)
+	if !errors.Is(err, ErrFileDeadline) || result.Failed != 1 {
+		t.Fatalf("expected deadline failure, got %+v %v", result, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected download to stop at its deadline, took %s", elapsed)
+	}
+	if failureCategory(result.Results[0].Err) != FailureDeadline {
+		t.Fatalf("unexpected failure category for %v", result.Results[0].Err)
+	}
+}
+
+func TestDirAndFileMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("audio"))
+	}))
+	defer server.Close()
+	SetDirMode(0700)
+	SetFileMode(0600)
+	defer func() {
+		SetDirMode(0755)
+		SetFileMode(0644)
+		fileModeSet.Store(false)
+	}()
+
+	storePath := filepath.Join(t.TempDir(), "work", "a.mp3")
+	if _, err := NewFixFileDownloader(server.URL+"/a.mp3", storePath, nil); err != nil {
+		t.Fatal(err)
+	}
+	dirStat, err := os.Stat(filepath.Dir(storePath))
+	if err != nil || dirStat.Mode().Perm() != 0700 {
+		t.Fatalf("unexpected dir mode: %v %v", dirStat.Mode(), err)
+	}
+	for _, engine := range []Engine{EngineNetHTTP, EngineGot} {
+		dir := t.TempDir()
+		if err := NewFileDownloaderWithOptions(server.URL+"/a.mp3", dir, "a.mp3", DownloadOptions{Engine: engine})(); err != nil {
+			t.Fatal(err)
+		}
+		stat, err := os.Stat(filepath.Join(dir, "a.mp3"))
+		if err != nil || stat.Mode().Perm() != 0600 {
+			t.Fatalf("%s: unexpected file mode: %v %v", engine, stat.Mode(), err)
+		}
+	}
+}
+
+func TestBandwidthSampler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("a", 1000)))
+	}))
+	defer server.Close()
+	StartBandwidthSampler(20*time.Millisecond, 3)
+	defer StopBandwidthSampler()
+
+	if _, err := DownloadFile(filepath.Join(t.TempDir(), "a.mp3"), server.URL); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	samples := BandwidthSamples()
+	if len(samples) != 3 {
+		t.Fatalf("expected ring buffer to keep 3 samples, got %d", len(samples))
+	}
+	for i := 1; i < len(samples); i++ {
+		if samples[i].Time.Before(samples[i-1].Time) {
+			t.Fatalf("expected samples in time order: %+v", samples)
+		}
+	}
+	if samples[len(samples)-1].TotalBytes < 1000 {
+		t.Fatalf("expected downloaded bytes to be counted: %+v", samples)
+	}
+	var buf strings.Builder
+	if err := WriteBandwidthCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 4 {
+		t.Fatalf("unexpected csv: %q", buf.String())
+	}
 }
 
 func TestWriteErrorFile(t *testing.T) {
@@ -123,3 +2655,25 @@ func TestGetRapidRespSiteUrl(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkCopyFileOpts(b *testing.B) {
+	dir := b.TempDir()
+	src := filepath.Join(dir, "src.bin")
+	if err := os.WriteFile(src, make([]byte, 8*1024*1024), 0644); err != nil {
+		b.Fatal(err)
+	}
+	cases := map[string]CopyOptions{
+		"default":     DefaultCopyOptions,
+		"nosync":      {PreserveMode: true},
+		"nosync-1MiB": {BufferSize: 1024 * 1024},
+	}
+	for name, opts := range cases {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := CopyFileOpts(src, filepath.Join(dir, "dst.bin"), opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}